@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v4"
+)
+
+const adminMaxBodySize = 1 << 16
+
+// AdminBroadcastStatus is a broadcast, as the admin API shows it, along with
+// the sessions publishing to it
+type AdminBroadcastStatus struct {
+	BroadcastStatus
+
+	// IDs of the sessions publishing to the broadcast, be it through
+	// /broadcast, WHIP, RTP ingest, or RTSP
+	Publishers []string `json:"publishers"`
+}
+
+// AdminCloseRequest is the (optional) body of a request to close a session
+type AdminCloseRequest struct {
+	// Sent to the client, before it gets disconnected
+	Reason string `json:"reason"`
+}
+
+// publishingEndpoints are the endpoints whose sessions publish, rather than
+// receive
+var publishingEndpoints = Set[string]{
+	"broadcast": true,
+	"whip":      true,
+	"rtp":       true,
+	"rtsp":      true,
+}
+
+// AdminAPI lets whoever holds the admin API token see what's going on, and
+// kick out publishers and receivers
+type AdminAPI struct {
+	tracksAndConnections TracksAndConnectionsManager
+	sessions             []SessionSource
+}
+
+func NewAdminAPI(
+	tracksAndConnections TracksAndConnectionsManager,
+	sessions ...SessionSource,
+) *AdminAPI {
+	return &AdminAPI{
+		tracksAndConnections: tracksAndConnections,
+		sessions:             sessions,
+	}
+}
+
+// authorized tells whether the request comes with the admin API token, and if
+// not, says so
+func (a *AdminAPI) authorized(res http.ResponseWriter, req *http.Request) bool {
+	if token, ok := bearerToken(req); ok && config.IsAdminAPIToken(token) {
+		return true
+	}
+	res.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(res, "Missing or unknown bearer token", http.StatusUnauthorized)
+	return false
+}
+
+// allowed checks the method and the token, and says what's wrong if either of
+// them is no good
+func (a *AdminAPI) allowed(res http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		res.Header().Set("Allow", method)
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	return a.authorized(res, req)
+}
+
+// allSessions lists the sessions of every source, oldest first
+func (a *AdminAPI) allSessions() []SessionStatus {
+	sessions := []SessionStatus{}
+	for _, source := range a.sessions {
+		sessions = append(sessions, source.Sessions()...)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions
+}
+
+// allSessionIDs maps the peer connections of every source's sessions to the
+// sessions' IDs
+func (a *AdminAPI) allSessionIDs() map[*webrtc.PeerConnection]string {
+	ids := map[*webrtc.PeerConnection]string{}
+	for _, source := range a.sessions {
+		for peerConnection, id := range source.SessionIDs() {
+			ids[peerConnection] = id
+		}
+	}
+	return ids
+}
+
+func writeAdminJSON(res http.ResponseWriter, v any) {
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(v)
+}
+
+// HandleKeys handles /admin/keys, which lists every key ID that has at least a
+// single broadcast going
+func (a *AdminAPI) HandleKeys(res http.ResponseWriter, req *http.Request) {
+	if !a.allowed(res, req, http.MethodGet) {
+		return
+	}
+
+	keyIDs := []KeyIDString{}
+	seen := Set[KeyIDString]{}
+	for _, broadcast := range a.tracksAndConnections.Status() {
+		if !seen[broadcast.KeyID] {
+			seen.Add(broadcast.KeyID)
+			keyIDs = append(keyIDs, broadcast.KeyID)
+		}
+	}
+	sort.Slice(keyIDs, func(i, j int) bool { return keyIDs[i] < keyIDs[j] })
+
+	writeAdminJSON(res, keyIDs)
+}
+
+// HandleBroadcasts handles /admin/broadcasts, which lists every broadcast, with
+// its tracks and receivers. `?keyId=` narrows things down to a single key ID.
+func (a *AdminAPI) HandleBroadcasts(res http.ResponseWriter, req *http.Request) {
+	if !a.allowed(res, req, http.MethodGet) {
+		return
+	}
+
+	query := req.URL.Query()
+	keyID, filtered := KeyIDString(query.Get("keyId")), query.Has("keyId")
+
+	ids := a.allSessionIDs()
+	publishers := map[broadcastKey][]string{}
+	for _, session := range a.allSessions() {
+		if !publishingEndpoints[session.Endpoint] {
+			continue
+		}
+		key := broadcastKey{session.KeyID, session.BroadcastID}
+		publishers[key] = append(publishers[key], session.ID)
+	}
+
+	broadcasts := []AdminBroadcastStatus{}
+	for _, broadcast := range a.tracksAndConnections.Status() {
+		if filtered && broadcast.KeyID != keyID {
+			continue
+		}
+		for i, receiver := range broadcast.Receivers {
+			if receiver.PeerConnection != nil {
+				broadcast.Receivers[i].Session = ids[receiver.PeerConnection]
+			}
+		}
+
+		sessions := publishers[broadcastKey{broadcast.KeyID, broadcast.BroadcastID}]
+		if sessions == nil {
+			sessions = []string{}
+		}
+		broadcasts = append(broadcasts, AdminBroadcastStatus{
+			BroadcastStatus: broadcast,
+			Publishers:      sessions,
+		})
+	}
+
+	writeAdminJSON(res, broadcasts)
+}
+
+// HandleSessions handles /admin/sessions, which lists every session, be it a
+// publisher's or a receiver's, whichever way they came in
+func (a *AdminAPI) HandleSessions(res http.ResponseWriter, req *http.Request) {
+	if !a.allowed(res, req, http.MethodGet) {
+		return
+	}
+
+	writeAdminJSON(res, a.allSessions())
+}
+
+// HandleCloseSession handles /admin/sessions/{id}/close, which tells the
+// session's client why it's being kicked out (if it has a WebSocket to tell it
+// on), and then closes the session. For a publisher, that takes its tracks down
+// with it.
+func (a *AdminAPI) HandleCloseSession(res http.ResponseWriter, req *http.Request) {
+	if !a.allowed(res, req, http.MethodPost) {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, adminMaxBodySize))
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var r AdminCloseRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &r); err != nil {
+			http.Error(res, "Failed to parse request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if r.Reason == "" {
+		r.Reason = "Closed by an administrator"
+	}
+
+	id := mux.Vars(req)["id"]
+	for _, source := range a.sessions {
+		if source.CloseSession(id, r.Reason) {
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	http.Error(res, "No such session", http.StatusNotFound)
+}
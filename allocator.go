@@ -0,0 +1,256 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v4"
+)
+
+// How often the bandwidth gets split up again, regardless of whether the
+// estimate changed, since the bitrates of the tracks themselves change too.
+const allocationInterval = time.Second
+
+// How long a video track gets to stay paused, before we try sending it again.
+//
+// Without this, a receiver that only gets a single video track would never get
+// it back: with nothing being sent, there's nothing for the bandwidth estimate
+// to go up from.
+const pausedProbeInterval = 5 * time.Second
+
+// DownTrackStats describes what a single DownTrack is sending
+type DownTrackStats struct {
+	KeyID       KeyIDString       `json:"keyId"`
+	BroadcastID BroadcastIDString `json:"id"`
+	TrackID     TrackIDString     `json:"track"`
+	Kind        string            `json:"kind"`
+	Layer       string            `json:"layer"`
+	Paused      bool              `json:"paused"`
+}
+
+// ReceiverStats describes what a single receiving peer connection is getting
+type ReceiverStats struct {
+	// In bits per second
+	EstimatedBitrate int              `json:"estimatedBitrate"`
+	Tracks           []DownTrackStats `json:"tracks"`
+}
+
+// BandwidthAllocator splits up the estimated bandwidth of a single receiving
+// peer connection, between all of the DownTracks that the peer connection is
+// getting.
+//
+// Audio always goes first, since it's cheap, and since losing audio is a lot
+// more noticeable than losing video. Whatever is left goes to video, in order
+// of priority: first making sure that every video track gets its lowest
+// layer, and then upgrading tracks to the highest layer that still fits. Video
+// tracks that don't even fit their lowest layer get paused.
+type BandwidthAllocator struct {
+	lock *sync.Mutex
+
+	// May be nil, in which case the receiver is assumed to have the initial
+	// bitrate, forever
+	estimator cc.BandwidthEstimator
+
+	downTracks  Set[*DownTrack]
+	pausedSince map[*DownTrack]time.Time
+
+	stop     chan struct{}
+	stopOnce *sync.Once
+}
+
+// NewBandwidthAllocator creates an allocator that goes off of the given
+// bandwidth estimator. It does nothing until Run is called.
+func NewBandwidthAllocator(estimator cc.BandwidthEstimator) *BandwidthAllocator {
+	a := &BandwidthAllocator{
+		lock:        &sync.Mutex{},
+		estimator:   estimator,
+		downTracks:  Set[*DownTrack]{},
+		pausedSince: map[*DownTrack]time.Time{},
+		stop:        make(chan struct{}),
+		stopOnce:    &sync.Once{},
+	}
+
+	if estimator != nil {
+		estimator.OnTargetBitrateChange(func(int) {
+			a.Allocate()
+		})
+	}
+
+	return a
+}
+
+// Run blocks, periodically splitting up the bandwidth, until Close is called.
+func (a *BandwidthAllocator) Run() {
+	ticker := time.NewTicker(allocationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+			a.Allocate()
+		}
+	}
+}
+
+// Close stops Run
+func (a *BandwidthAllocator) Close() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+}
+
+// Estimate returns the estimated bandwidth of the receiver, in bits per second
+func (a *BandwidthAllocator) Estimate() int {
+	if a.estimator == nil {
+		return config.InitialBitrate()
+	}
+	return a.estimator.GetTargetBitrate()
+}
+
+// AddDownTrack adds a DownTrack to the ones that the bandwidth is split
+// between.
+func (a *BandwidthAllocator) AddDownTrack(downTrack *DownTrack) {
+	a.lock.Lock()
+	a.downTracks.Add(downTrack)
+	a.lock.Unlock()
+
+	a.Allocate()
+}
+
+// RemoveDownTrack frees up whatever bandwidth a DownTrack was using
+func (a *BandwidthAllocator) RemoveDownTrack(downTrack *DownTrack) {
+	a.lock.Lock()
+	a.downTracks.Remove(downTrack)
+	delete(a.pausedSince, downTrack)
+	a.lock.Unlock()
+
+	a.Allocate()
+}
+
+// Stats returns the current estimate, and what each DownTrack is sending
+func (a *BandwidthAllocator) Stats() ReceiverStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	stats := ReceiverStats{
+		EstimatedBitrate: a.Estimate(),
+		Tracks:           []DownTrackStats{},
+	}
+	for downTrack := range a.downTracks {
+		layer, _ := downTrack.CurrentLayer()
+		stats.Tracks = append(stats.Tracks, DownTrackStats{
+			KeyID:       downTrack.Track().KeyID(),
+			BroadcastID: downTrack.Track().BroadcastID(),
+			TrackID:     downTrack.Track().ID(),
+			Kind:        downTrack.Kind().String(),
+			Layer:       layer,
+			Paused:      downTrack.Paused(),
+		})
+	}
+
+	return stats
+}
+
+// videoAllocation is the working state of a single video DownTrack, while the
+// bandwidth is being split up.
+type videoAllocation struct {
+	downTrack *DownTrack
+
+	// Ascending by bitrate
+	layers []layerBitrate
+	index  int
+	paused bool
+}
+
+// Allocate splits up the bandwidth between the DownTracks, right now.
+func (a *BandwidthAllocator) Allocate() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	budget := int64(a.Estimate())
+	videos := []*videoAllocation{}
+
+	for downTrack := range a.downTracks {
+		layers := downTrack.Track().layerBitrates()
+		if len(layers) == 0 {
+			// Nothing being published; nothing to pay for
+			continue
+		}
+
+		if downTrack.Kind() == webrtc.RTPCodecTypeAudio {
+			budget -= int64(layers[len(layers)-1].bitrate)
+			continue
+		}
+
+		// Anything above what the receiver asked for would be a waste
+		if preferred := downTrack.preferredLayer(); preferred != "" {
+			for i, layer := range layers {
+				if layer.rid == preferred {
+					layers = layers[:i+1]
+					break
+				}
+			}
+		}
+
+		videos = append(videos, &videoAllocation{downTrack: downTrack, layers: layers})
+	}
+
+	// Highest priority first, and then oldest first, so that newcomers don't
+	// get to knock anyone off
+	sort.SliceStable(videos, func(i, j int) bool {
+		first, second := videos[i].downTrack, videos[j].downTrack
+		if first.getPriority() != second.getPriority() {
+			return first.getPriority() > second.getPriority()
+		}
+		return first.created.Before(second.created)
+	})
+
+	now := time.Now()
+
+	// Everyone gets their lowest layer, if it fits
+	for _, video := range videos {
+		lowest := int64(video.layers[0].bitrate)
+		pausedSince, wasPaused := a.pausedSince[video.downTrack]
+		probing := wasPaused && now.Sub(pausedSince) >= pausedProbeInterval
+
+		if lowest <= budget || probing {
+			budget -= lowest
+			delete(a.pausedSince, video.downTrack)
+		} else {
+			video.paused = true
+			if !wasPaused {
+				a.pausedSince[video.downTrack] = now
+			}
+		}
+	}
+
+	// Then, whoever can get upgraded, does
+	for _, video := range videos {
+		if video.paused {
+			continue
+		}
+
+		current := int64(video.layers[video.index].bitrate)
+		for i := len(video.layers) - 1; i > video.index; i-- {
+			extra := int64(video.layers[i].bitrate) - current
+			if extra <= budget {
+				budget -= extra
+				video.index = i
+				break
+			}
+		}
+	}
+
+	for _, video := range videos {
+		video.downTrack.Track().allocate(
+			video.downTrack,
+			video.layers[video.index].rid,
+			video.paused,
+		)
+	}
+}
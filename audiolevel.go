@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Audio levels are in -dBov, just like the audio level header extension has
+// them: 0 is as loud as it gets, and 127 is silence.
+const silentAudioLevel = 127
+
+// Anything quieter than this (in -dBov) isn't considered to be anyone speaking
+const speakingAudioLevel = 50
+
+// How much each packet's level counts towards the smoothed level. At 50
+// packets per second, that gets most of the way there in about half a second,
+// which is enough to smooth over the gaps between words.
+const audioLevelSmoothing = 0.05
+
+// How long a track can go without sending anything, before it counts as
+// silent. Publishers using DTX stop sending altogether while nobody's talking.
+const audioLevelTimeout = 500 * time.Millisecond
+
+// audioActivity is how loud a track has been lately, going off of the audio
+// level header extension.
+type audioActivity struct {
+	lock *sync.Mutex
+
+	// Smoothed, in -dBov
+	level   float64
+	updated time.Time
+}
+
+func newAudioActivity() *audioActivity {
+	return &audioActivity{lock: &sync.Mutex{}, level: silentAudioLevel}
+}
+
+// observe takes into account the level of a single packet.
+//
+// The voice activity flag is ignored, since not every publisher sets it, and
+// there's no telling apart "not set" from "no voice".
+func (a *audioActivity) observe(extension rtp.AudioLevelExtension) {
+	level := float64(extension.Level)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if time.Since(a.updated) > audioLevelTimeout {
+		a.level = silentAudioLevel
+	}
+	a.level += (level - a.level) * audioLevelSmoothing
+	a.updated = time.Now()
+}
+
+// Level returns the smoothed level, in -dBov
+func (a *audioActivity) Level() float64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if time.Since(a.updated) > audioLevelTimeout {
+		return silentAudioLevel
+	}
+	return a.level
+}
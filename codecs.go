@@ -0,0 +1,300 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// What RegisterDefaultCodecs registers, as far as telling whether a publisher
+// offered anything acceptable goes.
+var defaultMimeTypes = []string{
+	webrtc.MimeTypeOpus,
+	webrtc.MimeTypeG722,
+	webrtc.MimeTypePCMU,
+	webrtc.MimeTypePCMA,
+	webrtc.MimeTypeVP8,
+	webrtc.MimeTypeVP9,
+	webrtc.MimeTypeH264,
+	webrtc.MimeTypeAV1,
+}
+
+// The feedback that RegisterDefaultCodecs gives every video codec, other than
+// RTX
+var defaultVideoFeedback = []webrtc.RTCPFeedback{
+	{Type: "goog-remb"},
+	{Type: "ccm", Parameter: "fir"},
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+}
+
+// Payload types that codecs have had since long before SDP could say so
+var staticPayloadTypes = map[string]uint8{
+	"audio/pcmu": 0,
+	"audio/pcma": 8,
+	"audio/g722": 9,
+}
+
+// rtpPayloadType is the payload type to send the codec with over plain RTP
+// (i.e. without anything to negotiate it with): its static one, if it has one,
+// or else the given dynamic one.
+func rtpPayloadType(codec webrtc.RTPCodecCapability, dynamic uint8) uint8 {
+	if payloadType, ok := staticPayloadTypes[strings.ToLower(codec.MimeType)]; ok {
+		return payloadType
+	}
+	return dynamic
+}
+
+// sdpRTPMap is the codec, the way that an SDP rtpmap attribute has it, e.g.
+// "opus/48000/2", for Opus
+func sdpRTPMap(codec webrtc.RTPCodecCapability) string {
+	_, name, _ := strings.Cut(codec.MimeType, "/")
+	rtpmap := name + "/" + strconv.Itoa(int(codec.ClockRate))
+	if codec.Channels > 0 {
+		rtpmap += "/" + strconv.Itoa(int(codec.Channels))
+	}
+	return rtpmap
+}
+
+// registerCodecs registers the configured codecs and header extensions with a
+// media engine, or Pion's default codecs, if there aren't any configured. The
+// given video feedback goes on every video codec other than RTX, unless the
+// codec already has it.
+//
+// The very same codecs are used for both publishers and receivers, since
+// whatever a publisher sends is forwarded to receivers as is.
+func registerCodecs(m *webrtc.MediaEngine, videoFeedback ...webrtc.RTCPFeedback) error {
+	codecs := config.Codecs()
+	if codecs == nil {
+		if err := m.RegisterDefaultCodecs(); err != nil {
+			return err
+		}
+		for _, f := range videoFeedback {
+			if !slices.Contains(defaultVideoFeedback, f) {
+				m.RegisterFeedback(f, webrtc.RTPCodecTypeVideo)
+			}
+		}
+		return nil
+	}
+
+	for _, codec := range codecs.Codecs {
+		feedback := []webrtc.RTCPFeedback{}
+		for _, f := range codec.RTCPFeedback {
+			feedback = append(feedback, webrtc.RTCPFeedback{Type: f.Type, Parameter: f.Parameter})
+		}
+		if codec.Kind == "video" && !strings.EqualFold(codec.MimeType, webrtc.MimeTypeRTX) {
+			for _, f := range videoFeedback {
+				if !slices.Contains(feedback, f) {
+					feedback = append(feedback, f)
+				}
+			}
+		}
+
+		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     codec.MimeType,
+				ClockRate:    codec.ClockRate,
+				Channels:     codec.Channels,
+				SDPFmtpLine:  codec.SDPFmtpLine,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: webrtc.PayloadType(codec.PayloadType),
+		}, webrtc.NewRTPCodecType(codec.Kind)); err != nil {
+			return err
+		}
+	}
+
+	for _, extension := range codecs.HeaderExtensions {
+		if err := m.RegisterHeaderExtension(
+			webrtc.RTPHeaderExtensionCapability{URI: extension.URI},
+			webrtc.NewRTPCodecType(extension.Kind),
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UnacceptableMedia is a media section of a publisher's offer, that doesn't
+// have a single codec that we accept.
+type UnacceptableMedia struct {
+	Mid  string `json:"mid"`
+	Kind string `json:"kind"`
+
+	// Every codec that was offered, as "<MIME type>/<clock rate>", followed by
+	// the format parameters, if any
+	Offered []string `json:"offered"`
+}
+
+// findUnacceptableMedia goes through the media sections of a publisher's
+// offer, looking for any that the publisher would be sending on, but that
+// doesn't have any codec that we accept.
+func findUnacceptableMedia(offer webrtc.SessionDescription) ([]UnacceptableMedia, error) {
+	description, err := offer.Unmarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	unacceptable := []UnacceptableMedia{}
+	for _, media := range description.MediaDescriptions {
+		kind := media.MediaName.Media
+		if kind != "audio" && kind != "video" {
+			continue
+		}
+
+		// Rejected, or not being sent on, so it doesn't matter
+		if media.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := media.Attribute(sdp.AttrKeyRecvOnly); ok {
+			continue
+		}
+		if _, ok := media.Attribute(sdp.AttrKeyInactive); ok {
+			continue
+		}
+
+		offered := offeredCodecs(kind, media)
+		acceptable := false
+		for _, codec := range offered {
+			if isAcceptableCodec(kind, codec) {
+				acceptable = true
+				break
+			}
+		}
+		if acceptable {
+			continue
+		}
+
+		mid, _ := media.Attribute(sdp.AttrKeyMID)
+		descriptions := []string{}
+		for _, codec := range offered {
+			description := codec.MimeType + "/" + strconv.FormatUint(uint64(codec.ClockRate), 10)
+			if codec.SDPFmtpLine != "" {
+				description += ";" + codec.SDPFmtpLine
+			}
+			descriptions = append(descriptions, description)
+		}
+		unacceptable = append(unacceptable, UnacceptableMedia{mid, kind, descriptions})
+	}
+
+	return unacceptable, nil
+}
+
+// offeredCodecs lists the codecs of a media section, going off of its rtpmap
+// and fmtp attributes
+func offeredCodecs(kind string, media *sdp.MediaDescription) []webrtc.RTPCodecCapability {
+	fmtps := map[string]string{}
+	for _, attribute := range media.Attributes {
+		if attribute.Key != "fmtp" {
+			continue
+		}
+		payloadType, line, ok := strings.Cut(attribute.Value, " ")
+		if ok {
+			fmtps[payloadType] = line
+		}
+	}
+
+	codecs := []webrtc.RTPCodecCapability{}
+	for _, attribute := range media.Attributes {
+		if attribute.Key != "rtpmap" {
+			continue
+		}
+
+		// e.g. "111 opus/48000/2"
+		payloadType, encoding, ok := strings.Cut(attribute.Value, " ")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(encoding, "/")
+		if len(parts) < 2 {
+			continue
+		}
+
+		clockRate, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			continue
+		}
+
+		codecs = append(codecs, webrtc.RTPCodecCapability{
+			MimeType:    kind + "/" + parts[0],
+			ClockRate:   uint32(clockRate),
+			SDPFmtpLine: fmtps[payloadType],
+		})
+	}
+
+	return codecs
+}
+
+// isAcceptableCodec tells whether a codec that a publisher offered is one that
+// we accept. RTX doesn't count, since it's nothing without the codec it
+// carries.
+func isAcceptableCodec(kind string, offered webrtc.RTPCodecCapability) bool {
+	if strings.EqualFold(offered.MimeType, webrtc.MimeTypeRTX) {
+		return false
+	}
+
+	codecs := config.Codecs()
+	if codecs == nil {
+		for _, mimeType := range defaultMimeTypes {
+			if strings.EqualFold(mimeType, offered.MimeType) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, codec := range codecs.Codecs {
+		if codec.Kind != kind ||
+			!strings.EqualFold(codec.MimeType, offered.MimeType) ||
+			codec.ClockRate != offered.ClockRate {
+			continue
+		}
+
+		// H.264 profiles are the one thing that can't be mixed and matched
+		if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) &&
+			!h264FormatsMatch(codec.SDPFmtpLine, offered.SDPFmtpLine) {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// h264FormatsMatch tells whether two H.264 fmtp lines describe the same
+// profile and packetization mode. The level doesn't matter.
+func h264FormatsMatch(a, b string) bool {
+	first, second := parseFmtp(a), parseFmtp(b)
+
+	if first["packetization-mode"] != second["packetization-mode"] {
+		// Not having one is the same as it being zero
+		if first["packetization-mode"]+second["packetization-mode"] != "0" {
+			return false
+		}
+	}
+
+	// The first four hex digits are the profile; the last two, the level
+	firstProfile, secondProfile := first["profile-level-id"], second["profile-level-id"]
+	if len(firstProfile) < 4 || len(secondProfile) < 4 {
+		return firstProfile == secondProfile
+	}
+	return strings.EqualFold(firstProfile[:4], secondProfile[:4])
+}
+
+// parseFmtp parses an fmtp line (e.g. "packetization-mode=1;profile-level-id=42e01f")
+func parseFmtp(line string) map[string]string {
+	parameters := map[string]string{}
+	for _, parameter := range strings.Split(line, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(parameter), "=")
+		if key != "" {
+			parameters[strings.ToLower(key)] = value
+		}
+	}
+	return parameters
+}
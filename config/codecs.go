@@ -0,0 +1,128 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Codec is a single codec that the SFU accepts from publishers, and sends to
+// receivers.
+type Codec struct {
+	// Either "audio" or "video"
+	Kind string `json:"kind"`
+
+	// e.g. "video/VP8"
+	MimeType    string `json:"mimeType"`
+	ClockRate   uint32 `json:"clockRate"`
+	Channels    uint16 `json:"channels"`
+	SDPFmtpLine string `json:"sdpFmtpLine"`
+	PayloadType uint8  `json:"payloadType"`
+
+	RTCPFeedback []RTCPFeedback `json:"rtcpFeedback"`
+}
+
+// RTCPFeedback is a single type of RTCP feedback that a codec supports, e.g.
+// "nack", or "nack" with the "pli" parameter.
+type RTCPFeedback struct {
+	Type      string `json:"type"`
+	Parameter string `json:"parameter"`
+}
+
+// HeaderExtension is an RTP header extension to negotiate, on top of the ones
+// that the SFU itself needs.
+type HeaderExtension struct {
+	// Either "audio" or "video"
+	Kind string `json:"kind"`
+	URI  string `json:"uri"`
+}
+
+// CodecConfig is what gets loaded from the file that the CODECS_FILE
+// environment variable points to.
+type CodecConfig struct {
+	Codecs           []Codec           `json:"codecs"`
+	HeaderExtensions []HeaderExtension `json:"headerExtensions"`
+}
+
+var codecConfig *CodecConfig
+
+// loadCodecConfig reads and checks the codec configuration file. There's no
+// point in starting up with a configuration that doesn't make sense, so this
+// panics on anything wrong with it.
+func loadCodecConfig(path string) *CodecConfig {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read codec configuration: %s", err.Error()))
+	}
+
+	var c CodecConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		panic(fmt.Sprintf("Failed to parse codec configuration: %s", err.Error()))
+	}
+
+	if len(c.Codecs) == 0 {
+		panic("Codec configuration has no codecs")
+	}
+
+	payloadTypes := map[uint8]string{}
+	for _, codec := range c.Codecs {
+		if codec.Kind != "audio" && codec.Kind != "video" {
+			panic(fmt.Sprintf("Codec %q has an unknown kind %q", codec.MimeType, codec.Kind))
+		}
+		if !strings.HasPrefix(strings.ToLower(codec.MimeType), codec.Kind+"/") {
+			panic(fmt.Sprintf("Codec %q doesn't look like an %s codec", codec.MimeType, codec.Kind))
+		}
+		if codec.ClockRate == 0 {
+			panic(fmt.Sprintf("Codec %q has no clock rate", codec.MimeType))
+		}
+		if other, ok := payloadTypes[codec.PayloadType]; ok {
+			panic(fmt.Sprintf(
+				"Codecs %q and %q have the same payload type %d",
+				other,
+				codec.MimeType,
+				codec.PayloadType,
+			))
+		}
+		payloadTypes[codec.PayloadType] = codec.MimeType
+	}
+
+	// RTX is for sending lost packets again, and has to say which codec's
+	// packets it carries
+	for _, codec := range c.Codecs {
+		if !strings.EqualFold(codec.MimeType, "video/rtx") {
+			continue
+		}
+		apt := ""
+		for _, parameter := range strings.Split(codec.SDPFmtpLine, ";") {
+			if key, value, _ := strings.Cut(strings.TrimSpace(parameter), "="); key == "apt" {
+				apt = value
+			}
+		}
+		payloadType, err := strconv.ParseUint(apt, 10, 8)
+		mimeType, ok := payloadTypes[uint8(payloadType)]
+		if err != nil || !ok ||
+			!strings.HasPrefix(strings.ToLower(mimeType), "video/") ||
+			strings.EqualFold(mimeType, "video/rtx") {
+			panic(fmt.Sprintf(
+				"RTX codec with payload type %d needs an \"apt\" of a video codec's payload type",
+				codec.PayloadType,
+			))
+		}
+	}
+
+	for _, extension := range c.HeaderExtensions {
+		if extension.Kind != "audio" && extension.Kind != "video" {
+			panic(fmt.Sprintf("Header extension %q has an unknown kind %q", extension.URI, extension.Kind))
+		}
+	}
+
+	return &c
+}
+
+// Codecs returns the codec configuration, or nil if there is none, in which
+// case Pion's default codecs are to be used.
+func Codecs() *CodecConfig {
+	return codecConfig
+}
@@ -1,12 +1,56 @@
 package config
 
 import (
+	"crypto/subtle"
+	"log/slog"
+	"net/url"
 	"os"
 	"strconv"
+	"time"
 )
 
 var portNumber = 8080
 
+var keyframeRequestInterval = 500 * time.Millisecond
+
+var initialBitrate = 3_000_000
+
+var sessionResumeWindow = 30 * time.Second
+
+var dataChannelMaxMessageSize = 16 * 1024
+
+var dataChannelMessageRate = 50
+
+var hlsSegmentDuration = 2 * time.Second
+
+var hlsPartDuration = 500 * time.Millisecond
+
+var hlsPlaylistSegments = 6
+
+var rtspPort = 0
+
+var rtspRTPPort = 0
+
+var originURL *url.URL
+
+var nodeID, _ = os.Hostname()
+
+var nodeURL string
+
+var registryURL *url.URL
+
+var registryToken string
+
+var registryServer = false
+
+var adminAPIToken string
+
+var metricsToken string
+
+var logLevel = slog.LevelInfo
+
+var logJSON = false
+
 func init() {
 	port := os.Getenv("PORT")
 	num, err := strconv.Atoi(port)
@@ -14,8 +58,263 @@ func init() {
 	if err == nil {
 		portNumber = num
 	}
+
+	interval, err := strconv.Atoi(os.Getenv("KEYFRAME_REQUEST_INTERVAL_MS"))
+	if err == nil && interval >= 0 {
+		keyframeRequestInterval = time.Duration(interval) * time.Millisecond
+	}
+
+	bitrate, err := strconv.Atoi(os.Getenv("INITIAL_BITRATE"))
+	if err == nil && bitrate > 0 {
+		initialBitrate = bitrate
+	}
+
+	window, err := strconv.Atoi(os.Getenv("SESSION_RESUME_WINDOW_MS"))
+	if err == nil && window >= 0 {
+		sessionResumeWindow = time.Duration(window) * time.Millisecond
+	}
+
+	size, err := strconv.Atoi(os.Getenv("DATA_CHANNEL_MAX_MESSAGE_SIZE"))
+	if err == nil && size > 0 {
+		dataChannelMaxMessageSize = size
+	}
+
+	rate, err := strconv.Atoi(os.Getenv("DATA_CHANNEL_MESSAGE_RATE"))
+	if err == nil && rate > 0 {
+		dataChannelMessageRate = rate
+	}
+
+	segment, err := strconv.Atoi(os.Getenv("HLS_SEGMENT_DURATION_MS"))
+	if err == nil && segment > 0 {
+		hlsSegmentDuration = time.Duration(segment) * time.Millisecond
+	}
+
+	part, err := strconv.Atoi(os.Getenv("HLS_PART_DURATION_MS"))
+	if err == nil && part > 0 {
+		hlsPartDuration = time.Duration(part) * time.Millisecond
+	}
+	if hlsPartDuration > hlsSegmentDuration {
+		hlsPartDuration = hlsSegmentDuration
+	}
+
+	segments, err := strconv.Atoi(os.Getenv("HLS_PLAYLIST_SEGMENTS"))
+	if err == nil && segments > 0 {
+		hlsPlaylistSegments = segments
+	}
+
+	rtsp, err := strconv.Atoi(os.Getenv("RTSP_PORT"))
+	if err == nil && rtsp >= 0 {
+		rtspPort = rtsp
+	}
+
+	// RTCP goes on the port right after, so there has to be one
+	rtp, err := strconv.Atoi(os.Getenv("RTSP_RTP_PORT"))
+	if err == nil && rtp > 0 && rtp < 65535 {
+		rtspRTPPort = rtp
+	}
+
+	if origin := os.Getenv("ORIGIN_URL"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			panic("ORIGIN_URL has to be a URL, like http://origin.example.com:8080")
+		}
+		switch u.Scheme {
+		case "http", "https", "ws", "wss":
+		default:
+			panic("ORIGIN_URL has to be either http(s) or ws(s)")
+		}
+		originURL = u
+	}
+
+	if id := os.Getenv("NODE_ID"); id != "" {
+		nodeID = id
+	}
+	nodeURL = os.Getenv("NODE_URL")
+
+	if registry := os.Getenv("REGISTRY_URL"); registry != "" {
+		u, err := url.Parse(registry)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			panic("REGISTRY_URL has to be an http(s) URL, like http://registry.example.com:8080")
+		}
+		registryURL = u
+	}
+	registryToken = os.Getenv("REGISTRY_TOKEN")
+	registryServer, _ = strconv.ParseBool(os.Getenv("REGISTRY_SERVER"))
+
+	adminAPIToken = os.Getenv("ADMIN_API_TOKEN")
+
+	metricsToken = os.Getenv("METRICS_TOKEN")
+
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			panic("LOG_LEVEL has to be one of debug, info, warn, or error")
+		}
+	}
+	switch os.Getenv("LOG_FORMAT") {
+	case "", "text":
+	case "json":
+		logJSON = true
+	default:
+		panic("LOG_FORMAT has to be either text or json")
+	}
+
+	if path := os.Getenv("CODECS_FILE"); path != "" {
+		codecConfig = loadCodecConfig(path)
+	}
+
+	if path := os.Getenv("RECORDING_FILE"); path != "" {
+		recordingConfig = loadRecordingConfig(path)
+	}
+
+	if path := os.Getenv("WHIP_TOKENS_FILE"); path != "" {
+		whipConfig = loadWHIPConfig(path)
+	}
+
+	if path := os.Getenv("RTP_INGEST_FILE"); path != "" {
+		rtpIngestConfig = loadRTPIngestConfig(path)
+	}
+
+	if path := os.Getenv("RTP_EGRESS_FILE"); path != "" {
+		rtpEgressConfig = loadRTPEgressConfig(path)
+	}
+	rtpEgressAPIToken = os.Getenv("RTP_EGRESS_API_TOKEN")
+
+	if path := os.Getenv("RTSP_PULL_FILE"); path != "" {
+		rtspPullConfig = loadRTSPPullConfig(path)
+	}
+
+	if path := os.Getenv("RTSP_USERS_FILE"); path != "" {
+		rtspUsersConfig = loadRTSPUsersConfig(path)
+	}
 }
 
 func PortNumber() int {
 	return portNumber
 }
+
+// KeyframeRequestInterval is the least amount of time between two keyframe
+// requests sent to a publisher, for a single track. Requests from receivers
+// that come in any faster than that are merged together.
+func KeyframeRequestInterval() time.Duration {
+	return keyframeRequestInterval
+}
+
+// InitialBitrate is the bandwidth (in bits per second) that receivers are
+// assumed to have, until the bandwidth estimate says otherwise.
+func InitialBitrate() int {
+	return initialBitrate
+}
+
+// SessionResumeWindow is how long a client's peer connection is kept around
+// for, after its signalling WebSocket connection closes, in case the client
+// reconnects. Zero means that clients can't reconnect.
+func SessionResumeWindow() time.Duration {
+	return sessionResumeWindow
+}
+
+// DataChannelMaxMessageSize is the largest data channel message (in bytes)
+// that gets relayed. Anything larger is dropped.
+func DataChannelMaxMessageSize() int {
+	return dataChannelMaxMessageSize
+}
+
+// DataChannelMessageRate is how many data channel messages per second get
+// relayed for a single broadcast, in each direction. Anything past that is
+// dropped.
+func DataChannelMessageRate() int {
+	return dataChannelMessageRate
+}
+
+// HLSSegmentDuration is how long HLS segments are aimed to be. Segments only
+// ever start on a keyframe, so they can end up a bit longer.
+func HLSSegmentDuration() time.Duration {
+	return hlsSegmentDuration
+}
+
+// HLSPartDuration is how long the partial segments of Low-Latency HLS are.
+func HLSPartDuration() time.Duration {
+	return hlsPartDuration
+}
+
+// HLSPlaylistSegments is how many complete segments HLS playlists list.
+func HLSPlaylistSegments() int {
+	return hlsPlaylistSegments
+}
+
+// RTSPPort is the TCP port that the RTSP server listens on. Zero (the default)
+// means that there's no RTSP server.
+func RTSPPort() int {
+	return rtspPort
+}
+
+// RTSPRTPPort is the UDP port that the RTSP server sends RTP from, to clients
+// that want it over UDP. RTCP goes out of the port right after. Zero (the
+// default) means that RTP only goes out interleaved on the RTSP connection.
+func RTSPRTPPort() int {
+	return rtspRTPPort
+}
+
+// OriginURL is where the origin server is, for servers that are edges. Nil
+// for servers that aren't (which includes the origin itself).
+func OriginURL() *url.URL {
+	return originURL
+}
+
+// NodeID tells this server apart from the others sharing a registry. The
+// hostname by default.
+func NodeID() string {
+	return nodeID
+}
+
+// NodeURL is where other servers can reach this one, e.g. to get broadcasts
+// from it. Empty if they can't.
+func NodeURL() string {
+	return nodeURL
+}
+
+// RegistryURL is where the registry that's shared with other servers is. Nil
+// for servers that keep their registry to themselves.
+func RegistryURL() *url.URL {
+	return registryURL
+}
+
+// RegistryToken is the bearer token that servers need, to use the registry.
+// Empty if anyone can.
+func RegistryToken() string {
+	return registryToken
+}
+
+// IsRegistryServer tells whether this server is the one serving the registry,
+// for others to share
+func IsRegistryServer() bool {
+	return registryServer
+}
+
+// IsAdminAPIToken tells whether the given bearer token lets its holder use the
+// admin API. Without a configured token, nobody can.
+func IsAdminAPIToken(token string) bool {
+	if adminAPIToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(adminAPIToken), []byte(token)) == 1
+}
+
+// IsMetricsToken tells whether the given bearer token lets its holder scrape
+// the metrics. Without a configured token, anyone can.
+func IsMetricsToken(token string) bool {
+	if metricsToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(metricsToken), []byte(token)) == 1
+}
+
+// LogLevel is the level below which nothing gets logged
+func LogLevel() slog.Level {
+	return logLevel
+}
+
+// IsLogJSON tells whether logs are written as JSON, one object per line, as
+// opposed to as key=value pairs
+func IsLogJSON() bool {
+	return logJSON
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// The container formats that recordings can be written in
+const (
+	// VP8, VP9, and AV1; one file per video track
+	RecordingFormatIVF = "ivf"
+
+	// Opus; one file per audio track
+	RecordingFormatOgg = "ogg"
+
+	// One file for the broadcast's audio and video together
+	RecordingFormatWebM = "webm"
+)
+
+// RecordingRule has broadcasts get recorded as soon as they're published to,
+// without the publisher having to ask.
+type RecordingRule struct {
+	// The key ID of the publisher. Empty (or "*") for any publisher.
+	KeyID string `json:"keyId"`
+
+	// A pattern (as in path.Match, e.g. "meeting-*") that the broadcast ID has
+	// to match. Empty for any broadcast.
+	ID string `json:"id"`
+
+	// "audio" and/or "video". Empty for both.
+	Kinds []string `json:"kinds"`
+
+	// Any of "ivf", "ogg", and "webm". Empty for just "webm".
+	Formats []string `json:"formats"`
+}
+
+// Matches tells whether the rule applies to the given broadcast
+func (r RecordingRule) Matches(keyId, broadcastId string) bool {
+	if r.KeyID != "" && r.KeyID != "*" && r.KeyID != keyId {
+		return false
+	}
+	if r.ID == "" {
+		return true
+	}
+	matched, err := path.Match(r.ID, broadcastId)
+	return err == nil && matched
+}
+
+// RecordingRetention says how long recordings are kept around for. Zero means
+// no limit.
+type RecordingRetention struct {
+	MaxAgeSeconds int `json:"maxAgeSeconds"`
+
+	// In bytes, across every recording
+	MaxTotalSize int64 `json:"maxTotalSize"`
+}
+
+// RecordingConfig is what gets loaded from the file that the RECORDING_FILE
+// environment variable points to.
+type RecordingConfig struct {
+	// Where recordings are written to
+	Directory string `json:"directory"`
+
+	// Once a file gets this big (in bytes), or this old, recording carries on in
+	// a new file. Zero means no limit.
+	MaxFileSize            int64 `json:"maxFileSize"`
+	MaxFileDurationSeconds int   `json:"maxFileDurationSeconds"`
+
+	Retention RecordingRetention `json:"retention"`
+
+	Rules []RecordingRule `json:"rules"`
+}
+
+// Without a configuration file, publishers can still ask for their broadcasts
+// to be recorded; recordings just pile up, forever
+var recordingConfig = &RecordingConfig{Directory: "recordings"}
+
+// loadRecordingConfig reads and checks the recording configuration file, and
+// panics on anything wrong with it, just like loadCodecConfig.
+func loadRecordingConfig(p string) *RecordingConfig {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read recording configuration: %s", err.Error()))
+	}
+
+	var c RecordingConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		panic(fmt.Sprintf("Failed to parse recording configuration: %s", err.Error()))
+	}
+
+	if c.Directory == "" {
+		c.Directory = "recordings"
+	}
+	if c.MaxFileSize < 0 || c.MaxFileDurationSeconds < 0 {
+		panic("Recording file limits can't be negative")
+	}
+	if c.Retention.MaxAgeSeconds < 0 || c.Retention.MaxTotalSize < 0 {
+		panic("Recording retention limits can't be negative")
+	}
+
+	for i, rule := range c.Rules {
+		if _, err := path.Match(rule.ID, ""); err != nil {
+			panic(fmt.Sprintf("Recording rule %d has a bad ID pattern %q", i, rule.ID))
+		}
+		if err := CheckRecordingKinds(rule.Kinds); err != nil {
+			panic(fmt.Sprintf("Recording rule %d: %s", i, err.Error()))
+		}
+		if err := CheckRecordingFormats(rule.Formats); err != nil {
+			panic(fmt.Sprintf("Recording rule %d: %s", i, err.Error()))
+		}
+	}
+
+	return &c
+}
+
+// CheckRecordingKinds makes sure that every kind is one that can be recorded
+func CheckRecordingKinds(kinds []string) error {
+	for _, kind := range kinds {
+		if kind != "audio" && kind != "video" {
+			return fmt.Errorf("unknown kind %q", kind)
+		}
+	}
+	return nil
+}
+
+// CheckRecordingFormats makes sure that every format is one that recordings
+// can be written in
+func CheckRecordingFormats(formats []string) error {
+	for _, format := range formats {
+		switch format {
+		case RecordingFormatIVF, RecordingFormatOgg, RecordingFormatWebM:
+		default:
+			return fmt.Errorf("unknown format %q", format)
+		}
+	}
+	return nil
+}
+
+// Recording returns the recording configuration. Never nil.
+func Recording() *RecordingConfig {
+	return recordingConfig
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// RTPEgressSink sends one of a broadcast's tracks, as plain RTP over UDP, to
+// wherever it's needed (e.g. an ffmpeg or GStreamer pipeline).
+type RTPEgressSink struct {
+	// What the sink is known by, in URLs. Letters, digits, "-", and "_" only.
+	Name string `json:"name"`
+
+	KeyID string `json:"keyId"`
+	ID    string `json:"id"`
+
+	// Either "audio" or "video"
+	Kind string `json:"kind"`
+
+	// Optional. Without it, the broadcast's first track of the kind gets sent.
+	Track string `json:"track,omitempty"`
+
+	// Where to send the packets to, as "host:port"
+	Destination string `json:"destination"`
+}
+
+// RTPEgressConfig is what gets loaded from the file that the RTP_EGRESS_FILE
+// environment variable points to.
+type RTPEgressConfig struct {
+	Sinks []RTPEgressSink `json:"sinks"`
+}
+
+var rtpEgressConfig = &RTPEgressConfig{}
+
+// Whoever has this token gets to create and destroy sinks over HTTP. Empty
+// means that nobody does.
+var rtpEgressAPIToken = ""
+
+var rtpEgressNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// loadRTPEgressConfig reads and checks the RTP egress configuration file.
+// Panics on anything wrong with it.
+func loadRTPEgressConfig(p string) *RTPEgressConfig {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read RTP egress configuration: %s", err.Error()))
+	}
+
+	var c RTPEgressConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		panic(fmt.Sprintf("Failed to parse RTP egress configuration: %s", err.Error()))
+	}
+
+	names := map[string]bool{}
+	for i, sink := range c.Sinks {
+		if err := CheckRTPEgressSink(sink); err != nil {
+			panic(fmt.Sprintf("RTP egress sink %d: %s", i, err.Error()))
+		}
+		if names[sink.Name] {
+			panic(fmt.Sprintf("RTP egress sink %q is listed more than once", sink.Name))
+		}
+		names[sink.Name] = true
+	}
+
+	return &c
+}
+
+// CheckRTPEgressSink makes sure that a sink has everything it needs. Used for
+// sinks from the configuration file, and from the API alike.
+func CheckRTPEgressSink(sink RTPEgressSink) error {
+	if !rtpEgressNamePattern.MatchString(sink.Name) {
+		return fmt.Errorf("bad name %q", sink.Name)
+	}
+	if sink.KeyID == "" || sink.ID == "" {
+		return errors.New("both a key ID and an ID are needed")
+	}
+	if sink.Kind != "audio" && sink.Kind != "video" {
+		return fmt.Errorf("unknown kind %q", sink.Kind)
+	}
+
+	host, port, err := net.SplitHostPort(sink.Destination)
+	if err != nil {
+		return fmt.Errorf("bad destination %q: %w", sink.Destination, err)
+	}
+	if host == "" {
+		return fmt.Errorf("destination %q has no host", sink.Destination)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("destination %q has a bad port", sink.Destination)
+	}
+
+	return nil
+}
+
+// RTPEgressSinks gets the sinks that are set up at startup
+func RTPEgressSinks() []RTPEgressSink {
+	return rtpEgressConfig.Sinks
+}
+
+// IsRTPEgressAPIToken tells whether the given bearer token lets its holder
+// create and destroy sinks
+func IsRTPEgressAPIToken(token string) bool {
+	if rtpEgressAPIToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(rtpEgressAPIToken), []byte(token)) == 1
+}
@@ -0,0 +1,284 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+// RTPIngestSource is a broadcast that gets fed with plain RTP over UDP (e.g.
+// from `ffmpeg -f rtp`), rather than by a browser.
+//
+// What the streams look like (ports, payload types, codecs) can either come
+// from an SDP file (like the one ffmpeg writes with -sdp_file), or, for a
+// single stream, be spelled out right here.
+type RTPIngestSource struct {
+	KeyID string `json:"keyId"`
+	ID    string `json:"id"`
+
+	// Path to an SDP file describing the streams. Every audio and video media
+	// section in it becomes a track. Relative paths are relative to the RTP
+	// ingest configuration file.
+	SDPFile string `json:"sdpFile"`
+
+	// Only used without an SDP file
+	Kind  string `json:"kind"`
+	Port  int    `json:"port"`
+	SSRC  uint32 `json:"ssrc"`
+	Track string `json:"track"`
+	Codec Codec  `json:"codec"`
+}
+
+// RTPIngestStream is a single RTP stream that's expected to come in on a UDP
+// port, and which track of which broadcast it turns into.
+type RTPIngestStream struct {
+	KeyID string
+	ID    string
+	Track string
+	Kind  string
+	Port  int
+
+	// Zero means any SSRC. Otherwise, only packets with this SSRC are taken,
+	// which is how more than one stream can share a port.
+	SSRC uint32
+
+	// What the packets are expected to look like. Packets with any other payload
+	// type get dropped.
+	Codec Codec
+}
+
+// RTPIngestConfig is what gets loaded from the file that the RTP_INGEST_FILE
+// environment variable points to.
+type RTPIngestConfig struct {
+	// The address to listen on, without the port. Empty means every interface.
+	Address string `json:"address"`
+
+	// How long a stream can go without any packets before its track is removed
+	// from the broadcast. Zero means 5 seconds.
+	TimeoutSeconds int `json:"timeoutSeconds"`
+
+	Sources []RTPIngestSource `json:"sources"`
+
+	// Every stream, out of every source
+	Streams []RTPIngestStream `json:"-"`
+}
+
+var rtpIngestConfig = &RTPIngestConfig{TimeoutSeconds: 5}
+
+// loadRTPIngestConfig reads and checks the RTP ingest configuration file, along
+// with any SDP files that it points to. Panics on anything wrong with either.
+func loadRTPIngestConfig(p string) *RTPIngestConfig {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read RTP ingest configuration: %s", err.Error()))
+	}
+
+	var c RTPIngestConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		panic(fmt.Sprintf("Failed to parse RTP ingest configuration: %s", err.Error()))
+	}
+
+	if c.TimeoutSeconds < 0 {
+		panic("RTP ingest timeout can't be negative")
+	}
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = 5
+	}
+
+	for i, source := range c.Sources {
+		if source.KeyID == "" || source.ID == "" {
+			panic(fmt.Sprintf("RTP ingest source %d needs both a key ID and an ID", i))
+		}
+
+		if source.SDPFile == "" {
+			c.Streams = append(c.Streams, singleRTPIngestStream(i, source))
+			continue
+		}
+
+		sdpFile := source.SDPFile
+		if !filepath.IsAbs(sdpFile) {
+			sdpFile = filepath.Join(filepath.Dir(p), sdpFile)
+		}
+		streams, err := parseRTPIngestSDP(sdpFile, source)
+		if err != nil {
+			panic(fmt.Sprintf("RTP ingest source %d: %s", i, err.Error()))
+		}
+		c.Streams = append(c.Streams, streams...)
+	}
+
+	// Streams sharing a port have to be told apart by their SSRCs, and tracks
+	// can't end up with the same ID
+	ports := map[int]map[uint32]bool{}
+	tracks := map[string]bool{}
+	for _, stream := range c.Streams {
+		if stream.Port <= 0 || stream.Port > 65535 {
+			panic(fmt.Sprintf("RTP ingest stream for %s/%s has a bad port %d", stream.KeyID, stream.ID, stream.Port))
+		}
+		if ports[stream.Port] == nil {
+			ports[stream.Port] = map[uint32]bool{}
+		}
+		ssrcs := ports[stream.Port]
+		if ssrcs[stream.SSRC] || (len(ssrcs) > 0 && (stream.SSRC == 0 || ssrcs[0])) {
+			panic(fmt.Sprintf("RTP ingest streams on port %d can't be told apart by their SSRCs", stream.Port))
+		}
+		ssrcs[stream.SSRC] = true
+
+		track := stream.KeyID + "\x00" + stream.ID + "\x00" + stream.Track
+		if tracks[track] {
+			panic(fmt.Sprintf("RTP ingest track %q of %s/%s is listed more than once", stream.Track, stream.KeyID, stream.ID))
+		}
+		tracks[track] = true
+	}
+
+	return &c
+}
+
+func singleRTPIngestStream(i int, source RTPIngestSource) RTPIngestStream {
+	if source.Kind != "audio" && source.Kind != "video" {
+		panic(fmt.Sprintf("RTP ingest source %d has an unknown kind %q", i, source.Kind))
+	}
+	codec := source.Codec
+	codec.Kind = source.Kind
+	if !strings.HasPrefix(strings.ToLower(codec.MimeType), codec.Kind+"/") {
+		panic(fmt.Sprintf("RTP ingest source %d has a codec %q that isn't %s", i, codec.MimeType, codec.Kind))
+	}
+	if codec.ClockRate == 0 {
+		panic(fmt.Sprintf("RTP ingest source %d has a codec with no clock rate", i))
+	}
+
+	track := source.Track
+	if track == "" {
+		track = source.Kind
+	}
+
+	return RTPIngestStream{
+		KeyID: source.KeyID,
+		ID:    source.ID,
+		Track: track,
+		Kind:  source.Kind,
+		Port:  source.Port,
+		SSRC:  source.SSRC,
+		Codec: codec,
+	}
+}
+
+// parseRTPIngestSDP gets the streams out of an SDP file. Only the first payload
+// type of each media section is expected; ffmpeg never offers more than one.
+func parseRTPIngestSDP(p string, source RTPIngestSource) ([]RTPIngestStream, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var description sdp.SessionDescription
+	if err := description.Unmarshal(b); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", p, err)
+	}
+
+	streams := []RTPIngestStream{}
+	kinds := map[string]int{}
+	for _, media := range description.MediaDescriptions {
+		kind := media.MediaName.Media
+		if kind != "audio" && kind != "video" {
+			continue
+		}
+		if len(media.MediaName.Formats) == 0 {
+			return nil, fmt.Errorf("%s media in %s has no payload type", kind, p)
+		}
+		payloadType, err := strconv.ParseUint(media.MediaName.Formats[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%s media in %s has a bad payload type %q", kind, p, media.MediaName.Formats[0])
+		}
+
+		codec := Codec{Kind: kind, PayloadType: uint8(payloadType)}
+		var ssrc uint32
+		for _, attribute := range media.Attributes {
+			// Everything of interest starts with the payload type (or the SSRC),
+			// followed by a space
+			key, value, _ := strings.Cut(attribute.Value, " ")
+			switch attribute.Key {
+			case "rtpmap":
+				if key != media.MediaName.Formats[0] {
+					continue
+				}
+				// e.g. "H264/90000", or "opus/48000/2"
+				parts := strings.Split(value, "/")
+				codec.MimeType = kind + "/" + parts[0]
+				if len(parts) > 1 {
+					clockRate, err := strconv.ParseUint(parts[1], 10, 32)
+					if err != nil {
+						return nil, fmt.Errorf("%s media in %s has a bad clock rate %q", kind, p, parts[1])
+					}
+					codec.ClockRate = uint32(clockRate)
+				}
+				if len(parts) > 2 {
+					channels, err := strconv.ParseUint(parts[2], 10, 16)
+					if err != nil {
+						return nil, fmt.Errorf("%s media in %s has a bad channel count %q", kind, p, parts[2])
+					}
+					codec.Channels = uint16(channels)
+				}
+			case "fmtp":
+				if key == media.MediaName.Formats[0] {
+					codec.SDPFmtpLine = strings.TrimSpace(value)
+				}
+			case "ssrc":
+				if parsed, err := strconv.ParseUint(key, 10, 32); err == nil {
+					ssrc = uint32(parsed)
+				}
+			}
+		}
+		if codec.MimeType == "" || codec.ClockRate == 0 {
+			return nil, fmt.Errorf("%s media in %s has no rtpmap for payload type %d", kind, p, payloadType)
+		}
+
+		// Tracks are named after their media IDs, if they have any, just like
+		// tracks coming from browsers
+		track, ok := media.Attribute("mid")
+		if !ok || track == "" {
+			track = kind
+			if kinds[kind] > 0 {
+				track = fmt.Sprintf("%s%d", kind, kinds[kind])
+			}
+		}
+		kinds[kind]++
+
+		streams = append(streams, RTPIngestStream{
+			KeyID: source.KeyID,
+			ID:    source.ID,
+			Track: track,
+			Kind:  kind,
+			Port:  media.MediaName.Port.Value,
+			SSRC:  ssrc,
+			Codec: codec,
+		})
+	}
+
+	if len(streams) == 0 {
+		return nil, fmt.Errorf("%s has no audio or video in it", p)
+	}
+
+	return streams, nil
+}
+
+// RTPIngestAddress is the address that RTP ingest listens on, without the port
+func RTPIngestAddress() string {
+	return rtpIngestConfig.Address
+}
+
+// RTPIngestTimeout is how long an RTP ingest stream can go without packets,
+// before it's considered gone
+func RTPIngestTimeout() time.Duration {
+	return time.Duration(rtpIngestConfig.TimeoutSeconds) * time.Second
+}
+
+// RTPIngestStreams gets every stream that's expected to come in over RTP
+func RTPIngestStreams() []RTPIngestStream {
+	return rtpIngestConfig.Streams
+}
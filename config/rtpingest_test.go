@@ -0,0 +1,173 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The lines that every SDP file starts with, the way ffmpeg writes them
+const testSDPHeader = `v=0
+o=- 0 0 IN IP4 127.0.0.1
+s=No Name
+c=IN IP4 127.0.0.1
+t=0 0
+a=tool:libavformat
+`
+
+func TestParseRTPIngestSDP(t *testing.T) {
+	source := RTPIngestSource{KeyID: "some/key", ID: "broadcast"}
+
+	stream := func(track, kind string, port int, ssrc uint32, codec Codec) RTPIngestStream {
+		codec.Kind = kind
+		return RTPIngestStream{
+			KeyID: source.KeyID,
+			ID:    source.ID,
+			Track: track,
+			Kind:  kind,
+			Port:  port,
+			SSRC:  ssrc,
+			Codec: codec,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		sdp     string
+		want    []RTPIngestStream
+		wantErr bool
+	}{
+		{
+			name: "ffmpeg",
+			sdp: `m=video 5004 RTP/AVP 96
+a=rtpmap:96 H264/90000
+a=fmtp:96 packetization-mode=1; profile-level-id=42e01f
+m=audio 5006 RTP/AVP 97
+a=rtpmap:97 opus/48000/2
+`,
+			want: []RTPIngestStream{
+				stream("video", "video", 5004, 0, Codec{
+					MimeType:    "video/H264",
+					ClockRate:   90000,
+					SDPFmtpLine: "packetization-mode=1; profile-level-id=42e01f",
+					PayloadType: 96,
+				}),
+				stream("audio", "audio", 5006, 0, Codec{
+					MimeType:    "audio/opus",
+					ClockRate:   48000,
+					Channels:    2,
+					PayloadType: 97,
+				}),
+			},
+		},
+		{
+			name: "media IDs and SSRCs",
+			sdp: `m=video 5004 RTP/AVP 96
+a=mid:camera
+a=rtpmap:96 VP8/90000
+a=ssrc:1234 cname:ffmpeg
+`,
+			want: []RTPIngestStream{
+				stream("camera", "video", 5004, 1234, Codec{
+					MimeType:    "video/VP8",
+					ClockRate:   90000,
+					PayloadType: 96,
+				}),
+			},
+		},
+		{
+			name: "more than one of a kind",
+			sdp: `m=video 5004 RTP/AVP 96
+a=rtpmap:96 VP8/90000
+m=video 5006 RTP/AVP 96
+a=rtpmap:96 VP8/90000
+`,
+			want: []RTPIngestStream{
+				stream("video", "video", 5004, 0, Codec{MimeType: "video/VP8", ClockRate: 90000, PayloadType: 96}),
+				stream("video1", "video", 5006, 0, Codec{MimeType: "video/VP8", ClockRate: 90000, PayloadType: 96}),
+			},
+		},
+		{
+			name: "only the first payload type",
+			sdp: `m=video 5004 RTP/AVP 96 97
+a=rtpmap:97 H264/90000
+a=fmtp:97 packetization-mode=1
+a=rtpmap:96 VP8/90000
+`,
+			want: []RTPIngestStream{
+				stream("video", "video", 5004, 0, Codec{MimeType: "video/VP8", ClockRate: 90000, PayloadType: 96}),
+			},
+		},
+		{
+			name: "other media",
+			sdp: `m=application 5008 RTP/AVP 98
+a=rtpmap:98 something/1000
+m=audio 5006 RTP/AVP 0
+a=rtpmap:0 PCMU/8000
+`,
+			want: []RTPIngestStream{
+				stream("audio", "audio", 5006, 0, Codec{MimeType: "audio/PCMU", ClockRate: 8000, PayloadType: 0}),
+			},
+		},
+		{
+			name: "no audio or video",
+			sdp: `m=application 5008 RTP/AVP 98
+a=rtpmap:98 something/1000
+`,
+			wantErr: true,
+		},
+		{
+			name: "no rtpmap",
+			sdp: `m=audio 5006 RTP/AVP 0
+`,
+			wantErr: true,
+		},
+		{
+			name: "bad payload type",
+			sdp: `m=video 5004 RTP/AVP VP8
+a=rtpmap:VP8 VP8/90000
+`,
+			wantErr: true,
+		},
+		{
+			name: "bad clock rate",
+			sdp: `m=video 5004 RTP/AVP 96
+a=rtpmap:96 VP8/fast
+`,
+			wantErr: true,
+		},
+		{
+			name: "bad channel count",
+			sdp: `m=audio 5006 RTP/AVP 97
+a=rtpmap:97 opus/48000/stereo
+`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "stream.sdp")
+			sdp := strings.ReplaceAll(testSDPHeader+test.sdp, "\n", "\r\n")
+			if err := os.WriteFile(p, []byte(sdp), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseRTPIngestSDP(p, source)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("parsed %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
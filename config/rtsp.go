@@ -0,0 +1,74 @@
+package config
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// RTSPUser is a username and password that RTSP clients (e.g. VLC, or NVR
+// software) can watch broadcasts with. Whoever has them gets to watch the
+// broadcasts of the key ID, and nothing else.
+type RTSPUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	KeyID    string `json:"keyId"`
+}
+
+// RTSPUsersConfig is what gets loaded from the file that the RTSP_USERS_FILE
+// environment variable points to.
+type RTSPUsersConfig struct {
+	Users []RTSPUser `json:"users"`
+}
+
+var rtspUsersConfig = &RTSPUsersConfig{}
+
+// loadRTSPUsersConfig reads and checks the RTSP users file. Panics on anything
+// wrong with it.
+func loadRTSPUsersConfig(path string) *RTSPUsersConfig {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read RTSP users: %s", err.Error()))
+	}
+
+	var c RTSPUsersConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		panic(fmt.Sprintf("Failed to parse RTSP users: %s", err.Error()))
+	}
+
+	usernames := map[string]bool{}
+	for i, user := range c.Users {
+		if user.Username == "" || user.Password == "" {
+			panic(fmt.Sprintf("RTSP user %d needs both a username and a password", i))
+		}
+		if user.KeyID == "" {
+			panic(fmt.Sprintf("RTSP user %d has no key ID", i))
+		}
+		if usernames[user.Username] {
+			panic(fmt.Sprintf("RTSP user %d is listed more than once", i))
+		}
+		usernames[user.Username] = true
+	}
+
+	return &c
+}
+
+// RTSPKeyID gets the key ID whose broadcasts the given username and password
+// get to watch over RTSP. Without an RTSP users file, no one gets to watch
+// anything.
+func RTSPKeyID(username, password string) (string, bool) {
+	// Every user gets compared, so that how long this takes says nothing about
+	// the users
+	keyID := ""
+	found := false
+	for _, u := range rtspUsersConfig.Users {
+		usernameMatches := subtle.ConstantTimeCompare([]byte(u.Username), []byte(username))
+		passwordMatches := subtle.ConstantTimeCompare([]byte(u.Password), []byte(password))
+		if usernameMatches&passwordMatches == 1 {
+			keyID = u.KeyID
+			found = true
+		}
+	}
+	return keyID, found
+}
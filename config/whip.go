@@ -0,0 +1,70 @@
+package config
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// WHIPToken is a bearer token that WHIP clients (e.g. OBS, or a hardware
+// encoder) can publish with. Whoever has the token gets to publish as if they
+// had authenticated with the key ID.
+type WHIPToken struct {
+	Token string `json:"token"`
+	KeyID string `json:"keyId"`
+}
+
+// WHIPConfig is what gets loaded from the file that the WHIP_TOKENS_FILE
+// environment variable points to.
+type WHIPConfig struct {
+	Tokens []WHIPToken `json:"tokens"`
+}
+
+var whipConfig = &WHIPConfig{}
+
+// loadWHIPConfig reads and checks the WHIP token file. Panics on anything
+// wrong with it.
+func loadWHIPConfig(path string) *WHIPConfig {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to read WHIP tokens: %s", err.Error()))
+	}
+
+	var c WHIPConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		panic(fmt.Sprintf("Failed to parse WHIP tokens: %s", err.Error()))
+	}
+
+	tokens := map[string]bool{}
+	for i, token := range c.Tokens {
+		if token.Token == "" {
+			panic(fmt.Sprintf("WHIP token %d is empty", i))
+		}
+		if token.KeyID == "" {
+			panic(fmt.Sprintf("WHIP token %d has no key ID", i))
+		}
+		if tokens[token.Token] {
+			panic(fmt.Sprintf("WHIP token %d is listed more than once", i))
+		}
+		tokens[token.Token] = true
+	}
+
+	return &c
+}
+
+// WHIPKeyID gets the key ID that the given bearer token publishes as. Without a
+// WHIP token file, no token is any good.
+func WHIPKeyID(token string) (string, bool) {
+	// Every token gets compared, so that how long this takes says nothing about
+	// the tokens
+	keyID := ""
+	found := false
+	for _, t := range whipConfig.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			keyID = t.KeyID
+			found = true
+		}
+	}
+	return keyID, found
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// containerWriter writes frames out to a single file, in some container
+// format.
+type containerWriter interface {
+	// The track is the index of the track that the frame belongs to, out of the
+	// tracks that the file was created with. The time is in milliseconds, since
+	// the start of the file.
+	writeFrame(track int, frame mediaFrame, millis int64) error
+
+	Close() error
+}
+
+// recordingFile is a file being recorded to, that keeps track of how big it
+// got.
+type recordingFile struct {
+	file *os.File
+
+	position int64
+	size     int64
+}
+
+func createRecordingFile(path string) (*recordingFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingFile{file: file}, nil
+}
+
+func (f *recordingFile) Write(b []byte) (int, error) {
+	n, err := f.file.Write(b)
+	f.position += int64(n)
+	if f.position > f.size {
+		f.size = f.position
+	}
+	return n, err
+}
+
+func (f *recordingFile) Seek(offset int64, whence int) (int64, error) {
+	position, err := f.file.Seek(offset, whence)
+	if err == nil {
+		f.position = position
+	}
+	return position, err
+}
+
+func (f *recordingFile) Close() error {
+	return f.file.Close()
+}
+
+// Size returns the size of the file, in bytes
+func (f *recordingFile) Size() int64 {
+	return f.size
+}
+
+// recordingTrack describes one of the tracks of a file being recorded to
+type recordingTrack struct {
+	codec webrtc.RTPCodecCapability
+
+	// Video only, and only if they could be read from a keyframe
+	width  int
+	height int
+}
+
+// ivfContainerCodecs are the codecs that IVF files can hold, by MIME type, and
+// what the files call them
+var ivfContainerCodecs = map[string]string{
+	strings.ToLower(webrtc.MimeTypeVP8): "VP80",
+	strings.ToLower(webrtc.MimeTypeVP9): "VP90",
+	strings.ToLower(webrtc.MimeTypeAV1): "AV01",
+}
+
+// ivfWriter writes a single video track to an IVF file, with the timestamps
+// in units of the codec's clock rate.
+type ivfWriter struct {
+	file *recordingFile
+
+	frames    uint32
+	first     uint32
+	hasFirst  bool
+	lastFrame uint64
+}
+
+func newIVFWriter(file *recordingFile, track recordingTrack) (*ivfWriter, error) {
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)  // Version
+	binary.LittleEndian.PutUint16(header[6:], 32) // Header size
+	copy(header[8:], ivfContainerCodecs[strings.ToLower(track.codec.MimeType)])
+	binary.LittleEndian.PutUint16(header[12:], uint16(track.width))
+	binary.LittleEndian.PutUint16(header[14:], uint16(track.height))
+	binary.LittleEndian.PutUint32(header[16:], track.codec.ClockRate) // Time base denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)                     // Time base numerator
+	binary.LittleEndian.PutUint32(header[24:], 0)                     // Frame count, for once we're done
+
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &ivfWriter{file: file}, nil
+}
+
+func (w *ivfWriter) writeFrame(_ int, frame mediaFrame, _ int64) error {
+	if !w.hasFirst {
+		w.first = frame.timestamp
+		w.hasFirst = true
+	}
+
+	// Timestamps can only ever go forwards
+	pts := uint64(frame.timestamp - w.first)
+	if w.frames > 0 && pts <= w.lastFrame {
+		pts = w.lastFrame + 1
+	}
+	w.lastFrame = pts
+
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame.data)))
+	binary.LittleEndian.PutUint64(header[4:], pts)
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(frame.data); err != nil {
+		return err
+	}
+	w.frames++
+
+	return nil
+}
+
+func (w *ivfWriter) Close() error {
+	// Fill in the frame count. Not the end of the world if this fails; players
+	// don't really care about it anyways.
+	if _, err := w.file.Seek(24, io.SeekStart); err == nil {
+		count := make([]byte, 4)
+		binary.LittleEndian.PutUint32(count, w.frames)
+		w.file.Write(count)
+	}
+	return w.file.Close()
+}
+
+// oggWriter writes a single Opus track to an Ogg file
+type oggWriter struct {
+	writer *oggwriter.OggWriter
+}
+
+func newOggWriter(file *recordingFile, track recordingTrack) (*oggWriter, error) {
+	channels := track.codec.Channels
+	if channels == 0 {
+		channels = 2
+	}
+
+	writer, err := oggwriter.NewWith(file, track.codec.ClockRate, channels)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &oggWriter{writer}, nil
+}
+
+func (w *oggWriter) writeFrame(_ int, frame mediaFrame, _ int64) error {
+	return w.writer.WriteRTP(&rtp.Packet{
+		Header:  rtp.Header{Timestamp: frame.timestamp},
+		Payload: frame.data,
+	})
+}
+
+func (w *oggWriter) Close() error {
+	// Closes the file too
+	return w.writer.Close()
+}
+
+// webmContainerCodecs are the codecs that WebM files can hold, by MIME type,
+// and what the files call them
+var webmContainerCodecs = map[string]string{
+	strings.ToLower(webrtc.MimeTypeVP8):  "V_VP8",
+	strings.ToLower(webrtc.MimeTypeVP9):  "V_VP9",
+	strings.ToLower(webrtc.MimeTypeAV1):  "V_AV1",
+	strings.ToLower(webrtc.MimeTypeOpus): "A_OPUS",
+}
+
+// webmWriter writes any number of tracks to a single WebM file
+type webmWriter struct {
+	writers []webm.BlockWriteCloser
+
+	// Last timestamp written, for each track
+	last []int64
+}
+
+func newWebMWriter(file *recordingFile, tracks []recordingTrack) (*webmWriter, error) {
+	entries := []webm.TrackEntry{}
+	for i, track := range tracks {
+		entry := webm.TrackEntry{
+			TrackNumber: uint64(i + 1),
+			TrackUID:    uint64(i + 1),
+			CodecID:     webmContainerCodecs[strings.ToLower(track.codec.MimeType)],
+		}
+
+		if strings.HasPrefix(strings.ToLower(track.codec.MimeType), "audio/") {
+			channels := track.codec.Channels
+			if channels == 0 {
+				channels = 2
+			}
+			entry.Name = "Audio"
+			entry.TrackType = 2
+			entry.Audio = &webm.Audio{
+				SamplingFrequency: float64(track.codec.ClockRate),
+				Channels:          uint64(channels),
+			}
+			entry.CodecPrivate = opusHead(channels, track.codec.ClockRate)
+		} else {
+			entry.Name = "Video"
+			entry.TrackType = 1
+			entry.Video = &webm.Video{
+				PixelWidth:  uint64(track.width),
+				PixelHeight: uint64(track.height),
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	writers, err := webm.NewSimpleBlockWriter(file, entries)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &webmWriter{writers: writers, last: make([]int64, len(writers))}, nil
+}
+
+func (w *webmWriter) writeFrame(track int, frame mediaFrame, millis int64) error {
+	// Blocks of a track have to be in order
+	if millis < w.last[track] {
+		millis = w.last[track]
+	}
+	w.last[track] = millis
+
+	_, err := w.writers[track].Write(frame.keyframe, millis, frame.data)
+	return err
+}
+
+func (w *webmWriter) Close() error {
+	// Closing any one of them closes the file, once they're all closed
+	var err error
+	for _, writer := range w.writers {
+		if cErr := writer.Close(); cErr != nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// opusHead is the identification header that Opus tracks need in Matroska
+func opusHead(channels uint16, sampleRate uint32) []byte {
+	head := make([]byte, 19)
+	copy(head[0:], "OpusHead")
+	head[8] = 1 // Version
+	head[9] = uint8(channels)
+	binary.LittleEndian.PutUint16(head[10:], 0) // Pre-skip
+	binary.LittleEndian.PutUint32(head[12:], sampleRate)
+	binary.LittleEndian.PutUint16(head[16:], 0) // Output gain
+	head[18] = 0                                // Channel mapping family
+	return head
+}
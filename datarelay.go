@@ -0,0 +1,375 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/webrtc/v4"
+)
+
+// How much (in bytes) can be waiting to be sent to a single receiver's data
+// channel, before messages start getting dropped for that receiver. Keeps a
+// receiver that can't keep up from eating up all of our memory.
+const maxDataChannelBufferedAmount = 1024 * 1024
+
+// DataRelay relays data channel messages between the publisher of a broadcast,
+// and the broadcast's receivers.
+//
+// Every data channel that the publisher opens gets mirrored onto the peer
+// connection of every receiver that wants data, with the same label. Messages
+// that the publisher sends on a channel go out to every receiver, on the
+// channel of the same label. If the publisher says so, messages that receivers
+// send go back to the publisher, the same way.
+type DataRelay struct {
+	lock       *sync.Mutex
+	broadcasts map[broadcastKey]*broadcastData
+}
+
+// broadcastData is everything data channel related about a single broadcast
+type broadcastData struct {
+	// The publisher's data channels, by label
+	publisher map[string]publisherChannel
+
+	receivers Set[*dataReceiver]
+
+	// The publisher that wants receivers' messages sent to it, if any. Kept by
+	// peer connection, so that a publisher going away doesn't take a newer
+	// publisher's choice with it.
+	acceptReceiverMessages *webrtc.PeerConnection
+
+	// One for each direction
+	downstream *rateLimiter
+	upstream   *rateLimiter
+}
+
+type publisherChannel struct {
+	channel *webrtc.DataChannel
+
+	// The peer connection that the channel belongs to
+	pc *webrtc.PeerConnection
+}
+
+// dataReceiver is a single receiver's peer connection, and the data channels
+// that got mirrored onto it
+type dataReceiver struct {
+	pc *webrtc.PeerConnection
+
+	// By label
+	channels map[string]*webrtc.DataChannel
+}
+
+// NewDataRelay creates a new DataRelay
+func NewDataRelay() *DataRelay {
+	return &DataRelay{
+		lock:       &sync.Mutex{},
+		broadcasts: map[broadcastKey]*broadcastData{},
+	}
+}
+
+// NOT THREAD SAFE!
+func (r *DataRelay) broadcast(key broadcastKey) *broadcastData {
+	data, ok := r.broadcasts[key]
+	if !ok {
+		data = &broadcastData{
+			publisher:  map[string]publisherChannel{},
+			receivers:  Set[*dataReceiver]{},
+			downstream: newRateLimiter(config.DataChannelMessageRate()),
+			upstream:   newRateLimiter(config.DataChannelMessageRate()),
+		}
+		r.broadcasts[key] = data
+	}
+	return data
+}
+
+// NOT THREAD SAFE!
+//
+// cleanUp forgets about a broadcast, once there's nothing left to it.
+func (r *DataRelay) cleanUp(key broadcastKey) {
+	data, ok := r.broadcasts[key]
+	if ok &&
+		len(data.publisher) == 0 &&
+		len(data.receivers) == 0 &&
+		data.acceptReceiverMessages == nil {
+		delete(r.broadcasts, key)
+	}
+}
+
+// AddPublisherChannel relays the messages of a data channel that the publisher
+// opened on the given peer connection.
+//
+// A channel replaces whichever channel of the broadcast has the same label.
+func (r *DataRelay) AddPublisherChannel(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	pc *webrtc.PeerConnection,
+	channel *webrtc.DataChannel,
+) {
+	key := broadcastKey{keyId, broadcastId}
+	label := channel.Label()
+
+	channel.OnOpen(func() {
+		r.lock.Lock()
+		data := r.broadcast(key)
+		data.publisher[label] = publisherChannel{channel, pc}
+
+		// Receivers that came before the channel need it mirrored
+		for receiver := range data.receivers {
+			r.mirror(key, receiver, channel)
+		}
+		r.lock.Unlock()
+	})
+
+	channel.OnMessage(func(message webrtc.DataChannelMessage) {
+		r.lock.Lock()
+		data, ok := r.broadcasts[key]
+		if !ok || data.publisher[label].channel != channel {
+			r.lock.Unlock()
+			return
+		}
+		if !allowDataMessage(message, data.downstream) {
+			r.lock.Unlock()
+			return
+		}
+
+		channels := []*webrtc.DataChannel{}
+		for receiver := range data.receivers {
+			if c, ok := receiver.channels[label]; ok {
+				channels = append(channels, c)
+			}
+		}
+		r.lock.Unlock()
+
+		for _, c := range channels {
+			if c.BufferedAmount() > maxDataChannelBufferedAmount {
+				continue
+			}
+			sendDataMessage(c, message)
+		}
+	})
+
+	channel.OnClose(func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		r.removePublisherChannel(key, label, channel)
+	})
+}
+
+// NOT THREAD SAFE!
+//
+// removePublisherChannel stops relaying a publisher's data channel, and closes
+// the channels that were mirrored from it, unless the channel got replaced in
+// the meantime.
+func (r *DataRelay) removePublisherChannel(
+	key broadcastKey,
+	label string,
+	channel *webrtc.DataChannel,
+) {
+	data, ok := r.broadcasts[key]
+	if !ok || data.publisher[label].channel != channel {
+		return
+	}
+	delete(data.publisher, label)
+
+	for receiver := range data.receivers {
+		if c, ok := receiver.channels[label]; ok {
+			c.Close()
+			delete(receiver.channels, label)
+		}
+	}
+
+	r.cleanUp(key)
+}
+
+// RemovePublisher stops relaying every data channel that was opened on the
+// given peer connection.
+func (r *DataRelay) RemovePublisher(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	pc *webrtc.PeerConnection,
+) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := broadcastKey{keyId, broadcastId}
+	data, ok := r.broadcasts[key]
+	if !ok {
+		return
+	}
+
+	for label, c := range data.publisher {
+		if c.pc == pc {
+			r.removePublisherChannel(key, label, c.channel)
+		}
+	}
+
+	// Whoever publishes next has to ask for receivers' messages all over again
+	if data.acceptReceiverMessages == pc {
+		data.acceptReceiverMessages = nil
+	}
+	r.cleanUp(key)
+}
+
+// SetAcceptReceiverMessages sets whether messages that receivers send on their
+// data channels get sent to the publisher with the given peer connection. It
+// lasts until the publisher is removed.
+func (r *DataRelay) SetAcceptReceiverMessages(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	pc *webrtc.PeerConnection,
+	accept bool,
+) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := broadcastKey{keyId, broadcastId}
+	data := r.broadcast(key)
+	if accept {
+		data.acceptReceiverMessages = pc
+	} else if data.acceptReceiverMessages == pc {
+		data.acceptReceiverMessages = nil
+	}
+	r.cleanUp(key)
+}
+
+// AddReceiver mirrors every data channel of a broadcast onto a receiver's peer
+// connection, for as long as the receiver is around. Returns a function that
+// stops it.
+func (r *DataRelay) AddReceiver(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	pc *webrtc.PeerConnection,
+) func() {
+	key := broadcastKey{keyId, broadcastId}
+	receiver := &dataReceiver{pc: pc, channels: map[string]*webrtc.DataChannel{}}
+
+	r.lock.Lock()
+	data := r.broadcast(key)
+	data.receivers.Add(receiver)
+	for _, c := range data.publisher {
+		r.mirror(key, receiver, c.channel)
+	}
+	r.lock.Unlock()
+
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		if data, ok := r.broadcasts[key]; ok {
+			data.receivers.Remove(receiver)
+		}
+		r.cleanUp(key)
+	}
+}
+
+// NOT THREAD SAFE!
+//
+// mirror opens a data channel on the receiver's peer connection, just like the
+// publisher's.
+func (r *DataRelay) mirror(key broadcastKey, receiver *dataReceiver, channel *webrtc.DataChannel) {
+	label := channel.Label()
+	if _, ok := receiver.channels[label]; ok {
+		// The publisher replaced the channel; the receiver can keep using the one
+		// that it has
+		return
+	}
+
+	ordered := channel.Ordered()
+	protocol := channel.Protocol()
+	mirrored, err := receiver.pc.CreateDataChannel(label, &webrtc.DataChannelInit{
+		Ordered:           &ordered,
+		MaxPacketLifeTime: channel.MaxPacketLifeTime(),
+		MaxRetransmits:    channel.MaxRetransmits(),
+		Protocol:          &protocol,
+	})
+	if err != nil {
+		slog.Warn(
+			"Failed to create data channel for receiver",
+			"component", "data",
+			"keyId", key.keyID,
+			"broadcastId", key.broadcastID,
+			"label", label,
+			"err", err,
+		)
+		return
+	}
+	receiver.channels[label] = mirrored
+
+	mirrored.OnMessage(func(message webrtc.DataChannelMessage) {
+		r.lock.Lock()
+		data, ok := r.broadcasts[key]
+		if !ok || data.acceptReceiverMessages == nil {
+			r.lock.Unlock()
+			return
+		}
+		// Only the publisher that asked for receivers' messages gets them, even if
+		// another publisher on the broadcast has a channel with the same label
+		publisher, ok := data.publisher[label]
+		if !ok || publisher.pc != data.acceptReceiverMessages || !allowDataMessage(message, data.upstream) {
+			r.lock.Unlock()
+			return
+		}
+		r.lock.Unlock()
+
+		sendDataMessage(publisher.channel, message)
+	})
+}
+
+// allowDataMessage tells whether a message is within the limits
+func allowDataMessage(message webrtc.DataChannelMessage, limiter *rateLimiter) bool {
+	if len(message.Data) > config.DataChannelMaxMessageSize() {
+		return false
+	}
+	return limiter.Allow()
+}
+
+func sendDataMessage(channel *webrtc.DataChannel, message webrtc.DataChannelMessage) {
+	// Errors are only ever the fault of that one channel (e.g. it isn't open
+	// yet, or anymore), so ignore them
+	if message.IsString {
+		channel.SendText(string(message.Data))
+	} else {
+		channel.Send(message.Data)
+	}
+}
+
+// rateLimiter is a token bucket, allowing for up to a second's worth of burst
+type rateLimiter struct {
+	lock *sync.Mutex
+
+	// Per second
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		lock:   &sync.Mutex{},
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token, if there is one
+func (l *rateLimiter) Allow() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+
+	return true
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How often the dominant speaker gets picked again
+const dominantSpeakerInterval = 300 * time.Millisecond
+
+// How much louder (in dB) someone has to be than the dominant speaker, to take
+// over. Otherwise, two people talking at once would have the dominant speaker
+// flip back and forth between them.
+const dominantSpeakerMargin = 3
+
+// For how many intervals in a row someone has to be the loudest, before they
+// take over
+const dominantSpeakerIntervals = 2
+
+// DominantSpeaker is the broadcast (and its track) that is doing most of the
+// talking.
+type DominantSpeaker struct {
+	KeyID       KeyIDString       `json:"keyId"`
+	BroadcastID BroadcastIDString `json:"id"`
+	TrackID     TrackIDString     `json:"track"`
+}
+
+// DominantSpeakerDetector picks out the broadcast that is doing most of the
+// talking, out of whichever audio tracks it's given.
+//
+// Each broadcast is only as loud as its loudest audio track. Whoever was the
+// dominant speaker stays the dominant speaker through silences, until someone
+// else starts talking.
+type DominantSpeakerDetector struct {
+	// Returns the audio tracks to pick from
+	tracks func() []*ForwardedTrack
+
+	// Gets called with the new dominant speaker, every time that it changes
+	onChange func(DominantSpeaker)
+
+	// Only ever touched from Run
+	current        DominantSpeaker
+	hasCurrent     bool
+	candidate      DominantSpeaker
+	candidateCount int
+
+	stop     chan struct{}
+	stopOnce *sync.Once
+}
+
+// NewDominantSpeakerDetector creates a detector that picks from whatever
+// tracks the given function returns. It does nothing until Run is called.
+func NewDominantSpeakerDetector(
+	tracks func() []*ForwardedTrack,
+	onChange func(DominantSpeaker),
+) *DominantSpeakerDetector {
+	return &DominantSpeakerDetector{
+		tracks:   tracks,
+		onChange: onChange,
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+}
+
+// Run blocks, periodically picking the dominant speaker, until Close is
+// called.
+func (d *DominantSpeakerDetector) Run() {
+	ticker := time.NewTicker(dominantSpeakerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.detect()
+		}
+	}
+}
+
+// Close stops Run
+func (d *DominantSpeakerDetector) Close() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+}
+
+func (d *DominantSpeakerDetector) detect() {
+	// Each broadcast is as loud as its loudest track
+	levels := map[broadcastKey]float64{}
+	loudest := map[broadcastKey]*ForwardedTrack{}
+	for _, track := range d.tracks() {
+		key := broadcastKey{track.KeyID(), track.BroadcastID()}
+		level := track.AudioLevel()
+		if current, ok := levels[key]; !ok || level < current {
+			levels[key] = level
+			loudest[key] = track
+		}
+	}
+
+	var best broadcastKey
+	bestLevel := float64(silentAudioLevel)
+	for key, level := range levels {
+		if level < bestLevel {
+			best = key
+			bestLevel = level
+		}
+	}
+
+	currentKey := broadcastKey{d.current.KeyID, d.current.BroadcastID}
+	currentLevel, ok := levels[currentKey]
+	if !ok || !d.hasCurrent {
+		currentLevel = silentAudioLevel
+	}
+
+	// Nobody's talking, or nobody's talking over the dominant speaker
+	if bestLevel > speakingAudioLevel ||
+		(d.hasCurrent && best == currentKey) ||
+		(currentLevel <= speakingAudioLevel && currentLevel-bestLevel < dominantSpeakerMargin) {
+		d.candidateCount = 0
+		return
+	}
+
+	candidate := DominantSpeaker{best.keyID, best.broadcastID, loudest[best].ID()}
+	if candidate != d.candidate {
+		d.candidate = candidate
+		d.candidateCount = 0
+	}
+	d.candidateCount++
+	if d.candidateCount < dominantSpeakerIntervals {
+		return
+	}
+
+	d.current = candidate
+	d.hasCurrent = true
+	d.candidateCount = 0
+	d.onChange(candidate)
+}
+
+// DominantSpeakers runs a single DominantSpeakerDetector per key ID, picking
+// out whichever of the key's broadcasts is doing most of the talking, for
+// every receiver of any of them to be told about. That way, receivers of just
+// a camera's video still get to know who's talking.
+//
+// A key's detector only runs while someone's listening.
+type DominantSpeakers struct {
+	tracksAndConnections TracksAndConnectionsManager
+
+	lock *sync.Mutex
+	keys map[KeyIDString]*keyDominantSpeaker
+}
+
+// keyDominantSpeaker is the dominant speaker of a single key ID, and who gets
+// told about it
+type keyDominantSpeaker struct {
+	detector  *DominantSpeakerDetector
+	listeners Set[*dominantSpeakerListener]
+
+	// Nil until the detector has picked someone
+	current *DominantSpeaker
+}
+
+type dominantSpeakerListener struct {
+	callback func(DominantSpeaker)
+}
+
+func NewDominantSpeakers(tracksAndConnections TracksAndConnectionsManager) *DominantSpeakers {
+	return &DominantSpeakers{
+		tracksAndConnections: tracksAndConnections,
+		lock:                 &sync.Mutex{},
+		keys:                 map[KeyIDString]*keyDominantSpeaker{},
+	}
+}
+
+// Listen calls the callback with the dominant speaker out of the key's
+// broadcasts, right away if there is one, and then again every time that it
+// changes, until the returned function is called.
+func (s *DominantSpeakers) Listen(
+	keyId KeyIDString,
+	callback func(DominantSpeaker),
+) func() {
+	listener := &dominantSpeakerListener{callback}
+
+	s.lock.Lock()
+	key, ok := s.keys[keyId]
+	if !ok {
+		key = &keyDominantSpeaker{listeners: Set[*dominantSpeakerListener]{}}
+		key.detector = NewDominantSpeakerDetector(
+			func() []*ForwardedTrack {
+				return s.tracksAndConnections.KeyAudioTracks(keyId)
+			},
+			func(speaker DominantSpeaker) {
+				s.changed(key, speaker)
+			},
+		)
+		s.keys[keyId] = key
+		go key.detector.Run()
+	}
+	key.listeners.Add(listener)
+	current := key.current
+	s.lock.Unlock()
+
+	if current != nil {
+		callback(*current)
+	}
+
+	return func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		key.listeners.Remove(listener)
+		if len(key.listeners) == 0 && s.keys[keyId] == key {
+			delete(s.keys, keyId)
+			key.detector.Close()
+		}
+	}
+}
+
+// changed tells everyone listening to a key about its new dominant speaker.
+//
+// The callbacks are called without the lock held, since they end up writing
+// to WebSockets.
+func (s *DominantSpeakers) changed(key *keyDominantSpeaker, speaker DominantSpeaker) {
+	s.lock.Lock()
+	key.current = &speaker
+	listeners := []*dominantSpeakerListener{}
+	for listener := range key.listeners {
+		listeners = append(listeners, listener)
+	}
+	s.lock.Unlock()
+
+	for _, listener := range listeners {
+		listener.callback(speaker)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// DownTrack is what a single receiving peer connection gets for a
+// ForwardedTrack.
+//
+// Unlike a TrackLocalStaticRTP, which is shared between every receiver, each
+// receiver gets its own DownTrack. That lets every receiver be on a different
+// simulcast layer, and lets a receiver move between layers without noticing:
+// the sequence numbers and timestamps of whatever layer is being sent get
+// rewritten, so that they carry on from where the previous layer left off. The
+// SSRC is always the one negotiated with the receiver.
+//
+// The very same goes for the ForwardedTrack itself. When a publisher
+// reconnects, or replaces its track, the DownTrack just gets pointed at the new
+// one (see ForwardedTrack.AttachDownTrack), and the receiver carries on as if
+// nothing happened, once the next keyframe comes in.
+type DownTrack struct {
+	// These never change, regardless of what the source is, so that the receiver
+	// never notices the source changing
+	id       string
+	streamID string
+	kind     webrtc.RTPCodecType
+	created  time.Time
+
+	lock *sync.Mutex
+
+	// Where the packets come from
+	source *ForwardedTrack
+
+	// Set once the track is bound to a peer connection
+	bound       bool
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	codec       webrtc.RTPCodecParameters
+	writeStream webrtc.TrackLocalWriter
+
+	// IDs of the header extensions negotiated with the receiver, by URI. Nil
+	// for sinks, which get no extensions at all.
+	extensions map[string]uint8
+
+	// Lost packets go out again on an RTX stream of their own, if the receiver
+	// negotiated RTX (i.e. the SSRC and payload type aren't zero). The stream is
+	// found by the ID of the context that the DownTrack got bound with (see
+	// RTXStreams).
+	rtxSSRC        webrtc.SSRC
+	rtxPayloadType webrtc.PayloadType
+	rtxStream      string
+	rtxSeq         uint16
+
+	// RID of the layer that the receiver asked for. Empty for "don't care"
+	preferred string
+
+	// What the BandwidthAllocator decided on, if it decided on anything. The
+	// allocation takes priority over the preference, since the allocator already
+	// took the preference into account.
+	allocated     string
+	hasAllocation bool
+	paused        bool
+
+	// Relative to the other DownTracks of the same receiver; higher goes first
+	priority int
+
+	// The layer currently being sent, and the layer that we want to be sending.
+	// When these differ, we're waiting on a keyframe from the target layer.
+	current    string
+	hasCurrent bool
+	target     string
+
+	// Rewriting state
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+
+	// What got sent, keyed by the sequence number that the receiver saw it with,
+	// so that lost packets can be traced back to the layer they came from.
+	history [packetCacheSize]sentPacket
+}
+
+// sentPacket is a record of a single packet that was sent by a DownTrack.
+type sentPacket struct {
+	valid bool
+
+	// As the receiver saw it
+	seq uint16
+
+	// As the publisher sent it
+	source *ForwardedTrack
+	rid    string
+	srcSeq uint16
+
+	// What the packet's timestamp got rewritten with
+	tsOffset uint32
+}
+
+func newDownTrack(track *ForwardedTrack, preferredLayer string) *DownTrack {
+	return &DownTrack{
+		id:        msidToken(string(track.KeyID()), string(track.BroadcastID()), string(track.ID())),
+		streamID:  track.StreamID(),
+		kind:      track.Kind(),
+		created:   time.Now(),
+		lock:      &sync.Mutex{},
+		source:    track,
+		preferred: preferredLayer,
+		rtxSeq:    uint16(rand.Uint32()),
+	}
+}
+
+// Bind is called by the peer connection once the track has been negotiated.
+func (d *DownTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	source := d.Track()
+
+	codec, ok := matchCodec(source.Codec(), ctx.CodecParameters())
+	if !ok {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	d.lock.Lock()
+	d.bound = true
+	d.ssrc = ctx.SSRC()
+	d.payloadType = codec.PayloadType
+	d.codec = codec
+	d.writeStream = ctx.WriteStream()
+	d.extensions = map[string]uint8{}
+	for _, extension := range ctx.HeaderExtensions() {
+		d.extensions[extension.URI] = uint8(extension.ID)
+	}
+	d.rtxSSRC = ctx.SSRCRetransmission()
+	d.rtxPayloadType = rtxPayloadType(codec, ctx.CodecParameters())
+	d.rtxStream = ctx.ID()
+	target := d.target
+	d.lock.Unlock()
+
+	// Anything sent before now went nowhere, so the receiver will need a fresh
+	// keyframe to start off with, and shouldn't have to wait long for it
+	source.RequestKeyframeNow(target)
+
+	return codec, nil
+}
+
+// Unbind is called by the peer connection when the track is no longer being
+// sent.
+func (d *DownTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.bound = false
+	d.writeStream = nil
+
+	return nil
+}
+
+// bindWriter is Bind, for sinks: there's no peer connection to negotiate
+// anything with, so the DownTrack goes with the publisher's codec, and a
+// random SSRC. The payload type is left at zero, for the sink to fill in, if
+// it even cares.
+func (d *DownTrack) bindWriter(writer webrtc.TrackLocalWriter) {
+	d.lock.Lock()
+	d.bound = true
+	d.ssrc = webrtc.SSRC(rand.Uint32())
+	d.payloadType = 0
+	d.codec = webrtc.RTPCodecParameters{RTPCodecCapability: d.source.Codec()}
+	d.writeStream = writer
+	d.extensions = nil
+	d.rtxSSRC = 0
+	d.rtxPayloadType = 0
+	d.rtxStream = ""
+	source := d.source
+	target := d.target
+	d.lock.Unlock()
+
+	source.RequestKeyframeNow(target)
+}
+
+// unbindWriter is Unbind, for sinks
+func (d *DownTrack) unbindWriter() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.bound = false
+	d.writeStream = nil
+}
+
+// ID is the track ID that the receiver sees
+func (d *DownTrack) ID() string {
+	return d.id
+}
+
+// RID is always empty; the receiver only ever gets a single layer
+func (d *DownTrack) RID() string {
+	return ""
+}
+
+// StreamID is the media stream ID that the receiver sees. Every track of a
+// broadcast shares the same stream, so that receivers can keep them in sync.
+func (d *DownTrack) StreamID() string {
+	return d.streamID
+}
+
+// Kind returns whether this is an audio or video track
+func (d *DownTrack) Kind() webrtc.RTPCodecType {
+	return d.kind
+}
+
+// Track returns the ForwardedTrack that this DownTrack gets its packets from
+func (d *DownTrack) Track() *ForwardedTrack {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.source
+}
+
+// CanSwitchTo tells whether the DownTrack can get its packets from the given
+// track instead, without the receiver having to negotiate anything.
+//
+// That's the case for as long as the kind is the same, and the codec is the
+// one that the receiver negotiated.
+func (d *DownTrack) CanSwitchTo(track *ForwardedTrack) bool {
+	if track.Kind() != d.kind {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	codec := d.source.Codec()
+	if d.bound {
+		codec = d.codec.RTPCodecCapability
+	}
+	return strings.EqualFold(codec.MimeType, track.Codec().MimeType)
+}
+
+// setSource points the DownTrack at another ForwardedTrack. Whatever was
+// decided about the layers of the old one no longer makes sense, so the
+// DownTrack starts over, waiting on a keyframe from the new one. The sequence
+// numbers and timestamps carry on from where the old one left off.
+func (d *DownTrack) setSource(track *ForwardedTrack) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.source = track
+	d.hasAllocation = false
+	d.paused = false
+	d.hasCurrent = false
+	d.target = ""
+}
+
+// CurrentLayer returns the RID of the layer being sent right now, and whether
+// anything is being sent at all.
+func (d *DownTrack) CurrentLayer() (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.current, d.hasCurrent
+}
+
+// Paused returns whether the BandwidthAllocator decided that there isn't
+// enough bandwidth to send anything at all
+func (d *DownTrack) Paused() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.paused
+}
+
+func (d *DownTrack) allocatedLayer() (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.allocated, d.hasAllocation
+}
+
+func (d *DownTrack) setAllocation(rid string, paused bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.allocated = rid
+	d.hasAllocation = true
+
+	// Once unpaused, the receiver will need a keyframe before it can carry on
+	if paused && !d.paused {
+		d.hasCurrent = false
+	}
+	d.paused = paused
+}
+
+func (d *DownTrack) getPriority() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.priority
+}
+
+func (d *DownTrack) setPriority(priority int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.priority = priority
+}
+
+func (d *DownTrack) preferredLayer() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.preferred
+}
+
+func (d *DownTrack) setPreferredLayer(rid string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.preferred = rid
+}
+
+// setTargetLayer returns true if the DownTrack is left waiting on a keyframe
+// from the target layer.
+func (d *DownTrack) setTargetLayer(rid string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.target = rid
+	return !d.paused && (!d.hasCurrent || d.current != d.target)
+}
+
+// RequestKeyframe asks the publisher for a keyframe on whichever layer this
+// DownTrack wants.
+func (d *DownTrack) RequestKeyframe() {
+	d.lock.Lock()
+	source := d.source
+	rid := d.target
+	d.lock.Unlock()
+
+	source.RequestKeyframe(rid)
+}
+
+// writeRTP sends a packet from the given layer of the given track to the
+// receiver, if that's a layer that the receiver should be getting.
+func (d *DownTrack) writeRTP(source *ForwardedTrack, layer *TrackForwarder, packet *rtp.Packet) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	rid := layer.RID()
+
+	// Could be a straggler from a source that the DownTrack just moved off of
+	if !d.bound || d.paused || source != d.source {
+		return nil
+	}
+
+	if rid == d.target && (!d.hasCurrent || d.current != d.target) {
+		// Can only start sending a layer from a keyframe. Otherwise, the receiver
+		// would just be decoding garbage until the next one.
+		if !IsKeyframe(d.codec.MimeType, packet.Payload) {
+			return nil
+		}
+		d.switchTo(rid, packet)
+	} else if !d.hasCurrent || rid != d.current {
+		return nil
+	}
+
+	header := packet.Header
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	header.SequenceNumber += d.seqOffset
+	header.Timestamp += d.tsOffset
+	d.rewriteExtensions(&header, layer.extensions)
+
+	if !d.hasWritten() || isNewerSequenceNumber(header.SequenceNumber, d.lastSeq) {
+		d.lastSeq = header.SequenceNumber
+		d.lastTS = header.Timestamp
+		d.lastWrite = time.Now()
+	}
+
+	d.history[header.SequenceNumber%packetCacheSize] = sentPacket{
+		valid:    true,
+		seq:      header.SequenceNumber,
+		source:   source,
+		rid:      rid,
+		srcSeq:   packet.SequenceNumber,
+		tsOffset: d.tsOffset,
+	}
+
+	size, err := d.writeStream.WriteRTP(&header, packet.Payload)
+	if err == nil {
+		metrics.PacketsForwarded.Inc()
+		metrics.BytesForwarded.Add(uint64(size))
+	}
+	return err
+}
+
+// writeRetransmission sends a packet that the receiver lost again, as it was
+// sent the first time around. That's on the RTX stream, if the receiver
+// negotiated one, or else on the same SSRC as everything else.
+func (d *DownTrack) writeRetransmission(sent sentPacket, layer *TrackForwarder, packet *rtp.Packet) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !d.bound {
+		return nil
+	}
+
+	header := packet.Header
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	header.SequenceNumber = sent.seq
+	header.Timestamp += sent.tsOffset
+	d.rewriteExtensions(&header, layer.extensions)
+
+	if d.rtxSSRC != 0 && d.rtxPayloadType != 0 {
+		if writer := rtxStreams.Writer(d.rtxStream); writer != nil {
+			header, payload := rtxPacket(header, packet.Payload, d.rtxSSRC, d.rtxPayloadType, d.rtxSeq)
+			d.rtxSeq++
+			_, err := writer.Write(&header, payload, nil)
+			return err
+		}
+	}
+
+	_, err := d.writeStream.WriteRTP(&header, packet.Payload)
+	return err
+}
+
+// Header extensions that only mean anything between two peers, and that Pion
+// (or the SFU itself) takes care of for each receiver
+var hopByHopExtensions = Set[string]{
+	sdp.SDESMidURI:             true,
+	sdp.SDESRTPStreamIDURI:     true,
+	sdesRepairedRTPStreamIDURI: true,
+	sdp.TransportCCURI:         true,
+	sdp.ABSSendTimeURI:         true,
+}
+
+// NOT THREAD SAFE!
+//
+// rewriteExtensions swaps the IDs of a packet's header extensions, as
+// negotiated with the publisher (by the given URIs), for the ones negotiated
+// with the receiver. Extensions that the receiver didn't negotiate are
+// dropped, and so are hop-by-hop ones.
+//
+// The header's extensions are replaced, rather than changed, since they're
+// still shared with the packet in the cache.
+func (d *DownTrack) rewriteExtensions(header *rtp.Header, publisher map[uint8]string) {
+	original := *header
+	header.Extension = false
+	header.Extensions = nil
+
+	for _, id := range original.GetExtensionIDs() {
+		uri, ok := publisher[id]
+		if !ok || hopByHopExtensions[uri] {
+			continue
+		}
+		receiverID, ok := d.extensions[uri]
+		if !ok {
+			continue
+		}
+
+		// Whatever doesn't fit in the profile picked for the first extension just
+		// doesn't get sent
+		header.SetExtension(receiverID, original.GetExtension(id))
+	}
+}
+
+// handleNACK sends again whatever packets the receiver says that it lost.
+func (d *DownTrack) handleNACK(nack *rtcp.TransportLayerNack) {
+	lost := map[*ForwardedTrack]map[string][]sentPacket{}
+
+	d.lock.Lock()
+	for _, pair := range nack.Nacks {
+		for _, seq := range pair.PacketList() {
+			sent := d.history[seq%packetCacheSize]
+			if !sent.valid || sent.seq != seq {
+				// Too long ago; no way of knowing what it even was
+				continue
+			}
+			if lost[sent.source] == nil {
+				lost[sent.source] = map[string][]sentPacket{}
+			}
+			lost[sent.source][sent.rid] = append(lost[sent.source][sent.rid], sent)
+		}
+	}
+	d.lock.Unlock()
+
+	for source, byLayer := range lost {
+		for rid, sent := range byLayer {
+			source.retransmit(d, rid, sent)
+		}
+	}
+}
+
+// NOT THREAD SAFE!
+//
+// switchTo makes the given layer the current one, starting from the given
+// packet. The offsets are picked such that the packet is the one right after
+// the last one that was sent, whether or not that came from the same layer, or
+// even the same source.
+func (d *DownTrack) switchTo(rid string, packet *rtp.Packet) {
+	if d.hasWritten() {
+		d.seqOffset = d.lastSeq + 1 - packet.SequenceNumber
+
+		// We have no idea how the timestamps of the two layers line up, so go
+		// with however much time actually passed since the last packet.
+		elapsed := uint32(time.Since(d.lastWrite).Seconds() * float64(d.codec.ClockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+		d.tsOffset = d.lastTS + elapsed - packet.Timestamp
+	}
+
+	d.current = rid
+	d.hasCurrent = true
+}
+
+// NOT THREAD SAFE!
+func (d *DownTrack) hasWritten() bool {
+	return !d.lastWrite.IsZero()
+}
+
+// readReceiverRTCP reads the RTCP that a receiver sends back for whatever
+// DownTrack the sender is sending, until the sender is stopped.
+//
+// Reading is needed regardless of whether we care about the packets, since
+// that's what drives the interceptors.
+func readReceiverRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		downTrack, ok := sender.Track().(*DownTrack)
+		if !ok {
+			continue
+		}
+
+		for _, packet := range packets {
+			switch packet := packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				metrics.PLIsReceived.Inc()
+				downTrack.RequestKeyframe()
+			case *rtcp.TransportLayerNack:
+				for _, pair := range packet.Nacks {
+					metrics.NACKsReceived.Add(uint64(len(pair.PacketList())))
+				}
+				downTrack.handleNACK(packet)
+			}
+		}
+	}
+}
+
+// isNewerSequenceNumber tells whether a comes after b, accounting for wrap
+// around.
+func isNewerSequenceNumber(a, b uint16) bool {
+	return a != b && a-b < 0x8000
+}
+
+// matchCodec finds the codec that the receiver negotiated, which is the same as
+// the one being published. Codecs with the same format parameters are
+// preferred, but the MIME type is good enough otherwise.
+func matchCodec(
+	needle webrtc.RTPCodecCapability,
+	haystack []webrtc.RTPCodecParameters,
+) (webrtc.RTPCodecParameters, bool) {
+	for _, codec := range haystack {
+		if strings.EqualFold(codec.MimeType, needle.MimeType) &&
+			codec.SDPFmtpLine == needle.SDPFmtpLine {
+			return codec, true
+		}
+	}
+
+	for _, codec := range haystack {
+		if strings.EqualFold(codec.MimeType, needle.MimeType) {
+			return codec, true
+		}
+	}
+
+	return webrtc.RTPCodecParameters{}, false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// testRTPSource is a publisher's layer that never gets read from; packets get
+// handed to the ForwardedTrack directly
+type testRTPSource struct{}
+
+func (testRTPSource) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	select {}
+}
+
+func (testRTPSource) RID() string {
+	return ""
+}
+
+func (testRTPSource) SSRC() webrtc.SSRC {
+	return 1234
+}
+
+// testRTPWriter keeps whatever gets written to it, be it RTP or RTCP
+type testRTPWriter struct {
+	lock    *sync.Mutex
+	packets []rtp.Packet
+	nacked  []uint16
+}
+
+func newTestRTPWriter() *testRTPWriter {
+	return &testRTPWriter{lock: &sync.Mutex{}}
+}
+
+func (w *testRTPWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.packets = append(w.packets, rtp.Packet{Header: *header, Payload: payload})
+	return len(payload), nil
+}
+
+func (w *testRTPWriter) Write(b []byte) (int, error) {
+	var packet rtp.Packet
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&packet.Header, packet.Payload)
+}
+
+func (w *testRTPWriter) WriteRTCP(pkts []rtcp.Packet) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, pkt := range pkts {
+		if nack, ok := pkt.(*rtcp.TransportLayerNack); ok {
+			for _, pair := range nack.Nacks {
+				w.nacked = append(w.nacked, pair.PacketList()...)
+			}
+		}
+	}
+	return nil
+}
+
+// sequenceNumbers lists the sequence numbers of whatever got written
+func (w *testRTPWriter) sequenceNumbers() []uint16 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	seqs := []uint16{}
+	for _, packet := range w.packets {
+		seqs = append(seqs, packet.SequenceNumber)
+	}
+	return seqs
+}
+
+func TestDownTrackNACK(t *testing.T) {
+	const (
+		ssrc           = webrtc.SSRC(5678)
+		rtxSSRC        = webrtc.SSRC(8765)
+		rtxPayloadType = webrtc.PayloadType(97)
+	)
+
+	tests := []struct {
+		name string
+
+		// What the publisher sent, all of which got forwarded
+		sent []uint16
+
+		// What got pushed out of the cache since
+		evicted []uint16
+
+		// Whether the receiver negotiated RTX
+		rtx bool
+
+		// What the receiver says that it lost
+		lost []uint16
+
+		// What gets sent to the receiver again
+		wantResent []uint16
+
+		// What gets asked for from the publisher
+		wantNACKed []uint16
+	}{
+		{
+			name:       "sent again from the cache",
+			sent:       []uint16{10, 11, 12, 13, 14},
+			lost:       []uint16{11, 13},
+			wantResent: []uint16{11, 13},
+		},
+		{
+			name:       "sent again on the RTX stream",
+			sent:       []uint16{10, 11, 12, 13, 14},
+			rtx:        true,
+			lost:       []uint16{11, 13},
+			wantResent: []uint16{11, 13},
+		},
+		{
+			name:       "no longer in the cache",
+			sent:       []uint16{10, 11, 12, 13, 14},
+			evicted:    []uint16{12},
+			lost:       []uint16{11, 12},
+			wantResent: []uint16{11},
+			wantNACKed: []uint16{12},
+		},
+		{
+			name:       "never sent",
+			sent:       []uint16{10, 11, 12},
+			lost:       []uint16{9, 20},
+			wantResent: []uint16{},
+		},
+		{
+			name:       "around the wrap",
+			sent:       []uint16{65534, 65535, 0, 1},
+			lost:       []uint16{65535, 0},
+			wantResent: []uint16{65535, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			publisher := newTestRTPWriter()
+			track := NewForwardedTrack("some/key", "broadcast", "video", webrtc.RTPCodecTypeVideo,
+				webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000})
+			layer := track.AddLayer(testRTPSource{}, publisher)
+			defer layer.keyframes.Stop()
+
+			media, rtx := newTestRTPWriter(), newTestRTPWriter()
+			downTrack := track.NewDownTrack("")
+			downTrack.bindWriter(media)
+			downTrack.lock.Lock()
+			downTrack.ssrc = ssrc
+			if test.rtx {
+				downTrack.rtxSSRC = rtxSSRC
+				downTrack.rtxPayloadType = rtxPayloadType
+				downTrack.rtxStream = t.Name()
+			}
+			downTrack.lock.Unlock()
+
+			rtxStreams.lock.Lock()
+			rtxStreams.writers[t.Name()] = interceptor.RTPWriterFunc(
+				func(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+					return rtx.WriteRTP(header, payload)
+				},
+			)
+			rtxStreams.lock.Unlock()
+			defer func() {
+				rtxStreams.lock.Lock()
+				delete(rtxStreams.writers, t.Name())
+				rtxStreams.lock.Unlock()
+			}()
+
+			for _, seq := range test.sent {
+				// Every packet's a VP8 keyframe, so that the first one gets sent
+				packet := &rtp.Packet{
+					Header:  rtp.Header{Version: 2, SequenceNumber: seq, SSRC: 1234},
+					Payload: []byte{0x10, 0x00, byte(seq)},
+				}
+				layer.cache.Add(packet)
+				track.forward(layer, packet)
+			}
+			for _, seq := range test.evicted {
+				layer.cache.packets[seq%packetCacheSize] = nil
+			}
+			if got := media.sequenceNumbers(); !reflect.DeepEqual(got, test.sent) {
+				t.Fatalf("forwarded %v, want %v", got, test.sent)
+			}
+			media.packets = nil
+
+			downTrack.handleNACK(&rtcp.TransportLayerNack{
+				MediaSSRC: uint32(ssrc),
+				Nacks:     rtcp.NackPairsFromSequenceNumbers(test.lost),
+			})
+
+			resent := media
+			if test.rtx {
+				resent = rtx
+				if len(media.packets) > 0 {
+					t.Errorf("sent again on the media stream: %v", media.sequenceNumbers())
+				}
+			}
+
+			got := []uint16{}
+			for i, packet := range resent.packets {
+				seq := packet.SequenceNumber
+				payload := packet.Payload
+				wantSSRC, wantPayloadType := ssrc, webrtc.PayloadType(0)
+				if test.rtx {
+					// The original sequence number goes in front of the payload, and the
+					// RTX stream has sequence numbers of its own
+					seq = binary.BigEndian.Uint16(payload)
+					payload = payload[2:]
+					wantSSRC, wantPayloadType = rtxSSRC, rtxPayloadType
+					if i > 0 && packet.SequenceNumber != resent.packets[i-1].SequenceNumber+1 {
+						t.Errorf("RTX sequence numbers %d and %d aren't consecutive",
+							resent.packets[i-1].SequenceNumber, packet.SequenceNumber)
+					}
+				}
+
+				if packet.SSRC != uint32(wantSSRC) || packet.PayloadType != uint8(wantPayloadType) {
+					t.Errorf("packet %d sent again with SSRC %d and payload type %d, want %d and %d",
+						seq, packet.SSRC, packet.PayloadType, wantSSRC, wantPayloadType)
+				}
+				if !reflect.DeepEqual(payload, []byte{0x10, 0x00, byte(seq)}) {
+					t.Errorf("packet %d sent again with payload %v", seq, payload)
+				}
+				got = append(got, seq)
+			}
+			if !reflect.DeepEqual(got, test.wantResent) {
+				t.Errorf("sent again %v, want %v", got, test.wantResent)
+			}
+
+			if !reflect.DeepEqual(publisher.nacked, test.wantNACKed) {
+				t.Errorf("asked the publisher for %v, want %v", publisher.nacked, test.wantNACKed)
+			}
+		})
+	}
+}
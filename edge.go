@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// How long to wait before connecting to the origin again, after losing it
+const edgeRetryInterval = 2 * time.Second
+
+// EdgeRelay is what makes a server an edge: receivers get to ask it for
+// broadcasts that are being published to another server (the origin), and it
+// gets them from the origin, over a single peer connection per broadcast, no
+// matter how many receivers it has for the broadcast. That way, the origin only
+// ever has to send a broadcast once to each edge, and the edges do the fanning
+// out.
+//
+// The origin is either configured, or, for servers that share a registry,
+// whichever server the registry says that the broadcast lives on.
+//
+// Edges get their broadcasts from the origin the same way that any other
+// receiver would, through /subscribe. Whatever tracks the broadcast has on the
+// origin get published on the edge, under the same key ID, broadcast ID, and
+// track IDs, for as long as the edge has any receivers for the broadcast.
+type EdgeRelay struct {
+	tracksAndConnections TracksAndConnectionsManager
+	registry             Registry
+
+	// Nil for servers that don't have a configured origin
+	origin *url.URL
+
+	lock       *sync.Mutex
+	broadcasts map[broadcastKey]*edgeBroadcast
+}
+
+func NewEdgeRelay(tracksAndConnections TracksAndConnectionsManager, registry Registry) *EdgeRelay {
+	return &EdgeRelay{
+		tracksAndConnections: tracksAndConnections,
+		registry:             registry,
+		origin:               config.OriginURL(),
+		lock:                 &sync.Mutex{},
+		broadcasts:           map[broadcastKey]*edgeBroadcast{},
+	}
+}
+
+// Acquire has the broadcast gotten from the origin, if it isn't already, and
+// isn't being published right here. Returns a function that lets go of it
+// again; once everything that acquired the broadcast has let go of it, the
+// origin stops being asked for it.
+//
+// Does nothing if there's no origin to get the broadcast from.
+func (r *EdgeRelay) Acquire(keyID KeyIDString, broadcastID BroadcastIDString) func() {
+	key := broadcastKey{keyID, broadcastID}
+
+	if release, ok := r.acquireExisting(key); ok {
+		return release
+	}
+
+	// Published right here; there's nothing to get from anywhere else
+	if len(r.tracksAndConnections.Tracks(keyID, broadcastID).Tracks) > 0 {
+		return func() {}
+	}
+
+	// Looked up without the lock held, since the registry might have to go over
+	// the network for it
+	origin := r.origin
+	if origin == nil {
+		origin = r.locate(keyID, broadcastID)
+	}
+	if origin == nil {
+		return func() {}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	broadcast, ok := r.broadcasts[key]
+	if !ok {
+		logger := slog.With("component", "edge", "origin", origin.Host)
+		broadcast = &edgeBroadcast{
+			tracksAndConnections: r.tracksAndConnections,
+			origin:               origin,
+			keyID:                keyID,
+			broadcastID:          broadcastID,
+			logger:               broadcastLogger(logger, keyID, broadcastID),
+			lock:                 &sync.Mutex{},
+			done:                 make(chan struct{}),
+		}
+		r.broadcasts[key] = broadcast
+		go broadcast.run()
+	}
+
+	return r.acquire(key, broadcast)
+}
+
+// acquireExisting acquires the broadcast, if it's already being gotten from the
+// origin
+func (r *EdgeRelay) acquireExisting(key broadcastKey) (func(), bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	broadcast, ok := r.broadcasts[key]
+	if !ok {
+		return nil, false
+	}
+	return r.acquire(key, broadcast), true
+}
+
+// acquire counts one more user of the broadcast. NOT THREAD SAFE! Only call
+// with the lock held.
+func (r *EdgeRelay) acquire(key broadcastKey, broadcast *edgeBroadcast) func() {
+	broadcast.refs++
+
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
+			r.release(key, broadcast)
+		})
+	}
+}
+
+// locate asks the registry which other server the broadcast lives on. Nil if
+// it's nowhere else (or nowhere that can be reached).
+func (r *EdgeRelay) locate(keyID KeyIDString, broadcastID BroadcastIDString) *url.URL {
+	entries, err := r.registry.Lookup(keyID, broadcastID)
+	if err != nil {
+		slog.Warn(
+			"Failed to look up the broadcast in the registry",
+			"component", "edge",
+			"keyId", keyID,
+			"broadcastId", broadcastID,
+			"err", err,
+		)
+		return nil
+	}
+
+	for _, entry := range entries {
+		if entry.Node.ID == config.NodeID() || entry.Node.URL == "" {
+			continue
+		}
+		u, err := url.Parse(entry.Node.URL)
+		if err != nil {
+			slog.Warn(
+				"Node has a bad URL in the registry",
+				"component", "edge",
+				"node", entry.Node.ID,
+				"err", err,
+			)
+			continue
+		}
+		return u
+	}
+
+	return nil
+}
+
+func (r *EdgeRelay) release(key broadcastKey, broadcast *edgeBroadcast) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	broadcast.refs--
+	if broadcast.refs > 0 {
+		return
+	}
+
+	if r.broadcasts[key] == broadcast {
+		delete(r.broadcasts, key)
+	}
+	broadcast.close()
+}
+
+// edgeBroadcast is a broadcast being gotten from the origin. If the origin goes
+// away, it gets connected to again, until the broadcast is closed.
+type edgeBroadcast struct {
+	tracksAndConnections TracksAndConnectionsManager
+	origin               *url.URL
+	keyID                KeyIDString
+	broadcastID          BroadcastIDString
+	logger               *slog.Logger
+
+	// How many times the broadcast has been acquired, and not yet released. Only
+	// touched while holding the EdgeRelay's lock.
+	refs int
+
+	lock   *sync.Mutex
+	done   chan struct{}
+	closed bool
+
+	// The connection to the origin that's going right now. Nil if there's none.
+	upstream *edgeUpstream
+}
+
+// errEdgeClosed is what ends a connection to the origin that was cut short by
+// the broadcast being closed
+var errEdgeClosed = errors.New("edge broadcast closed")
+
+func (b *edgeBroadcast) run() {
+	b.logger.Info("Getting the broadcast from the origin")
+
+	for {
+		err := b.subscribe()
+
+		select {
+		case <-b.done:
+			b.logger.Info("Stopped getting the broadcast from the origin")
+			return
+		default:
+		}
+
+		b.logger.Warn("Lost the origin; reconnecting", "err", err, "retryIn", edgeRetryInterval)
+
+		select {
+		case <-b.done:
+			b.logger.Info("Stopped getting the broadcast from the origin")
+			return
+		case <-time.After(edgeRetryInterval):
+		}
+	}
+}
+
+// close stops getting the broadcast from the origin. Whatever tracks were
+// gotten from it stop being published.
+func (b *edgeBroadcast) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.done)
+
+	if b.upstream != nil {
+		b.upstream.close()
+	}
+}
+
+// subscribeURL is where the origin's /subscribe endpoint is
+func (b *edgeBroadcast) subscribeURL() string {
+	u := *b.origin
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/subscribe"
+	u.RawPath = ""
+	u.RawQuery = ""
+	return u.String()
+}
+
+// subscribe connects to the origin, and blocks, publishing the broadcast's
+// tracks, until the connection goes away
+func (b *edgeBroadcast) subscribe() error {
+	conn, _, err := websocket.DefaultDialer.Dial(b.subscribeURL(), nil)
+	if err != nil {
+		return err
+	}
+
+	peerConnection, err := newPublishingPeerConnection()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	upstream := &edgeUpstream{
+		broadcast:      b,
+		conn:           conn,
+		signalling:     NewSignallingConn(conn),
+		peerConnection: peerConnection,
+		lock:           &sync.Mutex{},
+		mids:           map[string]TrackIDString{},
+		subscribed:     Set[TrackIDString]{},
+		published:      map[TrackIDString]*ForwardedTrack{},
+	}
+	defer upstream.close()
+
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return errEdgeClosed
+	}
+	b.upstream = upstream
+	b.lock.Unlock()
+
+	defer func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.upstream == upstream {
+			b.upstream = nil
+		}
+	}()
+
+	return upstream.run()
+}
+
+// edgeUpstream is a single connection to the origin, for a single broadcast
+type edgeUpstream struct {
+	broadcast *edgeBroadcast
+
+	conn           *websocket.Conn
+	signalling     *SignallingConn
+	peerConnection *webrtc.PeerConnection
+
+	lock *sync.Mutex
+
+	// Which track is on which transceiver, as the origin last said
+	mids map[string]TrackIDString
+
+	// The tracks that the origin was asked for
+	subscribed Set[TrackIDString]
+
+	// The tracks that are being published from the origin, by track ID
+	published map[TrackIDString]*ForwardedTrack
+}
+
+// run has the origin keep the edge posted on the broadcast's tracks, and
+// handles whatever the origin sends, until the connection goes away
+func (u *edgeUpstream) run() error {
+	u.peerConnection.OnTrack(u.onTrack)
+	u.peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+
+		if err := u.signalling.WriteJSON(TypeData[TypeData[*webrtc.ICECandidate]]{
+			Type: "SIGNALLING",
+			Data: TypeData[*webrtc.ICECandidate]{
+				Type: "ICE_CANDIDATE",
+				Data: c,
+			},
+		}); err != nil {
+			u.close()
+		}
+	})
+	u.peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		metrics.PeerConnectionState(s)
+
+		if s == webrtc.PeerConnectionStateFailed {
+			u.close()
+		}
+	})
+
+	if err := u.signalling.WriteJSON(TypeData[TrackKey]{
+		Type: "GET_TRACKS",
+		Data: TrackKey{KeyID: u.broadcast.keyID, BroadcastID: u.broadcast.broadcastID},
+	}); err != nil {
+		return err
+	}
+
+	for {
+		_, b, err := u.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		metrics.SignallingMessage("in", b)
+
+		var t TypeData[json.RawMessage]
+		if err := json.Unmarshal(b, &t); err != nil {
+			return err
+		}
+
+		if err := u.handle(t); err != nil {
+			return err
+		}
+	}
+}
+
+// handle handles a single message from the origin
+func (u *edgeUpstream) handle(t TypeData[json.RawMessage]) error {
+	switch t.Type {
+	case "TRACKS":
+		var tracks BroadcastTracks
+		if err := json.Unmarshal(t.Data, &tracks); err != nil {
+			return err
+		}
+
+		return u.setTracks(tracks)
+	case "SUBSCRIPTIONS":
+		var subscriptions []SubscriptionInfo
+		if err := json.Unmarshal(t.Data, &subscriptions); err != nil {
+			return err
+		}
+
+		u.lock.Lock()
+		defer u.lock.Unlock()
+		for _, subscription := range subscriptions {
+			if subscription.Mid != "" {
+				u.mids[subscription.Mid] = subscription.TrackID
+			}
+		}
+	case "SIGNALLING":
+		var s TypeData[json.RawMessage]
+		if err := json.Unmarshal(t.Data, &s); err != nil {
+			return err
+		}
+
+		switch s.Type {
+		case "DESCRIPTION":
+			var offer webrtc.SessionDescription
+			if err := json.Unmarshal(s.Data, &offer); err != nil {
+				return err
+			}
+
+			if err := u.peerConnection.SetRemoteDescription(offer); err != nil {
+				return err
+			}
+			answer, err := u.peerConnection.CreateAnswer(nil)
+			if err != nil {
+				return err
+			}
+			if err := u.peerConnection.SetLocalDescription(answer); err != nil {
+				return err
+			}
+
+			return u.signalling.WriteJSON(TypeData[TypeData[webrtc.SessionDescription]]{
+				Type: "SIGNALLING",
+				Data: TypeData[webrtc.SessionDescription]{
+					Type: "DESCRIPTION",
+					Data: answer,
+				},
+			})
+		case "ICE_CANDIDATE":
+			var candidate webrtc.ICECandidate
+			if err := json.Unmarshal(s.Data, &candidate); err != nil {
+				return err
+			}
+			if err := u.peerConnection.AddICECandidate(candidate.ToJSON()); err != nil {
+				u.broadcast.logger.Warn("Failed to add the origin's ICE candidate", "err", err)
+			}
+		}
+	case "SERVER_ERROR", "CLIENT_ERROR":
+		return errors.New("the origin said " + t.Type + ": " + string(t.Data))
+	}
+
+	return nil
+}
+
+// setTracks has the origin send every track that the broadcast has, and stop
+// sending the ones that the broadcast no longer has
+func (u *edgeUpstream) setTracks(tracks BroadcastTracks) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	current := Set[TrackIDString]{}
+	for _, track := range tracks.Tracks {
+		current.Add(track.ID)
+		if u.subscribed[track.ID] {
+			continue
+		}
+
+		u.subscribed.Add(track.ID)
+		if err := u.signalling.WriteJSON(TypeData[SubscribeRequest]{
+			Type: "SUBSCRIBE",
+			Data: SubscribeRequest{TrackKey: u.trackKey(track.ID)},
+		}); err != nil {
+			return err
+		}
+	}
+
+	for trackID := range u.subscribed {
+		if current[trackID] {
+			continue
+		}
+
+		u.subscribed.Remove(trackID)
+		if err := u.signalling.WriteJSON(TypeData[TrackKey]{
+			Type: "UNSUBSCRIBE",
+			Data: u.trackKey(trackID),
+		}); err != nil {
+			return err
+		}
+
+		// Receivers shouldn't have to wait on the origin to renegotiate to find
+		// out that the track is gone
+		if track, ok := u.published[trackID]; ok {
+			delete(u.published, trackID)
+			u.broadcast.tracksAndConnections.RemoveTrack(u.broadcast.keyID, u.broadcast.broadcastID, track)
+		}
+	}
+
+	return nil
+}
+
+func (u *edgeUpstream) trackKey(trackID TrackIDString) TrackKey {
+	return TrackKey{
+		KeyID:       u.broadcast.keyID,
+		BroadcastID: u.broadcast.broadcastID,
+		TrackID:     trackID,
+	}
+}
+
+// onTrack publishes a track coming from the origin, under the ID that it has on
+// the origin
+func (u *edgeUpstream) onTrack(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	mid := ""
+	for _, transceiver := range u.peerConnection.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			mid = transceiver.Mid()
+		}
+	}
+
+	keyID := u.broadcast.keyID
+	broadcastID := u.broadcast.broadcastID
+
+	u.lock.Lock()
+	trackID, ok := u.mids[mid]
+	if !ok || !u.subscribed[trackID] {
+		u.lock.Unlock()
+		u.broadcast.logger.Warn("Got a track from the origin that wasn't asked for", "mid", mid)
+		return
+	}
+
+	track := NewForwardedTrack(
+		keyID,
+		broadcastID,
+		trackID,
+		remoteTrack.Kind(),
+		remoteTrack.Codec().RTPCodecCapability,
+	)
+	track.relayed = true
+	forwarder := track.AddLayer(remoteTrack, u.peerConnection)
+	u.published[trackID] = track
+	u.lock.Unlock()
+
+	forwarder.SetHeaderExtensions(receiver.GetParameters().HeaderExtensions)
+
+	logger := u.broadcast.logger.With("kind", remoteTrack.Kind().String(), "track", trackID)
+	logger.Info("Forwarding track from the origin", "codec", remoteTrack.Codec().MimeType)
+
+	u.broadcast.tracksAndConnections.SetTrack(keyID, broadcastID, track)
+
+	// Keyframe requests from the edge's receivers go up to the origin, which
+	// passes them on to the publisher
+	go func() {
+		if err := forwarder.Run(); err != nil {
+			logger.Warn("Failed reading from the origin's track", "err", err)
+		}
+
+		stats := forwarder.Stats()
+		logger.Info("Stopped forwarding track from the origin", "packets", stats.Packets, "bytes", stats.Bytes)
+
+		track.RemoveLayer(forwarder)
+
+		u.lock.Lock()
+		if u.published[trackID] == track {
+			delete(u.published, trackID)
+		}
+		u.lock.Unlock()
+
+		u.broadcast.tracksAndConnections.RemoveTrack(keyID, broadcastID, track)
+	}()
+}
+
+// close hangs up on the origin. The tracks that were gotten from it stop being
+// published once the peer connection is closed.
+func (u *edgeUpstream) close() {
+	u.signalling.Close()
+	if err := u.peerConnection.Close(); err != nil {
+		u.broadcast.logger.Warn("Failed to close the origin's peer connection", "err", err)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Sample flags, as in ISO/IEC 14496-12. Keyframes don't depend on anything;
+// everything else depends on something, and isn't a sync sample.
+const (
+	fmp4KeyframeFlags    = 0x02000000
+	fmp4NonKeyframeFlags = 0x01010000
+)
+
+// fmp4Track describes a single track of a fragmented MP4 (CMAF) stream, as it
+// goes in the stream's initialization segment.
+type fmp4Track struct {
+	id    uint32
+	video bool
+	codec webrtc.RTPCodecCapability
+
+	// In units per second. Always the codec's clock rate, so that RTP timestamps
+	// can be used as is.
+	timescale uint32
+
+	// H.264 only
+	sps    []byte
+	pps    []byte
+	width  int
+	height int
+}
+
+// fmp4Sample is a single frame of a track
+type fmp4Sample struct {
+	data     []byte
+	duration uint32
+	keyframe bool
+}
+
+// fmp4TrackFragment is a run of samples of a single track, that goes in a
+// fragment
+type fmp4TrackFragment struct {
+	trackID uint32
+
+	// When the first sample gets decoded, in the track's timescale
+	baseDecodeTime uint64
+
+	samples []fmp4Sample
+}
+
+// codecString is what goes in the CODECS attribute of an HLS playlist, e.g.
+// "avc1.42e01f"
+func (t *fmp4Track) codecString() string {
+	switch strings.ToLower(t.codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		if len(t.sps) < 4 {
+			return "avc1"
+		}
+		return "avc1." + hex.EncodeToString(t.sps[1:4])
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		return "opus"
+	case mimeTypeAAC:
+		config := aacConfig(t.codec)
+		if len(config) == 0 {
+			return "mp4a.40.2"
+		}
+		return fmt.Sprintf("mp4a.40.%d", config[0]>>3)
+	}
+	return ""
+}
+
+// aacConfig is the AudioSpecificConfig of an AAC track, which comes in its fmtp
+// line
+func aacConfig(codec webrtc.RTPCodecCapability) []byte {
+	config, err := hex.DecodeString(parseFmtp(codec.SDPFmtpLine)["config"])
+	if err != nil {
+		return nil
+	}
+	return config
+}
+
+// mp4Box puts together a box of the given type, out of whatever goes in it
+func mp4Box(kind string, contents ...[]byte) []byte {
+	size := 8
+	for _, c := range contents {
+		size += len(c)
+	}
+
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box, uint32(size))
+	copy(box[4:], kind)
+	for _, c := range contents {
+		box = append(box, c...)
+	}
+	return box
+}
+
+// mp4FullBox is mp4Box, for boxes with a version and flags
+func mp4FullBox(kind string, version uint8, flags uint32, contents ...[]byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, flags)
+	header[0] = version
+	return mp4Box(kind, append([][]byte{header}, contents...)...)
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// The identity matrix, as it goes in mvhd and tkhd boxes
+var mp4Matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x00, 0x00, 0x00,
+}
+
+// fmp4InitSegment creates the initialization segment for the given tracks,
+// which has everything needed to decode the fragments that come after it.
+func fmp4InitSegment(tracks []*fmp4Track) []byte {
+	ftyp := mp4Box("ftyp", []byte("iso6"), u32(0), []byte("iso6cmfcmp41"))
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0),                     // Creation time
+		u32(0),                     // Modification time
+		u32(1000),                  // Timescale
+		u32(0),                     // Duration
+		u32(0x00010000),            // Rate
+		u16(0x0100),                // Volume
+		make([]byte, 10),           // Reserved
+		mp4Matrix,                  //
+		make([]byte, 24),           // Pre-defined
+		u32(uint32(len(tracks)+1)), // Next track ID
+	)
+
+	traks := [][]byte{}
+	trexs := [][]byte{}
+	for _, track := range tracks {
+		traks = append(traks, fmp4Trak(track))
+		trexs = append(trexs, mp4FullBox("trex", 0, 0,
+			u32(track.id),
+			u32(1), // Sample description index
+			u32(0), // Default sample duration
+			u32(0), // Default sample size
+			u32(0), // Default sample flags
+		))
+	}
+
+	moov := mp4Box("moov", append(append([][]byte{mvhd}, traks...), mp4Box("mvex", trexs...))...)
+
+	return append(ftyp, moov...)
+}
+
+func fmp4Trak(track *fmp4Track) []byte {
+	volume := uint16(0)
+	if !track.video {
+		volume = 0x0100
+	}
+
+	tkhd := mp4FullBox("tkhd", 0, 0x000003, // Enabled, and in the movie
+		u32(0),        // Creation time
+		u32(0),        // Modification time
+		u32(track.id), //
+		u32(0),        // Reserved
+		u32(0),        // Duration
+		make([]byte, 8),
+		u16(0), // Layer
+		u16(0), // Alternate group
+		u16(volume),
+		u16(0), // Reserved
+		mp4Matrix,
+		u32(uint32(track.width)<<16),
+		u32(uint32(track.height)<<16),
+	)
+
+	mdhd := mp4FullBox("mdhd", 0, 0,
+		u32(0), // Creation time
+		u32(0), // Modification time
+		u32(track.timescale),
+		u32(0),      // Duration
+		u16(0x55C4), // Language ("und")
+		u16(0),
+	)
+
+	handler, name, header := "soun", "SoundHandler", mp4FullBox("smhd", 0, 0, u16(0), u16(0))
+	if track.video {
+		handler, name, header = "vide", "VideoHandler", mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	}
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name), []byte{0})
+
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), fmp4SampleEntry(track)),
+		mp4FullBox("stts", 0, 0, u32(0)),
+		mp4FullBox("stsc", 0, 0, u32(0)),
+		mp4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		mp4FullBox("stco", 0, 0, u32(0)),
+	)
+
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", header, dinf, stbl)))
+}
+
+func fmp4SampleEntry(track *fmp4Track) []byte {
+	if track.video {
+		avcC := mp4Box("avcC",
+			[]byte{1, track.sps[1], track.sps[2], track.sps[3], 0xFF, 0xE1},
+			u16(uint16(len(track.sps))), track.sps,
+			[]byte{1},
+			u16(uint16(len(track.pps))), track.pps,
+		)
+
+		return mp4Box("avc1",
+			make([]byte, 6), // Reserved
+			u16(1),          // Data reference index
+			make([]byte, 16),
+			u16(uint16(track.width)),
+			u16(uint16(track.height)),
+			u32(0x00480000), // 72 DPI
+			u32(0x00480000),
+			u32(0),
+			u16(1), // Frame count
+			make([]byte, 32),
+			u16(0x0018), // Depth
+			u16(0xFFFF),
+			avcC,
+		)
+	}
+
+	channels := track.codec.Channels
+	if channels == 0 {
+		channels = 2
+	}
+
+	audioEntry := [][]byte{
+		make([]byte, 6), // Reserved
+		u16(1),          // Data reference index
+		make([]byte, 8),
+		u16(channels),
+		u16(16), // Sample size
+		u32(0),
+		u32(track.timescale << 16),
+	}
+
+	if strings.EqualFold(track.codec.MimeType, mimeTypeAAC) {
+		config := aacConfig(track.codec)
+		decoderSpecific := append([]byte{0x05, byte(len(config))}, config...)
+		decoderConfig := append([]byte{
+			0x04, byte(13 + len(decoderSpecific)),
+			0x40,    // Audio ISO/IEC 14496-3
+			0x15,    // Audio stream
+			0, 0, 0, // Buffer size
+			0, 0, 0, 0, // Max bitrate
+			0, 0, 0, 0, // Average bitrate
+		}, decoderSpecific...)
+		descriptor := append([]byte{0x03, byte(3 + len(decoderConfig) + 3), 0, 0, 0}, decoderConfig...)
+		descriptor = append(descriptor, 0x06, 0x01, 0x02)
+
+		return mp4Box("mp4a", append(audioEntry, mp4FullBox("esds", 0, 0, descriptor))...)
+	}
+
+	dOps := mp4Box("dOps",
+		[]byte{0, uint8(channels)},
+		u16(0), // Pre-skip
+		u32(track.codec.ClockRate),
+		u16(0),    // Output gain
+		[]byte{0}, // Channel mapping family
+	)
+	return mp4Box("Opus", append(audioEntry, dOps)...)
+}
+
+// fmp4Fragment creates a single fragment (a moof box, followed by an mdat box)
+// with the given runs of samples.
+func fmp4Fragment(sequence uint32, fragments []fmp4TrackFragment) []byte {
+	// The sizes of the boxes are known up front, which is needed to know where
+	// each track's samples end up
+	moofSize := 8 + 16
+	for _, f := range fragments {
+		moofSize += 8 + 16 + 20 + 20 + 12*len(f.samples)
+	}
+
+	mdat := []byte{}
+	trafs := [][]byte{}
+	for _, f := range fragments {
+		dataOffset := moofSize + 8 + len(mdat)
+
+		samples := []byte{}
+		for _, sample := range f.samples {
+			flags := uint32(fmp4NonKeyframeFlags)
+			if sample.keyframe {
+				flags = fmp4KeyframeFlags
+			}
+			samples = append(samples, u32(sample.duration)...)
+			samples = append(samples, u32(uint32(len(sample.data)))...)
+			samples = append(samples, u32(flags)...)
+			mdat = append(mdat, sample.data...)
+		}
+
+		trafs = append(trafs, mp4Box("traf",
+			mp4FullBox("tfhd", 0, 0x020000, u32(f.trackID)), // Default base is moof
+			mp4FullBox("tfdt", 1, 0, u64(f.baseDecodeTime)),
+			// Data offset, and sample durations, sizes, and flags
+			mp4FullBox("trun", 0, 0x000701, u32(uint32(len(f.samples))), u32(uint32(dataOffset)), samples),
+		))
+	}
+
+	moof := mp4Box("moof", append([][]byte{mp4FullBox("mfhd", 0, 0, u32(sequence))}, trafs...)...)
+	return append(moof, mp4Box("mdat", mdat)...)
+}
+
+// h264NALUnits splits up a frame in the AVC format (each NAL unit prefixed with
+// its length)
+func h264NALUnits(frame []byte) [][]byte {
+	units := [][]byte{}
+	for len(frame) >= 4 {
+		size := int(binary.BigEndian.Uint32(frame))
+		frame = frame[4:]
+		if size > len(frame) {
+			break
+		}
+		units = append(units, frame[:size])
+		frame = frame[size:]
+	}
+	return units
+}
+
+// h264Dimensions reads the width and height out of an SPS
+func h264Dimensions(sps []byte) (int, int, bool) {
+	if len(sps) < 4 {
+		return 0, 0, false
+	}
+
+	// Emulation prevention bytes aren't part of the actual data
+	rbsp := make([]byte, 0, len(sps))
+	for i := 0; i < len(sps); i++ {
+		if i >= 2 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+
+	r := bitReader{data: rbsp[1:]}
+	profile := r.read(8)
+	r.read(16) // Constraints, and level
+	r.readUE() // SPS ID
+
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.readUE()
+		if chromaFormat == 3 {
+			r.read(1) // Separate color plane
+		}
+		r.readUE() // Luma bit depth
+		r.readUE() // Chroma bit depth
+		r.read(1)  // QP prime Y zero transform bypass
+		if r.read(1) == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.read(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.readSE() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.readUE() // Max frame number
+	switch r.readUE() {
+	case 0:
+		r.readUE()
+	case 1:
+		r.read(1)
+		r.readSE()
+		r.readSE()
+		for n := r.readUE(); n > 0 && !r.overrun; n-- {
+			r.readSE()
+		}
+	}
+
+	r.readUE() // Max reference frames
+	r.read(1)  // Gaps in frame numbers allowed
+	widthInMBs := r.readUE() + 1
+	heightInMapUnits := r.readUE() + 1
+	frameMBsOnly := r.read(1)
+	if frameMBsOnly == 0 {
+		r.read(1)
+	}
+	r.read(1) // Direct 8x8 inference
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.read(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.readUE(), r.readUE(), r.readUE(), r.readUE()
+	}
+	if r.overrun {
+		return 0, 0, false
+	}
+
+	cropUnitX, cropUnitY := uint32(1), 2-frameMBsOnly
+	switch chromaFormat {
+	case 1:
+		cropUnitX, cropUnitY = 2, 2*(2-frameMBsOnly)
+	case 2:
+		cropUnitX = 2
+	}
+
+	width := widthInMBs*16 - (cropLeft+cropRight)*cropUnitX
+	height := (2-frameMBsOnly)*heightInMapUnits*16 - (cropTop+cropBottom)*cropUnitY
+	return int(width), int(height), true
+}
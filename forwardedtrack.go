@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// ForwardedTrack is a single track that a publisher is sending to a broadcast.
+//
+// When the publisher is doing simulcast, the track is made up of several
+// layers (one per RID), each being read by its own TrackForwarder. Otherwise,
+// there is just the one layer, with an empty RID.
+//
+// Receivers don't get the layers directly. Instead, each receiver gets its own
+// DownTrack, which picks one of the layers to send out.
+type ForwardedTrack struct {
+	keyID       KeyIDString
+	broadcastID BroadcastIDString
+	id          TrackIDString
+	kind        webrtc.RTPCodecType
+	codec       webrtc.RTPCodecCapability
+	created     time.Time
+
+	// Whether the track comes from some other server (see EdgeRelay), rather
+	// than from a publisher of this one. Only ever set before the track is.
+	relayed bool
+
+	// How loud the track has been lately. Only ever updated for audio tracks
+	// whose publisher sends audio levels.
+	activity *audioActivity
+
+	lock *sync.RWMutex
+
+	// In the order that the layers arrived in
+	layers []*TrackForwarder
+
+	downTracks Set[*DownTrack]
+}
+
+// NewForwardedTrack creates a track for a broadcast, without any layers. Layers
+// are to be added as the publisher's remote tracks come in.
+//
+// The track ID tells the track apart from the broadcast's other tracks.
+func NewForwardedTrack(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	trackId TrackIDString,
+	kind webrtc.RTPCodecType,
+	codec webrtc.RTPCodecCapability,
+) *ForwardedTrack {
+	return &ForwardedTrack{
+		keyID:       keyId,
+		broadcastID: broadcastId,
+		id:          trackId,
+		kind:        kind,
+		codec:       codec,
+		created:     time.Now(),
+		activity:    newAudioActivity(),
+		lock:        &sync.RWMutex{},
+		downTracks:  Set[*DownTrack]{},
+	}
+}
+
+// KeyID returns the key ID of the publisher of the track
+func (t *ForwardedTrack) KeyID() KeyIDString {
+	return t.keyID
+}
+
+// BroadcastID returns the ID of the broadcast that the track is a part of
+func (t *ForwardedTrack) BroadcastID() BroadcastIDString {
+	return t.broadcastID
+}
+
+// ID returns the ID that tells the track apart from the broadcast's other
+// tracks
+func (t *ForwardedTrack) ID() TrackIDString {
+	return t.id
+}
+
+// StreamID is the media stream ID that every track of the broadcast shares.
+func (t *ForwardedTrack) StreamID() string {
+	return msidToken(string(t.keyID), string(t.broadcastID))
+}
+
+// Info describes the track to receivers
+func (t *ForwardedTrack) Info() TrackInfo {
+	return TrackInfo{
+		ID:       t.id,
+		Kind:     KindString(t.kind.String()),
+		MimeType: t.codec.MimeType,
+		Layers:   t.Layers(),
+	}
+}
+
+// msidToken turns any set of strings into something that can be used as a
+// media stream ID, or a track ID, in an SDP.
+//
+// Key IDs, broadcast IDs, and track IDs can contain pretty much anything,
+// which isn't the case for media stream IDs, hence the hashing.
+func msidToken(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Kind returns whether this is an audio or video track
+func (t *ForwardedTrack) Kind() webrtc.RTPCodecType {
+	return t.kind
+}
+
+// Codec returns the codec that the publisher is sending with
+func (t *ForwardedTrack) Codec() webrtc.RTPCodecCapability {
+	return t.codec
+}
+
+// AudioLevel returns how loud the track has been lately, in -dBov (so, 0 is
+// as loud as it gets, and 127 is silence).
+func (t *ForwardedTrack) AudioLevel() float64 {
+	return t.activity.Level()
+}
+
+// AddLayer adds a remote track as one of the layers of this track. The
+// returned forwarder does nothing until its Run method is called.
+//
+// Keyframe requests for the layer are sent through rtcpWriter.
+func (t *ForwardedTrack) AddLayer(remote RTPSource, rtcpWriter RTCPWriter) *TrackForwarder {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	forwarder := &TrackForwarder{
+		remote:     remote,
+		track:      t,
+		cache:      newPacketCache(),
+		rtcpWriter: rtcpWriter,
+		keyframes: newKeyframeRequester(config.KeyframeRequestInterval(), func() error {
+			metrics.PLIsSent.Inc()
+			return rtcpWriter.WriteRTCP([]rtcp.Packet{
+				&rtcp.PictureLossIndication{MediaSSRC: uint32(remote.SSRC())},
+			})
+		}),
+	}
+	t.layers = append(t.layers, forwarder)
+	t.retargetDownTracks()
+
+	return forwarder
+}
+
+// RemoveLayer removes a layer (usually because its forwarder stopped running),
+// and returns the number of layers that are left.
+func (t *ForwardedTrack) RemoveLayer(forwarder *TrackForwarder) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, layer := range t.layers {
+		if layer == forwarder {
+			t.layers = append(t.layers[:i], t.layers[i+1:]...)
+			break
+		}
+	}
+	t.retargetDownTracks()
+
+	return len(t.layers)
+}
+
+// Layers returns the RIDs of all the layers currently being published
+func (t *ForwardedTrack) Layers() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	rids := make([]string, 0, len(t.layers))
+	for _, layer := range t.layers {
+		rids = append(rids, layer.RID())
+	}
+	return rids
+}
+
+// LayerStats describes a single layer of a track
+type LayerStats struct {
+	RID  string `json:"rid"`
+	SSRC uint32 `json:"ssrc"`
+	TrackStats
+}
+
+// LayerStats describes each of the layers currently being published, in the
+// order that they arrived in
+func (t *ForwardedTrack) LayerStats() []LayerStats {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	stats := make([]LayerStats, 0, len(t.layers))
+	for _, layer := range t.layers {
+		stats = append(stats, LayerStats{
+			RID:        layer.RID(),
+			SSRC:       uint32(layer.remote.SSRC()),
+			TrackStats: layer.Stats(),
+		})
+	}
+	return stats
+}
+
+// NewDownTrack creates a DownTrack that will send out this track's packets to
+// a single receiver.
+//
+// preferredLayer is the RID of the layer that the receiver wants. If it's
+// empty (or if that layer isn't being published), a layer is picked
+// automatically.
+func (t *ForwardedTrack) NewDownTrack(preferredLayer string) *DownTrack {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	downTrack := newDownTrack(t, preferredLayer)
+	t.downTracks.Add(downTrack)
+	t.retarget(downTrack)
+
+	return downTrack
+}
+
+// AttachDownTrack has this track send its packets to a DownTrack that was
+// created for some other track, for when the other track is being replaced.
+//
+// The DownTrack should have been removed from the other track beforehand, and
+// should be able to switch to this one (see DownTrack.CanSwitchTo).
+func (t *ForwardedTrack) AttachDownTrack(downTrack *DownTrack) {
+	downTrack.setSource(t)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.downTracks.Add(downTrack)
+	t.retarget(downTrack)
+}
+
+// RemoveDownTrack stops sending packets to the given DownTrack
+func (t *ForwardedTrack) RemoveDownTrack(downTrack *DownTrack) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.downTracks.Remove(downTrack)
+}
+
+// SelectLayer changes the layer that a DownTrack wants. An empty RID means
+// that the layer should be picked automatically.
+//
+// The switch itself only happens once the new layer sends a keyframe.
+func (t *ForwardedTrack) SelectLayer(downTrack *DownTrack, rid string) {
+	downTrack.setPreferredLayer(rid)
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	t.retarget(downTrack)
+}
+
+// RequestKeyframe asks the publisher for a keyframe on the given layer.
+func (t *ForwardedTrack) RequestKeyframe(rid string) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if layer := t.layer(rid); layer != nil {
+		layer.RequestKeyframe()
+	}
+}
+
+// RequestKeyframeNow is RequestKeyframe, for receivers that just joined, who
+// shouldn't have to wait out the whole rate limit.
+func (t *ForwardedTrack) RequestKeyframeNow(rid string) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if layer := t.layer(rid); layer != nil {
+		layer.RequestKeyframeNow()
+	}
+}
+
+// retransmit sends lost packets from the given layer to a DownTrack again.
+// Whichever packets are no longer in the cache get asked for from the
+// publisher.
+func (t *ForwardedTrack) retransmit(downTrack *DownTrack, rid string, lost []sentPacket) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	layer := t.layer(rid)
+	if layer == nil {
+		return
+	}
+
+	missing := []uint16{}
+	for _, sent := range lost {
+		packet, ok := layer.cache.Get(sent.srcSeq)
+		if !ok {
+			missing = append(missing, sent.srcSeq)
+			continue
+		}
+
+		layer.retransmissions.Add(1)
+		metrics.Retransmissions.Inc()
+		downTrack.writeRetransmission(sent, layer, packet)
+	}
+
+	if len(missing) > 0 {
+		layer.requestRetransmission(missing)
+	}
+}
+
+// layerBitrate is the bitrate of a single layer, at some point in time
+type layerBitrate struct {
+	rid     string
+	bitrate uint64
+}
+
+// layerBitrates returns the bitrate of every layer, from lowest to highest.
+func (t *ForwardedTrack) layerBitrates() []layerBitrate {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	bitrates := make([]layerBitrate, 0, len(t.layers))
+	for _, layer := range t.layers {
+		bitrates = append(bitrates, layerBitrate{layer.RID(), layer.bitrate.Load()})
+	}
+	sort.SliceStable(bitrates, func(i, j int) bool {
+		return bitrates[i].bitrate < bitrates[j].bitrate
+	})
+
+	return bitrates
+}
+
+// allocate applies what a BandwidthAllocator decided on for a DownTrack.
+func (t *ForwardedTrack) allocate(downTrack *DownTrack, rid string, paused bool) {
+	downTrack.setAllocation(rid, paused)
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	t.retarget(downTrack)
+}
+
+// layerBitrateUpdated gets called by the forwarders whenever they have a new
+// bitrate measurement, since that may change which layer is the best one.
+func (t *ForwardedTrack) layerBitrateUpdated() {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	t.retargetDownTracks()
+}
+
+// NOT THREAD SAFE!
+func (t *ForwardedTrack) retargetDownTracks() {
+	for downTrack := range t.downTracks {
+		t.retarget(downTrack)
+	}
+}
+
+// NOT THREAD SAFE!
+//
+// retarget points a DownTrack at the layer it should be getting. If that means
+// the DownTrack is waiting on a keyframe, then one gets requested.
+func (t *ForwardedTrack) retarget(downTrack *DownTrack) {
+	rid := t.layerFor(downTrack)
+	if !downTrack.setTargetLayer(rid) {
+		return
+	}
+
+	if layer := t.layer(rid); layer != nil {
+		layer.RequestKeyframe()
+	}
+}
+
+// NOT THREAD SAFE!
+func (t *ForwardedTrack) layer(rid string) *TrackForwarder {
+	for _, layer := range t.layers {
+		if layer.RID() == rid {
+			return layer
+		}
+	}
+	return nil
+}
+
+// NOT THREAD SAFE!
+//
+// layerFor returns the RID of the layer that should be sent to a DownTrack.
+func (t *ForwardedTrack) layerFor(downTrack *DownTrack) string {
+	if rid, ok := downTrack.allocatedLayer(); ok && t.layer(rid) != nil {
+		return rid
+	}
+
+	preferred := downTrack.preferredLayer()
+	if preferred != "" && t.layer(preferred) != nil {
+		return preferred
+	}
+
+	// Otherwise, go with the best looking layer. RIDs are just names that the
+	// publisher came up with, so we can't tell anything from them; the bitrate is
+	// the next best thing.
+	var best *TrackForwarder
+	for _, layer := range t.layers {
+		if best == nil || layer.bitrate.Load() > best.bitrate.Load() {
+			best = layer
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return best.RID()
+}
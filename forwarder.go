@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// TrackStats is a snapshot of how much has gone through a TrackForwarder.
+type TrackStats struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+
+	// Bitrate is in bits per second, measured over roughly the last second.
+	Bitrate uint64 `json:"bitrate"`
+
+	// Number of keyframe requests (PLIs) sent to the publisher
+	KeyframeRequests uint64 `json:"keyframeRequests"`
+
+	// Number of packets that receivers lost, and got sent again from the cache
+	Retransmissions uint64 `json:"retransmissions"`
+
+	// Number of packets that receivers lost, that were no longer in the cache,
+	// and so had to be asked for from the publisher
+	NACKs uint64 `json:"nacks"`
+}
+
+// RTCPWriter is anything that RTCP packets can be sent to a publisher through.
+// Usually, that's the publisher's peer connection.
+type RTCPWriter interface {
+	WriteRTCP(pkts []rtcp.Packet) error
+}
+
+// RTPSource is anything that a layer's RTP packets can be read from. Usually,
+// that's a publisher's remote track, but it could just as well be a UDP socket.
+type RTPSource interface {
+	ReadRTP() (*rtp.Packet, interceptor.Attributes, error)
+	RID() string
+	SSRC() webrtc.SSRC
+}
+
+// TrackForwarder pumps RTP packets from a publisher's remote track, into every
+// DownTrack subscribed to the ForwardedTrack that the remote track is a layer
+// of.
+//
+// One forwarder exists per remote track (so, per simulcast layer). It lives for
+// as long as the remote track can be read from.
+type TrackForwarder struct {
+	remote RTPSource
+	track  *ForwardedTrack
+
+	// Where receivers' requests for keyframes end up
+	keyframes *keyframeRequester
+
+	// Where receivers' requests for lost packets get answered from
+	cache      *packetCache
+	rtcpWriter RTCPWriter
+
+	// URIs of the header extensions negotiated with the publisher, by ID, so
+	// that DownTracks can send them on with whatever IDs their receivers
+	// negotiated
+	extensions map[uint8]string
+
+	// ID of the audio level header extension, as negotiated with the publisher.
+	// Zero if there is none.
+	audioLevelID uint8
+
+	packets         atomic.Uint64
+	bytes           atomic.Uint64
+	bitrate         atomic.Uint64
+	retransmissions atomic.Uint64
+	nacks           atomic.Uint64
+
+	// Only ever touched from Run
+	lastBitrateBytes uint64
+	lastBitrateTime  time.Time
+}
+
+// RID returns the RTP stream ID of the layer being forwarded. This is empty if
+// the publisher isn't doing simulcast.
+func (f *TrackForwarder) RID() string {
+	return f.remote.RID()
+}
+
+// Run blocks, forwarding packets until the remote track can no longer be read
+// from. That usually means that the publisher went away, in which case a nil
+// error is returned.
+func (f *TrackForwarder) Run() error {
+	defer f.keyframes.Stop()
+
+	f.lastBitrateTime = time.Now()
+
+	for {
+		packet, _, err := f.remote.ReadRTP()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		size := uint64(packet.MarshalSize())
+		f.packets.Add(1)
+		bytes := f.bytes.Add(size)
+		metrics.PacketsReceived.Inc()
+		metrics.BytesReceived.Add(size)
+
+		if elapsed := time.Since(f.lastBitrateTime); elapsed >= time.Second {
+			f.bitrate.Store(uint64(float64(bytes-f.lastBitrateBytes) * 8 / elapsed.Seconds()))
+			f.lastBitrateBytes = bytes
+			f.lastBitrateTime = time.Now()
+			f.track.layerBitrateUpdated()
+		}
+
+		if f.audioLevelID != 0 {
+			if payload := packet.GetExtension(f.audioLevelID); payload != nil {
+				var extension rtp.AudioLevelExtension
+				if err := extension.Unmarshal(payload); err == nil {
+					f.track.activity.observe(extension)
+				}
+			}
+		}
+
+		f.cache.Add(packet)
+		f.track.forward(f, packet)
+	}
+}
+
+// SetHeaderExtensions tells the forwarder which header extensions were
+// negotiated with the publisher. If there's an audio level extension, the
+// forwarder keeps track of how loud the track is. Must be called before Run.
+func (f *TrackForwarder) SetHeaderExtensions(extensions []webrtc.RTPHeaderExtensionParameter) {
+	f.extensions = map[uint8]string{}
+	for _, extension := range extensions {
+		f.extensions[uint8(extension.ID)] = extension.URI
+		if extension.URI == sdp.AudioLevelURI {
+			f.audioLevelID = uint8(extension.ID)
+		}
+	}
+}
+
+// Stats returns the number of packets and bytes forwarded so far.
+func (f *TrackForwarder) Stats() TrackStats {
+	return TrackStats{
+		Packets: f.packets.Load(),
+		Bytes:   f.bytes.Load(),
+		Bitrate: f.bitrate.Load(),
+
+		KeyframeRequests: f.keyframes.Sent(),
+		Retransmissions:  f.retransmissions.Load(),
+		NACKs:            f.nacks.Load(),
+	}
+}
+
+// RequestKeyframe asks the publisher for a keyframe on this layer. Requests
+// are merged together, and rate limited, across every receiver.
+func (f *TrackForwarder) RequestKeyframe() {
+	f.keyframes.Request()
+}
+
+// RequestKeyframeNow asks the publisher for a keyframe on this layer, waiting
+// out a much shorter gap than the rate limit. For receivers that just joined.
+func (f *TrackForwarder) RequestKeyframeNow() {
+	f.keyframes.RequestNow()
+}
+
+// requestRetransmission asks the publisher to send the given packets again,
+// for when a receiver lost packets that are no longer in the cache.
+//
+// Whatever the publisher sends again gets forwarded as usual.
+func (f *TrackForwarder) requestRetransmission(seqs []uint16) {
+	f.nacks.Add(uint64(len(seqs)))
+	metrics.NACKsSent.Add(uint64(len(seqs)))
+
+	// Not much that can be done if this fails. Odds are, the publisher is going
+	// away anyways.
+	f.rtcpWriter.WriteRTCP([]rtcp.Packet{
+		&rtcp.TransportLayerNack{
+			MediaSSRC: uint32(f.remote.SSRC()),
+			Nacks:     rtcp.NackPairsFromSequenceNumbers(seqs),
+		},
+	})
+}
+
+// forward writes a single packet to every DownTrack that might want it. It's up
+// to the DownTrack to decide whether it cares about the layer that the packet
+// came from.
+func (t *ForwardedTrack) forward(layer *TrackForwarder, packet *rtp.Packet) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for downTrack := range t.downTracks {
+		// Errors writing are only ever the fault of some receiver (e.g. a closed
+		// peer connection), and that shouldn't stop everyone else from getting
+		// their packets. So ignore them.
+		downTrack.writeRTP(t, layer, packet)
+	}
+}
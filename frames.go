@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/pkg/frame"
+	"github.com/pion/webrtc/v4"
+)
+
+// How many packets can be waiting on one that went missing, before giving up
+// on it
+const maxReorderedPackets = 64
+
+// AV1 OBU types that don't belong in a recording. Temporal delimiters get
+// written in by us, and tile lists aren't allowed in RTP to begin with.
+const (
+	av1OBUTemporalDelimiter = 2
+	av1OBUTileList          = 8
+)
+
+// mediaFrame is a whole frame of video, or a single packet's worth of audio,
+// put back together from RTP packets.
+type mediaFrame struct {
+	data      []byte
+	timestamp uint32
+	keyframe  bool
+}
+
+// frameAssembler puts frames back together from the RTP packets of a single
+// DownTrack, putting packets that came in out of order back in order.
+//
+// Whenever a packet goes missing, the frame it was a part of gets dropped,
+// and (for video) so does everything after it, until the next keyframe. That
+// way, nothing that can't be decoded ever gets written out.
+type frameAssembler struct {
+	mimeType string
+	fmtpLine string
+	video    bool
+
+	// Called with every frame, as soon as it's complete
+	onFrame func(mediaFrame)
+
+	// Called whenever a packet went missing, and a keyframe is needed
+	onLoss func()
+
+	// Packets that came in early, by sequence number
+	pending map[uint16]*rtp.Packet
+	nextSeq uint16
+	started bool
+
+	// The frame being put together
+	data      []byte
+	timestamp uint32
+	keyframe  bool
+	hasData   bool
+
+	// Whether we're waiting on a keyframe
+	broken bool
+
+	av1  frame.AV1
+	h264 *codecs.H264Packet
+
+	// Where the H.265 NAL unit being put back together from fragments starts in
+	// the frame. -1 if there isn't one.
+	h265Fragment int
+}
+
+func newFrameAssembler(
+	codec webrtc.RTPCodecCapability,
+	onFrame func(mediaFrame),
+	onLoss func(),
+) *frameAssembler {
+	return &frameAssembler{
+		mimeType: codec.MimeType,
+		fmtpLine: codec.SDPFmtpLine,
+		video:    strings.HasPrefix(strings.ToLower(codec.MimeType), "video/"),
+		onFrame:  onFrame,
+		onLoss:   onLoss,
+		pending:  map[uint16]*rtp.Packet{},
+		broken:   true,
+		h264:     &codecs.H264Packet{IsAVC: true},
+
+		h265Fragment: -1,
+	}
+}
+
+// push takes in a single packet, and calls onFrame with whatever frames it
+// completes.
+func (a *frameAssembler) push(packet *rtp.Packet) {
+	if !a.started {
+		a.started = true
+		a.nextSeq = packet.SequenceNumber
+	}
+
+	// Either a duplicate, or way too late
+	if packet.SequenceNumber != a.nextSeq && !isNewerSequenceNumber(packet.SequenceNumber, a.nextSeq) {
+		return
+	}
+	a.pending[packet.SequenceNumber] = packet
+
+	for {
+		for {
+			next, ok := a.pending[a.nextSeq]
+			if !ok {
+				break
+			}
+			delete(a.pending, a.nextSeq)
+			a.nextSeq++
+			a.process(next)
+		}
+
+		if len(a.pending) <= maxReorderedPackets {
+			return
+		}
+
+		// Whatever we were waiting on isn't coming, so skip to the oldest packet
+		// that we do have
+		oldest := a.nextSeq
+		first := true
+		for seq := range a.pending {
+			if first || isNewerSequenceNumber(oldest, seq) {
+				oldest = seq
+				first = false
+			}
+		}
+		a.nextSeq = oldest
+		a.lost()
+	}
+}
+
+// lost drops the frame being put together, since a part of it is missing
+func (a *frameAssembler) lost() {
+	a.data = nil
+	a.hasData = false
+	a.h264 = &codecs.H264Packet{IsAVC: true}
+	a.h265Fragment = -1
+
+	if a.video && !a.broken {
+		a.broken = true
+		a.onLoss()
+	}
+}
+
+func (a *frameAssembler) process(packet *rtp.Packet) {
+	if len(packet.Payload) == 0 {
+		return
+	}
+
+	if !a.video {
+		if !strings.EqualFold(a.mimeType, mimeTypeAAC) {
+			a.onFrame(mediaFrame{packet.Payload, packet.Timestamp, true})
+			return
+		}
+
+		units, err := aacAccessUnits(packet.Payload, a.fmtpLine)
+		if err != nil {
+			return
+		}
+		for i, unit := range units {
+			a.onFrame(mediaFrame{unit, packet.Timestamp + uint32(i*aacSamplesPerFrame), true})
+		}
+		return
+	}
+
+	// The end of the previous frame never came
+	if a.hasData && packet.Timestamp != a.timestamp {
+		a.lost()
+	}
+
+	if !a.hasData {
+		a.data = nil
+		a.h265Fragment = -1
+		a.timestamp = packet.Timestamp
+		a.keyframe = false
+		a.hasData = true
+	}
+
+	// Keyframes don't always start off with the keyframe itself (e.g. there
+	// could be an access unit delimiter in front of it)
+	a.keyframe = a.keyframe || IsKeyframe(a.mimeType, packet.Payload)
+
+	if err := a.depacketize(packet); err != nil {
+		a.lost()
+		return
+	}
+
+	if !packet.Marker {
+		return
+	}
+
+	data, keyframe := a.data, a.keyframe
+	a.data = nil
+	a.hasData = false
+
+	if a.broken && !keyframe {
+		return
+	}
+	a.broken = false
+
+	if len(data) > 0 {
+		a.onFrame(mediaFrame{data, a.timestamp, keyframe})
+	}
+}
+
+// depacketize adds a packet's part of the frame to the frame
+func (a *frameAssembler) depacketize(packet *rtp.Packet) error {
+	switch strings.ToLower(a.mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		var vp8 codecs.VP8Packet
+		payload, err := vp8.Unmarshal(packet.Payload)
+		if err != nil {
+			return err
+		}
+		a.data = append(a.data, payload...)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		var vp9 codecs.VP9Packet
+		payload, err := vp9.Unmarshal(packet.Payload)
+		if err != nil {
+			return err
+		}
+		a.data = append(a.data, payload...)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		var av1 codecs.AV1Packet
+		if _, err := av1.Unmarshal(packet.Payload); err != nil {
+			return err
+		}
+		obus, err := a.av1.ReadFrames(&av1)
+		if err != nil {
+			return err
+		}
+
+		// Every temporal unit starts off with a temporal delimiter
+		if len(a.data) == 0 {
+			a.data = append(a.data, av1OBUTemporalDelimiter<<3|0x02, 0)
+		}
+		for _, obu := range obus {
+			a.data = appendSizedOBU(a.data, obu)
+		}
+	case strings.ToLower(webrtc.MimeTypeH264):
+		// In the AVC format (each NAL unit prefixed with its length), which is what
+		// MP4 files want
+		payload, err := a.h264.Unmarshal(packet.Payload)
+		if err != nil {
+			return err
+		}
+		a.data = append(a.data, payload...)
+	case strings.ToLower(webrtc.MimeTypeH265):
+		return a.depacketizeH265(packet.Payload)
+	default:
+		a.data = append(a.data, packet.Payload...)
+	}
+
+	return nil
+}
+
+var errBadH265Payload = errors.New("bad H.265 payload")
+
+// depacketizeH265 adds the NAL units of an H.265 payload (RFC 7798) to the
+// frame, each prefixed with its length, just like H.264. Streams with DONL
+// fields (i.e. sprop-max-don-diff above zero) aren't supported.
+func (a *frameAssembler) depacketizeH265(payload []byte) error {
+	if len(payload) < 2 {
+		return errBadH265Payload
+	}
+
+	switch naluType := (payload[0] >> 1) & 0x3F; naluType {
+	case h265NALUTypeAP:
+		payload = payload[2:]
+		for len(payload) > 0 {
+			if len(payload) < 2 {
+				return errBadH265Payload
+			}
+			size := int(binary.BigEndian.Uint16(payload))
+			payload = payload[2:]
+			if size > len(payload) {
+				return errBadH265Payload
+			}
+			a.data = appendLengthPrefixed(a.data, payload[:size])
+			payload = payload[size:]
+		}
+	case h265NALUTypeFU:
+		if len(payload) < 3 {
+			return errBadH265Payload
+		}
+		header := payload[2]
+		if header&0x80 != 0 {
+			// The NAL unit's own header is made up of the payload header, with the
+			// type from the fragmentation unit header
+			a.h265Fragment = len(a.data)
+			a.data = append(a.data, 0, 0, 0, 0, payload[0]&0x81|(header&0x3F)<<1, payload[1])
+		} else if a.h265Fragment < 0 {
+			return errBadH265Payload
+		}
+		a.data = append(a.data, payload[3:]...)
+		if header&0x40 != 0 {
+			binary.BigEndian.PutUint32(a.data[a.h265Fragment:], uint32(len(a.data)-a.h265Fragment-4))
+			a.h265Fragment = -1
+		}
+	case h265NALUTypePACI:
+		// Nothing that anyone sends
+		return errBadH265Payload
+	default:
+		a.data = appendLengthPrefixed(a.data, payload)
+	}
+
+	return nil
+}
+
+// appendLengthPrefixed appends a NAL unit, prefixed with its 4 byte length
+func appendLengthPrefixed(data []byte, unit []byte) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(unit)))
+	return append(data, unit...)
+}
+
+// AAC, as sent over RTP (RFC 3640). WebRTC clients don't send it, but it's
+// there for anything that comes in over plain RTP.
+const mimeTypeAAC = "audio/mpeg4-generic"
+
+// Every AAC frame is 1024 samples long
+const aacSamplesPerFrame = 1024
+
+// aacAccessUnits splits an AAC RTP payload up into its access units (frames),
+// going off of the sizes in its AU headers. The sizes of those come from the
+// fmtp line, and default to what AAC-hbr uses.
+func aacAccessUnits(payload []byte, fmtpLine string) ([][]byte, error) {
+	parameters := parseFmtp(fmtpLine)
+	sizeLength := parseIntOr(parameters["sizelength"], 13)
+	indexLength := parseIntOr(parameters["indexlength"], 3)
+	indexDeltaLength := parseIntOr(parameters["indexdeltalength"], 3)
+
+	if len(payload) < 2 || sizeLength == 0 {
+		return nil, errBadAACPayload
+	}
+
+	// The length of the AU headers, in bits
+	headersLength := int(payload[0])<<8 | int(payload[1])
+	headersSize := (headersLength + 7) / 8
+	if len(payload) < 2+headersSize {
+		return nil, errBadAACPayload
+	}
+
+	headers := bitReader{data: payload[2 : 2+headersSize]}
+	data := payload[2+headersSize:]
+	units := [][]byte{}
+	for read := 0; read+sizeLength <= headersLength; {
+		size := int(headers.read(sizeLength))
+		read += sizeLength
+		if len(units) == 0 {
+			headers.read(indexLength)
+			read += indexLength
+		} else {
+			headers.read(indexDeltaLength)
+			read += indexDeltaLength
+		}
+
+		if size > len(data) {
+			return nil, errBadAACPayload
+		}
+		units = append(units, data[:size])
+		data = data[size:]
+	}
+
+	return units, nil
+}
+
+var errBadAACPayload = errors.New("bad AAC payload")
+
+func parseIntOr(s string, fallback int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+// appendSizedOBU appends an AV1 OBU the way that it's stored in files, with
+// its size spelled out. RTP leaves the size out, since the RTP payload already
+// says how big each OBU is.
+func appendSizedOBU(data []byte, obu []byte) []byte {
+	if len(obu) == 0 {
+		return data
+	}
+
+	header := obu[0]
+	obuType := (header >> 3) & 0x0F
+	if obuType == av1OBUTemporalDelimiter || obuType == av1OBUTileList {
+		return data
+	}
+
+	// Already has its size
+	if header&0x02 != 0 {
+		return append(data, obu...)
+	}
+
+	headerSize := 1
+	if header&0x04 != 0 {
+		headerSize = 2
+	}
+	if len(obu) < headerSize {
+		return data
+	}
+
+	data = append(data, header|0x02)
+	data = append(data, obu[1:headerSize]...)
+	data = appendLEB128(data, uint(len(obu)-headerSize))
+	return append(data, obu[headerSize:]...)
+}
+
+func appendLEB128(data []byte, value uint) []byte {
+	for {
+		b := byte(value & 0x7F)
+		value >>= 7
+		if value == 0 {
+			return append(data, b)
+		}
+		data = append(data, b|0x80)
+	}
+}
+
+// videoDimensions reads the width and height of a video keyframe, if it's in a
+// codec that we know how to read that from.
+func videoDimensions(mimeType string, keyframe []byte) (width int, height int, ok bool) {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		// A 3 byte frame tag, a 3 byte start code, and then the dimensions, which
+		// are 14 bits each
+		if len(keyframe) < 10 || keyframe[3] != 0x9D || keyframe[4] != 0x01 || keyframe[5] != 0x2A {
+			return 0, 0, false
+		}
+		width = int(keyframe[6]) | int(keyframe[7]&0x3F)<<8
+		height = int(keyframe[8]) | int(keyframe[9]&0x3F)<<8
+		return width, height, true
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return vp9Dimensions(keyframe)
+	}
+
+	return 0, 0, false
+}
+
+// vp9Dimensions reads the dimensions out of a VP9 keyframe's uncompressed
+// header
+func vp9Dimensions(keyframe []byte) (int, int, bool) {
+	r := bitReader{data: keyframe}
+
+	if r.read(2) != 2 {
+		// Not a frame marker
+		return 0, 0, false
+	}
+	profile := r.read(1) | r.read(1)<<1
+	if profile == 3 {
+		r.read(1)
+	}
+	if r.read(1) == 1 {
+		// Just shows a frame that came before
+		return 0, 0, false
+	}
+	if r.read(1) != 0 {
+		// Not a keyframe
+		return 0, 0, false
+	}
+	r.read(2) // show_frame, and error_resilient_mode
+	if r.read(24) != 0x498342 {
+		return 0, 0, false
+	}
+
+	// Color config
+	if profile >= 2 {
+		r.read(1)
+	}
+	if r.read(3) != 7 {
+		r.read(1)
+		if profile == 1 || profile == 3 {
+			r.read(3)
+		}
+	} else if profile == 1 || profile == 3 {
+		r.read(1)
+	}
+
+	width := r.read(16) + 1
+	height := r.read(16) + 1
+	if r.overrun {
+		return 0, 0, false
+	}
+	return int(width), int(height), true
+}
+
+// bitReader reads big endian bits, reading zeroes once it runs out of data
+type bitReader struct {
+	data    []byte
+	offset  int
+	overrun bool
+}
+
+func (r *bitReader) read(bits int) uint32 {
+	var value uint32
+	for i := 0; i < bits; i++ {
+		value <<= 1
+		if r.offset/8 >= len(r.data) {
+			r.overrun = true
+			continue
+		}
+		value |= uint32(r.data[r.offset/8]>>(7-r.offset%8)) & 1
+		r.offset++
+	}
+	return value
+}
+
+// readUE reads an unsigned Exp-Golomb number
+func (r *bitReader) readUE() uint32 {
+	zeroes := 0
+	for r.read(1) == 0 && !r.overrun && zeroes < 32 {
+		zeroes++
+	}
+	return (1<<zeroes - 1) + r.read(zeroes)
+}
+
+// readSE reads a signed Exp-Golomb number
+func (r *bitReader) readSE() int32 {
+	n := r.readUE()
+	if n%2 == 1 {
+		return int32((n + 1) / 2)
+	}
+	return -int32(n / 2)
+}
@@ -2,16 +2,15 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+	"sync"
 
-	"github.com/castcam-live/simple-forwarding-unit/finish"
+	"github.com/castcam-live/simple-forwarding-unit/config"
 	wskeyauth "github.com/castcam-live/ws-key-auth/go"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/pion/interceptor"
-	"github.com/pion/interceptor/pkg/intervalpli"
-	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v4"
 )
 
 // Things to test for:
@@ -41,7 +40,76 @@ var peerConnectionConfig = webrtc.Configuration{
 func CreateHandlers() http.Handler {
 	router := mux.NewRouter()
 
-	tracksAndConnections := NewTracksAndConnectionManager()
+	// Where broadcasts live. Servers that share a registry can find each other's
+	// broadcasts in it.
+	registry, registryServer := newRegistry()
+
+	tracksAndConnections := NewTracksAndConnectionManager(registry, slog.With("component", "tracks"))
+
+	// Clients that lose their WebSocket connection get to reconnect to whatever
+	// they had going, for a while
+	sessions := NewSessionStore()
+
+	// Chat, and whatever else publishers want to send alongside their media
+	dataRelay := NewDataRelay()
+
+	// Who's doing the talking, out of each key ID's broadcasts
+	dominantSpeakers := NewDominantSpeakers(tracksAndConnections)
+
+	// Records broadcasts to disk, either because the configuration says so (for
+	// however long anything is published to them), or because the publisher
+	// asked for it
+	recorder := NewRecorder(tracksAndConnections)
+	go recorder.RunRetention()
+
+	// For publishers that speak WHIP, rather than our own signalling
+	whipServer := NewWHIPServer(tracksAndConnections, dataRelay)
+
+	// For players that speak WHEP, rather than our own signalling
+	whepServer := NewWHEPServer(tracksAndConnections)
+
+	// Gets broadcasts from the origin (or whichever server the registry says has
+	// them), for servers that are edges
+	edgeRelay := NewEdgeRelay(tracksAndConnections, registry)
+
+	// Packages broadcasts up as HLS, for whoever can't do WebRTC
+	hlsPackager := NewHLSPackager(tracksAndConnections)
+	go hlsPackager.Run()
+
+	// Publishing for pipelines that send plain RTP over UDP, rather than WebRTC
+	rtpIngest := NewRTPIngest(tracksAndConnections)
+	if err := rtpIngest.Listen(); err != nil {
+		panic("Failed to listen for RTP: " + err.Error())
+	}
+
+	// Sends tracks as plain RTP over UDP, for piping into ffmpeg and the like
+	rtpEgress := NewRTPEgress(tracksAndConnections)
+	rtpEgress.AddConfigured()
+
+	// Pulls from IP cameras, which can't publish on their own
+	rtspPuller := NewRTSPPuller(tracksAndConnections)
+	rtspPuller.Start()
+
+	// For keeping an eye on things, and kicking people out, whichever way they
+	// came in
+	adminAPI := NewAdminAPI(
+		tracksAndConnections,
+		sessions,
+		whipServer,
+		whepServer,
+		rtpIngest,
+		rtspPuller,
+	)
+
+	// For monitoring tools that only speak RTSP, if there's a port for them
+	if config.RTSPPort() != 0 {
+		rtspServer := NewRTSPServer(tracksAndConnections)
+		go func() {
+			if err := rtspServer.ListenAndServe(); err != nil {
+				slog.Error("RTSP server stopped", "err", err)
+			}
+		}()
+	}
 
 	// Have clients request for "key ID", "kind" (either "audio" or "video"),
 	// and "id" via query parameters, rather than URLs. Don't standardize things
@@ -56,11 +124,17 @@ func CreateHandlers() http.Handler {
 		// For broadcasting, we just need to be given the ID. Key ID is implied
 		// during authentication, and the "kind" is implied when a track is added.
 		//
-		// Yes, a broadcast can accept multiple tracks, but only of different kinds.
-		// Tracks of the same kind will be overriden.
+		// A broadcast can have any number of tracks, of any kind (e.g. a camera
+		// and a screen share). Tracks are told apart by ID: whatever label the
+		// publisher gave the track's media ID in TRACK_LABELS, or otherwise the
+		// media ID itself. A track only replaces another if it has the same ID.
+		// Simulcast layers of a track all come in on the same media ID, and are
+		// told apart by their RIDs.
 		//
-		// Receivers will need to create separate peer connection for each track
-		// that they need.
+		// Receivers get told what tracks there are (BroadcastTracks, in TRACKS
+		// messages), and either get a single track (or whichever is first of a
+		// kind) through `/get`, or any number of tracks, across any number of
+		// broadcasts, over a single peer connection through `/subscribe`.
 
 		// Grab the ID from the URL
 		params := mux.Vars(req)
@@ -69,11 +143,12 @@ func CreateHandlers() http.Handler {
 			res.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		logger := requestLogger(req, "broadcast")
 
 		// Handle the upgrade request (assuming it even is an upgrade request)
 		conn, err := upgrader.Upgrade(res, req, nil)
 		if err != nil {
-			log.Println(err)
+			logger.Warn("Failed to upgrade to WebSocket", "err", err)
 			return
 		}
 		defer conn.Close()
@@ -81,237 +156,372 @@ func CreateHandlers() http.Handler {
 		// First authenticate
 		authenticated, keyID, err := wskeyauth.Handshake(conn)
 		if err != nil {
-			log.Println(err)
+			logger.Warn("Failed to authenticate", "err", err)
 			return
 		}
 
+		signalling := NewSignallingConn(conn)
+
 		if !authenticated {
-			if err := conn.WriteJSON(TypeData[TypeOnly]{
+			logger.Info("Authentication failed", "keyId", keyID)
+			if err := signalling.WriteJSON(TypeData[TypeOnly]{
 				Type: "UNKNOWN_ERROR",
 				Data: TypeOnly{"AUTHENTICATION_FAILED"},
 			}); err != nil {
-				log.Printf("Error writing JSON: %s", err.Error())
+				logger.Warn("Failed to write JSON", "err", err)
 				return
 			}
 			return
 		}
+		logger = broadcastLogger(logger, KeyIDString(keyID), BroadcastIDString(id))
 
-		// Create a media engine (which seems to be necessary for the purposes of
-		// setting up a codec). This is a Pion WebRTC thing.
-		m := &webrtc.MediaEngine{}
-		if err := m.RegisterDefaultCodecs(); err != nil {
-			if err := conn.WriteJSON(TypeData[TypeOnly]{
-				Type: "SERVER_ERROR",
-				Data: TypeOnly{"CODEC_REGISTRATION_FAILED"},
-			}); err != nil {
-				log.Printf("Error writing JSON: %s", err.Error())
-				return
-			}
-			return
+		owner := SessionOwner{
+			Endpoint:    "broadcast",
+			KeyID:       KeyIDString(keyID),
+			BroadcastID: BroadcastIDString(id),
 		}
 
-		i := &interceptor.Registry{}
-
-		// Use the default set of Interceptors
-		if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-			if err := conn.WriteJSON(TypeData[TypeOnly]{
-				Type: "SERVER_ERROR",
-				Data: TypeOnly{
-					Type: "INTERCEPTOR_REGISTRATION_FAILED",
-				},
-			}); err != nil {
-				log.Printf("Error writing JSON: %s", err.Error())
+		// A publisher that lost its WebSocket connection (but not its peer
+		// connection) gets to pick up where it left off, tracks and all
+		if token, ok := ParseQuery(req.URL.RawQuery)["resume"]; ok {
+			session, ok := sessions.Resume(token, owner)
+			if !ok {
+				logger.Info("No session to resume")
+				writeSessionNotFound(signalling)
 				return
 			}
-			return
-		}
 
-		// TODO: Right now, we are sending a PLI every 3 seconds.
-		//
-		//   But, ideally, we should let the receiver decide how often they want to
-		//   send PLIs.
-		//
-		//   Fix this ASAP.
-		intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
-		if err != nil {
-			if err := conn.WriteJSON(TypeData[TypeOnly]{
-				Type: "SERVER_ERROR",
-				Data: TypeOnly{
-					Type: "INTERCEPTOR_CREATION_FAILED",
-				},
-			}); err != nil {
-				log.Printf("Error writing JSON: %s", err.Error())
-				return
-			}
+			session.Serve(conn)
 			return
 		}
-		i.Add(intervalPliFactory)
 
-		peerConnection, err := webrtc.NewAPI(
-			webrtc.WithMediaEngine(m),
-			webrtc.WithInterceptorRegistry(i),
-		).
-			NewPeerConnection(peerConnectionConfig)
+		peerConnection, err := newPublishingPeerConnection()
 		if err != nil {
-			if err := conn.WriteJSON(TypeData[TypeOnly]{
-				Type: "SERVER_ERROR",
-				Data: TypeOnly{
-					Type: "PEER_CONNECTION_CREATION_FAILED",
-				},
-			}); err != nil {
-				log.Printf("Errro writing JSON: %s", err.Error())
-				return
-			}
+			logger.Error("Failed to create peer connection", "err", err)
+			writeServerError(signalling, err)
 			return
 		}
 
-		defer func() {
-			if cErr := peerConnection.Close(); cErr != nil {
-				log.Printf("cannot close peerConnection: %v\n", cErr)
-			}
-		}()
-
-		peerConnection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-			localTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(
-				remoteTrack.Codec().RTPCodecCapability,
-				remoteTrack.Kind().String(),
-				"pion",
-			)
-			if newTrackErr != nil {
-				log.Printf("cannot create new track: %v\n", newTrackErr)
-				return
-			}
+		// Created once there's a session, so that it gets to log with the
+		// session's ID. Nothing gets published until the client's offer comes
+		// in anyways.
+		var publisher *Publisher
 
-			tracksAndConnections.SetTrack(
-				KeyIDString(keyID),
-				BroadcastIDString(id),
-				localTrack,
-			)
-		})
+		// Whatever recording this publisher got going, to be stopped once the
+		// publisher is gone
+		recordingLock := &sync.Mutex{}
+		var recording *Recording
 
-		done := finish.NewDone()
-		defer done.Finish()
+		handleMessage := func(t TypeData[json.RawMessage]) bool {
+			switch t.Type {
+			// Labels for the tracks that are about to be published, by media ID. Only
+			// tracks that haven't arrived yet get their labels from this, so it
+			// should be sent before the offer.
+			case "TRACK_LABELS":
+				var labels map[string]TrackIDString
+				if err := json.Unmarshal(t.Data, &labels); err != nil {
+					logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+					return true
+				}
 
-		peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-			if s == webrtc.PeerConnectionStateClosed {
-				done.Finish()
-			}
-		})
+				publisher.SetLabels(labels)
+			// Whether messages that receivers send on their data channels should be
+			// sent to the publisher
+			case "ACCEPT_RECEIVER_MESSAGES":
+				var accept bool
+				if err := json.Unmarshal(t.Data, &accept); err != nil {
+					logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+					return true
+				}
 
-		peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
-			if c == nil {
-				return
-			}
+				dataRelay.SetAcceptReceiverMessages(
+					KeyIDString(keyID),
+					BroadcastIDString(id),
+					peerConnection,
+					accept,
+				)
+			// Have the broadcast recorded to disk. The data (which can be left out)
+			// says what to record, and how.
+			case "START_RECORDING":
+				var options RecordingOptions
+				if len(t.Data) > 0 {
+					if err := json.Unmarshal(t.Data, &options); err != nil {
+						logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+						return true
+					}
+				}
 
-			if err := conn.WriteJSON(TypeData[TypeData[*webrtc.ICECandidate]]{
-				Type: "SIGNALLING",
-				Data: TypeData[*webrtc.ICECandidate]{
-					Type: "ICE_CANDIDATE",
-					Data: c,
-				},
-			}); err != nil {
-				done.Finish()
-				return
-			}
-		})
+				recordingLock.Lock()
+				defer recordingLock.Unlock()
 
-		for {
-			if done.IsDone() {
-				return
-			}
-			_, b, err := conn.ReadMessage()
-			if err != nil {
-				log.Printf("Reading message from client failed. I guess the client is closed? %s", err.Error())
-				return
-			}
+				started, err := recorder.Start(KeyIDString(keyID), BroadcastIDString(id), options)
+				if err == ErrAlreadyRecording {
+					signalling.WriteJSON(TypeData[map[string]any]{
+						Type: "CLIENT_ERROR",
+						Data: map[string]any{
+							"type": "ALREADY_RECORDING",
+							"msg":  "The broadcast is already being recorded",
+						},
+					})
+					return true
+				}
+				if err != nil {
+					signalling.WriteJSON(TypeData[map[string]any]{
+						Type: "CLIENT_ERROR",
+						Data: map[string]any{
+							"type": "BAD_RECORDING_OPTIONS",
+							"msg":  "Can't record the broadcast like that: " + err.Error(),
+						},
+					})
+					return true
+				}
+				recording = started
 
-			var t TypeData[json.RawMessage]
-			if err = json.Unmarshal(b, &t); err != nil {
-				continue
-			}
+				if err := signalling.WriteJSON(TypeData[RecordingStatus]{
+					Type: "RECORDING",
+					Data: started.Status(),
+				}); err != nil {
+					return false
+				}
+			case "STOP_RECORDING":
+				recordingLock.Lock()
+				defer recordingLock.Unlock()
+
+				current, ok := recorder.Recording(KeyIDString(keyID), BroadcastIDString(id))
+				if !ok {
+					signalling.WriteJSON(TypeData[map[string]any]{
+						Type: "CLIENT_ERROR",
+						Data: map[string]any{
+							"type": "NOT_RECORDING",
+							"msg":  "The broadcast isn't being recorded",
+						},
+					})
+					return true
+				}
+				if current.ByRule() {
+					signalling.WriteJSON(TypeData[map[string]any]{
+						Type: "CLIENT_ERROR",
+						Data: map[string]any{
+							"type": "RECORDING_REQUIRED",
+							"msg":  "The server is configured to record the broadcast; it can't be stopped",
+						},
+					})
+					return true
+				}
+				recorder.Stop(current)
+				if recording == current {
+					recording = nil
+				}
 
-			switch t.Type {
+				if err := signalling.WriteJSON(TypeData[RecordingStatus]{
+					Type: "RECORDING",
+					Data: RecordingStatus{},
+				}); err != nil {
+					return false
+				}
 			// We will be the one receiving offers, and responding with answers
 			case "SIGNALLING":
 				var s TypeData[json.RawMessage]
-				if err = json.Unmarshal(t.Data, &s); err != nil {
-					continue
+				if err := json.Unmarshal(t.Data, &s); err != nil {
+					return true
 				}
 
 				switch s.Type {
 				case "DESCRIPTION":
 					var d webrtc.SessionDescription
-					if err = json.Unmarshal(s.Data, &d); err != nil {
-						log.Printf("Bad JSON message? %s", err.Error())
-						continue
+					if err := json.Unmarshal(s.Data, &d); err != nil {
+						logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+						return true
 					}
 
 					if d.Type == webrtc.SDPTypeAnswer {
-						conn.WriteJSON(TypeData[map[string]any]{
+						signalling.WriteJSON(TypeData[map[string]any]{
 							Type: "CLIENT_ERROR",
 							Data: map[string]any{
 								"type": "ANSWER_RECEIVED",
 								"msg":  "Received answer from client; server can't accept answers; only offers",
 							},
 						})
-						return
+						return false
 					}
 
-					if err = peerConnection.SetRemoteDescription(d); err != nil {
-						log.Printf("Failed to set remote description: %s", err.Error())
-						conn.WriteJSON(TypeData[TypeOnly]{
+					// Better to tell the publisher up front, than to have it wonder why
+					// nothing is being received
+					unacceptable, err := findUnacceptableMedia(d)
+					if err != nil {
+						logger.Warn("Failed to parse offer", "err", err)
+						signalling.WriteJSON(TypeData[map[string]any]{
+							Type: "CLIENT_ERROR",
+							Data: map[string]any{
+								"type": "BAD_OFFER",
+								"msg":  "Failed to parse offer: " + err.Error(),
+							},
+						})
+						return true
+					}
+					if len(unacceptable) > 0 {
+						signalling.WriteJSON(TypeData[map[string]any]{
+							Type: "CLIENT_ERROR",
+							Data: map[string]any{
+								"type":  "NO_ACCEPTABLE_CODECS",
+								"msg":   "Offer has media without a single codec that the server accepts; offer rejected",
+								"media": unacceptable,
+							},
+						})
+						return true
+					}
+
+					if err := peerConnection.SetRemoteDescription(d); err != nil {
+						logger.Warn("Failed to set remote description", "err", err)
+						signalling.WriteJSON(TypeData[TypeOnly]{
 							Type: "SERVER_ERROR",
 							Data: TypeOnly{
 								Type: "SET_REMOTE_DESCRIPTION_FAILED",
 							},
 						})
-						return
+						return false
 					}
 
 					answer, err := peerConnection.CreateAnswer(nil)
 					if err != nil {
-						log.Printf("Failed to create answer: %s", err.Error())
-						conn.WriteJSON(TypeData[TypeOnly]{
+						logger.Error("Failed to create answer", "err", err)
+						signalling.WriteJSON(TypeData[TypeOnly]{
 							Type: "SERVER_ERROR",
 							Data: TypeOnly{
 								Type: "CREATE_ANSWER_FAILED",
 							},
 						})
-						continue
+						return true
 					}
-					if err = peerConnection.SetLocalDescription(answer); err != nil {
-						log.Printf("Failed to set local description: %s", err.Error())
-						conn.WriteJSON(TypeData[TypeOnly]{
+					if err := peerConnection.SetLocalDescription(answer); err != nil {
+						logger.Error("Failed to set local description", "err", err)
+						signalling.WriteJSON(TypeData[TypeOnly]{
 							Type: "SERVER_ERROR",
 							Data: TypeOnly{
 								Type: "SET_LOCAL_DESCRIPTION_FAILED",
 							},
 						})
-						continue
+						return true
 					}
 
-					if err = conn.WriteJSON(TypeData[TypeData[webrtc.SessionDescription]]{
+					if err := signalling.WriteJSON(TypeData[TypeData[webrtc.SessionDescription]]{
 						Type: "SIGNALLING",
 						Data: TypeData[webrtc.SessionDescription]{
 							Type: "DESCRIPTION",
 							Data: answer,
 						},
 					}); err != nil {
-						return
+						return false
 					}
 				case "ICE_CANDIDATE":
 					var iceCandiate webrtc.ICECandidate
-					if err = json.Unmarshal(s.Data, &iceCandiate); err != nil {
-						log.Printf("Bad JSON message? %s", err.Error())
-						continue
+					if err := json.Unmarshal(s.Data, &iceCandiate); err != nil {
+						logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+						return true
 					}
-					if err = peerConnection.AddICECandidate(iceCandiate.ToJSON()); err != nil {
-						log.Printf("Failed to add ICE candidate: %s", err.Error())
-						continue
+					if err := peerConnection.AddICECandidate(iceCandiate.ToJSON()); err != nil {
+						logger.Warn("Failed to add ICE candidate", "err", err)
+						return true
 					}
 				}
 			}
+
+			return true
+		}
+
+		session, err := sessions.Create(owner, logger, peerConnection, signalling, handleMessage)
+		if err != nil {
+			logger.Error("Failed to create session", "err", err)
+			writeServerError(signalling, err)
+			peerConnection.Close()
+			return
 		}
+		logger = session.Logger()
+
+		publisher = NewPublisher(
+			logger,
+			tracksAndConnections,
+			KeyIDString(keyID),
+			BroadcastIDString(id),
+			peerConnection,
+		)
+		session.OnClose(func() {
+			if cErr := peerConnection.Close(); cErr != nil {
+				logger.Warn("Failed to close peer connection", "err", cErr)
+			}
+		})
+		session.OnClose(func() {
+			dataRelay.RemovePublisher(KeyIDString(keyID), BroadcastIDString(id), peerConnection)
+		})
+
+		// Some broadcasts get recorded whether or not the publisher asks for it,
+		// starting with the first track. The recorder takes care of those, but the
+		// publisher still gets told.
+		var toldByRule *Recording
+		session.OnClose(tracksAndConnections.WatchTracks(
+			KeyIDString(keyID),
+			BroadcastIDString(id),
+			func(BroadcastTracks) {
+				recordingLock.Lock()
+				defer recordingLock.Unlock()
+
+				current, ok := recorder.Recording(KeyIDString(keyID), BroadcastIDString(id))
+				if !ok || !current.ByRule() || current == toldByRule {
+					return
+				}
+				toldByRule = current
+
+				signalling.WriteJSON(TypeData[RecordingStatus]{
+					Type: "RECORDING",
+					Data: current.Status(),
+				})
+			},
+		))
+		session.OnClose(func() {
+			recordingLock.Lock()
+			defer recordingLock.Unlock()
+
+			if recording != nil {
+				recorder.Stop(recording)
+			}
+		})
+
+		// Whatever the publisher sends on its data channels goes out to receivers
+		peerConnection.OnDataChannel(func(channel *webrtc.DataChannel) {
+			dataRelay.AddPublisherChannel(
+				KeyIDString(keyID),
+				BroadcastIDString(id),
+				peerConnection,
+				channel,
+			)
+		})
+
+		peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+			metrics.PeerConnectionState(s)
+
+			if s == webrtc.PeerConnectionStateClosed {
+				session.Done().Finish()
+			}
+		})
+
+		peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
+			if c == nil {
+				return
+			}
+
+			if err := signalling.WriteJSON(TypeData[TypeData[*webrtc.ICECandidate]]{
+				Type: "SIGNALLING",
+				Data: TypeData[*webrtc.ICECandidate]{
+					Type: "ICE_CANDIDATE",
+					Data: c,
+				},
+			}); err != nil {
+				session.Done().Finish()
+				return
+			}
+		})
+
+		session.Serve(conn)
 	})
 
 	router.HandleFunc("/get", func(res http.ResponseWriter, req *http.Request) {
@@ -340,6 +550,28 @@ func CreateHandlers() http.Handler {
 		//    b. If the message is an ICE candidate, add the ICE candidate
 
 		queryParams := ParseQuery(req.URL.RawQuery)
+		logger := requestLogger(req, "get")
+
+		// A receiver that lost its WebSocket connection gets to pick up where it
+		// left off. Everything it asked for is already known.
+		if token, ok := queryParams["resume"]; ok {
+			conn, err := upgrader.Upgrade(res, req, nil)
+			if err != nil {
+				logger.Warn("Failed to upgrade to WebSocket", "err", err)
+				return
+			}
+			defer conn.Close()
+
+			session, ok := sessions.Resume(token, SessionOwner{Endpoint: "get"})
+			if !ok {
+				logger.Info("No session to resume")
+				writeSessionNotFound(NewSignallingConn(conn))
+				return
+			}
+
+			session.Serve(conn)
+			return
+		}
 
 		// Get the key ID, kind, and id from the query parameters
 
@@ -357,231 +589,184 @@ func CreateHandlers() http.Handler {
 			return
 		}
 
-		kind, ok := queryParams["kind"]
-		if !ok {
+		// Either a specific track is asked for, or whichever track of the kind was
+		// published first.
+		kind := queryParams["kind"]
+		track := queryParams["track"]
+		if kind == "" && track == "" {
 			res.WriteHeader(http.StatusBadRequest)
-			res.Write([]byte("Missing kind"))
+			res.Write([]byte("Missing kind or track"))
 			return
 		}
 
+		key := TrackKey{
+			KeyID:       KeyIDString(keyID),
+			BroadcastID: BroadcastIDString(id),
+			Kind:        KindString(kind),
+			TrackID:     TrackIDString(track),
+		}
+
+		// Optional; the simulcast layer (by RID) that the client wants. Without it,
+		// one gets picked for them.
+		layer := queryParams["layer"]
+
+		// Optional; whether the client wants the broadcast's data channels
+		_, wantsData := queryParams["data"]
+
+		logger = broadcastLogger(logger, key.KeyID, key.BroadcastID)
+		if key.Kind != "" {
+			logger = logger.With("kind", key.Kind)
+		}
+		if key.TrackID != "" {
+			logger = logger.With("track", key.TrackID)
+		}
+
 		// Handle the upgrade request (assuming it was an upgrade request; fail
 		// otherwise)
 
 		conn, err := upgrader.Upgrade(res, req, nil)
 		if err != nil {
-			log.Println(err)
+			logger.Warn("Failed to upgrade to WebSocket", "err", err)
 			return
 		}
 		defer conn.Close()
+		signalling := NewSignallingConn(conn)
 
-		// Create a media engine, for codecs and stuff
-
-		m := &webrtc.MediaEngine{}
-		if err := m.RegisterDefaultCodecs(); err != nil {
-			conn.WriteJSON(TypeData[TypeOnly]{
-				Type: "SERVER_ERROR",
-				Data: TypeOnly{
-					Type: "CODEC_REGISTRATION_FAILED",
-					// TODO: add more details
-				},
-			})
+		peerConnection, allocator, err := newReceivingPeerConnection()
+		if err != nil {
+			logger.Error("Failed to create peer connection", "err", err)
+			writeServerError(signalling, err)
 			return
 		}
 
-		i := &interceptor.Registry{}
+		handleMessage := func(t TypeData[json.RawMessage]) bool {
+			switch t.Type {
+			// The receiver wants to know how it's doing
+			case "GET_STATS":
+				if err := signalling.WriteJSON(TypeData[ReceiverStats]{
+					Type: "STATS",
+					Data: allocator.Stats(),
+				}); err != nil {
+					return false
+				}
+			// The receiver wants to know what tracks the broadcast has
+			case "GET_TRACKS":
+				if err := signalling.WriteJSON(TypeData[BroadcastTracks]{
+					Type: "TRACKS",
+					Data: tracksAndConnections.Tracks(key.KeyID, key.BroadcastID),
+				}); err != nil {
+					return false
+				}
+			// Switching simulcast layers. An empty RID goes back to having a layer
+			// picked automatically.
+			case "SELECT_LAYER":
+				var rid string
+				if err := json.Unmarshal(t.Data, &rid); err != nil {
+					logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+					return true
+				}
 
-		// Use the default set of interceptors (no idea what an "interceptor" even
-		// is)
-		if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
-			conn.WriteJSON(TypeData[TypeOnly]{
-				Type: "SERVER_ERROR",
-				Data: TypeOnly{
-					Type: "INTERCEPTOR_REGISTRATION_FAILED",
-				},
-			})
-			return
+				tracksAndConnections.SelectLayer(key, peerConnection, rid)
+			case "SIGNALLING":
+				if !handleReceiverSignalling(logger, signalling, peerConnection, t.Data) {
+					return false
+				}
+			}
+
+			return true
 		}
 
-		intervalPliFactory, err := intervalpli.NewReceiverInterceptor()
+		session, err := sessions.Create(SessionOwner{Endpoint: "get"}, logger, peerConnection, signalling, handleMessage)
 		if err != nil {
-			conn.WriteJSON(TypeData[TypeOnly]{
-				Type: "SERVER_ERROR",
-				Data: TypeOnly{
-					Type: "INTERCEPTOR_CREATION_FAILED",
-				},
-			})
+			logger.Error("Failed to create session", "err", err)
+			writeServerError(signalling, err)
+			allocator.Close()
+			peerConnection.Close()
 			return
 		}
-		i.Add(intervalPliFactory)
-
-		// Create an RTCPeerConnection
-		peerConnection, err := webrtc.NewAPI(
-			webrtc.WithMediaEngine(m),
-			webrtc.WithInterceptorRegistry(i),
-		).
-			NewPeerConnection(peerConnectionConfig)
-		if err != nil {
-			conn.WriteJSON(TypeData[TypeOnly]{
-				Type: "SERVER_ERROR",
-				Data: TypeOnly{
-					Type: "PEER_CONNECTION_CREATION_FAILED",
-				},
-			})
-		}
-
-		done := finish.NewDone()
-		defer done.Finish()
-
-		peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-			if s == webrtc.PeerConnectionStateClosed {
-				done.Finish()
-			}
-		})
-
-		// Listen for negotiation needed events.
-		peerConnection.OnNegotiationNeeded(func() {
-			// TODO: I guess we will need another one of those channels to detect if
-			//   the connection failed. In this callback, we will be signalling that
-			//   the offer failed
-			offer, err := peerConnection.CreateOffer(nil)
-
-			if err != nil {
-				conn.WriteJSON(TypeData[TypeOnly]{
-					Type: "SERVER_ERROR",
-					Data: TypeOnly{
-						Type: "CREATE_OFFER_FAILED",
-					},
-				})
-				done.Finish()
-				return
-			}
-
-			if err = peerConnection.SetLocalDescription(offer); err != nil {
-				done.Finish()
-				return
-			}
-
-			if err = conn.WriteJSON(TypeData[TypeData[webrtc.SessionDescription]]{
-				Type: "SIGNALLING",
-				Data: TypeData[webrtc.SessionDescription]{
-					Type: "DESCRIPTION",
-					Data: offer,
-				},
-			}); err != nil {
-				done.Finish()
-				return
+		logger = session.Logger()
+		session.OnClose(allocator.Close)
+		session.OnClose(func() {
+			if cErr := peerConnection.Close(); cErr != nil {
+				logger.Warn("Failed to close peer connection", "err", cErr)
 			}
-
 		})
 
-		// Listen for ICE candidates
-		peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
-			if c == nil {
-				return
-			}
-
-			if err = conn.WriteJSON(TypeData[TypeData[*webrtc.ICECandidate]]{
-				Type: "SIGNALLING",
-				Data: TypeData[*webrtc.ICECandidate]{
-					Type: "ICE_CANDIDATE",
-					Data: c,
-				},
-			}); err != nil {
-				done.Finish()
-				return
-			}
-		})
+		handleReceiverNegotiation(signalling, peerConnection, session.Done(), nil)
 
-		defer func() {
-			if cErr := peerConnection.Close(); cErr != nil {
-				log.Printf("cannot close peerConnection: %v\n", cErr)
-			}
-		}()
+		// On an edge, broadcasts that aren't published here come from the origin,
+		// for as long as anyone here is receiving them
+		session.OnClose(edgeRelay.Acquire(key.KeyID, key.BroadcastID))
 
 		// Add a receiving peer connection to the list of receiving peer connections
-		tracksAndConnections.AddReceivingPeerConnection(
-			KeyIDString(keyID),
-			BroadcastIDString(id),
-			KindString(kind),
-			peerConnection,
-		)
-		defer tracksAndConnections.RemoveReceivingPeerConnection(
-			KeyIDString(keyID),
-			BroadcastIDString(id),
-			KindString(kind),
-			peerConnection,
-		)
-
-		// Loop forever, or at least until shit hits the fan.
-		for {
-			if done.IsDone() {
-				return
-			}
-
-			_, b, err := conn.ReadMessage()
-			if err != nil {
-				log.Printf(
-					"Reading message from client failed. I guess the client is closed? %s",
-					err.Error(),
-				)
-				return
-			}
+		tracksAndConnections.AddReceivingPeerConnection(key, peerConnection, allocator)
+		if layer != "" {
+			tracksAndConnections.SelectLayer(key, peerConnection, layer)
+		}
+		session.OnClose(func() {
+			tracksAndConnections.RemoveReceivingPeerConnection(key, peerConnection)
+		})
 
-			var t TypeData[json.RawMessage]
-			if err = json.Unmarshal(b, &t); err != nil {
-				continue
-			}
+		if wantsData {
+			session.OnClose(dataRelay.AddReceiver(key.KeyID, key.BroadcastID, peerConnection))
+		}
 
-			switch t.Type {
-			case "SIGNALLING":
-				var s TypeData[json.RawMessage]
-				if err = json.Unmarshal(t.Data, &s); err != nil {
-					continue
+		session.OnClose(listenForDominantSpeaker(signalling, dominantSpeakers, key.KeyID))
+
+		// Let the receiver know what else the broadcast has to offer, for as long
+		// as it's around
+		session.OnClose(tracksAndConnections.WatchTracks(
+			key.KeyID,
+			key.BroadcastID,
+			func(tracks BroadcastTracks) {
+				if err := signalling.WriteJSON(TypeData[BroadcastTracks]{
+					Type: "TRACKS",
+					Data: tracks,
+				}); err != nil {
+					session.Done().Finish()
 				}
+			},
+		))
 
-				switch s.Type {
-				case "DESCRIPTION":
-					var d webrtc.SessionDescription
-					if err = json.Unmarshal(s.Data, &d); err != nil {
-						log.Printf("Bad JSON message? %s", err.Error())
-						continue
-					}
-
-					if d.Type == webrtc.SDPTypeOffer {
-						conn.WriteJSON(TypeData[map[string]any]{
-							Type: "CLIENT_ERROR",
-							Data: map[string]any{
-								"type": "OFFER_RECEIVED",
-								"msg":  "Received offer from client; server can't accept offers; only answers",
-							},
-						})
-						return
-					}
-
-					if err = peerConnection.SetRemoteDescription(d); err != nil {
-						log.Printf("Failed to set remote description: %s", err.Error())
-						conn.WriteJSON(TypeData[TypeOnly]{
-							Type: "SERVER_ERROR",
-							Data: TypeOnly{
-								Type: "SET_REMOTE_DESCRIPTION_FAILED",
-							},
-						})
-						return
-					}
-				case "ICE_CANDIDATE":
-					var iceCandiate webrtc.ICECandidate
-					if err = json.Unmarshal(s.Data, &iceCandiate); err != nil {
-						log.Printf("Bad JSON message? %s", err.Error())
-						continue
-					}
-					if err = peerConnection.AddICECandidate(iceCandiate.ToJSON()); err != nil {
-						log.Printf("Failed to add ICE candidate: %s", err.Error())
-						continue
-					}
-				}
-			}
-		}
+		// Loop forever, or at least until shit hits the fan.
+		session.Serve(conn)
 	})
 
+	router.HandleFunc("/subscribe", createSubscribeHandler(tracksAndConnections, sessions, dominantSpeakers))
+
+	// WHIP (RFC 9725) publishing. Publishers POST their offer to /whip/{id}, and
+	// get told where their session lives, via the Location header.
+	router.HandleFunc("/whip/{id}", whipServer.HandleEndpoint)
+	router.HandleFunc("/whip/{id}/{resource}", whipServer.HandleResource)
+
+	// WHEP playback. Players POST their offer to /whep/{keyId}/{id}, with the key
+	// ID URL-escaped, since it can have slashes in it.
+	router.PathPrefix("/whep/").Handler(whepServer)
+
+	// /hls/{keyId}/{id}/index.m3u8, and everything that it points to. Key IDs
+	// need to be URL-escaped, since they can have slashes in them.
+	router.PathPrefix("/hls/").Handler(hlsPackager)
+
+	// Creating and destroying RTP egress sinks, and the SDP files that describe
+	// them
+	router.HandleFunc("/egress", rtpEgress.HandleSinks)
+	router.HandleFunc("/egress/{name}", rtpEgress.HandleSink)
+	router.HandleFunc("/egress/{name}/stream.sdp", rtpEgress.HandleSDP)
+
+	// Seeing what's going on, and kicking people out
+	router.HandleFunc("/admin/keys", adminAPI.HandleKeys)
+	router.HandleFunc("/admin/broadcasts", adminAPI.HandleBroadcasts)
+	router.HandleFunc("/admin/sessions", adminAPI.HandleSessions)
+	router.HandleFunc("/admin/sessions/{id}/close", adminAPI.HandleCloseSession)
+
+	// For Prometheus
+	router.Handle("/metrics", NewMetricsHandler(tracksAndConnections))
+
+	// For the servers that share this one's registry
+	if registryServer != nil {
+		go registryServer.Run()
+		router.PathPrefix("/registry/").Handler(registryServer)
+	}
+
 	return router
 }
@@ -0,0 +1,1051 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// How long a broadcast keeps being packaged for HLS, after the last request for
+// any of its playlists or segments
+const hlsIdleTimeout = 30 * time.Second
+
+// How many packets can be waiting to be packaged, for a single broadcast,
+// before they start getting dropped
+const hlsQueueSize = 1024
+
+// The files that make up a broadcast's HLS stream
+var (
+	hlsInitPattern    = regexp.MustCompile(`^init(\d+)\.mp4$`)
+	hlsSegmentPattern = regexp.MustCompile(`^seg(\d+)\.m4s$`)
+	hlsPartPattern    = regexp.MustCompile(`^part(\d+)\.(\d+)\.m4s$`)
+)
+
+// HLSPackager packages broadcasts up as (Low-Latency) HLS, for viewers that
+// don't do WebRTC.
+//
+// Broadcasts only get packaged while someone is watching them. The first
+// request for a broadcast's playlist gets it going, and it stops once nobody
+// has asked for anything for a while.
+type HLSPackager struct {
+	tracks TracksAndConnectionsManager
+
+	lock    *sync.Mutex
+	streams map[broadcastKey]*hlsStream
+}
+
+func NewHLSPackager(tracks TracksAndConnectionsManager) *HLSPackager {
+	return &HLSPackager{
+		tracks:  tracks,
+		lock:    &sync.Mutex{},
+		streams: map[broadcastKey]*hlsStream{},
+	}
+}
+
+// Run blocks, stopping the packaging of broadcasts that nobody's watching
+// anymore.
+func (p *HLSPackager) Run() {
+	ticker := time.NewTicker(hlsIdleTimeout / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		idle := []*hlsStream{}
+
+		p.lock.Lock()
+		for key, stream := range p.streams {
+			if stream.idle() {
+				delete(p.streams, key)
+				idle = append(idle, stream)
+			}
+		}
+		p.lock.Unlock()
+
+		for _, stream := range idle {
+			stream.stop()
+		}
+	}
+}
+
+// stream gets the HLS stream of a broadcast, starting it off if it isn't
+// already going and create is set
+func (p *HLSPackager) stream(key broadcastKey, create bool) (*hlsStream, bool) {
+	p.lock.Lock()
+	stream, ok := p.streams[key]
+	if !ok && create {
+		stream = newHLSStream(p, key)
+		p.streams[key] = stream
+	}
+	p.lock.Unlock()
+
+	if !ok && !create {
+		return nil, false
+	}
+
+	stream.touch()
+	if !ok {
+		stream.start()
+	}
+
+	return stream, true
+}
+
+// ServeHTTP serves everything under /hls/{keyId}/{id}/. Since key IDs can have
+// slashes in them, they need to be escaped.
+func (p *HLSPackager) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts, err := splitEscapedPath(req, "/hls/")
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(parts) != 3 {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	keyID, id, file := parts[0], parts[1], parts[2]
+
+	isPlaylist := file == "index.m3u8" || file == "media.m3u8"
+	stream, ok := p.stream(broadcastKey{KeyIDString(keyID), BroadcastIDString(id)}, isPlaylist)
+	if !ok {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case file == "index.m3u8":
+		stream.serveMultivariantPlaylist(res, req)
+	case file == "media.m3u8":
+		stream.serveMediaPlaylist(res, req)
+	case hlsInitPattern.MatchString(file):
+		version, _ := strconv.Atoi(hlsInitPattern.FindStringSubmatch(file)[1])
+		stream.serveInit(res, version)
+	case hlsSegmentPattern.MatchString(file):
+		msn, _ := strconv.Atoi(hlsSegmentPattern.FindStringSubmatch(file)[1])
+		stream.serveSegment(res, req, msn)
+	case hlsPartPattern.MatchString(file):
+		match := hlsPartPattern.FindStringSubmatch(file)
+		msn, _ := strconv.Atoi(match[1])
+		part, _ := strconv.Atoi(match[2])
+		stream.servePart(res, req, msn, part)
+	default:
+		res.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// hlsStream packages a single broadcast. It's fed the broadcast's first
+// published audio and video tracks, the same way that recordings are, and
+// turns them into fMP4 segments, each made up of a few partial segments.
+//
+// Only H.264 video, and Opus or AAC audio can be packaged. Everything else
+// gets ignored.
+//
+// Whenever the tracks change, a new initialization segment gets made, and the
+// playlist gets a discontinuity.
+type hlsStream struct {
+	packager    *HLSPackager
+	keyID       KeyIDString
+	broadcastID BroadcastIDString
+
+	lock *sync.Mutex
+
+	tracks map[*DownTrack]*hlsTrack
+
+	// Whether the tracks changed since the last initialization segment
+	changed bool
+
+	lastRequest time.Time
+
+	// Initialization segments, by version, as long as there are segments that
+	// need them
+	inits       map[int][]byte
+	initVersion int
+
+	// What goes in the multivariant playlist, for the latest initialization
+	// segment
+	codecs     string
+	resolution string
+
+	// The complete segments, oldest first, and the one being put together
+	segments []*hlsSegment
+	current  *hlsSegment
+
+	discontinuities int
+
+	// Closed, and replaced, whenever there's a new part or segment, or a new
+	// initialization segment
+	updated chan struct{}
+
+	packets chan hlsPacket
+	done    chan struct{}
+
+	// Only ever touched from run
+	initTracks        []*hlsTrack
+	started           time.Time
+	sequence          uint32
+	segmentStart      float64
+	partStart         float64
+	hasSegmentStart   bool
+	keyframeRequested bool
+}
+
+// hlsSegment is a single segment of an HLS stream. Its data is just the data
+// of all its parts, one after the other.
+type hlsSegment struct {
+	msn                   int
+	init                  int
+	discontinuitySequence int
+	programDateTime       time.Time
+	parts                 []*hlsPart
+	duration              float64
+	complete              bool
+}
+
+type hlsPart struct {
+	data        []byte
+	duration    float64
+	independent bool
+}
+
+func (s *hlsSegment) size() int {
+	size := 0
+	for _, part := range s.parts {
+		size += len(part.data)
+	}
+	return size
+}
+
+type hlsTrack struct {
+	downTrack *DownTrack
+	codec     webrtc.RTPCodecCapability
+	video     bool
+	assembler *frameAssembler
+
+	// Only ever touched from run
+
+	// Where the track is in the latest initialization segment. Nil if it isn't.
+	fmp4 *fmp4Track
+
+	// The latest H.264 parameter sets
+	sps []byte
+	pps []byte
+
+	// Where the track's timestamps start from
+	hasBase bool
+	baseTS  uint32
+	baseDTS uint64
+	lastDTS uint64
+
+	// The latest frame, which can only go in a part once the next one comes
+	// along, since that's how long it is
+	pending      *hlsSample
+	lastDuration uint32
+
+	// The frames that go in the next part
+	samples    []fmp4Sample
+	samplesDTS uint64
+}
+
+type hlsSample struct {
+	data     []byte
+	dts      uint64
+	keyframe bool
+}
+
+type hlsPacket struct {
+	track  *hlsTrack
+	packet *rtp.Packet
+}
+
+// hlsTrackWriter hands packets over from a DownTrack to the hlsStream
+type hlsTrackWriter struct {
+	track   *hlsTrack
+	packets chan<- hlsPacket
+}
+
+func (w hlsTrackWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	select {
+	case w.packets <- hlsPacket{w.track, &rtp.Packet{Header: *header, Payload: payload}}:
+	default:
+	}
+	return len(payload), nil
+}
+
+func (w hlsTrackWriter) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&packet.Header, packet.Payload)
+}
+
+func newHLSStream(packager *HLSPackager, key broadcastKey) *hlsStream {
+	return &hlsStream{
+		packager:    packager,
+		keyID:       key.keyID,
+		broadcastID: key.broadcastID,
+		lock:        &sync.Mutex{},
+		tracks:      map[*DownTrack]*hlsTrack{},
+		lastRequest: time.Now(),
+		inits:       map[int][]byte{},
+		updated:     make(chan struct{}),
+		packets:     make(chan hlsPacket, hlsQueueSize),
+		done:        make(chan struct{}),
+	}
+}
+
+func (s *hlsStream) start() {
+	go s.run()
+	for _, kind := range []KindString{"video", "audio"} {
+		s.packager.tracks.AddSink(TrackKey{s.keyID, s.broadcastID, kind, ""}, s)
+	}
+}
+
+func (s *hlsStream) stop() {
+	s.packager.tracks.RemoveSink(s)
+	close(s.done)
+}
+
+func (s *hlsStream) touch() {
+	s.lock.Lock()
+	s.lastRequest = time.Now()
+	s.lock.Unlock()
+}
+
+func (s *hlsStream) idle() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Since(s.lastRequest) > hlsIdleTimeout
+}
+
+// AddDownTrack is part of TrackSink
+func (s *hlsStream) AddDownTrack(key TrackKey, downTrack *DownTrack) webrtc.TrackLocalWriter {
+	codec := downTrack.Track().Codec()
+	mimeType := strings.ToLower(codec.MimeType)
+
+	supported := mimeType == strings.ToLower(webrtc.MimeTypeH264) ||
+		mimeType == strings.ToLower(webrtc.MimeTypeOpus) ||
+		(mimeType == mimeTypeAAC && len(aacConfig(codec)) > 0)
+	if !supported {
+		slog.Info(
+			"Not packaging track for HLS, since the codec isn't supported",
+			"component", "hls",
+			"keyId", s.keyID,
+			"broadcastId", s.broadcastID,
+			"kind", downTrack.Kind().String(),
+			"codec", codec.MimeType,
+		)
+		return discardWriter{}
+	}
+
+	track := &hlsTrack{
+		downTrack: downTrack,
+		codec:     codec,
+		video:     downTrack.Kind() == webrtc.RTPCodecTypeVideo,
+	}
+	track.assembler = newFrameAssembler(codec, func(frame mediaFrame) {
+		s.writeFrame(track, frame)
+	}, downTrack.RequestKeyframe)
+
+	s.lock.Lock()
+	s.tracks[downTrack] = track
+	s.changed = true
+	s.lock.Unlock()
+
+	return hlsTrackWriter{track, s.packets}
+}
+
+// RemoveDownTrack is part of TrackSink
+func (s *hlsStream) RemoveDownTrack(key TrackKey, downTrack *DownTrack) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.tracks[downTrack]; ok {
+		delete(s.tracks, downTrack)
+		s.changed = true
+	}
+}
+
+// run blocks, packaging packets until the stream is stopped
+func (s *hlsStream) run() {
+	for {
+		select {
+		case p := <-s.packets:
+			p.track.assembler.push(p.packet)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// notify wakes up everything that's waiting on the stream.
+//
+// NOT THREAD SAFE! Only call this while holding the lock
+func (s *hlsStream) notify() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// writeFrame adds a frame of one of the tracks to the stream, cutting off a
+// part, or a segment, first, if it's time to.
+func (s *hlsStream) writeFrame(track *hlsTrack, frame mediaFrame) {
+	s.lock.Lock()
+	if _, ok := s.tracks[track.downTrack]; !ok {
+		s.lock.Unlock()
+		return
+	}
+	changed := s.changed
+	tracks := []*hlsTrack{}
+	for _, t := range s.tracks {
+		tracks = append(tracks, t)
+	}
+	s.lock.Unlock()
+
+	data := frame.data
+	if track.video {
+		data = track.stripParameterSets(data)
+
+		// New parameter sets need a new initialization segment
+		if track.fmp4 != nil && (!bytes.Equal(track.sps, track.fmp4.sps) || !bytes.Equal(track.pps, track.fmp4.pps)) {
+			changed = true
+		}
+	}
+
+	hasVideo := false
+	for _, t := range tracks {
+		if t.video {
+			hasVideo = true
+		}
+	}
+
+	if s.initTracks == nil || changed {
+		// Like with recordings, everything starts off with a video keyframe,
+		// unless there is no video
+		canStart := (track.video && frame.keyframe && track.sps != nil && track.pps != nil) ||
+			(!track.video && !hasVideo)
+		if canStart {
+			s.restart(tracks)
+		} else if hasVideo {
+			for _, t := range tracks {
+				if t.video {
+					t.downTrack.RequestKeyframe()
+				}
+			}
+		}
+	}
+
+	if track.fmp4 == nil || len(data) == 0 {
+		return
+	}
+
+	first := !track.hasBase
+	if first {
+		track.baseTS = frame.timestamp
+		track.baseDTS = uint64(time.Since(s.started).Seconds() * float64(track.fmp4.timescale))
+		track.hasBase = true
+	}
+	dts := track.baseDTS + uint64(int64(int32(frame.timestamp-track.baseTS)))
+	if !first && dts <= track.lastDTS {
+		dts = track.lastDTS + 1
+	}
+	track.lastDTS = dts
+
+	track.add(hlsSample{data: data, dts: dts, keyframe: frame.keyframe})
+
+	// The first track (video, if there is any) decides when parts and segments
+	// get cut off
+	if track != s.initTracks[0] {
+		return
+	}
+
+	now := float64(dts) / float64(track.fmp4.timescale)
+	if !s.hasSegmentStart {
+		s.startSegment(now)
+		return
+	}
+
+	segmentTarget := config.HLSSegmentDuration().Seconds()
+	partTarget := config.HLSPartDuration().Seconds()
+	frameDuration := float64(track.lastDuration) / float64(track.fmp4.timescale)
+
+	segmentElapsed := now - s.segmentStart
+	partElapsed := now - s.partStart
+
+	// Publishers that don't send keyframes when asked still get segments, just
+	// ones that can't be started from
+	if (frame.keyframe && segmentElapsed >= segmentTarget) ||
+		segmentElapsed+partTarget >= float64(hlsTargetDuration()) {
+		s.cutPart()
+		s.cutSegment()
+		s.startSegment(now)
+		return
+	}
+
+	if partElapsed+frameDuration > partTarget {
+		s.cutPart()
+		s.partStart = now
+	}
+
+	if track.video && !s.keyframeRequested && segmentElapsed >= segmentTarget*0.8 {
+		track.downTrack.RequestKeyframe()
+		s.keyframeRequested = true
+	}
+}
+
+// startSegment marks when the segment being put together starts, in seconds,
+// as far as the first track is concerned
+func (s *hlsStream) startSegment(now float64) {
+	s.segmentStart = now
+	s.partStart = now
+	s.hasSegmentStart = true
+	s.keyframeRequested = false
+
+	s.lock.Lock()
+	s.current.programDateTime = s.started.Add(time.Duration(now * float64(time.Second)))
+	s.lock.Unlock()
+}
+
+// restart finishes off whatever was being put together, and starts off a new
+// initialization segment, for the given tracks
+func (s *hlsStream) restart(tracks []*hlsTrack) {
+	if s.initTracks != nil {
+		// Whatever frames are left over get the same duration as the ones
+		// before them
+		for _, t := range s.initTracks {
+			if t.pending != nil {
+				duration := t.lastDuration
+				if duration == 0 {
+					duration = t.fmp4.timescale / 50
+				}
+				t.finish(duration)
+			}
+		}
+		s.cutPart()
+		s.cutSegment()
+	} else {
+		s.started = time.Now()
+	}
+
+	for _, t := range s.initTracks {
+		t.fmp4 = nil
+		t.samples = nil
+	}
+	s.initTracks = nil
+	s.hasSegmentStart = false
+
+	// Video first, for whatever players that care
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return tracks[i].video && !tracks[j].video
+	})
+
+	described := []*fmp4Track{}
+	codecs := []string{}
+	resolution := ""
+	for _, t := range tracks {
+		if t.video && (t.sps == nil || t.pps == nil) {
+			continue
+		}
+
+		t.fmp4 = &fmp4Track{
+			id:        uint32(len(described) + 1),
+			video:     t.video,
+			codec:     t.codec,
+			timescale: t.codec.ClockRate,
+		}
+		if t.video {
+			t.fmp4.sps = t.sps
+			t.fmp4.pps = t.pps
+			t.fmp4.width, t.fmp4.height, _ = h264Dimensions(t.sps)
+			if t.fmp4.width > 0 && t.fmp4.height > 0 {
+				resolution = fmt.Sprintf("%dx%d", t.fmp4.width, t.fmp4.height)
+			}
+		}
+		t.pending = nil
+
+		described = append(described, t.fmp4)
+		codecs = append(codecs, t.fmp4.codecString())
+		s.initTracks = append(s.initTracks, t)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.changed = false
+	s.initVersion++
+	s.inits[s.initVersion] = fmp4InitSegment(described)
+	s.codecs = strings.Join(codecs, ",")
+	s.resolution = resolution
+
+	msn := 0
+	if s.current != nil {
+		msn = s.current.msn
+		if len(s.current.parts) > 0 {
+			msn++
+		}
+	}
+	if len(s.segments) > 0 {
+		s.discontinuities++
+	}
+	s.current = &hlsSegment{
+		msn:                   msn,
+		init:                  s.initVersion,
+		discontinuitySequence: s.discontinuities,
+		programDateTime:       time.Now(),
+	}
+
+	s.notify()
+}
+
+// cutPart puts together a part out of whatever frames have come in since the
+// last one
+func (s *hlsStream) cutPart() {
+	if len(s.initTracks) == 0 || len(s.initTracks[0].samples) == 0 {
+		return
+	}
+
+	main := s.initTracks[0]
+	duration := uint64(0)
+	for _, sample := range main.samples {
+		duration += uint64(sample.duration)
+	}
+	independent := main.samples[0].keyframe || !main.video
+
+	fragments := []fmp4TrackFragment{}
+	for _, t := range s.initTracks {
+		if len(t.samples) == 0 {
+			continue
+		}
+		fragments = append(fragments, fmp4TrackFragment{
+			trackID:        t.fmp4.id,
+			baseDecodeTime: t.samplesDTS,
+			samples:        t.samples,
+		})
+		t.samples = nil
+	}
+
+	s.sequence++
+	part := &hlsPart{
+		data:        fmp4Fragment(s.sequence, fragments),
+		duration:    float64(duration) / float64(main.fmp4.timescale),
+		independent: independent,
+	}
+
+	s.lock.Lock()
+	s.current.parts = append(s.current.parts, part)
+	s.current.duration += part.duration
+	s.notify()
+	s.lock.Unlock()
+}
+
+// cutSegment finishes off the segment being put together, and starts off the
+// next one, dropping whatever segments no longer fit in the playlist
+func (s *hlsStream) cutSegment() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.current.parts) == 0 {
+		return
+	}
+
+	s.current.complete = true
+	s.segments = append(s.segments, s.current)
+	s.current = &hlsSegment{
+		msn:                   s.current.msn + 1,
+		init:                  s.initVersion,
+		discontinuitySequence: s.discontinuities,
+		programDateTime:       time.Now(),
+	}
+
+	if len(s.segments) > config.HLSPlaylistSegments() {
+		s.segments = s.segments[len(s.segments)-config.HLSPlaylistSegments():]
+	}
+
+	// Initialization segments that nothing needs anymore
+	needed := map[int]bool{s.current.init: true}
+	for _, segment := range s.segments {
+		needed[segment.init] = true
+	}
+	for version := range s.inits {
+		if !needed[version] {
+			delete(s.inits, version)
+		}
+	}
+
+	s.notify()
+}
+
+// stripParameterSets takes the SPS and PPS out of an H.264 frame (along with
+// any access unit delimiters), since those go in the initialization segment
+// instead.
+func (t *hlsTrack) stripParameterSets(frame []byte) []byte {
+	stripped := make([]byte, 0, len(frame))
+	for _, unit := range h264NALUnits(frame) {
+		if len(unit) == 0 {
+			continue
+		}
+		switch unit[0] & 0x1F {
+		case 7:
+			t.sps = append([]byte{}, unit...)
+		case 8:
+			t.pps = append([]byte{}, unit...)
+		case 9:
+		default:
+			stripped = append(stripped, u32(uint32(len(unit)))...)
+			stripped = append(stripped, unit...)
+		}
+	}
+	return stripped
+}
+
+// add holds on to a frame, until the next one comes along
+func (t *hlsTrack) add(sample hlsSample) {
+	if t.pending != nil {
+		t.finish(uint32(sample.dts - t.pending.dts))
+	}
+	t.pending = &sample
+}
+
+// finish puts the pending frame in the next part
+func (t *hlsTrack) finish(duration uint32) {
+	if len(t.samples) == 0 {
+		t.samplesDTS = t.pending.dts
+	}
+	t.samples = append(t.samples, fmp4Sample{
+		data:     t.pending.data,
+		duration: duration,
+		keyframe: t.pending.keyframe,
+	})
+	t.lastDuration = duration
+	t.pending = nil
+}
+
+// hlsTargetDuration is the most that any segment can be, in whole seconds.
+// Segments wait on keyframes, so a bit of room is left for that.
+func hlsTargetDuration() int {
+	return int(math.Ceil(config.HLSSegmentDuration().Seconds() * 1.5))
+}
+
+// hlsBlockingTimeout is how long a request can wait on something that isn't
+// there yet
+func hlsBlockingTimeout() time.Duration {
+	return 3 * time.Duration(hlsTargetDuration()) * time.Second
+}
+
+// wait blocks until ready says so, or until it's waited too long. ready is
+// called while holding the lock.
+func (s *hlsStream) wait(req *http.Request, ready func() bool) bool {
+	timeout := time.NewTimer(hlsBlockingTimeout())
+	defer timeout.Stop()
+
+	for {
+		s.lock.Lock()
+		if ready() {
+			s.lock.Unlock()
+			return true
+		}
+		updated := s.updated
+		s.lock.Unlock()
+
+		select {
+		case <-updated:
+		case <-timeout.C:
+			return false
+		case <-req.Context().Done():
+			return false
+		}
+	}
+}
+
+// segment finds a segment by its media sequence number, complete or not.
+//
+// NOT THREAD SAFE! Only call this while holding the lock
+func (s *hlsStream) segment(msn int) (*hlsSegment, bool) {
+	if s.current != nil && s.current.msn == msn {
+		return s.current, true
+	}
+	for _, segment := range s.segments {
+		if segment.msn == msn {
+			return segment, true
+		}
+	}
+	return nil, false
+}
+
+// hasPart tells whether the given part is out yet. A part of -1 is for the
+// whole segment.
+//
+// NOT THREAD SAFE! Only call this while holding the lock
+func (s *hlsStream) hasPart(msn int, part int) bool {
+	if s.current == nil {
+		return false
+	}
+	if msn < s.current.msn {
+		return true
+	}
+	return msn == s.current.msn && part >= 0 && part < len(s.current.parts)
+}
+
+func (s *hlsStream) serveMultivariantPlaylist(res http.ResponseWriter, req *http.Request) {
+	if !s.wait(req, func() bool { return s.initVersion > 0 }) {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	s.lock.Lock()
+	bandwidth := 0
+	for _, segment := range s.segments {
+		if segment.duration > 0 {
+			bits := int(float64(segment.size()*8) / segment.duration)
+			if bits > bandwidth {
+				bandwidth = bits
+			}
+		}
+	}
+	if bandwidth == 0 {
+		bandwidth = config.InitialBitrate()
+	}
+
+	attributes := fmt.Sprintf("BANDWIDTH=%d,CODECS=%q", bandwidth, s.codecs)
+	if s.resolution != "" {
+		attributes += ",RESOLUTION=" + s.resolution
+	}
+	s.lock.Unlock()
+
+	playlist := &strings.Builder{}
+	fmt.Fprintln(playlist, "#EXTM3U")
+	fmt.Fprintln(playlist, "#EXT-X-VERSION:9")
+	fmt.Fprintf(playlist, "#EXT-X-STREAM-INF:%s\n", attributes)
+	fmt.Fprintln(playlist, "media.m3u8")
+
+	res.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Write([]byte(playlist.String()))
+}
+
+// serveMediaPlaylist serves the playlist of segments and parts. Clients can
+// ask to wait until a particular part is out, via the _HLS_msn and _HLS_part
+// query parameters.
+func (s *hlsStream) serveMediaPlaylist(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	msn, part := -1, -1
+	if value := query.Get("_HLS_msn"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		msn = n
+	}
+	if value := query.Get("_HLS_part"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || msn < 0 {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		part = n
+	}
+
+	s.lock.Lock()
+	tooFar := s.current != nil && msn > s.current.msn+2
+	s.lock.Unlock()
+	if tooFar {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ready := func() bool {
+		if msn >= 0 {
+			return s.hasPart(msn, part)
+		}
+		return s.current != nil && (len(s.segments) > 0 || len(s.current.parts) > 0)
+	}
+	if !s.wait(req, ready) {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	s.lock.Lock()
+	playlist := s.mediaPlaylist()
+	s.lock.Unlock()
+
+	res.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Write([]byte(playlist))
+}
+
+// mediaPlaylist writes out the playlist of segments and parts.
+//
+// NOT THREAD SAFE! Only call this while holding the lock
+func (s *hlsStream) mediaPlaylist() string {
+	targetDuration := hlsTargetDuration()
+	partTarget := config.HLSPartDuration().Seconds()
+
+	segments := append(append([]*hlsSegment{}, s.segments...), s.current)
+
+	// Parts are only listed for the last few target durations' worth of
+	// segments
+	listParts := len(segments) - 1
+	for elapsed := 0.0; listParts > 0 && elapsed < float64(3*targetDuration); {
+		listParts--
+		elapsed += segments[listParts].duration
+	}
+
+	playlist := &strings.Builder{}
+	fmt.Fprintln(playlist, "#EXTM3U")
+	fmt.Fprintln(playlist, "#EXT-X-VERSION:9")
+	fmt.Fprintf(playlist, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(playlist, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	fmt.Fprintf(playlist, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+	fmt.Fprintf(playlist, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].msn)
+	fmt.Fprintf(playlist, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", segments[0].discontinuitySequence)
+
+	for i, segment := range segments {
+		if i == 0 || segment.init != segments[i-1].init {
+			if i > 0 {
+				fmt.Fprintln(playlist, "#EXT-X-DISCONTINUITY")
+			}
+			fmt.Fprintf(playlist, "#EXT-X-MAP:URI=\"init%d.mp4\"\n", segment.init)
+		}
+
+		if len(segment.parts) > 0 {
+			fmt.Fprintf(playlist, "#EXT-X-PROGRAM-DATE-TIME:%s\n", segment.programDateTime.UTC().Format("2006-01-02T15:04:05.000Z"))
+		}
+
+		if i >= listParts {
+			for j, part := range segment.parts {
+				independent := ""
+				if part.independent {
+					independent = ",INDEPENDENT=YES"
+				}
+				fmt.Fprintf(
+					playlist,
+					"#EXT-X-PART:DURATION=%.5f,URI=\"part%d.%d.m4s\"%s\n",
+					part.duration,
+					segment.msn,
+					j,
+					independent,
+				)
+			}
+		}
+
+		if segment.complete {
+			fmt.Fprintf(playlist, "#EXTINF:%.5f,\n", segment.duration)
+			fmt.Fprintf(playlist, "seg%d.m4s\n", segment.msn)
+		}
+	}
+
+	fmt.Fprintf(playlist, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s\"\n", s.current.msn, len(s.current.parts))
+
+	return playlist.String()
+}
+
+func (s *hlsStream) serveInit(res http.ResponseWriter, version int) {
+	s.lock.Lock()
+	init, ok := s.inits[version]
+	s.lock.Unlock()
+
+	if !ok {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "video/mp4")
+	res.Write(init)
+}
+
+// serveSegment serves a complete segment, waiting for it to be completed if
+// it's the one being put together
+func (s *hlsStream) serveSegment(res http.ResponseWriter, req *http.Request, msn int) {
+	s.lock.Lock()
+	_, ok := s.segment(msn)
+	s.lock.Unlock()
+	if !ok {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var data []byte
+	found := s.wait(req, func() bool {
+		segment, ok := s.segment(msn)
+		if !ok {
+			// Gone, somehow
+			return true
+		}
+		if !segment.complete {
+			return false
+		}
+		for _, part := range segment.parts {
+			data = append(data, part.data...)
+		}
+		return true
+	})
+	if !found {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if data == nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "video/mp4")
+	res.Write(data)
+}
+
+// servePart serves a part. The part that the playlist hints at next gets
+// waited on.
+func (s *hlsStream) servePart(res http.ResponseWriter, req *http.Request, msn int, index int) {
+	s.lock.Lock()
+	hinted := s.current != nil &&
+		((msn == s.current.msn && index >= len(s.current.parts)) || (msn == s.current.msn+1 && index == 0))
+	s.lock.Unlock()
+
+	var part *hlsPart
+	find := func() bool {
+		segment, ok := s.segment(msn)
+		if ok && index < len(segment.parts) {
+			part = segment.parts[index]
+			return true
+		}
+		// A segment can get cut off before the hinted part comes out, in which
+		// case the part won't ever come out
+		return s.current != nil && (msn < s.current.msn || (ok && segment.complete))
+	}
+
+	if hinted {
+		if !s.wait(req, find) {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	} else {
+		s.lock.Lock()
+		find()
+		s.lock.Unlock()
+	}
+
+	if part == nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "video/mp4")
+	res.Write(part.data)
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+)
+
+const (
+	// How long an entry lasts on the registry server, without the server that
+	// published it publishing it again. Servers that go away without
+	// unpublishing anything get forgotten after this long.
+	registryLeaseDuration = 15 * time.Second
+
+	// How often servers publish their entries again
+	registryRefreshInterval = 5 * time.Second
+
+	// How long a watcher's request waits for the entries to change, before it's
+	// told that nothing did
+	registryLongPollTimeout = 30 * time.Second
+
+	registryRequestTimeout = 5 * time.Second
+
+	// How long to wait before watching again, after failing to
+	registryRetryInterval = time.Second
+
+	registryMaxBodySize = 64 * 1024
+)
+
+// newRegistry picks the registry that this server uses: the one that it serves
+// to the others, the one that another server serves, or else one that it keeps
+// to itself. The server is nil unless this is the one serving the registry.
+func newRegistry() (Registry, *RegistryServer) {
+	if config.IsRegistryServer() {
+		server := NewRegistryServer(config.RegistryToken())
+		return server.registry, server
+	}
+
+	if u := config.RegistryURL(); u != nil {
+		registry := NewHTTPRegistry(u, config.RegistryToken())
+		go registry.Run()
+		return registry, nil
+	}
+
+	return NewMemoryRegistry(), nil
+}
+
+// registryLeaseKey identifies a single entry, out of every entry in the
+// registry
+type registryLeaseKey struct {
+	keyID       KeyIDString
+	broadcastID BroadcastIDString
+	entry       registryEntryKey
+}
+
+func leaseKeyOf(entry RegistryEntry) registryLeaseKey {
+	return registryLeaseKey{
+		keyID:       entry.KeyID,
+		broadcastID: entry.BroadcastID,
+		entry:       registryEntryKey{entry.Kind, entry.Node.ID},
+	}
+}
+
+// registryEntryPath is the path of an entry on the registry server, or, with
+// just the key ID and the broadcast ID, the path of the broadcast's entries.
+// Every part is escaped, since key IDs can have slashes in them.
+func registryEntryPath(parts ...string) string {
+	escaped := []string{}
+	for _, part := range parts {
+		escaped = append(escaped, url.PathEscape(part))
+	}
+	return "/registry/" + strings.Join(escaped, "/")
+}
+
+// registryETag tells apart one list of entries from another
+func registryETag(entries []RegistryEntry) string {
+	b, _ := json.Marshal(entries)
+	sum := sha1.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// RegistryServer serves a registry over HTTP, for servers to share, with
+// HTTPRegistry. It's a stand-in for something sturdier: everything is kept in
+// memory, so if it goes down, so does everyone's idea of where broadcasts live
+// (until it's back up, and everyone's published everything again).
+//
+//   - PUT /registry/{keyId}/{id}/{kind}/{nodeId}, with the node as the body,
+//     publishes an entry, for registryLeaseDuration
+//   - DELETE /registry/{keyId}/{id}/{kind}/{nodeId} unpublishes it
+//   - GET /registry/{keyId}/{id} looks up a broadcast's entries. With ?wait, and
+//     an If-None-Match header, it waits for them to be anything other than that.
+//
+// Every part of the path is escaped. If there's a token, every request has to
+// come with it, as a bearer token.
+type RegistryServer struct {
+	registry *MemoryRegistry
+	token    string
+
+	// How long a watcher's request waits for the entries to change
+	longPollTimeout time.Duration
+
+	// Held while publishing and unpublishing too, so that the registry always
+	// agrees with the leases
+	lock   *sync.Mutex
+	leases map[registryLeaseKey]registryLease
+}
+
+type registryLease struct {
+	entry   RegistryEntry
+	expires time.Time
+}
+
+func NewRegistryServer(token string) *RegistryServer {
+	return &RegistryServer{
+		registry:        NewMemoryRegistry(),
+		token:           token,
+		longPollTimeout: registryLongPollTimeout,
+		lock:            &sync.Mutex{},
+		leases:          map[registryLeaseKey]registryLease{},
+	}
+}
+
+// Run forgets about entries whose leases ran out, forever
+func (s *RegistryServer) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.lock.Lock()
+		for key, lease := range s.leases {
+			if now.Before(lease.expires) {
+				continue
+			}
+
+			slog.Info(
+				"Node stopped renewing its lease; forgetting about it",
+				"component", "registry",
+				"node", lease.entry.Node.ID,
+				"keyId", lease.entry.KeyID,
+				"broadcastId", lease.entry.BroadcastID,
+				"kind", lease.entry.Kind,
+			)
+			delete(s.leases, key)
+			s.registry.Unpublish(lease.entry)
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *RegistryServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if s.token != "" {
+		given, _ := bearerToken(req)
+		if subtle.ConstantTimeCompare([]byte(s.token), []byte(given)) != 1 {
+			http.Error(res, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	parts, err := splitEscapedPath(req, "/registry/")
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch len(parts) {
+	case 2:
+		s.handleBroadcast(res, req, KeyIDString(parts[0]), BroadcastIDString(parts[1]))
+	case 4:
+		s.handleEntry(res, req, RegistryEntry{
+			KeyID:       KeyIDString(parts[0]),
+			BroadcastID: BroadcastIDString(parts[1]),
+			Kind:        KindString(parts[2]),
+			Node:        RegistryNode{ID: parts[3]},
+		})
+	default:
+		res.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *RegistryServer) handleBroadcast(
+	res http.ResponseWriter,
+	req *http.Request,
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+) {
+	if req.Method != http.MethodGet {
+		res.Header().Set("Allow", "GET")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, wait := req.URL.Query()["wait"]
+	known := req.Header.Get("If-None-Match")
+
+	// The buffer is only there so that the watcher doesn't hold anything up.
+	// Anything dropped is caught by the next request.
+	updates := make(chan []RegistryEntry, 16)
+	unwatch := s.registry.Watch(keyID, broadcastID, func(entries []RegistryEntry) {
+		select {
+		case updates <- entries:
+		default:
+		}
+	})
+	defer unwatch()
+
+	timeout := time.NewTimer(s.longPollTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case entries := <-updates:
+			etag := registryETag(entries)
+			if wait && etag == known {
+				continue
+			}
+			if etag == known {
+				res.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			res.Header().Set("Content-Type", "application/json")
+			res.Header().Set("ETag", etag)
+			json.NewEncoder(res).Encode(entries)
+			return
+		case <-timeout.C:
+			res.WriteHeader(http.StatusNotModified)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *RegistryServer) handleEntry(res http.ResponseWriter, req *http.Request, entry RegistryEntry) {
+	if entry.Kind != "audio" && entry.Kind != "video" {
+		http.Error(res, "The kind has to be either audio or video", http.StatusBadRequest)
+		return
+	}
+
+	key := leaseKeyOf(entry)
+
+	switch req.Method {
+	case http.MethodPut:
+		var node RegistryNode
+		if err := json.NewDecoder(io.LimitReader(req.Body, registryMaxBodySize)).Decode(&node); err != nil {
+			http.Error(res, "Bad node: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if node.ID != entry.Node.ID {
+			http.Error(res, "The node's ID has to match the path", http.StatusBadRequest)
+			return
+		}
+		entry.Node = node
+
+		s.lock.Lock()
+		s.leases[key] = registryLease{entry, time.Now().Add(registryLeaseDuration)}
+		s.registry.Publish(entry)
+		s.lock.Unlock()
+	case http.MethodDelete:
+		s.lock.Lock()
+		if lease, ok := s.leases[key]; ok {
+			delete(s.leases, key)
+			s.registry.Unpublish(lease.entry)
+		}
+		s.lock.Unlock()
+	default:
+		res.Header().Set("Allow", "PUT, DELETE")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// HTTPRegistry is a registry shared with other servers, through a
+// RegistryServer.
+//
+// Publishing and unpublishing never wait on the registry server. Instead,
+// they're sent in the background, and tried again, until the registry server
+// gets them. Everything that's published gets published again every so often,
+// so that the registry server knows that this server is still around.
+type HTTPRegistry struct {
+	url    *url.URL
+	token  string
+	client *http.Client
+
+	lock *sync.Mutex
+
+	// Whatever should be on the registry server
+	published map[registryLeaseKey]RegistryEntry
+
+	// Whatever shouldn't be on the registry server anymore, but might still be
+	unpublished map[registryLeaseKey]RegistryEntry
+
+	// Entries that the registry server hasn't been told about yet
+	pending Set[registryLeaseKey]
+
+	wake chan struct{}
+}
+
+func NewHTTPRegistry(u *url.URL, token string) *HTTPRegistry {
+	return &HTTPRegistry{
+		url:         u,
+		token:       token,
+		client:      &http.Client{},
+		lock:        &sync.Mutex{},
+		published:   map[registryLeaseKey]RegistryEntry{},
+		unpublished: map[registryLeaseKey]RegistryEntry{},
+		pending:     Set[registryLeaseKey]{},
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Run keeps the registry server up to date, forever
+func (r *HTTPRegistry) Run() {
+	ticker := time.NewTicker(registryRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.lock.Lock()
+			for key := range r.published {
+				r.pending.Add(key)
+			}
+			for key := range r.unpublished {
+				r.pending.Add(key)
+			}
+			r.lock.Unlock()
+		case <-r.wake:
+		}
+
+		r.sync()
+	}
+}
+
+// sync tells the registry server about every pending entry. Whatever fails
+// stays pending.
+func (r *HTTPRegistry) sync() {
+	r.lock.Lock()
+	pending := r.pending
+	r.pending = Set[registryLeaseKey]{}
+	r.lock.Unlock()
+
+	for key := range pending {
+		r.lock.Lock()
+		entry, isPublished := r.published[key]
+		if !isPublished {
+			entry = r.unpublished[key]
+		}
+		r.lock.Unlock()
+
+		path := registryEntryPath(
+			string(entry.KeyID),
+			string(entry.BroadcastID),
+			string(entry.Kind),
+			entry.Node.ID,
+		)
+
+		var err error
+		if isPublished {
+			body, _ := json.Marshal(entry.Node)
+			err = r.do(http.MethodPut, path, body)
+		} else {
+			err = r.do(http.MethodDelete, path, nil)
+		}
+
+		r.lock.Lock()
+		if err != nil {
+			slog.Warn(
+				"Failed to update the registry",
+				"component", "registry",
+				"keyId", entry.KeyID,
+				"broadcastId", entry.BroadcastID,
+				"kind", entry.Kind,
+				"err", err,
+			)
+			r.pending.Add(key)
+		} else if !isPublished && r.unpublished[key] == entry {
+			delete(r.unpublished, key)
+		}
+		r.lock.Unlock()
+	}
+}
+
+func (r *HTTPRegistry) do(method, path string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), registryRequestTimeout)
+	defer cancel()
+
+	req, err := r.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("the registry responded with %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (r *HTTPRegistry) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	// The path is already escaped
+	u := *r.url
+	u.RawQuery = ""
+	target := strings.TrimSuffix(u.String(), "/") + path
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	return req, nil
+}
+
+func (r *HTTPRegistry) Publish(entry RegistryEntry) error {
+	key := leaseKeyOf(entry)
+
+	r.lock.Lock()
+	if current, ok := r.published[key]; ok && current == entry {
+		r.lock.Unlock()
+		return nil
+	}
+	r.published[key] = entry
+	delete(r.unpublished, key)
+	r.pending.Add(key)
+	r.lock.Unlock()
+
+	r.poke()
+	return nil
+}
+
+func (r *HTTPRegistry) Unpublish(entry RegistryEntry) error {
+	key := leaseKeyOf(entry)
+
+	r.lock.Lock()
+	if _, ok := r.published[key]; !ok {
+		r.lock.Unlock()
+		return nil
+	}
+	delete(r.published, key)
+	r.unpublished[key] = entry
+	r.pending.Add(key)
+	r.lock.Unlock()
+
+	r.poke()
+	return nil
+}
+
+// poke has whatever is pending sent right away
+func (r *HTTPRegistry) poke() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *HTTPRegistry) Lookup(
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+) ([]RegistryEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryRequestTimeout)
+	defer cancel()
+
+	entries, _, err := r.get(ctx, keyID, broadcastID, "")
+	return entries, err
+}
+
+// get gets a broadcast's entries. With an ETag, it waits for the entries to
+// change, and returns nil entries if they didn't.
+func (r *HTTPRegistry) get(
+	ctx context.Context,
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+	etag string,
+) ([]RegistryEntry, string, error) {
+	path := registryEntryPath(string(keyID), string(broadcastID))
+	if etag != "" {
+		path += "?wait"
+	}
+
+	req, err := r.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, etag, nil
+	default:
+		return nil, "", fmt.Errorf("the registry responded with %d", res.StatusCode)
+	}
+
+	entries := []RegistryEntry{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, registryMaxBodySize)).Decode(&entries); err != nil {
+		return nil, "", err
+	}
+	return entries, res.Header.Get("ETag"), nil
+}
+
+func (r *HTTPRegistry) Watch(
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+	callback func([]RegistryEntry),
+) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		etag := ""
+		for {
+			requestCtx, cancelRequest := context.WithTimeout(ctx, registryLongPollTimeout+registryRequestTimeout)
+			entries, newETag, err := r.get(requestCtx, keyID, broadcastID, etag)
+			cancelRequest()
+
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				slog.Warn(
+					"Failed to watch the broadcast on the registry",
+					"component", "registry",
+					"keyId", keyID,
+					"broadcastId", broadcastID,
+					"err", err,
+				)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(registryRetryInterval):
+				}
+				continue
+			}
+
+			if entries != nil {
+				etag = newETag
+				callback(entries)
+			}
+		}
+	}()
+
+	return cancel
+}
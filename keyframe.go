@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// IsKeyframe reports whether the given RTP payload is the start of a keyframe,
+// which is the only safe point for a receiver to start decoding from (or to
+// switch over to a different source).
+//
+// Anything that isn't a video codec that we know of is treated as always
+// being a keyframe, since audio has no such concept.
+func IsKeyframe(mimeType string, payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH265):
+		return isH265Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return isAV1Keyframe(payload)
+	}
+
+	return true
+}
+
+func isVP8Keyframe(payload []byte) bool {
+	var vp8 codecs.VP8Packet
+	if _, err := vp8.Unmarshal(payload); err != nil {
+		return false
+	}
+
+	// The first partition of a frame, whose frame header has the "inverse
+	// keyframe" bit cleared.
+	return vp8.S == 1 && vp8.PID == 0 && len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+}
+
+func isVP9Keyframe(payload []byte) bool {
+	var vp9 codecs.VP9Packet
+	if _, err := vp9.Unmarshal(payload); err != nil {
+		return false
+	}
+
+	return !vp9.P && vp9.B && vp9.SID == 0
+}
+
+const (
+	h264NALUTypeIDR  = 5
+	h264NALUTypeSPS  = 7
+	h264NALUTypePPS  = 8
+	h264NALUTypeSTAP = 24
+	h264NALUTypeFUA  = 28
+)
+
+func isH264Keyframe(payload []byte) bool {
+	switch payload[0] & 0x1F {
+	case h264NALUTypeIDR, h264NALUTypeSPS:
+		return true
+	case h264NALUTypeSTAP:
+		for offset := 1; offset+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			offset += 2
+			if offset >= len(payload) {
+				break
+			}
+			switch payload[offset] & 0x1F {
+			case h264NALUTypeIDR, h264NALUTypeSPS:
+				return true
+			}
+			offset += size
+		}
+	case h264NALUTypeFUA:
+		if len(payload) < 2 {
+			return false
+		}
+		isStart := payload[1]&0x80 != 0
+		return isStart && payload[1]&0x1F == h264NALUTypeIDR
+	}
+
+	return false
+}
+
+const (
+	h265NALUTypeVPS  = 32
+	h265NALUTypeSPS  = 33
+	h265NALUTypePPS  = 34
+	h265NALUTypeAP   = 48
+	h265NALUTypeFU   = 49
+	h265NALUTypePACI = 50
+)
+
+func isH265IRAPOrParameterSet(naluType byte) bool {
+	// 16 to 21 are IRAP pictures, and 32 to 34 are the VPS, SPS, and PPS.
+	return (naluType >= 16 && naluType <= 21) || (naluType >= 32 && naluType <= 34)
+}
+
+func isH265Keyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+
+	switch naluType := (payload[0] >> 1) & 0x3F; naluType {
+	case h265NALUTypeAP:
+		for offset := 2; offset+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			offset += 2
+			if offset >= len(payload) {
+				break
+			}
+			if isH265IRAPOrParameterSet((payload[offset] >> 1) & 0x3F) {
+				return true
+			}
+			offset += size
+		}
+		return false
+	case h265NALUTypeFU:
+		if len(payload) < 3 {
+			return false
+		}
+		isStart := payload[2]&0x80 != 0
+		return isStart && isH265IRAPOrParameterSet(payload[2]&0x3F)
+	default:
+		return isH265IRAPOrParameterSet(naluType)
+	}
+}
+
+func isAV1Keyframe(payload []byte) bool {
+	// The N bit in the aggregation header signals the start of a new coded
+	// video sequence.
+	return payload[0]&0x08 != 0
+}
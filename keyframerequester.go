@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The least amount of time between two keyframe requests sent for receivers
+// that just joined. Those can't wait out the whole interval, but a bunch of
+// receivers joining (or switching layers) all at once still only gets the one.
+const keyframeRequestMinGap = 150 * time.Millisecond
+
+// keyframeRequester sends keyframe requests upstream, to a publisher, on behalf
+// of every receiver of a single layer.
+//
+// Receivers ask for keyframes whenever they please (e.g. every receiver that
+// joins, or that lost a packet), but a publisher having to send a keyframe for
+// every one of them would be a waste of bandwidth. So requests are sent at most
+// once per interval. Anything that comes in during that interval gets merged
+// into a single request, sent once the interval is up. The exception is
+// receivers that just joined (RequestNow), who only wait for a much shorter
+// gap, and whose requests get merged all the same.
+type keyframeRequester struct {
+	lock     *sync.Mutex
+	send     func() error
+	interval time.Duration
+	minGap   time.Duration
+
+	lastSent time.Time
+
+	// The request that's waiting to be sent, if any, and when it's due
+	pending    *time.Timer
+	pendingDue time.Time
+
+	stopped bool
+
+	sent atomic.Uint64
+}
+
+func newKeyframeRequester(interval time.Duration, send func() error) *keyframeRequester {
+	minGap := keyframeRequestMinGap
+	if interval < minGap {
+		minGap = interval
+	}
+	return &keyframeRequester{
+		lock:     &sync.Mutex{},
+		send:     send,
+		interval: interval,
+		minGap:   minGap,
+	}
+}
+
+// Request asks for a keyframe, which will be sent either right away, or once
+// the interval since the last request is up.
+func (k *keyframeRequester) Request() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.stopped || k.pending != nil {
+		// Either way, nothing to do. If there is one pending, then this request
+		// will be taken care of by that one.
+		return
+	}
+
+	k.requestWithin(k.interval)
+}
+
+// RequestNow asks for a keyframe without waiting out the interval. This is for
+// receivers that just joined, who have nothing to show until a keyframe comes
+// in. It still goes out no sooner than the minimum gap since the last request,
+// and a pending request is sent early instead, rather than on top of this one.
+func (k *keyframeRequester) RequestNow() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.stopped {
+		return
+	}
+
+	k.requestWithin(k.minGap)
+}
+
+// NOT THREAD SAFE!
+//
+// requestWithin has a request sent once the given amount of time since the
+// last one is up, unless there's one pending that's due by then anyway.
+func (k *keyframeRequester) requestWithin(gap time.Duration) {
+	due := k.lastSent.Add(gap)
+	if k.pending != nil && !k.pendingDue.After(due) {
+		return
+	}
+
+	wait := time.Until(due)
+	if wait <= 0 {
+		k.sendNow()
+		return
+	}
+
+	if k.pending != nil {
+		k.pending.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(wait, func() {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+
+		// Might've been replaced by a request that was due sooner, or sent early
+		if k.pending != timer {
+			return
+		}
+		if !k.stopped {
+			k.sendNow()
+		}
+	})
+	k.pending = timer
+	k.pendingDue = due
+}
+
+// Sent returns the number of requests actually sent upstream
+func (k *keyframeRequester) Sent() uint64 {
+	return k.sent.Load()
+}
+
+// Stop drops any pending request, and ignores any new ones.
+func (k *keyframeRequester) Stop() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.stopped = true
+	if k.pending != nil {
+		k.pending.Stop()
+		k.pending = nil
+	}
+}
+
+// NOT THREAD SAFE!
+//
+// sendNow sends a request, which takes care of whatever request was pending.
+func (k *keyframeRequester) sendNow() {
+	if k.pending != nil {
+		k.pending.Stop()
+		k.pending = nil
+	}
+	k.lastSent = time.Now()
+
+	// Not much that can be done if this fails. Odds are, the publisher is going
+	// away anyways.
+	if err := k.send(); err == nil {
+		k.sent.Add(1)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyframeRequester(t *testing.T) {
+	// Long enough apart that the tests don't get flaky on a busy machine
+	const (
+		interval = 400 * time.Millisecond
+		minGap   = 100 * time.Millisecond
+		margin   = 50 * time.Millisecond
+	)
+
+	type step struct {
+		// How long to wait before doing anything
+		wait time.Duration
+
+		// "request", "now", or "stop"; anything else does nothing
+		call string
+
+		// How many requests should've been sent, by the end of the step
+		want uint64
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "first request goes right away",
+			steps: []step{
+				{0, "request", 1},
+			},
+		},
+		{
+			name: "requests within the interval get merged",
+			steps: []step{
+				{0, "request", 1},
+				{0, "request", 1},
+				{0, "request", 1},
+				{interval / 2, "", 1},
+				{interval/2 + margin, "", 2},
+				{interval, "", 2},
+			},
+		},
+		{
+			name: "receivers joining all at once get merged",
+			steps: []step{
+				{0, "now", 1},
+				{0, "now", 1},
+				{0, "now", 1},
+				{0, "now", 1},
+				{minGap + margin, "", 2},
+				{interval, "", 2},
+			},
+		},
+		{
+			name: "receiver joining after the gap goes right away",
+			steps: []step{
+				{0, "request", 1},
+				{minGap + margin, "now", 2},
+			},
+		},
+		{
+			name: "receiver joining has a pending request sent early",
+			steps: []step{
+				{0, "request", 1},
+				{0, "request", 1},
+				{0, "now", 1},
+				{minGap + margin, "", 2},
+				{interval, "", 2},
+			},
+		},
+		{
+			name: "request doesn't hold up a receiver joining",
+			steps: []step{
+				{0, "now", 1},
+				{0, "request", 1},
+				{0, "now", 1},
+				{minGap + margin, "", 2},
+				{interval, "", 2},
+			},
+		},
+		{
+			name: "stopping drops pending requests",
+			steps: []step{
+				{0, "request", 1},
+				{0, "request", 1},
+				{0, "stop", 1},
+				{interval + margin, "request", 1},
+				{0, "now", 1},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sent := atomic.Uint64{}
+			k := newKeyframeRequester(interval, func() error {
+				sent.Add(1)
+				return nil
+			})
+			k.minGap = minGap
+			defer k.Stop()
+
+			for i, step := range test.steps {
+				time.Sleep(step.wait)
+				switch step.call {
+				case "request":
+					k.Request()
+				case "now":
+					k.RequestNow()
+				case "stop":
+					k.Stop()
+				}
+
+				if got := sent.Load(); got != step.want {
+					t.Fatalf("step %d: %d requests sent, want %d", i, got, step.want)
+				}
+				if got := k.Sent(); got != step.want {
+					t.Fatalf("step %d: Sent() is %d, want %d", i, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyframeRequesterMinGap(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		want     time.Duration
+	}{
+		{time.Second, keyframeRequestMinGap},
+		{keyframeRequestMinGap, keyframeRequestMinGap},
+		{keyframeRequestMinGap / 2, keyframeRequestMinGap / 2},
+	}
+
+	for _, test := range tests {
+		k := newKeyframeRequester(test.interval, func() error { return nil })
+		if k.minGap != test.want {
+			t.Errorf("interval %v: minimum gap is %v, want %v", test.interval, k.minGap, test.want)
+		}
+	}
+}
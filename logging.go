@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+)
+
+// setUpLogging has everything get logged through slog, at the configured
+// level, in the configured format. Whatever still goes through the log package
+// (ours or anybody else's) ends up there too.
+func setUpLogging() {
+	options := &slog.HandlerOptions{Level: config.LogLevel()}
+
+	var handler slog.Handler
+	if config.IsLogJSON() {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// requestLogger is the logger for everything to do with a single request, or
+// the WebSocket connection that it turned into. Whatever becomes known along
+// the way (the key ID, the session) gets tacked on with With.
+func requestLogger(req *http.Request, endpoint string) *slog.Logger {
+	return slog.With("endpoint", endpoint, "remote", req.RemoteAddr)
+}
+
+// broadcastLogger tacks the broadcast onto a logger
+func broadcastLogger(
+	logger *slog.Logger,
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+) *slog.Logger {
+	return logger.With("keyId", keyID, "broadcastId", broadcastID)
+}
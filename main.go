@@ -2,14 +2,17 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
 	"net/http"
 
 	"github.com/castcam-live/simple-forwarding-unit/config"
 )
 
 func main() {
+	setUpLogging()
+
 	router := CreateHandlers()
 
-	fmt.Println("Listening on port", config.PortNumber())
+	slog.Info("Listening", "port", config.PortNumber())
 	panic(http.ListenAndServe(fmt.Sprintf(":%d", config.PortNumber()), router))
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/webrtc/v4"
+)
+
+// How many different sets of labels a single counter keeps apart. Labels like
+// signalling message types come from clients, who could otherwise make up as
+// many as they like. Past that, the last label (which is always the one that
+// clients get to pick) gets counted as "other".
+const maxMetricLabelSets = 128
+
+// counter only ever goes up
+type counter struct {
+	value atomic.Uint64
+}
+
+func (c *counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+func (c *counter) Inc() {
+	c.value.Add(1)
+}
+
+// labeledCounter is a bunch of counters, told apart by the values of their
+// labels
+type labeledCounter struct {
+	labels []string
+
+	lock   *sync.Mutex
+	values map[string]*counter
+}
+
+func newLabeledCounter(labels ...string) *labeledCounter {
+	return &labeledCounter{
+		labels: labels,
+		lock:   &sync.Mutex{},
+		values: map[string]*counter{},
+	}
+}
+
+// With returns the counter for the given label values, in the same order as
+// the labels that the counter was created with
+func (c *labeledCounter) With(values ...string) *counter {
+	key := formatMetricLabels(c.labels, values)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if counter, ok := c.values[key]; ok {
+		return counter
+	}
+	if len(c.values) >= maxMetricLabelSets {
+		others := append([]string{}, values...)
+		others[len(others)-1] = "other"
+		key = formatMetricLabels(c.labels, others)
+		if counter, ok := c.values[key]; ok {
+			return counter
+		}
+	}
+
+	counter := &counter{}
+	c.values[key] = counter
+	return counter
+}
+
+// NOT THREAD SAFE!
+func (c *labeledCounter) sortedKeys() []string {
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Metrics counts everything that's worth keeping an eye on, for Prometheus to
+// scrape off of /metrics.
+//
+// There's just the one, in the `metrics` variable, since things get counted
+// from all over the place.
+type Metrics struct {
+	// By direction ("in" or "out"), and type
+	SignallingMessages *labeledCounter
+
+	// Errors sent to clients, by type ("SERVER_ERROR" or "CLIENT_ERROR"), and
+	// the type of the error itself (e.g. "SET_REMOTE_DESCRIPTION_FAILED")
+	Errors *labeledCounter
+
+	// Every state that peer connections went into
+	PeerConnectionStates *labeledCounter
+
+	// From publishers
+	PacketsReceived counter
+	BytesReceived   counter
+
+	// To receivers, not counting retransmissions
+	PacketsForwarded counter
+	BytesForwarded   counter
+
+	// Lost packets sent to receivers again, from the cache
+	Retransmissions counter
+
+	// Keyframe requests from receivers, and to publishers. Most of the ones from
+	// receivers get merged together.
+	PLIsReceived counter
+	PLIsSent     counter
+
+	// Lost packets that receivers asked for, and that got asked for from
+	// publishers, since they were no longer in the cache
+	NACKsReceived counter
+	NACKsSent     counter
+}
+
+var metrics = &Metrics{
+	SignallingMessages:   newLabeledCounter("direction", "type"),
+	Errors:               newLabeledCounter("type", "code"),
+	PeerConnectionStates: newLabeledCounter("state"),
+}
+
+// SignallingMessage counts a signalling message going either "in" or "out".
+// Errors going out get counted as errors too.
+func (m *Metrics) SignallingMessage(direction string, message []byte) {
+	var t TypeData[json.RawMessage]
+	if err := json.Unmarshal(message, &t); err != nil {
+		return
+	}
+	m.SignallingMessages.With(direction, t.Type).Inc()
+
+	if direction == "out" && (t.Type == "SERVER_ERROR" || t.Type == "CLIENT_ERROR") {
+		var data TypeOnly
+		json.Unmarshal(t.Data, &data)
+		m.Errors.With(t.Type, data.Type).Inc()
+	}
+}
+
+// PeerConnectionState counts a peer connection going into the given state
+func (m *Metrics) PeerConnectionState(state webrtc.PeerConnectionState) {
+	m.PeerConnectionStates.With(state.String()).Inc()
+}
+
+// MetricsHandler serves /metrics, in Prometheus' text format. Besides the
+// counters, there are gauges for what's going on right now, straight from the
+// tracks manager.
+type MetricsHandler struct {
+	tracksAndConnections TracksAndConnectionsManager
+}
+
+func NewMetricsHandler(tracksAndConnections TracksAndConnectionsManager) *MetricsHandler {
+	return &MetricsHandler{tracksAndConnections}
+}
+
+func (h *MetricsHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if token, _ := bearerToken(req); !config.IsMetricsToken(token) {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(res, "Missing or unknown bearer token", http.StatusUnauthorized)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.writeGauges(res)
+	metrics.write(res)
+}
+
+// writeGauges writes out how many publishers there are, and how many receivers
+// each key ID's broadcasts have. A publisher is a broadcast with at least a
+// single track that wasn't relayed from another server.
+//
+// Receivers are only told apart by key ID, rather than by broadcast too, since
+// broadcast IDs are made up by clients, and there's no end to them.
+func (h *MetricsHandler) writeGauges(w io.Writer) {
+	publishers := 0
+	receivers := map[string]int{}
+	for _, broadcast := range h.tracksAndConnections.Status() {
+		for _, track := range broadcast.Tracks {
+			if !track.Relayed {
+				publishers++
+				break
+			}
+		}
+
+		// Receivers subscribe to tracks one kind at a time, but it's the same
+		// receiver either way
+		peerConnections := Set[*webrtc.PeerConnection]{}
+		count := 0
+		for _, receiver := range broadcast.Receivers {
+			if receiver.PeerConnection != nil {
+				if peerConnections[receiver.PeerConnection] {
+					continue
+				}
+				peerConnections.Add(receiver.PeerConnection)
+			}
+			count++
+		}
+		labels := formatMetricLabels([]string{"key_id"}, []string{string(broadcast.KeyID)})
+		receivers[labels] += count
+	}
+
+	writeMetricHeader(w, "sfu_publishers", "gauge", "Broadcasts being published to this server")
+	fmt.Fprintf(w, "sfu_publishers %d\n", publishers)
+
+	writeMetricHeader(w, "sfu_receivers", "gauge", "Receivers of each key ID's broadcasts, be they peer connections or sinks")
+	labels := make([]string, 0, len(receivers))
+	for label := range receivers {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Fprintf(w, "sfu_receivers%s %d\n", label, receivers[label])
+	}
+}
+
+func (m *Metrics) write(w io.Writer) {
+	writeLabeledCounter(w, "sfu_signalling_messages_total", "Signalling messages, by direction and type", m.SignallingMessages)
+	writeLabeledCounter(w, "sfu_errors_total", "Errors sent to clients, by message type and error type", m.Errors)
+	writeLabeledCounter(w, "sfu_peer_connection_state_changes_total", "Peer connections going into each state", m.PeerConnectionStates)
+
+	writeCounter(w, "sfu_rtp_received_packets_total", "RTP packets received from publishers", &m.PacketsReceived)
+	writeCounter(w, "sfu_rtp_received_bytes_total", "RTP bytes received from publishers", &m.BytesReceived)
+	writeCounter(w, "sfu_rtp_forwarded_packets_total", "RTP packets forwarded to receivers", &m.PacketsForwarded)
+	writeCounter(w, "sfu_rtp_forwarded_bytes_total", "RTP bytes forwarded to receivers", &m.BytesForwarded)
+	writeCounter(w, "sfu_rtp_retransmitted_packets_total", "RTP packets sent to receivers again from the cache", &m.Retransmissions)
+	writeCounter(w, "sfu_plis_received_total", "Keyframe requests from receivers", &m.PLIsReceived)
+	writeCounter(w, "sfu_plis_sent_total", "Keyframe requests to publishers", &m.PLIsSent)
+	writeCounter(w, "sfu_nacks_received_total", "Lost packets that receivers asked for", &m.NACKsReceived)
+	writeCounter(w, "sfu_nacks_sent_total", "Lost packets asked for from publishers", &m.NACKsSent)
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeCounter(w io.Writer, name, help string, c *counter) {
+	writeMetricHeader(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %d\n", name, c.value.Load())
+}
+
+func writeLabeledCounter(w io.Writer, name, help string, c *labeledCounter) {
+	writeMetricHeader(w, name, "counter", help)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %d\n", name, key, c.values[key].value.Load())
+	}
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// formatMetricLabels formats labels the way that they go right after a
+// metric's name, e.g. `{state="connected"}`
+func formatMetricLabels(labels []string, values []string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(label)
+		b.WriteString(`="`)
+		b.WriteString(metricLabelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// packetCacheSize is the number of packets that a packetCache holds on to.
+// Being a power of two, sequence numbers wrap around the cache evenly.
+const packetCacheSize = 1024
+
+// packetCache holds on to the last few packets of a layer, so that receivers
+// that lost any of them can be sent them again, without the publisher having
+// to be bothered.
+type packetCache struct {
+	lock    *sync.RWMutex
+	packets [packetCacheSize]*rtp.Packet
+}
+
+func newPacketCache() *packetCache {
+	return &packetCache{lock: &sync.RWMutex{}}
+}
+
+// Add stores a packet, evicting whichever packet was in its slot.
+//
+// The packet must not be modified afterwards.
+func (c *packetCache) Add(packet *rtp.Packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.packets[packet.SequenceNumber%packetCacheSize] = packet
+}
+
+// Get returns the packet with the given sequence number, if it is still around
+func (c *packetCache) Get(seq uint16) (*rtp.Packet, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	packet := c.packets[seq%packetCacheSize]
+	if packet == nil || packet.SequenceNumber != seq {
+		return nil, false
+	}
+	return packet, true
+}
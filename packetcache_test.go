@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestPacketCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		added []uint16
+		get   uint16
+		want  bool
+	}{
+		{"added", []uint16{1, 2, 3}, 2, true},
+		{"never added", []uint16{1, 3}, 2, false},
+		{"nothing added", nil, 0, false},
+		{"evicted", []uint16{1, 1 + packetCacheSize}, 1, false},
+		{"evicting", []uint16{1, 1 + packetCacheSize}, 1 + packetCacheSize, true},
+		{"same slot, not added yet", []uint16{1}, 1 + packetCacheSize, false},
+		{"around the wrap", []uint16{65534, 65535, 0, 1}, 65535, true},
+		{"after the wrap", []uint16{65534, 65535, 0, 1}, 0, true},
+		{"wrapped over", []uint16{65535, packetCacheSize - 1}, 65535, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := newPacketCache()
+			for _, seq := range test.added {
+				cache.Add(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}})
+			}
+
+			packet, ok := cache.Get(test.get)
+			if ok != test.want {
+				t.Fatalf("Get(%d) found a packet: %v, want %v", test.get, ok, test.want)
+			}
+			if ok && packet.SequenceNumber != test.get {
+				t.Fatalf("Get(%d) returned packet %d", test.get, packet.SequenceNumber)
+			}
+		})
+	}
+}
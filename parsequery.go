@@ -1,6 +1,10 @@
 package main
 
-import "strings"
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
 
 func ParseQuery(query string) map[string]string {
 	expressions := strings.Split(query, "&")
@@ -18,3 +22,19 @@ func ParseQuery(query string) map[string]string {
 
 	return result
 }
+
+// splitEscapedPath splits up whatever comes after the prefix in the request's
+// path, unescaping each part on its own. Unlike splitting up the (already
+// unescaped) path, this lets parts have slashes in them, as %2F, which key IDs
+// can.
+func splitEscapedPath(req *http.Request, prefix string) ([]string, error) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.EscapedPath(), prefix), "/")
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = unescaped
+	}
+	return parts, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// The extension that RTX packets of a simulcast layer say their layer's RID
+// with. Pion's sdp package doesn't have it.
+const sdesRepairedRTPStreamIDURI = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+
+// newPublishingPeerConnection creates a peer connection for receiving tracks
+// from a publisher.
+func newPublishingPeerConnection() (*webrtc.PeerConnection, error) {
+	// Create a media engine (which seems to be necessary for the purposes of
+	// setting up a codec). This is a Pion WebRTC thing.
+	m := &webrtc.MediaEngine{}
+	if err := registerCodecs(m); err != nil {
+		return nil, ServerError{"CODEC_REGISTRATION_FAILED", err}
+	}
+
+	// Lets us tell who is talking, without having to decode any audio
+	if err := m.RegisterHeaderExtension(
+		webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI},
+		webrtc.RTPCodecTypeAudio,
+	); err != nil {
+		return nil, ServerError{"HEADER_EXTENSION_REGISTRATION_FAILED", err}
+	}
+
+	// Needed in order for simulcast layers to be told apart
+	for _, extension := range []string{
+		sdp.SDESMidURI,
+		sdp.SDESRTPStreamIDURI,
+		sdesRepairedRTPStreamIDURI,
+	} {
+		if err := m.RegisterHeaderExtension(
+			webrtc.RTPHeaderExtensionCapability{URI: extension},
+			webrtc.RTPCodecTypeVideo,
+		); err != nil {
+			return nil, ServerError{"HEADER_EXTENSION_REGISTRATION_FAILED", err}
+		}
+	}
+
+	i := &interceptor.Registry{}
+
+	// Use the default set of Interceptors
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, ServerError{"INTERCEPTOR_REGISTRATION_FAILED", err}
+	}
+
+	peerConnection, err := webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(i),
+	).
+		NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		return nil, ServerError{"PEER_CONNECTION_CREATION_FAILED", err}
+	}
+
+	return peerConnection, nil
+}
+
+// Publisher publishes whatever tracks come in on a publisher's peer connection
+// to the publisher's broadcast, for as long as they keep coming in.
+//
+// Simulcast layers all come in as separate remote tracks on the same
+// transceiver, so they get grouped into the one forwarded track, by media ID.
+type Publisher struct {
+	logger               *slog.Logger
+	tracksAndConnections TracksAndConnectionsManager
+	keyID                KeyIDString
+	broadcastID          BroadcastIDString
+	peerConnection       *webrtc.PeerConnection
+
+	lock *sync.Mutex
+
+	// The tracks being published, by media ID
+	published map[string]*ForwardedTrack
+
+	// Labels that the publisher gave its tracks, by media ID
+	labels map[string]TrackIDString
+}
+
+// NewPublisher has the tracks that come in on the peer connection get
+// published to the given broadcast
+func NewPublisher(
+	logger *slog.Logger,
+	tracksAndConnections TracksAndConnectionsManager,
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+	peerConnection *webrtc.PeerConnection,
+) *Publisher {
+	p := &Publisher{
+		logger:               logger,
+		tracksAndConnections: tracksAndConnections,
+		keyID:                keyID,
+		broadcastID:          broadcastID,
+		peerConnection:       peerConnection,
+		lock:                 &sync.Mutex{},
+		published:            map[string]*ForwardedTrack{},
+		labels:               map[string]TrackIDString{},
+	}
+	peerConnection.OnTrack(p.onTrack)
+	return p
+}
+
+// SetLabels sets the labels of the tracks that are about to be published, by
+// media ID. Only tracks that haven't arrived yet get their labels from this.
+// An empty label removes the label.
+func (p *Publisher) SetLabels(labels map[string]TrackIDString) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for mid, label := range labels {
+		if label == "" {
+			delete(p.labels, mid)
+			continue
+		}
+		p.labels[mid] = label
+	}
+}
+
+func (p *Publisher) onTrack(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	mid := ""
+	for _, transceiver := range p.peerConnection.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			mid = transceiver.Mid()
+		}
+	}
+
+	p.lock.Lock()
+	track, ok := p.published[mid]
+	if !ok {
+		trackID, hasLabel := p.labels[mid]
+		if !hasLabel {
+			trackID = TrackIDString(mid)
+		}
+
+		track = NewForwardedTrack(
+			p.keyID,
+			p.broadcastID,
+			trackID,
+			remoteTrack.Kind(),
+			remoteTrack.Codec().RTPCodecCapability,
+		)
+		p.published[mid] = track
+	}
+	forwarder := track.AddLayer(remoteTrack, p.peerConnection)
+	p.lock.Unlock()
+
+	logger := p.logger.With(
+		"kind", remoteTrack.Kind().String(),
+		"track", track.ID(),
+		"rid", remoteTrack.RID(),
+	)
+	logger.Info("Forwarding track", "codec", remoteTrack.Codec().MimeType)
+
+	forwarder.SetHeaderExtensions(receiver.GetParameters().HeaderExtensions)
+
+	if !ok {
+		p.tracksAndConnections.SetTrack(p.keyID, p.broadcastID, track)
+	}
+
+	// The forwarder runs until the publisher stops sending us the track (either
+	// the track got removed, or the peer connection closed), at which point,
+	// receivers should stop expecting anything from it.
+	go func() {
+		if err := forwarder.Run(); err != nil {
+			logger.Warn("Failed reading from remote track", "err", err)
+		}
+
+		stats := forwarder.Stats()
+		logger.Info("Stopped forwarding track", "packets", stats.Packets, "bytes", stats.Bytes)
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		// Only once every layer is gone is the track really gone
+		if track.RemoveLayer(forwarder) > 0 {
+			return
+		}
+		if p.published[mid] == track {
+			delete(p.published, mid)
+		}
+
+		p.tracksAndConnections.RemoveTrack(p.keyID, p.broadcastID, track)
+	}()
+}
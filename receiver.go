@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/castcam-live/simple-forwarding-unit/finish"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v4"
+)
+
+// ServerError is an error that the client gets told about, as a SERVER_ERROR
+// of the given type.
+type ServerError struct {
+	Type string
+	Err  error
+}
+
+func (e ServerError) Error() string {
+	return e.Type + ": " + e.Err.Error()
+}
+
+// newReceivingPeerConnection creates a peer connection for sending tracks to a
+// receiver, along with the allocator that splits up the receiver's bandwidth
+// between those tracks.
+//
+// The allocator is already running, and needs to be closed along with the
+// peer connection.
+func newReceivingPeerConnection() (*webrtc.PeerConnection, *BandwidthAllocator, error) {
+	// Create a media engine, for codecs and stuff. Receivers have to be able to
+	// say what they lost, for the DownTracks to send it again, and to ask for
+	// keyframes.
+	m := &webrtc.MediaEngine{}
+	if err := registerCodecs(
+		m,
+		webrtc.RTCPFeedback{Type: "nack"},
+		webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"},
+	); err != nil {
+		return nil, nil, ServerError{"CODEC_REGISTRATION_FAILED", err}
+	}
+
+	i := &interceptor.Registry{}
+
+	// Has to come before everything else; see RTXStreams
+	i.Add(rtxStreams)
+
+	// Use the default set of interceptors (no idea what an "interceptor" even
+	// is), minus Pion's NACK responder. Lost packets get sent again by the
+	// DownTracks, out of each track's packet cache, so the responder would only
+	// be keeping a second copy of everything.
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		return nil, nil, ServerError{"INTERCEPTOR_REGISTRATION_FAILED", err}
+	}
+	if err := webrtc.ConfigureTWCCSender(m, i); err != nil {
+		return nil, nil, ServerError{"INTERCEPTOR_REGISTRATION_FAILED", err}
+	}
+
+	// Estimate the receiver's bandwidth, off of the transport wide congestion
+	// control feedback that it sends back.
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		// No pacing; the allocator makes sure that we don't send more than what
+		// the receiver can take.
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(config.InitialBitrate()),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, nil, ServerError{"INTERCEPTOR_CREATION_FAILED", err}
+	}
+
+	var estimator cc.BandwidthEstimator
+	congestionController.OnNewPeerConnection(func(id string, e cc.BandwidthEstimator) {
+		estimator = e
+	})
+	i.Add(congestionController)
+
+	// Has to come after the congestion controller, so that packets already have
+	// their transport wide sequence numbers by the time the controller sees them
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return nil, nil, ServerError{"INTERCEPTOR_REGISTRATION_FAILED", err}
+	}
+
+	// Create an RTCPeerConnection
+	peerConnection, err := webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(i),
+	).
+		NewPeerConnection(peerConnectionConfig)
+	if err != nil {
+		return nil, nil, ServerError{"PEER_CONNECTION_CREATION_FAILED", err}
+	}
+
+	// The estimator is handed to us while the peer connection is being created
+	allocator := NewBandwidthAllocator(estimator)
+	go allocator.Run()
+
+	return peerConnection, allocator, nil
+}
+
+// writeServerError tells the client about an error. Anything that isn't a
+// ServerError is reported as an unknown error.
+func writeServerError(signalling *SignallingConn, err error) error {
+	serverErr, ok := err.(ServerError)
+	if !ok {
+		serverErr = ServerError{"UNKNOWN_ERROR", err}
+	}
+
+	return signalling.WriteJSON(TypeData[TypeOnly]{
+		Type: "SERVER_ERROR",
+		Data: TypeOnly{
+			Type: serverErr.Type,
+		},
+	})
+}
+
+// listenForDominantSpeaker has a receiver get told whenever the dominant
+// speaker out of a key ID's broadcasts changes, whatever it is that the
+// receiver is receiving. Returns a function that stops it.
+func listenForDominantSpeaker(
+	signalling *SignallingConn,
+	dominantSpeakers *DominantSpeakers,
+	keyId KeyIDString,
+) func() {
+	return dominantSpeakers.Listen(keyId, func(speaker DominantSpeaker) {
+		signalling.WriteJSON(TypeData[DominantSpeaker]{
+			Type: "DOMINANT_SPEAKER",
+			Data: speaker,
+		})
+	})
+}
+
+// writeSessionNotFound tells a client that the session it tried to resume is
+// gone (or never was).
+func writeSessionNotFound(signalling *SignallingConn) error {
+	return signalling.WriteJSON(TypeData[map[string]any]{
+		Type: "CLIENT_ERROR",
+		Data: map[string]any{
+			"type": "SESSION_NOT_FOUND",
+			"msg":  "The session to resume doesn't exist, or has expired; start a new one instead",
+		},
+	})
+}
+
+// handleReceiverNegotiation has the server be the one making offers to a
+// receiver, whenever the tracks being sent to it change, and trickles ICE
+// candidates to the receiver.
+//
+// beforeOffer (which may be nil) gets called right before an offer is sent,
+// once the local description is set.
+func handleReceiverNegotiation(
+	signalling *SignallingConn,
+	peerConnection *webrtc.PeerConnection,
+	done *finish.Done,
+	beforeOffer func(),
+) {
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		metrics.PeerConnectionState(s)
+
+		if s == webrtc.PeerConnectionStateClosed {
+			done.Finish()
+		}
+	})
+
+	// Listen for negotiation needed events.
+	peerConnection.OnNegotiationNeeded(func() {
+		// TODO: I guess we will need another one of those channels to detect if
+		//   the connection failed. In this callback, we will be signalling that
+		//   the offer failed
+		offer, err := peerConnection.CreateOffer(nil)
+
+		if err != nil {
+			signalling.WriteJSON(TypeData[TypeOnly]{
+				Type: "SERVER_ERROR",
+				Data: TypeOnly{
+					Type: "CREATE_OFFER_FAILED",
+				},
+			})
+			done.Finish()
+			return
+		}
+
+		if err = peerConnection.SetLocalDescription(offer); err != nil {
+			done.Finish()
+			return
+		}
+
+		if beforeOffer != nil {
+			beforeOffer()
+		}
+
+		if err = signalling.WriteJSON(TypeData[TypeData[webrtc.SessionDescription]]{
+			Type: "SIGNALLING",
+			Data: TypeData[webrtc.SessionDescription]{
+				Type: "DESCRIPTION",
+				Data: offer,
+			},
+		}); err != nil {
+			done.Finish()
+			return
+		}
+	})
+
+	// Listen for ICE candidates
+	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+
+		if err := signalling.WriteJSON(TypeData[TypeData[*webrtc.ICECandidate]]{
+			Type: "SIGNALLING",
+			Data: TypeData[*webrtc.ICECandidate]{
+				Type: "ICE_CANDIDATE",
+				Data: c,
+			},
+		}); err != nil {
+			done.Finish()
+			return
+		}
+	})
+}
+
+// handleReceiverSignalling handles a SIGNALLING message from a receiver.
+// Receivers only ever get to answer; never offer.
+//
+// Returns false if the receiver's connection should be closed.
+func handleReceiverSignalling(
+	logger *slog.Logger,
+	signalling *SignallingConn,
+	peerConnection *webrtc.PeerConnection,
+	data json.RawMessage,
+) bool {
+	var s TypeData[json.RawMessage]
+	if err := json.Unmarshal(data, &s); err != nil {
+		return true
+	}
+
+	switch s.Type {
+	case "DESCRIPTION":
+		var d webrtc.SessionDescription
+		if err := json.Unmarshal(s.Data, &d); err != nil {
+			logger.Warn("Bad JSON message", "type", s.Type, "err", err)
+			return true
+		}
+
+		if d.Type == webrtc.SDPTypeOffer {
+			signalling.WriteJSON(TypeData[map[string]any]{
+				Type: "CLIENT_ERROR",
+				Data: map[string]any{
+					"type": "OFFER_RECEIVED",
+					"msg":  "Received offer from client; server can't accept offers; only answers",
+				},
+			})
+			return false
+		}
+
+		if err := peerConnection.SetRemoteDescription(d); err != nil {
+			logger.Warn("Failed to set remote description", "err", err)
+			signalling.WriteJSON(TypeData[TypeOnly]{
+				Type: "SERVER_ERROR",
+				Data: TypeOnly{
+					Type: "SET_REMOTE_DESCRIPTION_FAILED",
+				},
+			})
+			return false
+		}
+	case "ICE_CANDIDATE":
+		var iceCandiate webrtc.ICECandidate
+		if err := json.Unmarshal(s.Data, &iceCandiate); err != nil {
+			logger.Warn("Bad JSON message", "type", s.Type, "err", err)
+			return true
+		}
+		if err := peerConnection.AddICECandidate(iceCandiate.ToJSON()); err != nil {
+			logger.Warn("Failed to add ICE candidate", "err", err)
+			return true
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,995 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// How many packets can be waiting to be written to disk, for a single file,
+// before they start getting dropped
+const recordingQueueSize = 1024
+
+// How often old recordings get cleaned up
+const retentionInterval = time.Minute
+
+// What the recorder names directories and files, so that retention only ever
+// touches what the recorder wrote, even if the recordings directory is shared
+// with something else. See safeFileName, and rotatingFile.create.
+var (
+	recordingDirectoryPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{0,64}_[0-9a-f]{8}$`)
+	recordingFilePattern      = regexp.MustCompile(
+		`^\d{8}T\d{6}\.\d{3}Z(-[A-Za-z0-9_-]{0,64}_[0-9a-f]{8})?\.(ivf|ogg|webm)$`,
+	)
+)
+
+var ErrAlreadyRecording = errors.New("broadcast is already being recorded")
+
+// RecordingOptions says what gets recorded of a broadcast, and how
+type RecordingOptions struct {
+	// "audio" and/or "video". Empty for both.
+	Kinds []KindString `json:"kinds"`
+
+	// Any of "ivf", "ogg", and "webm". Empty for just "webm".
+	Formats []string `json:"formats"`
+}
+
+// withDefaults fills in whatever was left empty, and checks the rest
+func (o RecordingOptions) withDefaults() (RecordingOptions, error) {
+	if len(o.Kinds) == 0 {
+		o.Kinds = []KindString{"audio", "video"}
+	}
+	if len(o.Formats) == 0 {
+		o.Formats = []string{config.RecordingFormatWebM}
+	}
+
+	kinds := []string{}
+	for _, kind := range o.Kinds {
+		kinds = append(kinds, string(kind))
+	}
+	if err := config.CheckRecordingKinds(kinds); err != nil {
+		return o, err
+	}
+	if err := config.CheckRecordingFormats(o.Formats); err != nil {
+		return o, err
+	}
+
+	return o, nil
+}
+
+func (o RecordingOptions) hasKind(kind KindString) bool {
+	for _, k := range o.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (o RecordingOptions) hasFormat(format string) bool {
+	for _, f := range o.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordingStatus tells a publisher whether its broadcast is being recorded
+type RecordingStatus struct {
+	Recording bool `json:"recording"`
+
+	// Whether the recording was started by the server's configuration, rather
+	// than by the publisher. Those can't be stopped by the publisher.
+	ByRule bool `json:"byRule"`
+
+	RecordingOptions
+}
+
+// Recorder records broadcasts to disk, by subscribing to their tracks as a
+// sink, just like a receiver would.
+//
+// At most one recording of a broadcast happens at a time. Recordings get
+// split up into several files as they grow (see config.RecordingConfig), and
+// old files get cleaned up, as per the retention policy.
+//
+// Broadcasts that the configured rules say are to be recorded get recorded
+// for as long as anything is published to them, whichever way it's published.
+type Recorder struct {
+	lock *sync.Mutex
+
+	tracks TracksAndConnectionsManager
+
+	recordings map[broadcastKey]*Recording
+
+	// Paths of the files being written to right now, which retention leaves
+	// alone
+	open Set[string]
+}
+
+// NewRecorder creates a new Recorder, which applies the recording rules to
+// every broadcast that gets published to the given manager
+func NewRecorder(tracks TracksAndConnectionsManager) *Recorder {
+	r := &Recorder{
+		lock:       &sync.Mutex{},
+		tracks:     tracks,
+		recordings: map[broadcastKey]*Recording{},
+		open:       Set[string]{},
+	}
+	tracks.OnBroadcastStarted(r.startFromRules)
+	tracks.OnBroadcastEnded(r.stopByRule)
+	return r
+}
+
+// Start starts recording a broadcast. Tracks get recorded as they're
+// published, so the broadcast doesn't need to have anything published to it
+// yet.
+func (r *Recorder) Start(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	options RecordingOptions,
+) (*Recording, error) {
+	return r.start(keyId, broadcastId, options, false)
+}
+
+// startFromRules starts recording a broadcast, if any of the configured rules
+// say so, and it isn't already being recorded.
+func (r *Recorder) startFromRules(keyId KeyIDString, broadcastId BroadcastIDString) {
+	for _, rule := range config.Recording().Rules {
+		if !rule.Matches(string(keyId), string(broadcastId)) {
+			continue
+		}
+
+		options := RecordingOptions{Formats: rule.Formats}
+		for _, kind := range rule.Kinds {
+			options.Kinds = append(options.Kinds, KindString(kind))
+		}
+
+		if _, err := r.start(keyId, broadcastId, options, true); err != nil {
+			recorderLogger(keyId, broadcastId).Warn("Not recording", "err", err)
+		}
+		return
+	}
+}
+
+// stopByRule stops recording a broadcast, if the recording was started by a
+// rule. Ones that publishers asked for are up to them to stop.
+func (r *Recorder) stopByRule(keyId KeyIDString, broadcastId BroadcastIDString) {
+	if recording, ok := r.Recording(keyId, broadcastId); ok && recording.ByRule() {
+		r.Stop(recording)
+	}
+}
+
+func (r *Recorder) start(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	options RecordingOptions,
+	byRule bool,
+) (*Recording, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	key := broadcastKey{keyId, broadcastId}
+
+	r.lock.Lock()
+	if _, ok := r.recordings[key]; ok {
+		r.lock.Unlock()
+		return nil, ErrAlreadyRecording
+	}
+	recording := &Recording{
+		recorder:    r,
+		keyID:       keyId,
+		broadcastID: broadcastId,
+		options:     options,
+		byRule:      byRule,
+		directory: filepath.Join(
+			config.Recording().Directory,
+			safeFileName(string(keyId)),
+			safeFileName(string(broadcastId)),
+		),
+		lock:   &sync.Mutex{},
+		tracks: Set[TrackIDString]{},
+		files:  map[*DownTrack]*trackRecording{},
+	}
+	r.recordings[key] = recording
+	r.lock.Unlock()
+
+	recording.start()
+
+	recording.logger().Info("Recording", "kinds", options.Kinds, "formats", options.Formats)
+
+	return recording, nil
+}
+
+// Stop stops a recording, if it's still going.
+func (r *Recorder) Stop(recording *Recording) {
+	key := broadcastKey{recording.keyID, recording.broadcastID}
+
+	r.lock.Lock()
+	if r.recordings[key] != recording {
+		r.lock.Unlock()
+		return
+	}
+	delete(r.recordings, key)
+	r.lock.Unlock()
+
+	recording.stop()
+
+	recording.logger().Info("Stopped recording")
+}
+
+// Recording returns the recording of a broadcast, if it's being recorded
+func (r *Recorder) Recording(keyId KeyIDString, broadcastId BroadcastIDString) (*Recording, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	recording, ok := r.recordings[broadcastKey{keyId, broadcastId}]
+	return recording, ok
+}
+
+func (r *Recorder) opened(path string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.open.Add(path)
+}
+
+func (r *Recorder) closed(path string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.open.Remove(path)
+}
+
+// RunRetention blocks forever, periodically deleting whichever recordings the
+// retention policy says are to go. Returns right away if there is no policy.
+func (r *Recorder) RunRetention() {
+	retention := config.Recording().Retention
+	if retention.MaxAgeSeconds == 0 && retention.MaxTotalSize == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.enforceRetention(config.Recording().Directory, retention)
+	}
+}
+
+// isRecordingPath tells whether a path, relative to the recordings directory,
+// is somewhere that the recorder would've written a recording to: a file
+// named after when it was started, in a directory for the broadcast, in a
+// directory for the key ID. Directories on the way there count too.
+func isRecordingPath(path string, isDir bool) bool {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	if isDir {
+		if len(parts) > 2 {
+			return false
+		}
+	} else if len(parts) != 3 || !recordingFilePattern.MatchString(parts[2]) {
+		return false
+	}
+
+	for i := 0; i < len(parts) && i < 2; i++ {
+		if !recordingDirectoryPattern.MatchString(parts[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// enforceRetention deletes the recordings in the given directory that the
+// retention policy says are to go, oldest first. Anything in there that the
+// recorder didn't write is left alone, and doesn't count towards the total
+// size either.
+func (r *Recorder) enforceRetention(root string, retention config.RecordingRetention) {
+	type recordedFile struct {
+		path     string
+		size     int64
+		modified time.Time
+	}
+
+	files := []recordedFile{}
+	var total int64
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if !isRecordingPath(rel, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !isRecordingPath(rel, false) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		files = append(files, recordedFile{path, info.Size(), info.ModTime()})
+		return nil
+	})
+
+	// Oldest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modified.Before(files[j].modified)
+	})
+
+	r.lock.Lock()
+	open := Set[string]{}
+	for path := range r.open {
+		open.Add(path)
+	}
+	r.lock.Unlock()
+
+	maxAge := time.Duration(retention.MaxAgeSeconds) * time.Second
+	for _, file := range files {
+		if open[file.path] {
+			continue
+		}
+
+		tooOld := maxAge > 0 && time.Since(file.modified) > maxAge
+		tooBig := retention.MaxTotalSize > 0 && total > retention.MaxTotalSize
+		if !tooOld && !tooBig {
+			continue
+		}
+
+		if err := os.Remove(file.path); err != nil {
+			slog.Warn("Failed to delete recording", "component", "recorder", "path", file.path, "err", err)
+			continue
+		}
+		total -= file.size
+
+		// Doesn't do anything unless the directories are empty
+		dir := filepath.Dir(file.path)
+		for dir != root && strings.HasPrefix(dir, root) {
+			if os.Remove(dir) != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+}
+
+// Recording is a single broadcast being recorded.
+//
+// The "ivf" and "ogg" formats get every track of the broadcast its own file
+// (VP8, VP9, and AV1 to IVF, and Opus to Ogg), while "webm" puts the first
+// published audio and video tracks together in the one file.
+type Recording struct {
+	recorder    *Recorder
+	keyID       KeyIDString
+	broadcastID BroadcastIDString
+	options     RecordingOptions
+	byRule      bool
+	directory   string
+
+	lock *sync.Mutex
+
+	// The tracks that get their own files, by ID
+	tracks Set[TrackIDString]
+
+	// The files of the tracks that get their own files, by the DownTrack that
+	// they're being written from
+	files map[*DownTrack]*trackRecording
+
+	webm    *webmRecording
+	unwatch func()
+	stopped bool
+}
+
+// logger is what everything to do with the recording logs through
+func (r *Recording) logger() *slog.Logger {
+	return recorderLogger(r.keyID, r.broadcastID)
+}
+
+// recorderLogger is the recorder's logger, with a broadcast tacked on
+func recorderLogger(keyID KeyIDString, broadcastID BroadcastIDString) *slog.Logger {
+	return broadcastLogger(slog.With("component", "recorder"), keyID, broadcastID)
+}
+
+// Status describes the recording to the publisher
+func (r *Recording) Status() RecordingStatus {
+	return RecordingStatus{Recording: true, ByRule: r.byRule, RecordingOptions: r.options}
+}
+
+// ByRule tells whether the recording was started by the server's
+// configuration
+func (r *Recording) ByRule() bool {
+	return r.byRule
+}
+
+func (r *Recording) start() {
+	if r.options.hasFormat(config.RecordingFormatWebM) {
+		r.webm = newWebMRecording(r)
+		go r.webm.run()
+
+		for _, kind := range []KindString{"video", "audio"} {
+			if r.options.hasKind(kind) {
+				r.recorder.tracks.AddSink(TrackKey{r.keyID, r.broadcastID, kind, ""}, r)
+			}
+		}
+	}
+
+	if r.options.hasFormat(config.RecordingFormatIVF) || r.options.hasFormat(config.RecordingFormatOgg) {
+		unwatch := r.recorder.tracks.WatchTracks(r.keyID, r.broadcastID, r.tracksChanged)
+
+		r.lock.Lock()
+		r.unwatch = unwatch
+		stopped := r.stopped
+		r.lock.Unlock()
+
+		if stopped {
+			unwatch()
+		}
+	}
+}
+
+// tracksChanged subscribes to whichever tracks of the broadcast haven't been
+// subscribed to yet. Tracks that go away stay subscribed to, in case they come
+// back.
+func (r *Recording) tracksChanged(tracks BroadcastTracks) {
+	added := []TrackIDString{}
+
+	r.lock.Lock()
+	if r.stopped {
+		r.lock.Unlock()
+		return
+	}
+	for _, track := range tracks.Tracks {
+		if !r.options.hasKind(track.Kind) || r.tracks[track.ID] {
+			continue
+		}
+		r.tracks.Add(track.ID)
+		added = append(added, track.ID)
+	}
+	r.lock.Unlock()
+
+	for _, id := range added {
+		r.recorder.tracks.AddSink(TrackKey{r.keyID, r.broadcastID, "", id}, r)
+	}
+}
+
+func (r *Recording) stop() {
+	r.lock.Lock()
+	r.stopped = true
+	unwatch := r.unwatch
+	r.lock.Unlock()
+
+	if unwatch != nil {
+		unwatch()
+	}
+
+	// Has RemoveDownTrack called for everything, which closes every file
+	r.recorder.tracks.RemoveSink(r)
+
+	if r.webm != nil {
+		r.webm.close()
+	}
+}
+
+// AddDownTrack is part of TrackSink
+func (r *Recording) AddDownTrack(key TrackKey, downTrack *DownTrack) webrtc.TrackLocalWriter {
+	if key.Kind != "" {
+		return r.webm.addTrack(downTrack)
+	}
+
+	codec := downTrack.Track().Codec()
+	mimeType := strings.ToLower(codec.MimeType)
+
+	format := ""
+	extension := ""
+	if _, ok := ivfContainerCodecs[mimeType]; ok && r.options.hasFormat(config.RecordingFormatIVF) {
+		format = config.RecordingFormatIVF
+		extension = "ivf"
+	} else if mimeType == strings.ToLower(webrtc.MimeTypeOpus) && r.options.hasFormat(config.RecordingFormatOgg) {
+		format = config.RecordingFormatOgg
+		extension = "ogg"
+	}
+	if format == "" {
+		r.logger().Info(
+			"Not recording track, since the codec can't be recorded in any of the formats",
+			"track", key.TrackID,
+			"codec", codec.MimeType,
+			"formats", r.options.Formats,
+		)
+		return discardWriter{}
+	}
+
+	file := &trackRecording{
+		downTrack: downTrack,
+		file: &rotatingFile{
+			recording: r,
+			name:      string(key.TrackID),
+			extension: extension,
+			open: func(file *recordingFile, tracks []recordingTrack) (containerWriter, error) {
+				if format == config.RecordingFormatIVF {
+					return newIVFWriter(file, tracks[0])
+				}
+				return newOggWriter(file, tracks[0])
+			},
+		},
+		track:   recordingTrack{codec: codec},
+		packets: make(chan *rtp.Packet, recordingQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	r.lock.Lock()
+	r.files[downTrack] = file
+	r.lock.Unlock()
+
+	go file.run()
+
+	return packetQueue(file.packets)
+}
+
+// RemoveDownTrack is part of TrackSink
+func (r *Recording) RemoveDownTrack(key TrackKey, downTrack *DownTrack) {
+	if key.Kind != "" {
+		r.webm.removeTrack(downTrack)
+		return
+	}
+
+	r.lock.Lock()
+	file, ok := r.files[downTrack]
+	delete(r.files, downTrack)
+	r.lock.Unlock()
+
+	if ok {
+		close(file.done)
+	}
+}
+
+// packetQueue hands packets over from a DownTrack to whatever's writing them to
+// disk, so that the DownTrack never has to wait on the disk. If the disk can't
+// keep up, packets get dropped, which looks just like packet loss.
+type packetQueue chan<- *rtp.Packet
+
+func (q packetQueue) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	select {
+	case q <- &rtp.Packet{Header: *header, Payload: payload}:
+	default:
+	}
+	return len(payload), nil
+}
+
+func (q packetQueue) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return q.WriteRTP(&packet.Header, packet.Payload)
+}
+
+// discardWriter is for tracks that can't be recorded
+type discardWriter struct{}
+
+func (discardWriter) WriteRTP(_ *rtp.Header, payload []byte) (int, error) {
+	return len(payload), nil
+}
+
+func (discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// rotatingFile is a recording that gets split up into several files, as it
+// grows.
+type rotatingFile struct {
+	recording *Recording
+
+	// What goes in the names of the files, after the time that they were started
+	// at. Empty for nothing.
+	name      string
+	extension string
+
+	// Creates a container writer for a file
+	open func(file *recordingFile, tracks []recordingTrack) (containerWriter, error)
+
+	path    string
+	file    *recordingFile
+	writer  containerWriter
+	started time.Time
+}
+
+// isOpen tells whether there's a file being written to
+func (f *rotatingFile) isOpen() bool {
+	return f.writer != nil
+}
+
+// due tells whether the file is big enough, or old enough, that the recording
+// should carry on in a new one
+func (f *rotatingFile) due() bool {
+	if !f.isOpen() {
+		return false
+	}
+
+	c := config.Recording()
+	if c.MaxFileSize > 0 && f.file.Size() >= c.MaxFileSize {
+		return true
+	}
+	maxDuration := time.Duration(c.MaxFileDurationSeconds) * time.Second
+	return maxDuration > 0 && time.Since(f.started) >= maxDuration
+}
+
+// create closes whatever file is being written to, and starts a new one, with
+// the given tracks.
+func (f *rotatingFile) create(tracks []recordingTrack) error {
+	f.close()
+
+	if err := os.MkdirAll(f.recording.directory, 0o755); err != nil {
+		return err
+	}
+
+	f.started = time.Now()
+	name := f.started.UTC().Format("20060102T150405.000Z")
+	if f.name != "" {
+		name += "-" + safeFileName(f.name)
+	}
+	path := filepath.Join(f.recording.directory, name+"."+f.extension)
+
+	file, err := createRecordingFile(path)
+	if err != nil {
+		return err
+	}
+	writer, err := f.open(file, tracks)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	f.path = path
+	f.file = file
+	f.writer = writer
+	f.recording.recorder.opened(path)
+
+	return nil
+}
+
+// write writes a frame to the file
+func (f *rotatingFile) write(track int, frame mediaFrame, millis int64) {
+	if err := f.writer.writeFrame(track, frame, millis); err != nil {
+		f.recording.logger().Warn("Failed to write to recording", "path", f.path, "err", err)
+		f.close()
+	}
+}
+
+// close closes whatever file is being written to
+func (f *rotatingFile) close() {
+	if !f.isOpen() {
+		return
+	}
+
+	if err := f.writer.Close(); err != nil {
+		f.recording.logger().Warn("Failed to close recording", "path", f.path, "err", err)
+	}
+	f.recording.recorder.closed(f.path)
+
+	f.path = ""
+	f.file = nil
+	f.writer = nil
+}
+
+// trackRecording writes a single DownTrack to its own files
+type trackRecording struct {
+	downTrack *DownTrack
+	file      *rotatingFile
+	track     recordingTrack
+
+	packets chan *rtp.Packet
+	done    chan struct{}
+}
+
+// run blocks, writing packets to disk until done is closed.
+func (t *trackRecording) run() {
+	video := t.downTrack.Kind() == webrtc.RTPCodecTypeVideo
+	requestedKeyframe := false
+
+	assembler := newFrameAssembler(t.track.codec, func(frame mediaFrame) {
+		// Video files have to start off with a keyframe
+		if video && !frame.keyframe && (!t.file.isOpen() || t.file.due()) {
+			if !requestedKeyframe {
+				t.downTrack.RequestKeyframe()
+				requestedKeyframe = true
+			}
+			if !t.file.isOpen() {
+				return
+			}
+		} else if !t.file.isOpen() || t.file.due() {
+			requestedKeyframe = false
+			if video {
+				t.track.width, t.track.height, _ = videoDimensions(t.track.codec.MimeType, frame.data)
+			}
+			if err := t.file.create([]recordingTrack{t.track}); err != nil {
+				t.file.recording.logger().Warn("Failed to create recording", "err", err)
+				return
+			}
+		}
+
+		t.file.write(0, frame, 0)
+	}, t.downTrack.RequestKeyframe)
+
+	defer t.file.close()
+
+	for {
+		select {
+		case packet := <-t.packets:
+			assembler.push(packet)
+		case <-t.done:
+			// Whatever made it in before the end still gets written
+			for {
+				select {
+				case packet := <-t.packets:
+					assembler.push(packet)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// webmRecording writes a broadcast's audio and video tracks to the same files.
+//
+// The files are made for whatever tracks there are at the time, so whenever
+// the tracks change, the recording carries on in a new file. New files start
+// off with a video keyframe, unless there is no video.
+type webmRecording struct {
+	recording *Recording
+	file      *rotatingFile
+
+	lock   *sync.Mutex
+	tracks map[*DownTrack]*webmTrack
+
+	// Whether the tracks changed since the file was created
+	changed bool
+
+	packets chan webmPacket
+	done    chan struct{}
+
+	// Only ever touched from run. The tracks of the current file, in order
+	fileTracks []*webmTrack
+}
+
+type webmTrack struct {
+	downTrack *DownTrack
+	track     recordingTrack
+	assembler *frameAssembler
+
+	// Only ever touched from run. Where the track is in the current file, and
+	// where its timestamps start from.
+	index     int
+	inFile    bool
+	hasBase   bool
+	baseTS    uint32
+	baseMilli int64
+}
+
+type webmPacket struct {
+	track  *webmTrack
+	packet *rtp.Packet
+}
+
+// webmTrackWriter hands packets over from a DownTrack to the webmRecording
+type webmTrackWriter struct {
+	track   *webmTrack
+	packets chan<- webmPacket
+}
+
+func (w webmTrackWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	select {
+	case w.packets <- webmPacket{w.track, &rtp.Packet{Header: *header, Payload: payload}}:
+	default:
+	}
+	return len(payload), nil
+}
+
+func (w webmTrackWriter) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&packet.Header, packet.Payload)
+}
+
+func newWebMRecording(recording *Recording) *webmRecording {
+	w := &webmRecording{
+		recording: recording,
+		lock:      &sync.Mutex{},
+		tracks:    map[*DownTrack]*webmTrack{},
+		packets:   make(chan webmPacket, recordingQueueSize),
+		done:      make(chan struct{}),
+	}
+	w.file = &rotatingFile{
+		recording: recording,
+		extension: "webm",
+		open: func(file *recordingFile, tracks []recordingTrack) (containerWriter, error) {
+			return newWebMWriter(file, tracks)
+		},
+	}
+	return w
+}
+
+func (w *webmRecording) addTrack(downTrack *DownTrack) webrtc.TrackLocalWriter {
+	codec := downTrack.Track().Codec()
+	if _, ok := webmContainerCodecs[strings.ToLower(codec.MimeType)]; !ok {
+		w.recording.logger().Info(
+			"Not recording track, since the codec can't be recorded as webm",
+			"kind", downTrack.Kind().String(),
+			"codec", codec.MimeType,
+		)
+		return discardWriter{}
+	}
+
+	track := &webmTrack{downTrack: downTrack, track: recordingTrack{codec: codec}}
+	track.assembler = newFrameAssembler(codec, func(frame mediaFrame) {
+		w.writeFrame(track, frame)
+	}, downTrack.RequestKeyframe)
+
+	w.lock.Lock()
+	w.tracks[downTrack] = track
+	w.changed = true
+	w.lock.Unlock()
+
+	return webmTrackWriter{track, w.packets}
+}
+
+func (w *webmRecording) removeTrack(downTrack *DownTrack) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if _, ok := w.tracks[downTrack]; ok {
+		delete(w.tracks, downTrack)
+		w.changed = true
+	}
+}
+
+func (w *webmRecording) close() {
+	close(w.done)
+}
+
+// run blocks, writing packets to disk until close is called
+func (w *webmRecording) run() {
+	defer w.file.close()
+
+	for {
+		select {
+		case p := <-w.packets:
+			p.track.assembler.push(p.packet)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// writeFrame writes a frame of one of the tracks, starting off a new file
+// first, if it's time to.
+func (w *webmRecording) writeFrame(track *webmTrack, frame mediaFrame) {
+	w.lock.Lock()
+	if _, ok := w.tracks[track.downTrack]; !ok {
+		w.lock.Unlock()
+		return
+	}
+	changed := w.changed
+	tracks := []*webmTrack{}
+	for _, t := range w.tracks {
+		tracks = append(tracks, t)
+	}
+	w.lock.Unlock()
+
+	hasVideo := false
+	for _, t := range tracks {
+		if t.downTrack.Kind() == webrtc.RTPCodecTypeVideo {
+			hasVideo = true
+		}
+	}
+	isVideo := track.downTrack.Kind() == webrtc.RTPCodecTypeVideo
+
+	if !w.file.isOpen() || changed || w.file.due() {
+		// Files start off with a video keyframe, unless there's no video
+		canStart := (isVideo && frame.keyframe) || (!isVideo && !hasVideo)
+		if canStart {
+			if isVideo {
+				track.track.width, track.track.height, _ = videoDimensions(track.track.codec.MimeType, frame.data)
+			}
+			w.create(tracks)
+		} else if hasVideo && w.file.isOpen() {
+			// Carry on with the old file until there's a keyframe
+			for _, t := range tracks {
+				if t.downTrack.Kind() == webrtc.RTPCodecTypeVideo {
+					t.downTrack.RequestKeyframe()
+				}
+			}
+		}
+	}
+
+	if !w.file.isOpen() || !track.inFile {
+		return
+	}
+
+	if !track.hasBase {
+		track.baseTS = frame.timestamp
+		track.baseMilli = time.Since(w.file.started).Milliseconds()
+		track.hasBase = true
+	}
+	elapsed := int64(int32(frame.timestamp-track.baseTS)) * 1000 / int64(track.track.codec.ClockRate)
+
+	w.file.write(track.index, frame, track.baseMilli+elapsed)
+}
+
+// create starts off a new file, for the given tracks
+func (w *webmRecording) create(tracks []*webmTrack) {
+	w.lock.Lock()
+	w.changed = false
+	w.lock.Unlock()
+
+	for _, t := range w.fileTracks {
+		t.inFile = false
+	}
+	w.fileTracks = nil
+
+	// Video first, for whatever players that care
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return tracks[i].downTrack.Kind() == webrtc.RTPCodecTypeVideo &&
+			tracks[j].downTrack.Kind() != webrtc.RTPCodecTypeVideo
+	})
+
+	described := []recordingTrack{}
+	for i, t := range tracks {
+		t.index = i
+		t.hasBase = false
+		described = append(described, t.track)
+	}
+
+	if err := w.file.create(described); err != nil {
+		w.recording.logger().Warn("Failed to create recording", "err", err)
+		return
+	}
+
+	for _, t := range tracks {
+		t.inFile = true
+	}
+	w.fileTracks = tracks
+}
+
+// safeFileName turns any string into something that can be used as a file
+// name. Anything other than letters, digits, dashes, and underscores gets
+// replaced, so a bit of a hash goes on the end, to keep names that would've
+// otherwise ended up the same apart.
+func safeFileName(s string) string {
+	safe := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+	if len(safe) > 64 {
+		safe = safe[:64]
+	}
+
+	sum := sha1.Sum([]byte(s))
+	return fmt.Sprintf("%s_%s", safe, hex.EncodeToString(sum[:4]))
+}
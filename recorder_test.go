@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+)
+
+func TestIsRecordingPath(t *testing.T) {
+	key := safeFileName("some/key")
+	broadcast := safeFileName("broadcast")
+
+	tests := []struct {
+		name  string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"key directory", key, true, true},
+		{"broadcast directory", filepath.Join(key, broadcast), true, true},
+		{"ivf", filepath.Join(key, broadcast, "20240102T030405.678Z-"+safeFileName("video")+".ivf"), false, true},
+		{"ogg", filepath.Join(key, broadcast, "20240102T030405.678Z-"+safeFileName("audio")+".ogg"), false, true},
+		{"webm", filepath.Join(key, broadcast, "20240102T030405.678Z.webm"), false, true},
+
+		{"unrelated directory", "backups", true, false},
+		{"too deep a directory", filepath.Join(key, broadcast, key), true, false},
+		{"unrelated file", filepath.Join(key, broadcast, "notes.txt"), false, false},
+		{"other extension", filepath.Join(key, broadcast, "20240102T030405.678Z.mp4"), false, false},
+		{"unhashed name", filepath.Join(key, broadcast, "20240102T030405.678Z-video.ivf"), false, false},
+		{"file at the top", "20240102T030405.678Z.webm", false, false},
+		{"file too shallow", filepath.Join(key, "20240102T030405.678Z.webm"), false, false},
+		{"unrelated parent", filepath.Join("backups", broadcast, "20240102T030405.678Z.webm"), false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRecordingPath(test.path, test.isDir); got != test.want {
+				t.Errorf("isRecordingPath(%q, %v) = %v, want %v", test.path, test.isDir, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEnforceRetention(t *testing.T) {
+	broadcast := filepath.Join(safeFileName("some/key"), safeFileName("broadcast"))
+	open := filepath.Join(broadcast, "20240102T050405.678Z.ivf")
+
+	type file struct {
+		path string
+		size int
+		age  time.Duration
+		left bool
+	}
+
+	tests := []struct {
+		name      string
+		retention config.RecordingRetention
+		files     []file
+	}{
+		{
+			name:      "too old",
+			retention: config.RecordingRetention{MaxAgeSeconds: 60},
+			files: []file{
+				{filepath.Join(broadcast, "20240102T030405.678Z.webm"), 10, time.Hour, false},
+				{filepath.Join(broadcast, "20240102T040405.678Z.webm"), 10, 0, true},
+				{open, 10, time.Hour, true},
+				{filepath.Join(broadcast, "notes.txt"), 10, time.Hour, true},
+				{filepath.Join("backups", "b", "20240102T030405.678Z.webm"), 10, time.Hour, true},
+				{"database.sqlite", 10, time.Hour, true},
+			},
+		},
+		{
+			name:      "too big",
+			retention: config.RecordingRetention{MaxTotalSize: 25},
+			files: []file{
+				{filepath.Join(broadcast, "20240102T030405.678Z.webm"), 10, 2 * time.Hour, false},
+				{filepath.Join(broadcast, "20240102T040405.678Z.webm"), 10, time.Hour, true},
+				{filepath.Join(broadcast, "20240102T050405.678Z.webm"), 10, 0, true},
+
+				// Doesn't count towards the total
+				{"database.sqlite", 1000, 3 * time.Hour, true},
+			},
+		},
+		{
+			name:      "empty directories",
+			retention: config.RecordingRetention{MaxAgeSeconds: 60},
+			files: []file{
+				{filepath.Join(broadcast, "20240102T030405.678Z.webm"), 10, time.Hour, false},
+				{broadcast, 0, 0, false},
+				{filepath.Dir(broadcast), 0, 0, false},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, f := range test.files {
+				path := filepath.Join(root, f.path)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				// Directories get made along the way, for the files in them
+				if _, err := os.Stat(path); err == nil {
+					continue
+				}
+				if err := os.WriteFile(path, make([]byte, f.size), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				modified := time.Now().Add(-f.age)
+				if err := os.Chtimes(path, modified, modified); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			recorder := &Recorder{lock: &sync.Mutex{}, open: Set[string]{}}
+			recorder.opened(filepath.Join(root, open))
+			recorder.enforceRetention(root, test.retention)
+
+			for _, f := range test.files {
+				_, err := os.Stat(filepath.Join(root, f.path))
+				if exists := err == nil; exists != f.left {
+					t.Errorf("%s exists: %v, want %v", f.path, exists, f.left)
+				}
+			}
+		})
+	}
+}
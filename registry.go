@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// RegistryNode is a single server, as the other servers sharing a registry see
+// it
+type RegistryNode struct {
+	ID string `json:"id"`
+
+	// Where other servers can reach the server. Empty if they can't.
+	URL string `json:"url"`
+}
+
+// RegistryEntry says that a node has tracks of a kind for a broadcast, i.e.
+// that the broadcast (or at least that part of it) lives there
+type RegistryEntry struct {
+	KeyID       KeyIDString       `json:"keyId"`
+	BroadcastID BroadcastIDString `json:"id"`
+	Kind        KindString        `json:"kind"`
+	Node        RegistryNode      `json:"node"`
+}
+
+// Registry keeps track of where broadcasts live, for when there's more than a
+// single server. Every server publishes the kinds of tracks that each of its
+// broadcasts has, and any server can then look up which server a broadcast is
+// on.
+//
+// Publishing an entry that's already published, or unpublishing one that isn't,
+// does nothing.
+type Registry interface {
+	Publish(entry RegistryEntry) error
+	Unpublish(entry RegistryEntry) error
+
+	// Lookup lists every entry for a broadcast, by kind, and then by node ID
+	Lookup(keyID KeyIDString, broadcastID BroadcastIDString) ([]RegistryEntry, error)
+
+	// Watch calls the callback with the entries for a broadcast right away (or
+	// as soon as they're known), and then again every time that they change,
+	// until the returned function is called.
+	Watch(
+		keyID KeyIDString,
+		broadcastID BroadcastIDString,
+		callback func([]RegistryEntry),
+	) func()
+}
+
+// registryEntryKey tells the entries for a single broadcast apart
+type registryEntryKey struct {
+	kind   KindString
+	nodeID string
+}
+
+// registryWatcher gets told whenever the entries for a broadcast change
+type registryWatcher struct {
+	callback func([]RegistryEntry)
+}
+
+// MemoryRegistry is a registry that's kept right in memory. It's all that a
+// single server needs, and it's what the registry server keeps the registry of
+// every other server in.
+type MemoryRegistry struct {
+	lock *sync.Mutex
+
+	entries  Map3D[KeyIDString, BroadcastIDString, registryEntryKey, RegistryEntry]
+	watchers map[broadcastKey]Set[*registryWatcher]
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		lock:     &sync.Mutex{},
+		entries:  Map3D[KeyIDString, BroadcastIDString, registryEntryKey, RegistryEntry]{},
+		watchers: map[broadcastKey]Set[*registryWatcher]{},
+	}
+}
+
+func (r *MemoryRegistry) Publish(entry RegistryEntry) error {
+	key := registryEntryKey{entry.Kind, entry.Node.ID}
+
+	r.lock.Lock()
+	if current, ok := r.entries.Get(entry.KeyID, entry.BroadcastID, key); ok && current == entry {
+		r.lock.Unlock()
+		return nil
+	}
+	r.entries.Set(entry.KeyID, entry.BroadcastID, key, entry)
+	r.lock.Unlock()
+
+	r.notifyWatchers(entry.KeyID, entry.BroadcastID)
+	return nil
+}
+
+func (r *MemoryRegistry) Unpublish(entry RegistryEntry) error {
+	key := registryEntryKey{entry.Kind, entry.Node.ID}
+
+	r.lock.Lock()
+	if _, ok := r.entries.Get(entry.KeyID, entry.BroadcastID, key); !ok {
+		r.lock.Unlock()
+		return nil
+	}
+	r.entries.Remove(entry.KeyID, entry.BroadcastID, key)
+	r.lock.Unlock()
+
+	r.notifyWatchers(entry.KeyID, entry.BroadcastID)
+	return nil
+}
+
+func (r *MemoryRegistry) Lookup(
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+) ([]RegistryEntry, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.broadcastEntries(keyID, broadcastID), nil
+}
+
+func (r *MemoryRegistry) Watch(
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+	callback func([]RegistryEntry),
+) func() {
+	watcher := &registryWatcher{callback}
+	key := broadcastKey{keyID, broadcastID}
+
+	r.lock.Lock()
+	watchers, ok := r.watchers[key]
+	if !ok {
+		watchers = Set[*registryWatcher]{}
+		r.watchers[key] = watchers
+	}
+	watchers.Add(watcher)
+	entries := r.broadcastEntries(keyID, broadcastID)
+	r.lock.Unlock()
+
+	callback(entries)
+
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		watchers.Remove(watcher)
+		if len(watchers) == 0 {
+			delete(r.watchers, key)
+		}
+	}
+}
+
+// NOT THREAD SAFE!
+func (r *MemoryRegistry) broadcastEntries(
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+) []RegistryEntry {
+	entries := []RegistryEntry{}
+	for _, entry := range r.entries[keyID][broadcastID] {
+		entries = append(entries, entry)
+	}
+	sortRegistryEntries(entries)
+	return entries
+}
+
+// notifyWatchers tells everyone watching a broadcast what its entries are. The
+// callbacks are called without the lock held, just like with the tracks
+// manager's watchers.
+func (r *MemoryRegistry) notifyWatchers(keyID KeyIDString, broadcastID BroadcastIDString) {
+	r.lock.Lock()
+	entries := r.broadcastEntries(keyID, broadcastID)
+	watchers := []*registryWatcher{}
+	for watcher := range r.watchers[broadcastKey{keyID, broadcastID}] {
+		watchers = append(watchers, watcher)
+	}
+	r.lock.Unlock()
+
+	for _, watcher := range watchers {
+		watcher.callback(entries)
+	}
+}
+
+func sortRegistryEntries(entries []RegistryEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].Node.ID < entries[j].Node.ID
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// How long the tests wait for the HTTP registry to catch up with the registry
+// server, and the other way around
+const registryTestTimeout = 2 * time.Second
+
+// newTestRegistry starts a registry server, for HTTP registries to use. Long
+// polls are cut short, so that the tests don't have to wait them out.
+func newTestRegistry(t *testing.T, token string) (*RegistryServer, *httptest.Server) {
+	t.Helper()
+
+	server := NewRegistryServer(token)
+	server.longPollTimeout = 50 * time.Millisecond
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	return server, httpServer
+}
+
+func newTestHTTPRegistry(t *testing.T, httpServer *httptest.Server, token string) *HTTPRegistry {
+	t.Helper()
+
+	u, err := url.Parse(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHTTPRegistry(u, token)
+}
+
+// waitForEntries waits for the registry server to have exactly the given
+// entries for the broadcast
+func waitForEntries(
+	t *testing.T,
+	server *RegistryServer,
+	keyID KeyIDString,
+	broadcastID BroadcastIDString,
+	want []RegistryEntry,
+) {
+	t.Helper()
+
+	deadline := time.Now().Add(registryTestTimeout)
+	for {
+		got, _ := server.registry.Lookup(keyID, broadcastID)
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("registry server has %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testRegistryEntry(kind KindString, nodeID string) RegistryEntry {
+	return RegistryEntry{
+		KeyID:       "some/key",
+		BroadcastID: "broadcast",
+		Kind:        kind,
+		Node:        RegistryNode{ID: nodeID, URL: "http://" + nodeID + ".internal"},
+	}
+}
+
+func TestHTTPRegistryPublishAndUnpublish(t *testing.T) {
+	server, httpServer := newTestRegistry(t, "")
+	registry := newTestHTTPRegistry(t, httpServer, "")
+	go registry.Run()
+
+	video := testRegistryEntry("video", "a")
+	audio := testRegistryEntry("audio", "a")
+
+	registry.Publish(video)
+	registry.Publish(audio)
+	waitForEntries(t, server, video.KeyID, video.BroadcastID, []RegistryEntry{audio, video})
+
+	registry.Unpublish(video)
+	waitForEntries(t, server, video.KeyID, video.BroadcastID, []RegistryEntry{audio})
+
+	registry.Unpublish(audio)
+	waitForEntries(t, server, video.KeyID, video.BroadcastID, []RegistryEntry{})
+}
+
+func TestHTTPRegistryLookupOrder(t *testing.T) {
+	server, httpServer := newTestRegistry(t, "")
+	registry := newTestHTTPRegistry(t, httpServer, "")
+
+	published := []RegistryEntry{
+		testRegistryEntry("video", "c"),
+		testRegistryEntry("audio", "b"),
+		testRegistryEntry("video", "a"),
+		testRegistryEntry("audio", "c"),
+		testRegistryEntry("audio", "a"),
+	}
+	for _, entry := range published {
+		server.registry.Publish(entry)
+	}
+
+	got, err := registry.Lookup("some/key", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := append([]RegistryEntry{}, published...)
+	sortRegistryEntries(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Lookup returned %v, want %v", got, want)
+	}
+
+	// Spelled out, in case sortRegistryEntries itself is off
+	order := []registryEntryKey{{"audio", "a"}, {"audio", "b"}, {"audio", "c"}, {"video", "a"}, {"video", "c"}}
+	for i, entry := range got {
+		if key := (registryEntryKey{entry.Kind, entry.Node.ID}); key != order[i] {
+			t.Fatalf("entry %d is %v, want %v", i, key, order[i])
+		}
+	}
+
+	got, err = registry.Lookup("some/key", "elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("Lookup of an unknown broadcast returned %v", got)
+	}
+}
+
+func TestHTTPRegistryWatch(t *testing.T) {
+	server, httpServer := newTestRegistry(t, "")
+	registry := newTestHTTPRegistry(t, httpServer, "")
+
+	updates := make(chan []RegistryEntry, 16)
+	unwatch := registry.Watch("some/key", "broadcast", func(entries []RegistryEntry) {
+		updates <- entries
+	})
+	defer unwatch()
+
+	next := func() []RegistryEntry {
+		t.Helper()
+		select {
+		case entries := <-updates:
+			return entries
+		case <-time.After(registryTestTimeout):
+			t.Fatal("Watch didn't call back")
+			return nil
+		}
+	}
+
+	if entries := next(); len(entries) != 0 {
+		t.Fatalf("Watch started with %v, want nothing", entries)
+	}
+
+	// Long polls that time out come back with a 304, which isn't a change
+	select {
+	case entries := <-updates:
+		t.Fatalf("Watch called back with %v, without anything changing", entries)
+	case <-time.After(5 * server.longPollTimeout):
+	}
+
+	video := testRegistryEntry("video", "a")
+	server.registry.Publish(video)
+	if entries := next(); !reflect.DeepEqual(entries, []RegistryEntry{video}) {
+		t.Fatalf("Watch called back with %v, want %v", entries, []RegistryEntry{video})
+	}
+
+	server.registry.Unpublish(video)
+	if entries := next(); len(entries) != 0 {
+		t.Fatalf("Watch called back with %v, want nothing", entries)
+	}
+}
+
+func TestRegistryServerNotModified(t *testing.T) {
+	server, httpServer := newTestRegistry(t, "")
+	server.registry.Publish(testRegistryEntry("video", "a"))
+
+	path := httpServer.URL + registryEntryPath("some/key", "broadcast")
+
+	res, err := http.Get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("got %d with ETag %q, want 200 with an ETag", res.StatusCode, etag)
+	}
+
+	// Without ?wait, that's right away. With it, it's once the long poll runs
+	// out, since nothing changes.
+	for _, query := range []string{"", "?wait"} {
+		req, err := http.NewRequest(http.MethodGet, path+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-None-Match", etag)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotModified {
+			t.Fatalf("GET%s with a matching ETag got %d, want 304", query, res.StatusCode)
+		}
+	}
+}
+
+func TestRegistryServerUnauthorized(t *testing.T) {
+	server, httpServer := newTestRegistry(t, "secret")
+	entry := testRegistryEntry("video", "a")
+	server.registry.Publish(entry)
+
+	path := httpServer.URL + registryEntryPath("some/key", "broadcast")
+	for _, authorization := range []string{"", "Bearer wrong", "secret"} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Authorization %q got %d, want 401", authorization, res.StatusCode)
+		}
+	}
+
+	if _, err := newTestHTTPRegistry(t, httpServer, "wrong").Lookup("some/key", "broadcast"); err == nil {
+		t.Fatal("Lookup with the wrong token didn't fail")
+	}
+
+	got, err := newTestHTTPRegistry(t, httpServer, "secret").Lookup("some/key", "broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []RegistryEntry{entry}) {
+		t.Fatalf("Lookup returned %v, want %v", got, []RegistryEntry{entry})
+	}
+}
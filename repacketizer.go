@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// The most payload that repacketized packets carry. Anything bigger might not
+// make it over the internet in one piece, once WebRTC has had its way with it.
+const repacketizerMTU = 1200
+
+// h26xRepacketizer puts H.264 and H.265 from sources other than browsers (such
+// as IP cameras) back into packets that WebRTC receivers can take. Those
+// sources tend to send packets much bigger than would ever make it over the
+// internet (especially over TCP), and to leave the parameter sets out of the
+// stream, since the SDP already has them.
+//
+// So, frames are put back together, the parameter sets put in front of every
+// keyframe that doesn't have them, and everything split up into packets no
+// bigger than the MTU.
+type h26xRepacketizer struct {
+	h265 bool
+
+	assembler *frameAssembler
+	onPacket  func(*rtp.Packet)
+
+	// The latest of each of the parameter sets, by NAL unit type
+	parameterSets map[byte][]byte
+
+	ssrc           uint32
+	payloadType    uint8
+	sequenceNumber uint16
+}
+
+// newH26xRepacketizer has repacketized packets go to onPacket. Parameter sets
+// are taken out of the codec's fmtp line, if they're in there.
+func newH26xRepacketizer(codec webrtc.RTPCodecCapability, onPacket func(*rtp.Packet)) *h26xRepacketizer {
+	r := &h26xRepacketizer{
+		h265:          strings.EqualFold(codec.MimeType, webrtc.MimeTypeH265),
+		onPacket:      onPacket,
+		parameterSets: map[byte][]byte{},
+	}
+	r.assembler = newFrameAssembler(codec, r.writeFrame, func() {})
+
+	// sprop-parameter-sets, for H.264, and sprop-vps, sprop-sps, and
+	// sprop-pps, for H.265
+	for _, param := range strings.Split(codec.SDPFmtpLine, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch strings.ToLower(key) {
+		case "sprop-parameter-sets", "sprop-vps", "sprop-sps", "sprop-pps":
+		default:
+			continue
+		}
+		for _, encoded := range strings.Split(value, ",") {
+			if unit, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(unit) > 0 {
+				r.learn(unit)
+			}
+		}
+	}
+
+	return r
+}
+
+// nalUnitType gets the type of a NAL unit, out of its header
+func (r *h26xRepacketizer) nalUnitType(unit []byte) byte {
+	if r.h265 {
+		return (unit[0] >> 1) & 0x3F
+	}
+	return unit[0] & 0x1F
+}
+
+// isParameterSet tells whether the NAL unit type is one of the parameter sets
+func (r *h26xRepacketizer) isParameterSet(naluType byte) bool {
+	if r.h265 {
+		return naluType == h265NALUTypeVPS || naluType == h265NALUTypeSPS || naluType == h265NALUTypePPS
+	}
+	return naluType == h264NALUTypeSPS || naluType == h264NALUTypePPS
+}
+
+// learn keeps the NAL unit around, if it's a parameter set, so that it can be
+// put in front of keyframes that don't have it
+func (r *h26xRepacketizer) learn(unit []byte) {
+	if naluType := r.nalUnitType(unit); r.isParameterSet(naluType) {
+		r.parameterSets[naluType] = append([]byte(nil), unit...)
+	}
+}
+
+func (r *h26xRepacketizer) push(packet *rtp.Packet) {
+	r.ssrc = packet.SSRC
+	r.payloadType = packet.PayloadType
+	r.assembler.push(packet)
+}
+
+func (r *h26xRepacketizer) writeFrame(frame mediaFrame) {
+	units := [][]byte{}
+	hasParameterSets := false
+	for _, unit := range h264NALUnits(frame.data) {
+		if len(unit) < 2 {
+			continue
+		}
+		if r.isParameterSet(r.nalUnitType(unit)) {
+			hasParameterSets = true
+			r.learn(unit)
+		}
+		units = append(units, unit)
+	}
+
+	if frame.keyframe && !hasParameterSets {
+		// In order, since the decoder needs them in order
+		prefix := [][]byte{}
+		types := []byte{h264NALUTypeSPS, h264NALUTypePPS}
+		if r.h265 {
+			types = []byte{h265NALUTypeVPS, h265NALUTypeSPS, h265NALUTypePPS}
+		}
+		for _, naluType := range types {
+			if unit, ok := r.parameterSets[naluType]; ok {
+				prefix = append(prefix, unit)
+			}
+		}
+		units = append(prefix, units...)
+	}
+
+	payloads := [][]byte{}
+	for _, unit := range units {
+		payloads = append(payloads, r.fragment(unit)...)
+	}
+
+	for i, payload := range payloads {
+		r.onPacket(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				PayloadType:    r.payloadType,
+				SequenceNumber: r.sequenceNumber,
+				Timestamp:      frame.timestamp,
+				SSRC:           r.ssrc,
+			},
+			Payload: payload,
+		})
+		r.sequenceNumber++
+	}
+}
+
+// fragment splits a NAL unit up into fragmentation units (FU-A, for H.264), if
+// it doesn't fit in a single packet
+func (r *h26xRepacketizer) fragment(unit []byte) [][]byte {
+	if len(unit) <= repacketizerMTU {
+		return [][]byte{unit}
+	}
+
+	var header []byte
+	var data []byte
+	if r.h265 {
+		// Payload header, followed by the fragmentation unit header
+		header = []byte{unit[0]&0x81 | h265NALUTypeFU<<1, unit[1], r.nalUnitType(unit)}
+		data = unit[2:]
+	} else {
+		header = []byte{unit[0]&0xE0 | h264NALUTypeFUA, r.nalUnitType(unit)}
+		data = unit[1:]
+	}
+	fuHeader := len(header) - 1
+
+	payloads := [][]byte{}
+	size := repacketizerMTU - len(header)
+	for offset := 0; offset < len(data); offset += size {
+		end := offset + size
+		if end > len(data) {
+			end = len(data)
+		}
+
+		payload := make([]byte, 0, len(header)+end-offset)
+		payload = append(payload, header...)
+		if offset == 0 {
+			payload[fuHeader] |= 0x80
+		}
+		if end == len(data) {
+			payload[fuHeader] |= 0x40
+		}
+		payloads = append(payloads, append(payload, data[offset:end]...))
+	}
+	return payloads
+}
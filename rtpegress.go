@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/gorilla/mux"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// The payload type that everything without a static one goes out with.
+	// Since every sink sends just the one track, there's nothing to clash with.
+	rtpEgressDynamicPayloadType = 96
+
+	// How long to wait, after handing out a sink's SDP, before asking for a
+	// keyframe. That's roughly how long ffmpeg takes to start listening.
+	rtpEgressKeyframeDelay = time.Second
+
+	rtpEgressMaxBodySize = 1 << 16
+)
+
+// RTPEgress sends tracks of broadcasts, as plain RTP over UDP, to wherever
+// they're needed, so that they can be piped into ffmpeg, GStreamer, or
+// whatever else, for archiving and analysis.
+//
+// Each sink sends a single track, and has an SDP file describing it, so that
+// `ffmpeg -i http://sfu/egress/{name}/stream.sdp` knows what to expect. Sinks
+// come from the configuration file, and from the API.
+type RTPEgress struct {
+	tracksAndConnections TracksAndConnectionsManager
+
+	lock  *sync.Mutex
+	sinks map[string]*rtpEgressSink
+}
+
+// RTPEgressInfo is what the API says about a sink
+type RTPEgressInfo struct {
+	config.RTPEgressSink
+
+	// MIME type of what's being sent. Empty while there's nothing to send.
+	Codec   string `json:"codec,omitempty"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+func NewRTPEgress(tracksAndConnections TracksAndConnectionsManager) *RTPEgress {
+	return &RTPEgress{
+		tracksAndConnections: tracksAndConnections,
+		lock:                 &sync.Mutex{},
+		sinks:                map[string]*rtpEgressSink{},
+	}
+}
+
+// AddConfigured adds every sink from the configuration file. A sink that can't
+// be added (e.g. its destination's host name doesn't resolve) is skipped.
+func (e *RTPEgress) AddConfigured() {
+	for _, c := range config.RTPEgressSinks() {
+		if err := e.Add(c); err != nil {
+			slog.Error("Failed to add RTP egress sink", "component", "rtpEgress", "sink", c.Name, "err", err)
+		}
+	}
+}
+
+// Add starts sending a track to the sink's destination, for as long as the
+// sink is around. Sinks are replaced by sinks with the same name.
+func (e *RTPEgress) Add(c config.RTPEgressSink) error {
+	if err := config.CheckRTPEgressSink(c); err != nil {
+		return err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", c.Destination)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	sink := &rtpEgressSink{
+		config:      c,
+		destination: addr,
+		conn:        conn,
+		lock:        &sync.Mutex{},
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if old, ok := e.sinks[c.Name]; ok {
+		e.stop(old)
+	}
+	e.sinks[c.Name] = sink
+
+	rtpEgressLogger(c).Info("Sending track as RTP")
+	e.tracksAndConnections.AddSink(TrackKey{
+		KeyID:       KeyIDString(c.KeyID),
+		BroadcastID: BroadcastIDString(c.ID),
+		Kind:        KindString(c.Kind),
+		TrackID:     TrackIDString(c.Track),
+	}, sink)
+
+	return nil
+}
+
+// Remove stops the sink with the given name. Returns false if there's no such
+// sink.
+func (e *RTPEgress) Remove(name string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	sink, ok := e.sinks[name]
+	if ok {
+		delete(e.sinks, name)
+		e.stop(sink)
+	}
+	return ok
+}
+
+// NOT THREAD SAFE! Only call this while holding the lock
+func (e *RTPEgress) stop(sink *rtpEgressSink) {
+	e.tracksAndConnections.RemoveSink(sink)
+	sink.conn.Close()
+	rtpEgressLogger(sink.config).Info("Stopped sending track as RTP")
+}
+
+func (e *RTPEgress) sink(name string) (*rtpEgressSink, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	sink, ok := e.sinks[name]
+	return sink, ok
+}
+
+// authorized tells whether the request comes with the API token, and if not,
+// says so
+func (e *RTPEgress) authorized(res http.ResponseWriter, req *http.Request) bool {
+	if token, ok := bearerToken(req); ok && config.IsRTPEgressAPIToken(token) {
+		return true
+	}
+	res.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(res, "Missing or unknown bearer token", http.StatusUnauthorized)
+	return false
+}
+
+// HandleSinks handles /egress, which lists every sink on GET, and creates one
+// from the JSON body on POST
+func (e *RTPEgress) HandleSinks(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		res.Header().Set("Allow", "GET, POST")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !e.authorized(res, req) {
+		return
+	}
+
+	if req.Method == http.MethodGet {
+		e.lock.Lock()
+		infos := []RTPEgressInfo{}
+		for _, sink := range e.sinks {
+			infos = append(infos, sink.info())
+		}
+		e.lock.Unlock()
+
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(infos)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, rtpEgressMaxBodySize))
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var c config.RTPEgressSink
+	if err := json.Unmarshal(body, &c); err != nil {
+		http.Error(res, "Failed to parse sink: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := config.CheckRTPEgressSink(c); err != nil {
+		http.Error(res, "Bad sink: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, exists := e.sink(c.Name); exists {
+		http.Error(res, fmt.Sprintf("There's already a sink named %q", c.Name), http.StatusConflict)
+		return
+	}
+	if err := e.Add(c); err != nil {
+		http.Error(res, "Failed to create sink: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sink, _ := e.sink(c.Name)
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Location", "/egress/"+c.Name)
+	res.WriteHeader(http.StatusCreated)
+	json.NewEncoder(res).Encode(sink.info())
+}
+
+// HandleSink handles /egress/{name}, which describes the sink on GET, and
+// destroys it on DELETE
+func (e *RTPEgress) HandleSink(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodDelete {
+		res.Header().Set("Allow", "GET, DELETE")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !e.authorized(res, req) {
+		return
+	}
+
+	name := mux.Vars(req)["name"]
+	sink, ok := e.sink(name)
+	if !ok {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		e.Remove(name)
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(sink.info())
+}
+
+// HandleSDP handles /egress/{name}/stream.sdp, which is what to point ffmpeg
+// (or anything else) at. It doesn't need the API token, since ffmpeg wouldn't
+// know to send it.
+func (e *RTPEgress) HandleSDP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		res.Header().Set("Allow", "GET, HEAD")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	sink, ok := e.sink(mux.Vars(req)["name"])
+	if !ok {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	description, ok := sink.sdp()
+	if !ok {
+		// There's no saying what the codec is going to be until there's a track
+		res.Header().Set("Retry-After", "1")
+		http.Error(res, "The broadcast has nothing to send yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Whoever is fetching the SDP is about to start listening, and is going to
+	// need a keyframe to start off with
+	time.AfterFunc(rtpEgressKeyframeDelay, sink.requestKeyframe)
+
+	res.Header().Set("Content-Type", "application/sdp")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Write([]byte(description))
+}
+
+// rtpEgressSink is a TrackSink that sends whatever it gets to a UDP
+// destination
+type rtpEgressSink struct {
+	config      config.RTPEgressSink
+	destination *net.UDPAddr
+	conn        *net.UDPConn
+
+	lock *sync.Mutex
+
+	// What's being sent right now. Nil if nothing is.
+	downTrack   *DownTrack
+	codec       webrtc.RTPCodecCapability
+	payloadType uint8
+
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+// AddDownTrack is part of TrackSink
+func (s *rtpEgressSink) AddDownTrack(key TrackKey, downTrack *DownTrack) webrtc.TrackLocalWriter {
+	codec := downTrack.Track().Codec()
+	payloadType := rtpPayloadType(codec, rtpEgressDynamicPayloadType)
+
+	s.lock.Lock()
+	s.downTrack = downTrack
+	s.codec = codec
+	s.payloadType = payloadType
+	s.lock.Unlock()
+
+	return rtpEgressWriter{s, payloadType}
+}
+
+// RemoveDownTrack is part of TrackSink
+func (s *rtpEgressSink) RemoveDownTrack(key TrackKey, downTrack *DownTrack) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.downTrack == downTrack {
+		s.downTrack = nil
+	}
+}
+
+func (s *rtpEgressSink) requestKeyframe() {
+	s.lock.Lock()
+	downTrack := s.downTrack
+	s.lock.Unlock()
+
+	if downTrack != nil {
+		downTrack.RequestKeyframe()
+	}
+}
+
+func (s *rtpEgressSink) info() RTPEgressInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info := RTPEgressInfo{
+		RTPEgressSink: s.config,
+		Packets:       s.packets.Load(),
+		Bytes:         s.bytes.Load(),
+	}
+	if s.downTrack != nil {
+		info.Codec = s.codec.MimeType
+	}
+	return info
+}
+
+// sdp describes what the sink is sending, for whoever is on the receiving end.
+// Returns false if there's nothing being sent yet.
+func (s *rtpEgressSink) sdp() (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.downTrack == nil {
+		return "", false
+	}
+
+	addressType := "IP4"
+	if s.destination.IP.To4() == nil {
+		addressType = "IP6"
+	}
+
+	lines := []string{
+		"v=0",
+		fmt.Sprintf("o=- 0 0 IN %s %s", addressType, s.destination.IP.String()),
+		fmt.Sprintf("s=%s/%s", s.config.KeyID, s.config.ID),
+		fmt.Sprintf("c=IN %s %s", addressType, s.destination.IP.String()),
+		"t=0 0",
+		fmt.Sprintf("m=%s %d RTP/AVP %d", s.config.Kind, s.destination.Port, s.payloadType),
+		fmt.Sprintf("a=rtpmap:%d %s", s.payloadType, sdpRTPMap(s.codec)),
+	}
+	if s.codec.SDPFmtpLine != "" {
+		lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", s.payloadType, s.codec.SDPFmtpLine))
+	}
+	lines = append(lines, "a=recvonly")
+
+	return strings.Join(lines, "\r\n") + "\r\n", true
+}
+
+// rtpEgressWriter sends a DownTrack's packets to the sink's destination
+type rtpEgressWriter struct {
+	sink        *rtpEgressSink
+	payloadType uint8
+}
+
+func (w rtpEgressWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	header.PayloadType = w.payloadType
+	b, err := (&rtp.Packet{Header: *header, Payload: payload}).Marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	// Nobody listening (yet) is no reason to stop sending
+	if _, err := w.sink.conn.Write(b); err != nil {
+		return len(payload), nil
+	}
+
+	w.sink.packets.Add(1)
+	w.sink.bytes.Add(uint64(len(b)))
+	return len(payload), nil
+}
+
+func (w rtpEgressWriter) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&packet.Header, packet.Payload)
+}
+
+// rtpEgressLogger is the logger for everything to do with a sink
+func rtpEgressLogger(c config.RTPEgressSink) *slog.Logger {
+	return broadcastLogger(
+		slog.With("component", "rtpEgress", "sink", c.Name),
+		KeyIDString(c.KeyID),
+		BroadcastIDString(c.ID),
+	).With("kind", c.Kind, "track", c.Track, "destination", c.Destination)
+}
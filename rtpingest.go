@@ -0,0 +1,391 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// Big enough for any UDP datagram
+	rtpIngestReadSize = 1 << 16
+
+	// How many packets can pile up for a stream, before they start getting
+	// dropped
+	rtpIngestQueueSize = 512
+)
+
+// RTPIngest turns plain RTP coming in over UDP (e.g. from `ffmpeg -f rtp`)
+// into broadcasts, so that pipelines without a browser can publish.
+//
+// Every configured stream becomes a track once its first packet arrives, and
+// stops being one once packets stop coming in for a while. A sender that
+// restarts (and so, comes back with a new SSRC) ends up as a brand new track,
+// which receivers get switched over to, just like when a browser publisher
+// reconnects.
+type RTPIngest struct {
+	tracksAndConnections TracksAndConnectionsManager
+	timeout              time.Duration
+
+	// Every configured stream, once Listen has been called
+	streams []*rtpIngestStream
+}
+
+func NewRTPIngest(tracksAndConnections TracksAndConnectionsManager) *RTPIngest {
+	return &RTPIngest{
+		tracksAndConnections: tracksAndConnections,
+		timeout:              config.RTPIngestTimeout(),
+	}
+}
+
+// Listen opens a UDP socket for every port that the configured streams come in
+// on, and starts reading from them in the background. Without any configured
+// streams, this does nothing.
+func (r *RTPIngest) Listen() error {
+	ports := map[int][]*rtpIngestStream{}
+	for _, c := range config.RTPIngestStreams() {
+		stream := newRTPIngestStream(r.tracksAndConnections, r.timeout, c)
+		ports[c.Port] = append(ports[c.Port], stream)
+		r.streams = append(r.streams, stream)
+	}
+
+	for port, streams := range ports {
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(config.RTPIngestAddress(), strconv.Itoa(port)))
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+
+		for _, stream := range streams {
+			stream.logger().Info(
+				"Listening for RTP",
+				"codec", stream.config.Codec.MimeType,
+				"address", conn.LocalAddr().String(),
+			)
+		}
+
+		go r.read(conn, streams)
+	}
+
+	return nil
+}
+
+// Sessions is part of SessionSource. Every stream that's being published is a
+// session of its own; a sender that restarts gets a new one.
+func (r *RTPIngest) Sessions() []SessionStatus {
+	sessions := []SessionStatus{}
+	for _, stream := range r.streams {
+		stream.lock.Lock()
+		if stream.source != nil {
+			sessions = append(sessions, SessionStatus{
+				ID:          stream.source.id,
+				Endpoint:    "rtp",
+				KeyID:       KeyIDString(stream.config.KeyID),
+				BroadcastID: BroadcastIDString(stream.config.ID),
+				Created:     stream.source.created,
+				Connected:   true,
+			})
+		}
+		stream.lock.Unlock()
+	}
+	return sessions
+}
+
+// SessionIDs is part of SessionSource. There are no peer connections involved
+// in RTP ingest.
+func (r *RTPIngest) SessionIDs() map[*webrtc.PeerConnection]string {
+	return map[*webrtc.PeerConnection]string{}
+}
+
+// CloseSession is part of SessionSource. The track goes away right away, but
+// there's no stopping the sender, so it gets published again (as a new session)
+// as soon as more packets come in.
+func (r *RTPIngest) CloseSession(id string, reason string) bool {
+	for _, stream := range r.streams {
+		stream.lock.Lock()
+		found := stream.source != nil && stream.source.id == id
+		stream.lock.Unlock()
+
+		if found {
+			stream.logger().Info("RTP stream closed by an administrator", "session", id, "reason", reason)
+			stream.close()
+			return true
+		}
+	}
+	return false
+}
+
+// read hands every packet that comes in on the socket to whichever stream it
+// belongs to, forever
+func (r *RTPIngest) read(conn *net.UDPConn, streams []*rtpIngestStream) {
+	buf := make([]byte, rtpIngestReadSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			slog.Error(
+				"Failed to read RTP",
+				"component", "rtpIngest",
+				"address", conn.LocalAddr().String(),
+				"err", err,
+			)
+			return
+		}
+
+		// RTCP might be coming in on the same port (payload types 200 to 223,
+		// once the marker bit gets included). Senders get along fine without us
+		// reading it.
+		if n < 2 || (buf[1] >= 192 && buf[1] <= 223) {
+			continue
+		}
+
+		// The buffer gets reused, and the packet is going to another goroutine
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+			continue
+		}
+
+		for _, stream := range streams {
+			if stream.config.SSRC == 0 || stream.config.SSRC == packet.SSRC {
+				stream.write(packet)
+				break
+			}
+		}
+	}
+}
+
+// rtpIngestStream is a single stream that's expected to come in over RTP, and
+// gets published once it does
+type rtpIngestStream struct {
+	tracksAndConnections TracksAndConnectionsManager
+	timeout              time.Duration
+	config               config.RTPIngestStream
+
+	// The session that whatever gets published belongs to, for streams that are
+	// part of something bigger (e.g. an RTSP camera). If empty, every source
+	// gets a session of its own.
+	sessionID string
+
+	lock *sync.Mutex
+
+	// Whatever is being published right now. Nil if nothing is.
+	source *rtpIngestSource
+}
+
+func newRTPIngestStream(
+	tracksAndConnections TracksAndConnectionsManager,
+	timeout time.Duration,
+	c config.RTPIngestStream,
+) *rtpIngestStream {
+	return &rtpIngestStream{
+		tracksAndConnections: tracksAndConnections,
+		timeout:              timeout,
+		config:               c,
+		lock:                 &sync.Mutex{},
+	}
+}
+
+// close stops publishing whatever is being published, right away, rather than
+// once packets have stopped coming in for a while. Any packets that come in
+// after have it published again.
+func (s *rtpIngestStream) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.source != nil {
+		s.source.close()
+		s.source = nil
+	}
+}
+
+func (s *rtpIngestStream) write(packet *rtp.Packet) {
+	if packet.PayloadType != s.config.Codec.PayloadType {
+		return
+	}
+
+	s.lock.Lock()
+	if s.source != nil && (s.source.ssrc != packet.SSRC || s.source.isClosed()) {
+		s.source.close()
+		s.source = nil
+	}
+	if s.source == nil {
+		source, err := s.publish(packet.SSRC)
+		if err != nil {
+			s.lock.Unlock()
+			s.logger().Error("Failed to create session ID", "err", err)
+			return
+		}
+		s.source = source
+	}
+	source := s.source
+	s.lock.Unlock()
+
+	source.write(packet)
+}
+
+// publish sets a new track on the stream's broadcast, with packets coming from
+// the returned source. NOT THREAD SAFE! Only call with the lock held.
+func (s *rtpIngestStream) publish(ssrc uint32) (*rtpIngestSource, error) {
+	id := s.sessionID
+	if id == "" {
+		var err error
+		if id, err = newSessionID(); err != nil {
+			return nil, err
+		}
+	}
+	source := newRTPIngestSource(id, ssrc, s.timeout)
+
+	keyID := KeyIDString(s.config.KeyID)
+	broadcastID := BroadcastIDString(s.config.ID)
+
+	feedback := []webrtc.RTCPFeedback{}
+	for _, f := range s.config.Codec.RTCPFeedback {
+		feedback = append(feedback, webrtc.RTCPFeedback{Type: f.Type, Parameter: f.Parameter})
+	}
+	track := NewForwardedTrack(
+		keyID,
+		broadcastID,
+		TrackIDString(s.config.Track),
+		webrtc.NewRTPCodecType(s.config.Kind),
+		webrtc.RTPCodecCapability{
+			MimeType:     s.config.Codec.MimeType,
+			ClockRate:    s.config.Codec.ClockRate,
+			Channels:     s.config.Codec.Channels,
+			SDPFmtpLine:  s.config.Codec.SDPFmtpLine,
+			RTCPFeedback: feedback,
+		},
+	)
+	forwarder := track.AddLayer(source, rtpIngestRTCPWriter{})
+
+	logger := s.logger().With("session", id, "ssrc", ssrc)
+	logger.Info("Publishing track from RTP")
+	s.tracksAndConnections.SetTrack(keyID, broadcastID, track)
+
+	go func() {
+		if err := forwarder.Run(); err != nil {
+			logger.Warn("Failed reading from RTP stream", "err", err)
+		}
+
+		stats := forwarder.Stats()
+		logger.Info("Stopped forwarding track from RTP", "packets", stats.Packets, "bytes", stats.Bytes)
+
+		track.RemoveLayer(forwarder)
+		s.tracksAndConnections.RemoveTrack(keyID, broadcastID, track)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.source == source {
+			s.source = nil
+		}
+	}()
+
+	return source, nil
+}
+
+// rtpIngestSource is where a forwarder reads an RTP stream's packets from, for
+// streams that don't come from a peer connection. It comes to an end once it's
+// closed, or once packets stop coming in.
+type rtpIngestSource struct {
+	id      string
+	created time.Time
+	ssrc    uint32
+	timeout time.Duration
+	packets chan *rtp.Packet
+
+	lock   *sync.Mutex
+	done   chan struct{}
+	closed bool
+}
+
+var _ RTPSource = &rtpIngestSource{}
+
+func newRTPIngestSource(id string, ssrc uint32, timeout time.Duration) *rtpIngestSource {
+	return &rtpIngestSource{
+		id:      id,
+		created: time.Now(),
+		ssrc:    ssrc,
+		timeout: timeout,
+		packets: make(chan *rtp.Packet, rtpIngestQueueSize),
+		done:    make(chan struct{}),
+		lock:    &sync.Mutex{},
+	}
+}
+
+func (s *rtpIngestSource) write(packet *rtp.Packet) {
+	select {
+	case s.packets <- packet:
+	default:
+		// The forwarder isn't keeping up, and packets get lost on UDP anyway
+	}
+}
+
+func (s *rtpIngestSource) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+func (s *rtpIngestSource) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// ReadRTP blocks until the next packet comes in. Once packets have stopped
+// coming in for the timeout, io.EOF is returned, just like for a remote track
+// whose publisher went away.
+func (s *rtpIngestSource) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+
+	select {
+	case packet := <-s.packets:
+		return packet, nil, nil
+	case <-s.done:
+		return nil, nil, io.EOF
+	case <-timer.C:
+		s.close()
+		return nil, nil, io.EOF
+	}
+}
+
+// RID is always empty; there's no simulcast over plain RTP
+func (s *rtpIngestSource) RID() string {
+	return ""
+}
+
+func (s *rtpIngestSource) SSRC() webrtc.SSRC {
+	return webrtc.SSRC(s.ssrc)
+}
+
+// rtpIngestRTCPWriter throws away keyframe requests. There's no way of getting
+// them to the sender (ffmpeg wouldn't listen anyway), so receivers just have to
+// wait for the sender's next keyframe.
+type rtpIngestRTCPWriter struct{}
+
+func (rtpIngestRTCPWriter) WriteRTCP(pkts []rtcp.Packet) error {
+	return nil
+}
+
+// logger is the logger for everything to do with the stream
+func (s *rtpIngestStream) logger() *slog.Logger {
+	return broadcastLogger(
+		slog.With("component", "rtpIngest"),
+		KeyIDString(s.config.KeyID),
+		BroadcastIDString(s.config.ID),
+	).With("kind", s.config.Kind, "track", s.config.Track)
+}
@@ -0,0 +1,824 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// The first payload type that tracks without a static one get. Every other
+	// track of the broadcast gets the next one.
+	rtspDynamicPayloadType = 96
+
+	// How many packets (and responses) can pile up for a client on TCP, before
+	// packets start getting dropped
+	rtspQueueSize = 1024
+
+	// How often clients get RTCP sender reports, so that they can line audio and
+	// video up
+	rtspReportInterval = 2 * time.Second
+
+	rtspMaxBodySize = 1 << 16
+
+	// The control attribute of each track, in DESCRIBE responses, is this,
+	// followed by the URL-escaped track ID
+	rtspTrackControl = "trackID="
+)
+
+var rtspStatusText = map[int]string{
+	http.StatusOK:                  "OK",
+	http.StatusBadRequest:          "Bad Request",
+	http.StatusUnauthorized:        "Unauthorized",
+	http.StatusNotFound:            "Not Found",
+	http.StatusMethodNotAllowed:    "Method Not Allowed",
+	http.StatusInternalServerError: "Internal Server Error",
+	http.StatusNotImplemented:      "Not Implemented",
+	454:                            "Session Not Found",
+	455:                            "Method Not Valid in This State",
+	461:                            "Unsupported Transport",
+}
+
+// RTSPServer makes live broadcasts available over RTSP, for monitoring tools
+// (VLC, NVR software, and the like) that don't speak anything else. Broadcasts
+// are at rtsp://host/{keyId}/{id}, and key IDs with slashes in them can have
+// them as is.
+//
+// RTSP clients get their tracks the same way that WebRTC receivers do: through
+// DownTracks. So, they get the best simulcast layer, and carry on through
+// publishers reconnecting, as long as the codecs don't change.
+//
+// Packets go out either interleaved on the RTSP connection itself, or over UDP.
+// A session only lasts as long as the connection that set it up.
+//
+// Just like with WHIP, clients can't authenticate with a key, so they log in
+// with a username and password instead, which the server's configuration maps
+// to a key ID. Clients only get to watch that key ID's broadcasts.
+type RTSPServer struct {
+	tracksAndConnections TracksAndConnectionsManager
+
+	// Shared by every session that gets its packets over UDP. Nil without an RTP
+	// port, in which case no session does.
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+}
+
+func NewRTSPServer(tracksAndConnections TracksAndConnectionsManager) *RTSPServer {
+	return &RTSPServer{tracksAndConnections: tracksAndConnections}
+}
+
+// ListenAndServe listens for RTSP connections on the configured TCP port, and
+// blocks, serving them. RTP for UDP clients goes out of the configured RTP port,
+// and RTCP out of the port after; without an RTP port, clients can only get
+// packets interleaved. Without a port, this returns right away.
+func (s *RTSPServer) ListenAndServe() error {
+	port := config.RTSPPort()
+	if port == 0 {
+		return nil
+	}
+
+	if rtpPort := config.RTSPRTPPort(); rtpPort != 0 {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: rtpPort})
+		if err != nil {
+			return err
+		}
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: rtpPort + 1})
+		if err != nil {
+			rtpConn.Close()
+			return err
+		}
+		s.rtpConn = rtpConn
+		s.rtcpConn = rtcpConn
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *RTSPServer) serve(conn net.Conn) {
+	c := &rtspConn{
+		server:       s,
+		conn:         conn,
+		reader:       bufio.NewReader(conn),
+		out:          make(chan []byte, rtspQueueSize),
+		done:         make(chan struct{}),
+		payloadTypes: map[TrackIDString]uint8{},
+	}
+	go c.write()
+
+	defer func() {
+		close(c.done)
+		conn.Close()
+		if c.session != nil {
+			c.session.stop()
+		}
+	}()
+
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn(
+					"Failed to read RTSP request",
+					"component", "rtsp",
+					"remote", conn.RemoteAddr().String(),
+					"err", err,
+				)
+			}
+			return
+		}
+		c.handle(req)
+	}
+}
+
+// rtspRequest is a single request from an RTSP client
+type rtspRequest struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+}
+
+// rtspResponse is what to answer an RTSP request with
+type rtspResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newRTSPResponse(status int) *rtspResponse {
+	return &rtspResponse{status: status, header: http.Header{}}
+}
+
+// rtspConn is a single client's RTSP connection
+type rtspConn struct {
+	server *RTSPServer
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Responses, and interleaved packets, all go out through here, so that a
+	// slow client can't hold up forwarding
+	out  chan []byte
+	done chan struct{}
+
+	// The payload types that the tracks were described with, so that they go
+	// out with those
+	payloadTypes map[TrackIDString]uint8
+
+	// Only ever touched from serve
+	session *rtspSession
+}
+
+func (c *rtspConn) write() {
+	for {
+		select {
+		case b := <-c.out:
+			if _, err := c.conn.Write(b); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// writeInterleaved sends a packet on the connection itself. If the client
+// isn't keeping up, the packet is dropped.
+func (c *rtspConn) writeInterleaved(channel uint8, packet []byte) {
+	frame := make([]byte, 4+len(packet))
+	frame[0] = '$'
+	frame[1] = channel
+	binary.BigEndian.PutUint16(frame[2:], uint16(len(packet)))
+	copy(frame[4:], packet)
+
+	select {
+	case c.out <- frame:
+	default:
+	}
+}
+
+// readRequest blocks until the next request comes in. Anything interleaved
+// that the client sends (i.e. RTCP receiver reports) is skipped.
+func (c *rtspConn) readRequest() (*rtspRequest, error) {
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		if _, err := c.reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	reader := textproto.NewReader(c.reader)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("bad request line %q", line)
+	}
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing that we handle has a body worth reading
+	if length := header.Get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n > rtspMaxBodySize {
+			return nil, fmt.Errorf("bad content length %q", length)
+		}
+		if _, err := c.reader.Discard(n); err != nil {
+			return nil, err
+		}
+	}
+
+	return &rtspRequest{method: parts[0], url: u, header: header}, nil
+}
+
+func (c *rtspConn) handle(req *rtspRequest) {
+	var res *rtspResponse
+	switch req.method {
+	case "OPTIONS", "GET_PARAMETER":
+		// GET_PARAMETER is what clients keep sessions alive with
+		res = newRTSPResponse(http.StatusOK)
+		res.header.Set("Public", "OPTIONS, DESCRIBE, SETUP, PLAY, PAUSE, TEARDOWN, GET_PARAMETER")
+	case "DESCRIBE":
+		res = c.describe(req)
+	case "SETUP":
+		res = c.setup(req)
+	case "PLAY":
+		res = c.play(req)
+	case "PAUSE":
+		res = c.pause(req)
+	case "TEARDOWN":
+		res = c.teardown(req)
+	default:
+		res = newRTSPResponse(http.StatusNotImplemented)
+	}
+
+	if c.session != nil {
+		res.header.Set("Session", c.session.id)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", res.status, rtspStatusText[res.status])
+	// Written out by hand, since it isn't spelled the way Go would spell it
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	if len(res.body) > 0 {
+		res.header.Set("Content-Length", strconv.Itoa(len(res.body)))
+	}
+	res.header.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(res.body)
+
+	select {
+	case c.out <- b.Bytes():
+	case <-c.done:
+	}
+}
+
+// broadcast gets the key ID, broadcast ID, and (for SETUP) the track ID out of
+// a request's URL. Everything but the last part (or the last two parts, for a
+// track) is the key ID.
+func (c *rtspConn) broadcast(req *rtspRequest) (KeyIDString, BroadcastIDString, TrackIDString, bool) {
+	parts := strings.Split(strings.Trim(req.url.EscapedPath(), "/"), "/")
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			return "", "", "", false
+		}
+		parts[i] = unescaped
+	}
+
+	trackID := ""
+	if last := parts[len(parts)-1]; strings.HasPrefix(last, rtspTrackControl) {
+		trackID = strings.TrimPrefix(last, rtspTrackControl)
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) < 2 {
+		return "", "", "", false
+	}
+
+	keyID := strings.Join(parts[:len(parts)-1], "/")
+	id := parts[len(parts)-1]
+	if keyID == "" || id == "" {
+		return "", "", "", false
+	}
+	return KeyIDString(keyID), BroadcastIDString(id), TrackIDString(trackID), true
+}
+
+// authorize makes sure that the request comes with the username and password
+// of a user that gets to watch the key ID's broadcasts. If it doesn't, the
+// response to send instead is returned.
+func (c *rtspConn) authorize(req *rtspRequest, keyID KeyIDString) (*rtspResponse, bool) {
+	username, password, ok := rtspBasicAuth(req)
+	if ok {
+		userKeyID, known := config.RTSPKeyID(username, password)
+		if known && KeyIDString(userKeyID) == keyID {
+			return nil, true
+		}
+		if known {
+			// Other key IDs' broadcasts may as well not exist
+			return newRTSPResponse(http.StatusNotFound), false
+		}
+	}
+
+	res := newRTSPResponse(http.StatusUnauthorized)
+	res.header.Set("WWW-Authenticate", `Basic realm="simple-forwarding-unit"`)
+	return res, false
+}
+
+// rtspBasicAuth gets the username and password out of a request's Basic
+// Authorization header, if there is one
+func rtspBasicAuth(req *rtspRequest) (string, string, bool) {
+	scheme, credentials, ok := strings.Cut(req.header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+func (c *rtspConn) describe(req *rtspRequest) *rtspResponse {
+	keyID, id, _, ok := c.broadcast(req)
+	if !ok {
+		return newRTSPResponse(http.StatusNotFound)
+	}
+	if res, ok := c.authorize(req, keyID); !ok {
+		return res
+	}
+
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		fmt.Sprintf("s=%s/%s", keyID, id),
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=control:*",
+	}
+
+	dynamic := uint8(rtspDynamicPayloadType)
+	described := 0
+	for _, info := range c.server.tracksAndConnections.Tracks(keyID, id).Tracks {
+		track, ok := c.server.tracksAndConnections.Track(keyID, id, info.ID)
+		if !ok {
+			continue
+		}
+		codec := track.Codec()
+
+		payloadType := rtpPayloadType(codec, dynamic)
+		if payloadType == dynamic {
+			dynamic++
+		}
+		c.payloadTypes[info.ID] = payloadType
+
+		lines = append(lines,
+			fmt.Sprintf("m=%s 0 RTP/AVP %d", info.Kind, payloadType),
+			fmt.Sprintf("a=rtpmap:%d %s", payloadType, sdpRTPMap(codec)),
+		)
+		if codec.SDPFmtpLine != "" {
+			lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", payloadType, codec.SDPFmtpLine))
+		}
+		lines = append(lines, "a=control:"+rtspTrackControl+url.PathEscape(string(info.ID)))
+		described++
+	}
+
+	if described == 0 {
+		return newRTSPResponse(http.StatusNotFound)
+	}
+
+	base := *req.url
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+		base.RawPath = ""
+	}
+
+	res := newRTSPResponse(http.StatusOK)
+	res.header.Set("Content-Type", "application/sdp")
+	res.header.Set("Content-Base", base.String())
+	res.body = []byte(strings.Join(lines, "\r\n") + "\r\n")
+	return res
+}
+
+// sessionFor makes sure that the request is for the connection's session
+func (c *rtspConn) sessionFor(req *rtspRequest) (*rtspSession, bool) {
+	id, _, _ := strings.Cut(req.header.Get("Session"), ";")
+	if c.session == nil || strings.TrimSpace(id) != c.session.id {
+		return nil, false
+	}
+	return c.session, true
+}
+
+func (c *rtspConn) setup(req *rtspRequest) *rtspResponse {
+	keyID, id, trackID, ok := c.broadcast(req)
+	if !ok || trackID == "" {
+		return newRTSPResponse(http.StatusNotFound)
+	}
+	if res, ok := c.authorize(req, keyID); !ok {
+		return res
+	}
+	track, ok := c.server.tracksAndConnections.Track(keyID, id, trackID)
+	if !ok {
+		return newRTSPResponse(http.StatusNotFound)
+	}
+
+	session := c.session
+	if req.header.Get("Session") != "" || session != nil {
+		if session, ok = c.sessionFor(req); !ok {
+			return newRTSPResponse(454)
+		}
+		if session.keyID != keyID || session.broadcastID != id {
+			return newRTSPResponse(455)
+		}
+	}
+
+	payloadType, ok := c.payloadTypes[trackID]
+	if !ok {
+		payloadType = rtpPayloadType(track.Codec(), rtspDynamicPayloadType)
+	}
+	media := &rtspMedia{
+		trackID:     trackID,
+		codec:       track.Codec(),
+		payloadType: payloadType,
+	}
+
+	transport, ok := c.transport(req.header.Get("Transport"), media)
+	if !ok {
+		return newRTSPResponse(461)
+	}
+
+	if session == nil {
+		sessionID, err := newSessionToken()
+		if err != nil {
+			slog.Error(
+				"Failed to create RTSP session ID",
+				"component", "rtsp",
+				"remote", c.conn.RemoteAddr().String(),
+				"err", err,
+			)
+			return newRTSPResponse(http.StatusInternalServerError)
+		}
+		session = &rtspSession{
+			id:          sessionID[:16],
+			conn:        c,
+			keyID:       keyID,
+			broadcastID: id,
+			lock:        &sync.Mutex{},
+			medias:      map[TrackIDString]*rtspMedia{},
+		}
+		c.session = session
+	}
+
+	// Tracks can't be added to what's already playing
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if session.playing {
+		return newRTSPResponse(455)
+	}
+	session.medias[trackID] = media
+
+	res := newRTSPResponse(http.StatusOK)
+	res.header.Set("Transport", transport)
+	return res
+}
+
+// transport picks the first of the transports that the client asked for that
+// works for us, and sets the media up for it. Returns the transport to respond
+// with.
+func (c *rtspConn) transport(header string, media *rtspMedia) (string, bool) {
+	for _, option := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(option), ";")
+		profile := strings.ToUpper(params[0])
+
+		values := map[string]string{}
+		multicast := false
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(param, "=")
+			values[strings.ToLower(key)] = value
+			if strings.EqualFold(key, "multicast") {
+				multicast = true
+			}
+		}
+		if multicast {
+			continue
+		}
+
+		switch profile {
+		case "RTP/AVP/TCP":
+			channel := uint8(2 * c.mediaCount())
+			if interleaved, ok := values["interleaved"]; ok {
+				first, _, _ := strings.Cut(interleaved, "-")
+				n, err := strconv.Atoi(first)
+				if err != nil || n < 0 || n > 254 {
+					continue
+				}
+				channel = uint8(n)
+			}
+			media.interleaved = true
+			media.channel = channel
+			return fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1), true
+
+		case "RTP/AVP", "RTP/AVP/UDP":
+			ports, ok := values["client_port"]
+			if !ok || c.server.rtpConn == nil {
+				continue
+			}
+			first, second, hasSecond := strings.Cut(ports, "-")
+			rtpPort, err := strconv.Atoi(first)
+			if err != nil || rtpPort <= 0 || rtpPort > 65535 {
+				continue
+			}
+			rtcpPort := rtpPort + 1
+			if hasSecond {
+				if rtcpPort, err = strconv.Atoi(second); err != nil {
+					continue
+				}
+			}
+
+			// Packets only ever go to whoever asked for them
+			addr, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+			if !ok {
+				continue
+			}
+			media.rtpAddr = &net.UDPAddr{IP: addr.IP, Port: rtpPort, Zone: addr.Zone}
+			media.rtcpAddr = &net.UDPAddr{IP: addr.IP, Port: rtcpPort, Zone: addr.Zone}
+			serverPort := c.server.rtpConn.LocalAddr().(*net.UDPAddr).Port
+			return fmt.Sprintf(
+				"RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d",
+				rtpPort, rtcpPort, serverPort, serverPort+1,
+			), true
+		}
+	}
+
+	return "", false
+}
+
+// mediaCount is how many tracks have been set up so far
+func (c *rtspConn) mediaCount() int {
+	if c.session == nil {
+		return 0
+	}
+	c.session.lock.Lock()
+	defer c.session.lock.Unlock()
+	return len(c.session.medias)
+}
+
+func (c *rtspConn) play(req *rtspRequest) *rtspResponse {
+	session, ok := c.sessionFor(req)
+	if !ok {
+		return newRTSPResponse(454)
+	}
+	session.play()
+
+	res := newRTSPResponse(http.StatusOK)
+	res.header.Set("Range", "npt=0.000-")
+	return res
+}
+
+func (c *rtspConn) pause(req *rtspRequest) *rtspResponse {
+	session, ok := c.sessionFor(req)
+	if !ok {
+		return newRTSPResponse(454)
+	}
+	session.stop()
+	return newRTSPResponse(http.StatusOK)
+}
+
+func (c *rtspConn) teardown(req *rtspRequest) *rtspResponse {
+	session, ok := c.sessionFor(req)
+	if !ok {
+		return newRTSPResponse(454)
+	}
+	session.stop()
+	c.session = nil
+	return newRTSPResponse(http.StatusOK)
+}
+
+// rtspSession is a client's interest in a broadcast's tracks. It's a TrackSink,
+// subscribed to every track that the client set up, while it's playing.
+type rtspSession struct {
+	id          string
+	conn        *rtspConn
+	keyID       KeyIDString
+	broadcastID BroadcastIDString
+
+	lock    *sync.Mutex
+	medias  map[TrackIDString]*rtspMedia
+	playing bool
+}
+
+// rtspMedia is a single track that a client set up
+type rtspMedia struct {
+	trackID     TrackIDString
+	codec       webrtc.RTPCodecCapability
+	payloadType uint8
+
+	// Either interleaved on the RTSP connection, on the channel (with RTCP on
+	// the one after), or else over UDP
+	interleaved bool
+	channel     uint8
+	rtpAddr     *net.UDPAddr
+	rtcpAddr    *net.UDPAddr
+
+	// For sender reports. Only touched with the session's lock held.
+	ssrc       uint32
+	timestamp  uint32
+	packets    uint32
+	octets     uint32
+	reportedAt time.Time
+}
+
+func (s *rtspSession) play() {
+	s.lock.Lock()
+	if s.playing {
+		s.lock.Unlock()
+		return
+	}
+	s.playing = true
+	trackIDs := []TrackIDString{}
+	for trackID := range s.medias {
+		trackIDs = append(trackIDs, trackID)
+	}
+	s.lock.Unlock()
+
+	for _, trackID := range trackIDs {
+		s.conn.server.tracksAndConnections.AddSink(TrackKey{
+			KeyID:       s.keyID,
+			BroadcastID: s.broadcastID,
+			TrackID:     trackID,
+		}, s)
+	}
+}
+
+func (s *rtspSession) stop() {
+	s.conn.server.tracksAndConnections.RemoveSink(s)
+
+	s.lock.Lock()
+	s.playing = false
+	s.lock.Unlock()
+}
+
+// AddDownTrack is part of TrackSink
+func (s *rtspSession) AddDownTrack(key TrackKey, downTrack *DownTrack) webrtc.TrackLocalWriter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	media, ok := s.medias[key.TrackID]
+	if !ok {
+		return discardWriter{}
+	}
+
+	// There's no telling the client that the codec changed
+	codec := downTrack.Track().Codec()
+	if !strings.EqualFold(codec.MimeType, media.codec.MimeType) || codec.ClockRate != media.codec.ClockRate {
+		broadcastLogger(slog.With("component", "rtsp"), s.keyID, s.broadcastID).Info(
+			"Not sending track over RTSP anymore, since its codec changed",
+			"remote", s.conn.conn.RemoteAddr().String(),
+			"track", key.TrackID,
+			"from", media.codec.MimeType,
+			"to", codec.MimeType,
+		)
+		return discardWriter{}
+	}
+
+	return rtspWriter{s, media}
+}
+
+// RemoveDownTrack is part of TrackSink
+func (s *rtspSession) RemoveDownTrack(key TrackKey, downTrack *DownTrack) {}
+
+// rtspWriter sends a DownTrack's packets to an RTSP client
+type rtspWriter struct {
+	session *rtspSession
+	media   *rtspMedia
+}
+
+func (w rtspWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	header.PayloadType = w.media.payloadType
+	packet, err := (&rtp.Packet{Header: *header, Payload: payload}).Marshal()
+	if err != nil {
+		return 0, err
+	}
+
+	report := w.report(header, len(payload))
+
+	w.send(false, packet)
+	if report != nil {
+		w.send(true, report)
+	}
+
+	return len(payload), nil
+}
+
+func (w rtspWriter) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	return w.WriteRTP(&packet.Header, packet.Payload)
+}
+
+// report keeps track of what's been sent, for sender reports, and returns one,
+// if it's time for one.
+func (w rtspWriter) report(header *rtp.Header, size int) []byte {
+	w.session.lock.Lock()
+	defer w.session.lock.Unlock()
+
+	media := w.media
+	now := time.Now()
+	media.ssrc = header.SSRC
+	media.timestamp = header.Timestamp
+	media.packets++
+	media.octets += uint32(size)
+
+	if now.Sub(media.reportedAt) < rtspReportInterval {
+		return nil
+	}
+	media.reportedAt = now
+
+	report, err := (&rtcp.SenderReport{
+		SSRC:        media.ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     media.timestamp,
+		PacketCount: media.packets,
+		OctetCount:  media.octets,
+	}).Marshal()
+	if err != nil {
+		return nil
+	}
+	return report
+}
+
+func (w rtspWriter) send(isRTCP bool, b []byte) {
+	if w.media.interleaved {
+		channel := w.media.channel
+		if isRTCP {
+			channel++
+		}
+		w.session.conn.writeInterleaved(channel, b)
+		return
+	}
+
+	server := w.session.conn.server
+	if isRTCP {
+		server.rtcpConn.WriteToUDP(b, w.media.rtcpAddr)
+	} else {
+		server.rtpConn.WriteToUDP(b, w.media.rtpAddr)
+	}
+}
+
+// ntpTime is the time, the way that RTCP has it: seconds since 1900 in the top
+// 32 bits, and the fraction of a second in the bottom 32
+func ntpTime(t time.Time) uint64 {
+	// Seconds between 1900 and 1970
+	const ntpEpochOffset = 2208988800
+
+	seconds := uint64(t.Unix()) + ntpEpochOffset
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/textproto"
+	"testing"
+)
+
+func TestRTSPBasicAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		username      string
+		password      string
+		ok            bool
+	}{
+		{"basic", "Basic dmxjOnNlY3JldA==", "vlc", "secret", true},
+		{"lowercase scheme", "basic dmxjOnNlY3JldA==", "vlc", "secret", true},
+		{"colon in password", "Basic dmxjOnNlOmNyZXQ=", "vlc", "se:cret", true},
+		{"missing", "", "", "", false},
+		{"bearer", "Bearer dmxjOnNlY3JldA==", "", "", false},
+		{"digest", `Digest username="vlc"`, "", "", false},
+		{"bad base64", "Basic !!!", "", "", false},
+		{"no colon", "Basic dmxj", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := textproto.MIMEHeader{}
+			if test.authorization != "" {
+				header.Set("Authorization", test.authorization)
+			}
+
+			username, password, ok := rtspBasicAuth(&rtspRequest{header: header})
+			if ok != test.ok || (ok && (username != test.username || password != test.password)) {
+				t.Errorf(
+					"got %q, %q, %v; want %q, %q, %v",
+					username, password, ok, test.username, test.password, test.ok,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	rtspPullDialTimeout = 10 * time.Second
+
+	// A camera that sends nothing for this long is considered gone
+	rtspPullReadTimeout = 10 * time.Second
+
+	// How long RTSP sessions last without a keepalive, unless the camera says
+	// otherwise
+	rtspDefaultSessionTimeout = 60 * time.Second
+
+	rtspUserAgent = "simple-forwarding-unit"
+)
+
+// RTSPPuller brings IP cameras (or anything else with an RTSP server) in as
+// publishers, without a browser in between. Each camera's video (H.264 or
+// H.265) and audio get pulled over TCP, and published to the camera's
+// broadcast.
+//
+// Cameras that go away (or that can't be reached to begin with) get
+// reconnected to, with exponential backoff. Receivers carry on through that,
+// just like they would with a browser publisher reconnecting.
+type RTSPPuller struct {
+	tracksAndConnections TracksAndConnectionsManager
+
+	lock *sync.Mutex
+
+	// Every camera that's playing right now, by session ID
+	sessions map[string]*rtspPullSession
+}
+
+// rtspPullSession is a camera that's playing, as the admin API sees it
+type rtspPullSession struct {
+	camera  config.RTSPCamera
+	created time.Time
+	client  *rtspClient
+}
+
+func NewRTSPPuller(tracksAndConnections TracksAndConnectionsManager) *RTSPPuller {
+	return &RTSPPuller{
+		tracksAndConnections: tracksAndConnections,
+		lock:                 &sync.Mutex{},
+		sessions:             map[string]*rtspPullSession{},
+	}
+}
+
+// Start pulls from every configured camera, in the background, for as long as
+// the server runs
+func (p *RTSPPuller) Start() {
+	for _, camera := range config.RTSPCameras() {
+		go p.pull(camera)
+	}
+}
+
+// Sessions is part of SessionSource. Cameras that are being reconnected to
+// aren't listed.
+func (p *RTSPPuller) Sessions() []SessionStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sessions := make([]SessionStatus, 0, len(p.sessions))
+	for id, session := range p.sessions {
+		sessions = append(sessions, SessionStatus{
+			ID:          id,
+			Endpoint:    "rtsp",
+			KeyID:       KeyIDString(session.camera.KeyID),
+			BroadcastID: BroadcastIDString(session.camera.ID),
+			Created:     session.created,
+			Connected:   true,
+		})
+	}
+	return sessions
+}
+
+// SessionIDs is part of SessionSource. There are no peer connections involved
+// in pulling from cameras.
+func (p *RTSPPuller) SessionIDs() map[*webrtc.PeerConnection]string {
+	return map[*webrtc.PeerConnection]string{}
+}
+
+// CloseSession is part of SessionSource. The camera gets disconnected from,
+// which takes its tracks down, but it's still configured, and so gets
+// reconnected to just like a camera that went away on its own.
+func (p *RTSPPuller) CloseSession(id string, reason string) bool {
+	p.lock.Lock()
+	session, ok := p.sessions[id]
+	p.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+	slog.Info(
+		"RTSP camera closed by an administrator",
+		"component", "rtspPull",
+		"session", id,
+		"keyId", session.camera.KeyID,
+		"broadcastId", session.camera.ID,
+		"reason", reason,
+	)
+	session.client.conn.Close()
+	return true
+}
+
+func (p *RTSPPuller) pull(camera config.RTSPCamera) {
+	minBackoff, maxBackoff := config.RTSPPullBackoff()
+	backoff := minBackoff
+
+	name := camera.URL
+	if u, err := url.Parse(camera.URL); err == nil {
+		name = u.Redacted()
+	}
+
+	for {
+		played, err := p.session(camera)
+
+		// Only cameras that can't be gotten going get waited on for longer and
+		// longer
+		if played {
+			backoff = minBackoff
+		}
+		slog.Warn(
+			"Lost RTSP camera; reconnecting",
+			"component", "rtspPull",
+			"camera", name,
+			"keyId", camera.KeyID,
+			"broadcastId", camera.ID,
+			"err", err,
+			"retryIn", backoff,
+		)
+		time.Sleep(backoff)
+		if !played {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// rtspPullMedia is a single audio or video stream that's being pulled from a
+// camera
+type rtspPullMedia struct {
+	control string
+	stream  *rtpIngestStream
+
+	// Only for video, which needs putting into packets that WebRTC can take
+	repacketizer *h26xRepacketizer
+}
+
+func (m *rtspPullMedia) write(packet *rtp.Packet) {
+	if m.repacketizer != nil {
+		m.repacketizer.push(packet)
+		return
+	}
+	m.stream.write(packet)
+}
+
+// session connects to the camera, and blocks, publishing whatever it sends,
+// until it goes away. Returns whether the camera got as far as sending
+// anything, and why it went away.
+func (p *RTSPPuller) session(camera config.RTSPCamera) (bool, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return false, err
+	}
+
+	client, err := dialRTSP(camera.URL)
+	if err != nil {
+		return false, err
+	}
+	defer client.conn.Close()
+
+	options, err := client.request("OPTIONS", client.url.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	keepalive := "OPTIONS"
+	if strings.Contains(options.header.Get("Public"), "GET_PARAMETER") {
+		keepalive = "GET_PARAMETER"
+	}
+
+	describe, err := client.request("DESCRIBE", client.url.String(), map[string]string{
+		"Accept": "application/sdp",
+	})
+	if err != nil {
+		return false, err
+	}
+	if describe.status != 200 {
+		return false, fmt.Errorf("DESCRIBE failed with %d", describe.status)
+	}
+
+	base := client.url
+	for _, header := range []string{"Content-Base", "Content-Location"} {
+		if value := describe.header.Get(header); value != "" {
+			if u, err := url.Parse(value); err == nil {
+				base = u
+				break
+			}
+		}
+	}
+
+	medias, err := p.medias(camera, base, describe.body)
+	if err != nil {
+		return false, err
+	}
+	for _, media := range medias {
+		media.stream.sessionID = id
+	}
+
+	for i, media := range medias {
+		res, err := client.request("SETUP", media.control, map[string]string{
+			"Transport": fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", 2*i, 2*i+1),
+		})
+		if err != nil {
+			return false, err
+		}
+		if res.status != 200 {
+			return false, fmt.Errorf("SETUP failed with %d", res.status)
+		}
+		client.setSession(res.header.Get("Session"))
+	}
+
+	res, err := client.request("PLAY", base.String(), map[string]string{
+		"Range": "npt=0.000-",
+	})
+	if err != nil {
+		return false, err
+	}
+	if res.status != 200 {
+		return false, fmt.Errorf("PLAY failed with %d", res.status)
+	}
+
+	p.lock.Lock()
+	p.sessions[id] = &rtspPullSession{camera: camera, created: time.Now(), client: client}
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		delete(p.sessions, id)
+		p.lock.Unlock()
+	}()
+
+	// Whatever got published goes away along with the camera
+	defer func() {
+		for _, media := range medias {
+			media.stream.close()
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(client.sessionTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := client.write(keepalive, base.String(), nil); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	played := false
+	for {
+		client.conn.SetReadDeadline(time.Now().Add(rtspPullReadTimeout))
+
+		channel, packet, err := client.readInterleaved()
+		if err != nil {
+			return played, err
+		}
+
+		// RTCP comes in on the odd channels
+		if channel%2 != 0 || int(channel/2) >= len(medias) {
+			continue
+		}
+
+		rtpPacket := &rtp.Packet{}
+		if err := rtpPacket.Unmarshal(packet); err != nil {
+			continue
+		}
+		played = true
+		medias[channel/2].write(rtpPacket)
+	}
+}
+
+// medias picks the first video (H.264 or H.265), and the first audio, out of
+// the camera's SDP
+func (p *RTSPPuller) medias(camera config.RTSPCamera, base *url.URL, body []byte) ([]*rtspPullMedia, error) {
+	var description sdp.SessionDescription
+	if err := description.Unmarshal(body); err != nil {
+		return nil, fmt.Errorf("failed to parse SDP: %w", err)
+	}
+
+	medias := []*rtspPullMedia{}
+	kinds := map[string]bool{}
+	for _, media := range description.MediaDescriptions {
+		kind := media.MediaName.Media
+		if kinds[kind] || (kind != "video" && kind != "audio") || (kind == "audio" && camera.NoAudio) {
+			continue
+		}
+		if len(media.MediaName.Formats) == 0 {
+			continue
+		}
+
+		codec, ok := rtspMediaCodec(media)
+		if !ok {
+			continue
+		}
+		isH26x := strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) ||
+			strings.EqualFold(codec.MimeType, webrtc.MimeTypeH265)
+		if kind == "video" && !isH26x {
+			continue
+		}
+
+		control := base.String()
+		if value, ok := media.Attribute("control"); ok && value != "*" {
+			if u, err := url.Parse(value); err == nil {
+				if !strings.HasSuffix(base.Path, "/") && !u.IsAbs() {
+					// Relative to the base, rather than to its parent
+					withSlash := *base
+					withSlash.Path += "/"
+					withSlash.RawPath = ""
+					control = withSlash.ResolveReference(u).String()
+				} else {
+					control = base.ResolveReference(u).String()
+				}
+			}
+		}
+
+		track := camera.AudioTrack
+		if kind == "video" {
+			track = camera.VideoTrack
+		}
+
+		pullMedia := &rtspPullMedia{control: control}
+		published := codec
+		if isH26x {
+			published.SDPFmtpLine = rtspPublishedFmtpLine(codec)
+		}
+		pullMedia.stream = newRTPIngestStream(
+			p.tracksAndConnections,
+			rtspPullReadTimeout,
+			config.RTPIngestStream{
+				KeyID: camera.KeyID,
+				ID:    camera.ID,
+				Track: track,
+				Kind:  kind,
+				Codec: published,
+			},
+		)
+		if isH26x {
+			pullMedia.repacketizer = newH26xRepacketizer(webrtc.RTPCodecCapability{
+				MimeType:    codec.MimeType,
+				ClockRate:   codec.ClockRate,
+				SDPFmtpLine: codec.SDPFmtpLine,
+			}, pullMedia.stream.write)
+		}
+
+		medias = append(medias, pullMedia)
+		kinds[kind] = true
+	}
+
+	if len(medias) == 0 {
+		return nil, errors.New("the camera has nothing that can be pulled")
+	}
+	return medias, nil
+}
+
+// rtspMediaCodec gets the codec of the first payload type of a media section
+func rtspMediaCodec(media *sdp.MediaDescription) (config.Codec, bool) {
+	kind := media.MediaName.Media
+	format := media.MediaName.Formats[0]
+	payloadType, err := strconv.ParseUint(format, 10, 8)
+	if err != nil {
+		return config.Codec{}, false
+	}
+
+	codec := config.Codec{Kind: kind, PayloadType: uint8(payloadType)}
+	for _, attribute := range media.Attributes {
+		key, value, _ := strings.Cut(attribute.Value, " ")
+		if key != format {
+			continue
+		}
+		switch attribute.Key {
+		case "rtpmap":
+			parts := strings.Split(value, "/")
+			codec.MimeType = kind + "/" + parts[0]
+			if len(parts) > 1 {
+				clockRate, _ := strconv.ParseUint(parts[1], 10, 32)
+				codec.ClockRate = uint32(clockRate)
+			}
+			if len(parts) > 2 {
+				channels, _ := strconv.ParseUint(parts[2], 10, 16)
+				codec.Channels = uint16(channels)
+			}
+		case "fmtp":
+			codec.SDPFmtpLine = strings.TrimSpace(value)
+		}
+	}
+
+	// Cameras tend to leave the rtpmap out for G.711
+	if codec.MimeType == "" {
+		switch payloadType {
+		case 0:
+			codec.MimeType, codec.ClockRate = webrtc.MimeTypePCMU, 8000
+		case 8:
+			codec.MimeType, codec.ClockRate = webrtc.MimeTypePCMA, 8000
+		}
+	}
+
+	return codec, codec.MimeType != "" && codec.ClockRate > 0
+}
+
+// rtspPublishedFmtpLine is the fmtp line that pulled H.264 and H.265 get
+// published with. The parameter sets are left out, since they end up in the
+// stream, and for H.264, it looks just like what a browser would send, with the
+// camera's profile, so that receivers take it.
+func rtspPublishedFmtpLine(codec config.Codec) string {
+	params := []string{}
+	profileLevelID := ""
+	for _, param := range strings.Split(codec.SDPFmtpLine, ";") {
+		param = strings.TrimSpace(param)
+		key, value, _ := strings.Cut(param, "=")
+		key = strings.ToLower(key)
+
+		switch {
+		case param == "", strings.HasPrefix(key, "sprop-"):
+		case key == "profile-level-id":
+			profileLevelID = value
+		default:
+			params = append(params, param)
+		}
+
+		// Without a profile, there's still the SPS to go by
+		if key == "sprop-parameter-sets" && profileLevelID == "" {
+			sps, _, _ := strings.Cut(value, ",")
+			if b, err := base64.StdEncoding.DecodeString(sps); err == nil && len(b) >= 4 {
+				profileLevelID = hex.EncodeToString(b[1:4])
+			}
+		}
+	}
+
+	if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) {
+		return strings.Join(params, ";")
+	}
+
+	if profileLevelID == "" {
+		profileLevelID = "42e01f"
+	}
+	// Everything gets repacketized with fragmentation units, so it's always
+	// packetization mode 1
+	return fmt.Sprintf(
+		"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%s",
+		strings.ToLower(profileLevelID),
+	)
+}
+
+// rtspClient is a connection to an RTSP server, with everything sent over the
+// one TCP connection
+type rtspClient struct {
+	url      *url.URL
+	username string
+	password string
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Writes can come from the keepalive, while everything else goes on
+	lock *sync.Mutex
+
+	// Only touched while holding the lock
+	cseq           int
+	session        string
+	sessionTimeout time.Duration
+	challenge      *rtspChallenge
+}
+
+// rtspClientResponse is what an RTSP server responded with
+type rtspClientResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func dialRTSP(rawURL string) (*rtspClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &rtspClient{
+		lock:           &sync.Mutex{},
+		sessionTimeout: rtspDefaultSessionTimeout,
+	}
+	if u.User != nil {
+		client.username = u.User.Username()
+		client.password, _ = u.User.Password()
+	}
+	withoutUser := *u
+	withoutUser.User = nil
+	client.url = &withoutUser
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+	conn, err := net.DialTimeout("tcp", host, rtspPullDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+
+	return client, nil
+}
+
+// setSession keeps the session that the server handed out, along with how long
+// it lasts for without a keepalive
+func (c *rtspClient) setSession(header string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	parts := strings.Split(header, ";")
+	if c.session == "" {
+		c.session = strings.TrimSpace(parts[0])
+	}
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if strings.EqualFold(key, "timeout") {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				c.sessionTimeout = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+}
+
+// request sends a request, and waits for the response. If the server wants
+// credentials, and there are any, the request is sent again with them.
+func (c *rtspClient) request(method, uri string, header map[string]string) (*rtspClientResponse, error) {
+	c.conn.SetDeadline(time.Now().Add(rtspPullReadTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	for attempt := 0; ; attempt++ {
+		if err := c.write(method, uri, header); err != nil {
+			return nil, err
+		}
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if res.status != 401 || attempt > 0 || c.username == "" {
+			return res, nil
+		}
+		challenge, ok := parseRTSPChallenge(res.header.Values("WWW-Authenticate"))
+		if !ok {
+			return res, nil
+		}
+		c.lock.Lock()
+		c.challenge = challenge
+		c.lock.Unlock()
+	}
+}
+
+// write sends a request, without waiting for the response
+func (c *rtspClient) write(method, uri string, header map[string]string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(&b, "CSeq: %d\r\n", c.cseq)
+	fmt.Fprintf(&b, "User-Agent: %s\r\n", rtspUserAgent)
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	if c.challenge != nil {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", c.challenge.authorization(method, uri, c.username, c.password))
+	}
+	for key, value := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+	}
+	b.WriteString("\r\n")
+
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// readResponse reads the next response, skipping over anything interleaved
+// that comes before it
+func (c *rtspClient) readResponse() (*rtspClientResponse, error) {
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			break
+		}
+		if _, _, err := c.readInterleaved(); err != nil {
+			return nil, err
+		}
+	}
+
+	reader := textproto.NewReader(c.reader)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+		return nil, fmt.Errorf("bad status line %q", line)
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad status line %q", line)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if length := header.Get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n > rtspMaxBodySize {
+			return nil, fmt.Errorf("bad content length %q", length)
+		}
+		body = make([]byte, n)
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			return nil, err
+		}
+	}
+
+	return &rtspClientResponse{status: status, header: header, body: body}, nil
+}
+
+// readInterleaved reads the next interleaved packet. Responses that come in
+// along the way (to keepalives) are skipped.
+func (c *rtspClient) readInterleaved() (uint8, []byte, error) {
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if b[0] != '$' {
+			if _, err := c.readResponse(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return 0, nil, err
+		}
+		packet := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(c.reader, packet); err != nil {
+			return 0, nil, err
+		}
+		return header[1], packet, nil
+	}
+}
+
+// rtspChallenge is what an RTSP server wants credentials sent with
+type rtspChallenge struct {
+	digest bool
+	realm  string
+	nonce  string
+	opaque string
+	qop    bool
+
+	// How many times the nonce has been used
+	count int
+}
+
+// parseRTSPChallenge picks Digest out of the server's challenges, if it's
+// there, or else Basic
+func parseRTSPChallenge(headers []string) (*rtspChallenge, bool) {
+	var basic *rtspChallenge
+	for _, header := range headers {
+		scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+		switch strings.ToLower(scheme) {
+		case "digest":
+			params := parseAuthParams(rest)
+			challenge := &rtspChallenge{
+				digest: true,
+				realm:  params["realm"],
+				nonce:  params["nonce"],
+				opaque: params["opaque"],
+			}
+			for _, qop := range strings.Split(params["qop"], ",") {
+				if strings.TrimSpace(qop) == "auth" {
+					challenge.qop = true
+				}
+			}
+			return challenge, true
+		case "basic":
+			basic = &rtspChallenge{}
+		}
+	}
+	return basic, basic != nil
+}
+
+// parseAuthParams parses the comma separated key="value" pairs of a challenge
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimSpace(rest)
+
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+
+		_, rest, _ = strings.Cut(rest, ",")
+		s = strings.TrimSpace(rest)
+	}
+	return params
+}
+
+// authorization is the Authorization header for a request. NOT THREAD SAFE!
+// Only call this while holding the client's lock.
+func (c *rtspChallenge) authorization(method, uri, username, password string) string {
+	if !c.digest {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	md5Hex := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := md5Hex(username + ":" + c.realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+
+	header := fmt.Sprintf(
+		`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		username, c.realm, c.nonce, uri,
+	)
+	if c.qop {
+		c.count++
+		nc := fmt.Sprintf("%08x", c.count)
+		cnonce := fmt.Sprintf("%08x", time.Now().UnixNano()&0xFFFFFFFF)
+		response := md5Hex(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+c.nonce+":"+ha2))
+	}
+	if c.opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, c.opaque)
+	}
+	return header + `, algorithm="MD5"`
+}
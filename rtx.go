@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// RTX (RFC 4588) sends lost packets again on a stream of their own, so that
+// receivers can tell retransmissions apart from everything else, e.g. for
+// bandwidth estimation. It's negotiated as a codec of its own, whose "apt"
+// format parameter says which codec it carries, and Pion picks the SSRC that
+// goes with each track's media SSRC.
+
+// rtxPayloadType finds the payload type of the RTX codec that carries the
+// given codec, out of the negotiated codecs. Zero if RTX wasn't negotiated.
+func rtxPayloadType(
+	codec webrtc.RTPCodecParameters,
+	negotiated []webrtc.RTPCodecParameters,
+) webrtc.PayloadType {
+	apt := strconv.Itoa(int(codec.PayloadType))
+	for _, candidate := range negotiated {
+		if strings.EqualFold(candidate.MimeType, webrtc.MimeTypeRTX) &&
+			parseFmtp(candidate.SDPFmtpLine)["apt"] == apt {
+			return candidate.PayloadType
+		}
+	}
+	return 0
+}
+
+// rtxPacket turns a packet that's about to be sent again into an RTX packet:
+// the original sequence number goes in front of the payload, and the packet
+// goes out with the RTX stream's own SSRC, payload type, and sequence number.
+func rtxPacket(
+	header rtp.Header,
+	payload []byte,
+	ssrc webrtc.SSRC,
+	payloadType webrtc.PayloadType,
+	seq uint16,
+) (rtp.Header, []byte) {
+	rtxPayload := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(rtxPayload, header.SequenceNumber)
+	copy(rtxPayload[2:], payload)
+
+	header.SSRC = uint32(ssrc)
+	header.PayloadType = uint8(payloadType)
+	header.SequenceNumber = seq
+
+	return header, rtxPayload
+}
+
+// RTXStreams keeps track of where the RTX packets of each RTP sender go out.
+//
+// Pion hands a track a single stream to write to, and everything written to it
+// goes through the interceptors bound to the media stream. Retransmissions
+// going that way would get counted as media in sender reports, and by the
+// congestion controller, so RTX packets get written further down instead,
+// straight to the sender's SRTP stream.
+type RTXStreams struct {
+	lock *sync.Mutex
+
+	// By the ID of the RTP sender, which is also the ID of the context that its
+	// track gets bound with
+	writers map[string]interceptor.RTPWriter
+}
+
+var rtxStreams = &RTXStreams{
+	lock:    &sync.Mutex{},
+	writers: map[string]interceptor.RTPWriter{},
+}
+
+// Writer is where the RTX packets of the track bound with the given context ID
+// go. Nil until the sender has started sending.
+func (r *RTXStreams) Writer(id string) interceptor.RTPWriter {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.writers[id]
+}
+
+// NewInterceptor is for the interceptor registry, which has to have the
+// RTXStreams first, so that it gets the writers that nothing else intercepts.
+func (r *RTXStreams) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return &rtxInterceptor{streams: r}, nil
+}
+
+// rtxInterceptor picks up the writers of the streams that negotiated RTX, for
+// RTXStreams
+type rtxInterceptor struct {
+	interceptor.NoOp
+	streams *RTXStreams
+}
+
+func (i *rtxInterceptor) BindLocalStream(
+	info *interceptor.StreamInfo,
+	writer interceptor.RTPWriter,
+) interceptor.RTPWriter {
+	if info.SSRCRetransmission != 0 {
+		i.streams.lock.Lock()
+		i.streams.writers[info.ID] = writer
+		i.streams.lock.Unlock()
+	}
+	return writer
+}
+
+func (i *rtxInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.streams.lock.Lock()
+	delete(i.streams.writers, info.ID)
+	i.streams.lock.Unlock()
+}
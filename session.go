@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/castcam-live/simple-forwarding-unit/finish"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// SessionOwner is who a session belongs to. Only a client that is the very
+// same owner gets to resume the session.
+type SessionOwner struct {
+	// Which endpoint the session was created through ("broadcast", "get", or
+	// "subscribe")
+	Endpoint string
+
+	// Both empty when not applicable
+	KeyID       KeyIDString
+	BroadcastID BroadcastIDString
+}
+
+// SessionInfo tells a client how to resume its session
+type SessionInfo struct {
+	Token string `json:"token"`
+
+	// In milliseconds
+	ResumeWindow int64 `json:"resumeWindow"`
+
+	// Whether the client just resumed the session, as opposed to starting it
+	Resumed bool `json:"resumed"`
+}
+
+// Session is everything about a client that outlives the client's signalling
+// WebSocket connection: the peer connection, and whatever hangs off of it.
+//
+// When the WebSocket connection closes, the session sticks around for a
+// while, in case the client reconnects (with the session's token). Only once
+// that doesn't happen does the session get closed, along with the peer
+// connection.
+type Session struct {
+	token string
+	owner SessionOwner
+	store *SessionStore
+
+	// Tells the session apart from the others, for the admin API. Unlike the
+	// token, this isn't a secret.
+	id      string
+	created time.Time
+
+	peerConnection *webrtc.PeerConnection
+
+	// Has the session's ID on every line, along with whatever the logger that the
+	// session was created with had
+	logger *slog.Logger
+
+	signalling *SignallingConn
+	handler    func(TypeData[json.RawMessage]) bool
+
+	// Finished once the peer connection is done for
+	done finish.Done
+
+	lock    *sync.Mutex
+	expiry  *time.Timer
+	closers []func()
+	closed  bool
+	resumed bool
+}
+
+// SessionStore keeps track of every session, by token
+type SessionStore struct {
+	lock     *sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewSessionStore creates a new SessionStore
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		lock:     &sync.Mutex{},
+		sessions: map[string]*Session{},
+	}
+}
+
+// Create creates a session for the given owner, and its peer connection.
+// Messages from the client get handed to the handler; if the handler returns
+// false, the session is closed.
+//
+// The session logs through the given logger, with the session's ID added on.
+// That's what Logger returns, for whatever else has to do with the session.
+func (s *SessionStore) Create(
+	owner SessionOwner,
+	logger *slog.Logger,
+	peerConnection *webrtc.PeerConnection,
+	signalling *SignallingConn,
+	handler func(TypeData[json.RawMessage]) bool,
+) (*Session, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, ServerError{"SESSION_CREATION_FAILED", err}
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return nil, ServerError{"SESSION_CREATION_FAILED", err}
+	}
+
+	session := &Session{
+		token:          token,
+		owner:          owner,
+		store:          s,
+		id:             id,
+		created:        time.Now(),
+		peerConnection: peerConnection,
+		logger:         logger.With("session", id),
+		signalling:     signalling,
+		handler:        handler,
+		done:           finish.NewDone(),
+		lock:           &sync.Mutex{},
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessions[token] = session
+
+	session.logger.Info("Session started")
+
+	return session, nil
+}
+
+// Resume finds the session with the given token, so long as it belongs to the
+// given owner, and hasn't been closed yet.
+func (s *SessionStore) Resume(token string, owner SessionOwner) (*Session, bool) {
+	s.lock.Lock()
+	session, ok := s.sessions[token]
+	s.lock.Unlock()
+
+	if !ok || session.owner != owner {
+		return nil, false
+	}
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if session.closed {
+		return nil, false
+	}
+	session.resumed = true
+
+	return session, true
+}
+
+// SessionStatus describes a session, for the admin API
+type SessionStatus struct {
+	ID          string            `json:"id"`
+	Endpoint    string            `json:"endpoint"`
+	KeyID       KeyIDString       `json:"keyId,omitempty"`
+	BroadcastID BroadcastIDString `json:"broadcastId,omitempty"`
+	Created     time.Time         `json:"created"`
+
+	// Whether the client's WebSocket connection is there, as opposed to the
+	// session waiting for the client to reconnect. Always true for sessions
+	// without a WebSocket connection to lose.
+	Connected bool `json:"connected"`
+
+	// Of the session's peer connection, if it has one
+	ConnectionState string `json:"connectionState,omitempty"`
+}
+
+// SessionSource is anything with sessions for the admin API to list, and
+// close. Besides the SessionStore, with the sessions of everyone on a
+// WebSocket, that's WHIP publishers, WHEP players, and whatever's coming in
+// over RTP and RTSP.
+type SessionSource interface {
+	// Sessions lists the sessions, in no particular order
+	Sessions() []SessionStatus
+
+	// SessionIDs maps the peer connections of the sessions to their IDs
+	SessionIDs() map[*webrtc.PeerConnection]string
+
+	// CloseSession closes the session with the given ID, telling the client
+	// why, if there's any way to. Returns false if there's no such session.
+	CloseSession(id string, reason string) bool
+}
+
+// Sessions lists every session, oldest first
+func (s *SessionStore) Sessions() []SessionStatus {
+	s.lock.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.lock.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].created.Before(sessions[j].created)
+	})
+
+	statuses := []SessionStatus{}
+	for _, session := range sessions {
+		statuses = append(statuses, session.Status())
+	}
+	return statuses
+}
+
+// Find finds the session with the given ID (not the token)
+func (s *SessionStore) Find(id string) (*Session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, session := range s.sessions {
+		if session.id == id {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// CloseSession is part of SessionSource
+func (s *SessionStore) CloseSession(id string, reason string) bool {
+	session, ok := s.Find(id)
+	if ok {
+		session.Kick(reason)
+	}
+	return ok
+}
+
+// SessionIDs maps each session's peer connection to the session's ID
+func (s *SessionStore) SessionIDs() map[*webrtc.PeerConnection]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ids := map[*webrtc.PeerConnection]string{}
+	for _, session := range s.sessions {
+		ids[session.peerConnection] = session.id
+	}
+	return ids
+}
+
+func (s *SessionStore) remove(session *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.sessions[session.token] == session {
+		delete(s.sessions, session.token)
+	}
+}
+
+// newSessionID is shorter than a token, since all it needs to be is unique
+func newSessionID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Status describes the session
+func (s *Session) Status() SessionStatus {
+	return SessionStatus{
+		ID:              s.id,
+		Endpoint:        s.owner.Endpoint,
+		KeyID:           s.owner.KeyID,
+		BroadcastID:     s.owner.BroadcastID,
+		Created:         s.created,
+		Connected:       s.signalling.IsAttached(),
+		ConnectionState: s.peerConnection.ConnectionState().String(),
+	}
+}
+
+// Logger is the session's logger
+func (s *Session) Logger() *slog.Logger {
+	return s.logger
+}
+
+// Done is to be finished once the peer connection is done for, at which point
+// the session closes as soon as it notices.
+func (s *Session) Done() *finish.Done {
+	return &s.done
+}
+
+// OnClose adds a function to be called when the session closes. Just like
+// with defer, the functions are called in the reverse order that they were
+// added in.
+func (s *Session) OnClose(closer func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closers = append(s.closers, closer)
+}
+
+// Serve blocks, handing messages from the WebSocket connection over to the
+// session's handler, until the connection closes (or gets replaced by another
+// one), or until the session closes.
+//
+// The client is told the session's token first thing, unless sessions can't
+// be resumed.
+func (s *Session) Serve(conn *websocket.Conn) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	resumed := s.resumed
+	s.signalling.Attach(conn)
+	s.lock.Unlock()
+
+	if resumed {
+		s.logger.Info("Session resumed", "remote", conn.RemoteAddr().String())
+	}
+
+	if window := config.SessionResumeWindow(); window > 0 {
+		s.signalling.WriteJSON(TypeData[SessionInfo]{
+			Type: "SESSION",
+			Data: SessionInfo{
+				Token:        s.token,
+				ResumeWindow: window.Milliseconds(),
+				Resumed:      resumed,
+			},
+		})
+	}
+
+	for {
+		if s.done.IsDone() {
+			s.Close()
+			return
+		}
+
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			s.logger.Info("WebSocket connection closed", "err", err)
+			s.detach(conn)
+			return
+		}
+
+		metrics.SignallingMessage("in", b)
+
+		var t TypeData[json.RawMessage]
+		if err = json.Unmarshal(b, &t); err != nil {
+			continue
+		}
+
+		if !s.handler(t) {
+			s.Close()
+			return
+		}
+	}
+}
+
+// detach gives the client a chance to reconnect, now that the WebSocket
+// connection is gone. If the client doesn't, the session is closed.
+func (s *Session) detach(conn *websocket.Conn) {
+	window := config.SessionResumeWindow()
+
+	s.lock.Lock()
+	if s.closed || !s.signalling.Detach(conn) {
+		// Either way, there's nothing left to do. Some other connection took over
+		// in the meantime, or it's all over already.
+		s.lock.Unlock()
+		return
+	}
+	if window > 0 && !s.done.IsDone() {
+		s.expiry = time.AfterFunc(window, s.Close)
+		s.lock.Unlock()
+		s.logger.Debug("Waiting for the client to reconnect", "window", window)
+		return
+	}
+	s.lock.Unlock()
+
+	s.Close()
+}
+
+// Kick tells the client why its session is being closed, and closes it. If the
+// client isn't connected, it never finds out why.
+func (s *Session) Kick(reason string) {
+	s.logger.Info("Kicking session", "reason", reason)
+	s.signalling.WriteJSON(TypeData[map[string]any]{
+		Type: "SERVER_ERROR",
+		Data: map[string]any{
+			"type": "SESSION_CLOSED",
+			"msg":  reason,
+		},
+	})
+	s.Close()
+}
+
+// Close closes the session for good, along with the WebSocket connection.
+func (s *Session) Close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	closers := s.closers
+	s.closers = nil
+	s.lock.Unlock()
+
+	s.store.remove(s)
+	s.signalling.Close()
+	s.done.Finish()
+
+	s.logger.Info("Session closed")
+
+	for i := len(closers) - 1; i >= 0; i-- {
+		closers[i]()
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// How many messages get held on to for a client whose WebSocket connection is
+// gone, in case it reconnects. Anything past that is dropped.
+const maxPendingSignallingMessages = 256
+
+// ErrSignallingClosed is returned when writing to a SignallingConn that has
+// been closed for good.
+var ErrSignallingClosed = errors.New("signalling connection closed")
+
+// SignallingConn is the WebSocket connection that a client's signalling
+// messages are sent over.
+//
+// Messages get sent from all over the place (peer connection callbacks, the
+// read loop, other clients' goroutines), but a WebSocket connection only
+// allows for one writer at a time, so writes are done under a lock.
+//
+// The WebSocket connection can come and go (see Session). While there is none,
+// or while it's failing, messages are held on to, and sent once the client
+// reconnects.
+type SignallingConn struct {
+	conn *websocket.Conn
+	lock *sync.Mutex
+
+	pending [][]byte
+	closed  bool
+}
+
+// NewSignallingConn wraps a WebSocket connection
+func NewSignallingConn(conn *websocket.Conn) *SignallingConn {
+	return &SignallingConn{conn: conn, lock: &sync.Mutex{}}
+}
+
+// WriteJSON sends a single message to the client.
+//
+// Only fails once the SignallingConn is closed. If the WebSocket connection is
+// gone, the message is sent once the client reconnects instead.
+func (s *SignallingConn) WriteJSON(v any) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrSignallingClosed
+	}
+
+	// Marshalled right away, since whatever v points to might change before it
+	// gets sent
+	message, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	metrics.SignallingMessage("out", message)
+
+	if s.conn != nil {
+		err := s.conn.WriteMessage(websocket.TextMessage, message)
+		if err == nil {
+			return nil
+		}
+
+		// The connection is as good as gone. Closing it is what gets whoever is
+		// reading from it to notice.
+		s.conn.Close()
+	}
+
+	if len(s.pending) >= maxPendingSignallingMessages {
+		return nil
+	}
+	s.pending = append(s.pending, message)
+
+	return nil
+}
+
+// Attach has messages go out over the given WebSocket connection from now on,
+// starting with whatever was held on to. Any other connection is closed.
+func (s *SignallingConn) Attach(conn *websocket.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil && s.conn != conn {
+		s.conn.Close()
+	}
+	s.conn = conn
+
+	for len(s.pending) > 0 {
+		if err := conn.WriteMessage(websocket.TextMessage, s.pending[0]); err != nil {
+			conn.Close()
+			return
+		}
+		s.pending = s.pending[1:]
+	}
+}
+
+// Detach stops messages from going out over the given WebSocket connection.
+//
+// Returns false if the connection had already been replaced by another one.
+func (s *SignallingConn) Detach(conn *websocket.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != conn {
+		return false
+	}
+	s.conn = nil
+
+	return true
+}
+
+// IsAttached tells whether there's a WebSocket connection to send messages over
+func (s *SignallingConn) IsAttached() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.conn != nil
+}
+
+// Close closes the WebSocket connection, if there is one, and drops anything
+// that would have been sent over it.
+func (s *SignallingConn) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.pending = nil
+	s.closed = true
+}
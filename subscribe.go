@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// SubscribeRequest is what a receiver sends to subscribe to a track, or to
+// change an existing subscription.
+type SubscribeRequest struct {
+	TrackKey
+
+	// RID of the simulcast layer to receive. Empty to have one picked
+	Layer string `json:"layer"`
+
+	// Tracks with a higher priority get bandwidth first
+	Priority int `json:"priority"`
+}
+
+// createSubscribeHandler creates the handler for receivers that want a single
+// peer connection (and a single WebSocket) for any number of tracks, across
+// any number of broadcasts.
+//
+// Unlike `/get`, nothing is subscribed to up front. Instead, the receiver
+// sends SUBSCRIBE and UNSUBSCRIBE messages, and the server renegotiates the
+// peer connection as tracks come and go. Every time that happens, the receiver
+// is sent a SUBSCRIPTIONS message, which maps each subscription to the media ID
+// of the transceiver that the track is sent on.
+//
+// Just like with `/get`, a receiver that loses its WebSocket connection can
+// reconnect with its session's token, and carry on where it left off.
+func createSubscribeHandler(
+	tracksAndConnections TracksAndConnectionsManager,
+	sessions *SessionStore,
+	dominantSpeakers *DominantSpeakers,
+) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		logger := requestLogger(req, "subscribe")
+
+		conn, err := upgrader.Upgrade(res, req, nil)
+		if err != nil {
+			logger.Warn("Failed to upgrade to WebSocket", "err", err)
+			return
+		}
+		defer conn.Close()
+		signalling := NewSignallingConn(conn)
+
+		if token, ok := ParseQuery(req.URL.RawQuery)["resume"]; ok {
+			session, ok := sessions.Resume(token, SessionOwner{Endpoint: "subscribe"})
+			if !ok {
+				logger.Info("No session to resume")
+				writeSessionNotFound(signalling)
+				return
+			}
+
+			session.Serve(conn)
+			return
+		}
+
+		peerConnection, allocator, err := newReceivingPeerConnection()
+		if err != nil {
+			logger.Error("Failed to create peer connection", "err", err)
+			writeServerError(signalling, err)
+			return
+		}
+		sendSubscriptions := func() error {
+			return signalling.WriteJSON(TypeData[[]SubscriptionInfo]{
+				Type: "SUBSCRIPTIONS",
+				Data: tracksAndConnections.Subscriptions(peerConnection),
+			})
+		}
+
+		// The message handler fills in watching and listening, but the session can
+		// be closed from elsewhere (e.g. when it expires, or by an administrator),
+		// which stops everything in them. Once it's closed, nothing new gets
+		// started.
+		lock := &sync.Mutex{}
+		closed := false
+
+		// Broadcasts whose tracks the receiver asked about, and so gets kept posted
+		// on
+		watching := map[broadcastKey]func(){}
+
+		// Key IDs whose dominant speaker the receiver gets told about: those of
+		// every broadcast that it's subscribed to
+		listening := map[KeyIDString]func(){}
+		listenForDominantSpeakers := func() {
+			lock.Lock()
+			defer lock.Unlock()
+			if closed {
+				return
+			}
+
+			keyIDs := Set[KeyIDString]{}
+			for _, sub := range tracksAndConnections.Subscriptions(peerConnection) {
+				keyIDs.Add(sub.KeyID)
+			}
+			for keyID, stop := range listening {
+				if !keyIDs[keyID] {
+					stop()
+					delete(listening, keyID)
+				}
+			}
+			for keyID := range keyIDs {
+				if _, ok := listening[keyID]; !ok {
+					listening[keyID] = listenForDominantSpeaker(signalling, dominantSpeakers, keyID)
+				}
+			}
+		}
+
+		handleMessage := func(t TypeData[json.RawMessage]) bool {
+			switch t.Type {
+			case "SUBSCRIBE":
+				var r SubscribeRequest
+				if err := json.Unmarshal(t.Data, &r); err != nil {
+					logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+					return true
+				}
+
+				logger.Debug(
+					"Subscribing",
+					"keyId", r.KeyID,
+					"broadcastId", r.BroadcastID,
+					"kind", r.Kind,
+					"track", r.TrackID,
+				)
+				tracksAndConnections.AddReceivingPeerConnection(
+					r.TrackKey, peerConnection, allocator,
+				)
+				tracksAndConnections.SetPriority(r.TrackKey, peerConnection, r.Priority)
+				tracksAndConnections.SelectLayer(r.TrackKey, peerConnection, r.Layer)
+				listenForDominantSpeakers()
+
+				if err := sendSubscriptions(); err != nil {
+					return false
+				}
+			case "UNSUBSCRIBE":
+				var key TrackKey
+				if err := json.Unmarshal(t.Data, &key); err != nil {
+					logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+					return true
+				}
+
+				tracksAndConnections.RemoveReceivingPeerConnection(key, peerConnection)
+				listenForDominantSpeakers()
+
+				if err := sendSubscriptions(); err != nil {
+					return false
+				}
+			case "SELECT_LAYER":
+				var r SubscribeRequest
+				if err := json.Unmarshal(t.Data, &r); err != nil {
+					logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+					return true
+				}
+
+				tracksAndConnections.SelectLayer(r.TrackKey, peerConnection, r.Layer)
+			case "SET_PRIORITY":
+				var r SubscribeRequest
+				if err := json.Unmarshal(t.Data, &r); err != nil {
+					logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+					return true
+				}
+
+				tracksAndConnections.SetPriority(r.TrackKey, peerConnection, r.Priority)
+			// Lists the tracks of a broadcast. From then on, the receiver gets told
+			// whenever the broadcast's tracks change, until it asks to stop.
+			case "GET_TRACKS", "UNWATCH_TRACKS":
+				var key TrackKey
+				if err := json.Unmarshal(t.Data, &key); err != nil {
+					logger.Warn("Bad JSON message", "type", t.Type, "err", err)
+					return true
+				}
+				broadcast := broadcastKey{key.KeyID, key.BroadcastID}
+
+				lock.Lock()
+				defer lock.Unlock()
+
+				if unwatch, ok := watching[broadcast]; ok {
+					unwatch()
+					delete(watching, broadcast)
+				}
+				if t.Type == "UNWATCH_TRACKS" || closed {
+					return true
+				}
+
+				watching[broadcast] = tracksAndConnections.WatchTracks(
+					key.KeyID,
+					key.BroadcastID,
+					func(tracks BroadcastTracks) {
+						signalling.WriteJSON(TypeData[BroadcastTracks]{
+							Type: "TRACKS",
+							Data: tracks,
+						})
+					},
+				)
+			case "GET_STATS":
+				if err := signalling.WriteJSON(TypeData[ReceiverStats]{
+					Type: "STATS",
+					Data: allocator.Stats(),
+				}); err != nil {
+					return false
+				}
+			case "SIGNALLING":
+				if !handleReceiverSignalling(logger, signalling, peerConnection, t.Data) {
+					return false
+				}
+			}
+
+			return true
+		}
+
+		session, err := sessions.Create(SessionOwner{Endpoint: "subscribe"}, logger, peerConnection, signalling, handleMessage)
+		if err != nil {
+			logger.Error("Failed to create session", "err", err)
+			writeServerError(signalling, err)
+			allocator.Close()
+			peerConnection.Close()
+			return
+		}
+		logger = session.Logger()
+		session.OnClose(allocator.Close)
+		session.OnClose(func() {
+			if cErr := peerConnection.Close(); cErr != nil {
+				logger.Warn("Failed to close peer connection", "err", cErr)
+			}
+		})
+		session.OnClose(func() {
+			tracksAndConnections.RemoveAllSubscriptions(peerConnection)
+		})
+		session.OnClose(func() {
+			lock.Lock()
+			defer lock.Unlock()
+
+			closed = true
+			for _, unwatch := range watching {
+				unwatch()
+			}
+			for _, stop := range listening {
+				stop()
+			}
+		})
+
+		// The receiver needs to know which track is which before it gets them
+		handleReceiverNegotiation(signalling, peerConnection, session.Done(), func() {
+			sendSubscriptions()
+		})
+
+		session.Serve(conn)
+	}
+}
@@ -1,183 +1,1090 @@
 package main
 
 import (
+	"log/slog"
+	"sort"
 	"sync"
 
-	"github.com/pion/webrtc/v3"
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/pion/webrtc/v4"
 )
 
 type KeyIDString string
 type BroadcastIDString string
 type KindString string
+type TrackIDString string
+
+// TrackKey identifies a track that a receiver can subscribe to.
+//
+// A track is either picked by its ID, or by its kind. Picking by kind gets
+// whichever track of that kind was published to the broadcast first.
+type TrackKey struct {
+	KeyID       KeyIDString       `json:"keyId"`
+	BroadcastID BroadcastIDString `json:"id"`
+	Kind        KindString        `json:"kind,omitempty"`
+	TrackID     TrackIDString     `json:"track,omitempty"`
+}
+
+// normalize drops the kind when there's a track ID, since the track ID alone
+// says everything. Otherwise, the same track could be subscribed to twice.
+func (k TrackKey) normalize() TrackKey {
+	if k.TrackID != "" {
+		k.Kind = ""
+	}
+	return k
+}
+
+// selector is the part of the key that picks a track out of the broadcast
+func (k TrackKey) selector() trackSelector {
+	return trackSelector{k.Kind, k.TrackID}
+}
+
+type trackSelector struct {
+	kind    KindString
+	trackID TrackIDString
+}
+
+// TrackInfo describes a single track of a broadcast to receivers
+type TrackInfo struct {
+	ID       TrackIDString `json:"track"`
+	Kind     KindString    `json:"kind"`
+	MimeType string        `json:"mimeType"`
+	Layers   []string      `json:"layers"`
+}
+
+// BroadcastTracks lists every track of a broadcast
+type BroadcastTracks struct {
+	KeyID       KeyIDString       `json:"keyId"`
+	BroadcastID BroadcastIDString `json:"id"`
+	Tracks      []TrackInfo       `json:"tracks"`
+}
+
+type broadcastKey struct {
+	keyID       KeyIDString
+	broadcastID BroadcastIDString
+}
+
+// trackWatcher gets told whenever the tracks of a broadcast change
+type trackWatcher struct {
+	callback func(BroadcastTracks)
+}
+
+// broadcastHooks get called whenever a broadcast starts or stops being
+// published to this server, no matter how it's published
+type broadcastHooks struct {
+	lock *sync.Mutex
+
+	started []func(KeyIDString, BroadcastIDString)
+	ended   []func(KeyIDString, BroadcastIDString)
+
+	// Broadcasts that the hooks were last told had started
+	published Set[broadcastKey]
+}
 
 // TracksAndConnectionsManager is just a simple object, whose sole purpose is to
 // manage tracks, and adding tracks to a peer connection, and nothing more.
 type TracksAndConnectionsManager struct {
 	lock *sync.RWMutex
 
-	// Peer connections on the receiving end
-	receivingPeerConnections Map3D[KeyIDString, BroadcastIDString, KindString, Set[*webrtc.PeerConnection]]
+	// Subscriptions of the peer connections (and sinks) on the receiving end, by
+	// what they subscribed to. A peer connection can be subscribed to any number
+	// of tracks.
+	subscriptions Map3D[KeyIDString, BroadcastIDString, trackSelector, Set[*Subscription]]
+
+	// The very same subscriptions, but by peer connection
+	peerConnections map[*webrtc.PeerConnection]map[TrackKey]*Subscription
+
+	// ...and by sink
+	sinks map[TrackSink]map[TrackKey]*Subscription
 
 	// Tracks to send to the peer connections.
-	tracks Map3D[KeyIDString, BroadcastIDString, KindString, webrtc.TrackLocal]
+	tracks Map3D[KeyIDString, BroadcastIDString, TrackIDString, *ForwardedTrack]
+
+	watchers map[broadcastKey]Set[*trackWatcher]
+
+	// Where every server sharing the registry gets told which broadcasts live
+	// here
+	registry Registry
+
+	// The kinds of tracks that each broadcast has, as far as the registry knows.
+	// Only touched while holding registryLock, which is never taken while the
+	// main lock is held.
+	registryLock *sync.Mutex
+	registered   map[broadcastKey]Set[KindString]
+
+	// Never taken while the main lock is held either
+	hooks *broadcastHooks
+
+	logger *slog.Logger
+}
+
+// Subscription is a single receiving peer connection's interest in a track.
+//
+// The subscription outlives any one track, so that whatever the receiver asked
+// for still holds once a publisher (re)publishes.
+type Subscription struct {
+	key TrackKey
+
+	// Only one of these is ever set
+	pc   *webrtc.PeerConnection
+	sink TrackSink
+
+	// Splits up the peer connection's bandwidth between everything it receives.
+	// Nil for sinks, which have all the bandwidth they could want.
+	allocator *BandwidthAllocator
+
+	// RID of the simulcast layer that the receiver wants. Empty for "pick one
+	// for me"
+	layer string
+
+	// Tracks with a higher priority get bandwidth first
+	priority int
+
+	// The track being received. Nil while there's no track to receive
+	track *ForwardedTrack
+
+	// What the peer connection is being sent. Both stick around for when there's
+	// no track to receive, so that if one comes along, the receiver can just
+	// carry on. Both nil until there's been a track to receive. Sinks never have
+	// a sender.
+	downTrack *DownTrack
+	sender    *webrtc.RTPSender
+}
+
+// TrackSink is a receiver without a peer connection, e.g. a recorder. It gets
+// tracks the very same way that a receiving peer connection would, through a
+// DownTrack, so that it sees a single, continuous stream regardless of layer
+// switches, or publishers coming and going. Since there's no bandwidth to
+// worry about, it always gets the best layer.
+type TrackSink interface {
+	// AddDownTrack is called with each new DownTrack that the sink gets for one
+	// of its subscriptions: once there's first a track to get, and again
+	// whenever a track comes along that the old DownTrack can't switch to (e.g.
+	// the codec changed). The DownTrack's packets get written to the returned
+	// writer.
+	//
+	// Called with the manager's lock held, so it must not call back into the
+	// manager, and should return quickly.
+	AddDownTrack(key TrackKey, downTrack *DownTrack) webrtc.TrackLocalWriter
+
+	// RemoveDownTrack is called once a DownTrack won't be written to anymore.
+	// Just as with AddDownTrack, the manager's lock is held.
+	RemoveDownTrack(key TrackKey, downTrack *DownTrack)
+}
+
+// SubscriptionInfo describes a subscription to the receiver, so that the
+// receiver can tell which of the tracks it's getting is which.
+type SubscriptionInfo struct {
+	TrackKey
+
+	// ID of the track being received; handy for when the subscription was by
+	// kind. Empty while there's no track to receive.
+	Current TrackIDString `json:"current"`
+
+	// Media ID of the transceiver that the track is being sent on. Empty until
+	// there's been a track to receive, after which the transceiver sticks around
+	// for whenever there's a track again.
+	Mid string `json:"mid"`
 }
 
-// NewTracksAndConnectionManager creates a new TracksAndConnectionsManager
-func NewTracksAndConnectionManager() TracksAndConnectionsManager {
+// NewTracksAndConnectionManager creates a new TracksAndConnectionsManager,
+// which publishes its broadcasts to the given registry, and logs through the
+// given logger
+func NewTracksAndConnectionManager(
+	registry Registry,
+	logger *slog.Logger,
+) TracksAndConnectionsManager {
 	return TracksAndConnectionsManager{
-		lock:                     &sync.RWMutex{},
-		receivingPeerConnections: Map3D[KeyIDString, BroadcastIDString, KindString, Set[*webrtc.PeerConnection]]{},
-		tracks:                   Map3D[KeyIDString, BroadcastIDString, KindString, webrtc.TrackLocal]{},
+		lock:            &sync.RWMutex{},
+		subscriptions:   Map3D[KeyIDString, BroadcastIDString, trackSelector, Set[*Subscription]]{},
+		peerConnections: map[*webrtc.PeerConnection]map[TrackKey]*Subscription{},
+		sinks:           map[TrackSink]map[TrackKey]*Subscription{},
+		tracks:          Map3D[KeyIDString, BroadcastIDString, TrackIDString, *ForwardedTrack]{},
+		watchers:        map[broadcastKey]Set[*trackWatcher]{},
+		registry:        registry,
+		registryLock:    &sync.Mutex{},
+		registered:      map[broadcastKey]Set[KindString]{},
+		hooks: &broadcastHooks{
+			lock:      &sync.Mutex{},
+			published: Set[broadcastKey]{},
+		},
+		logger: logger,
 	}
 }
 
 // NOT THREAD SAFE!
-func setTrackForPeerConnection(pc *webrtc.PeerConnection, track webrtc.TrackLocal) error {
-	// Check if a track exists. If it does, then replace it
-	for _, t := range pc.GetTransceivers() {
-		if t.Sender().Track().Kind() == track.Kind() {
-			if t.Sender().Track() == track {
-				return nil
-			}
-			return t.Sender().ReplaceTrack(track)
+//
+// setTrackForSubscription has the subscription's peer connection receive the
+// given track, instead of whatever it was getting before.
+//
+// Whenever possible, the DownTrack that the peer connection already has just
+// gets pointed at the new track, so that there's nothing for the receiver to
+// negotiate, and nothing for it to notice besides waiting on a keyframe. Only
+// when that can't be done (e.g. the codec changed) does the peer connection
+// get a fresh DownTrack.
+func setTrackForSubscription(sub *Subscription, track *ForwardedTrack) error {
+	if sub.track == track {
+		return nil
+	}
+	detachTrackFromSubscription(sub)
+	sub.track = track
+
+	if sub.downTrack != nil && sub.downTrack.CanSwitchTo(track) {
+		track.AttachDownTrack(sub.downTrack)
+		if sub.allocator != nil {
+			sub.allocator.AddDownTrack(sub.downTrack)
 		}
+		return nil
+	}
+
+	if sub.sink != nil {
+		// Nothing to negotiate; the sink just has to be told to expect something
+		// else
+		if sub.downTrack != nil {
+			sub.downTrack.unbindWriter()
+			sub.sink.RemoveDownTrack(sub.key, sub.downTrack)
+		}
+		downTrack := track.NewDownTrack(sub.layer)
+		sub.downTrack = downTrack
+		downTrack.bindWriter(sub.sink.AddDownTrack(sub.key, downTrack))
+		return nil
+	}
+
+	downTrack := track.NewDownTrack(sub.layer)
+	downTrack.setPriority(sub.priority)
+	sub.downTrack = downTrack
+	sub.allocator.AddDownTrack(downTrack)
+
+	// If we're already sending something, then try replacing it. That only
+	// works if the receiver already negotiated the codec, though. Otherwise,
+	// there's no way around negotiating all over again.
+	if sub.sender != nil {
+		if err := sub.sender.ReplaceTrack(downTrack); err == nil {
+			return nil
+		}
+		sub.pc.RemoveTrack(sub.sender)
+		sub.sender = nil
 	}
 
 	// Otherwise, just add the track
-	_, err := pc.AddTrack(track)
-	return err
+	sender, err := sub.pc.AddTrack(downTrack)
+	if err != nil {
+		return err
+	}
+	sub.sender = sender
+	go readReceiverRTCP(sender)
+
+	return nil
 }
 
 // NOT THREAD SAFE!
-func (t TracksAndConnectionsManager) getTrack(
+//
+// detachTrackFromSubscription stops the subscription from getting the track it
+// was getting, but leaves the peer connection's DownTrack in place, with
+// nothing being sent on it. That way, if the publisher comes back, the
+// receiver won't have to negotiate anything.
+func detachTrackFromSubscription(sub *Subscription) {
+	if sub.track == nil {
+		return
+	}
+
+	if sub.downTrack != nil {
+		sub.track.RemoveDownTrack(sub.downTrack)
+		if sub.allocator != nil {
+			sub.allocator.RemoveDownTrack(sub.downTrack)
+		}
+	}
+	sub.track = nil
+}
+
+// NOT THREAD SAFE!
+//
+// removeTrackFromSubscription stops sending anything to the subscription's
+// peer connection (or sink).
+func removeTrackFromSubscription(sub *Subscription) {
+	detachTrackFromSubscription(sub)
+	if sub.sink != nil && sub.downTrack != nil {
+		sub.downTrack.unbindWriter()
+		sub.sink.RemoveDownTrack(sub.key, sub.downTrack)
+	}
+	sub.downTrack = nil
+
+	if sub.sender != nil {
+		sub.pc.RemoveTrack(sub.sender)
+		sub.sender = nil
+	}
+}
+
+// NOT THREAD SAFE!
+//
+// resolve finds the track that a subscription should be getting
+func (t TracksAndConnectionsManager) resolve(
 	keyId KeyIDString,
 	broadcastId BroadcastIDString,
-	kind KindString,
-) (webrtc.TrackLocal, bool) {
-	keyIds, ok := t.tracks[keyId]
-	if !ok {
-		keyIds = map[BroadcastIDString]map[KindString]webrtc.TrackLocal{}
-		t.tracks[keyId] = keyIds
+	selector trackSelector,
+) (*ForwardedTrack, bool) {
+	if selector.trackID != "" {
+		return t.tracks.Get(keyId, broadcastId, selector.trackID)
 	}
 
-	broadcasts, ok := keyIds[broadcastId]
-	if !ok {
-		broadcasts = map[KindString]webrtc.TrackLocal{}
-		keyIds[broadcastId] = broadcasts
+	// Whichever of the kind was published first
+	var oldest *ForwardedTrack
+	for _, track := range t.tracks[keyId][broadcastId] {
+		if KindString(track.Kind().String()) != selector.kind {
+			continue
+		}
+		if oldest == nil || track.created.Before(oldest.created) {
+			oldest = track
+		}
 	}
 
-	track, ok := broadcasts[kind]
-	return track, ok
+	return oldest, oldest != nil
+}
+
+// NOT THREAD SAFE!
+//
+// refreshSubscriptions makes sure that every subscription to a broadcast is
+// getting the track that it should be, after the broadcast's tracks changed.
+func (t TracksAndConnectionsManager) refreshSubscriptions(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+) {
+	for selector, subscriptions := range t.subscriptions[keyId][broadcastId] {
+		track, ok := t.resolve(keyId, broadcastId, selector)
+		for sub := range subscriptions {
+			if !ok {
+				detachTrackFromSubscription(sub)
+				continue
+			}
+			if err := setTrackForSubscription(sub, track); err != nil {
+				t.subscriptionLogger(sub).Warn("Failed to send track to receiver", "err", err)
+			}
+		}
+	}
+}
+
+// NOT THREAD SAFE!
+func (t TracksAndConnectionsManager) getSubscription(
+	key TrackKey,
+	pc *webrtc.PeerConnection,
+) (*Subscription, bool) {
+	sub, ok := t.peerConnections[pc][key]
+	return sub, ok
 }
 
 // SetTrack sets a track, and adds them to all the peer connections that are
 // listening to the track.
+//
+// A track replaces whichever track of the broadcast has the same ID.
 func (t TracksAndConnectionsManager) SetTrack(
 	keyId KeyIDString,
 	broadcastId BroadcastIDString,
-	track webrtc.TrackLocal,
+	track *ForwardedTrack,
 ) {
-	// We iterate through each of the peer connections,
-	t.lock.RLock()
-	defer t.lock.RUnlock()
+	defer t.notifyWatchers(keyId, broadcastId)
+	defer t.syncRegistry(keyId, broadcastId)
+	defer t.syncHooks(keyId, broadcastId)
 
-	kind := KindString(track.Kind().String())
+	// We iterate through each of the peer connections,
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
 	// Some notes:
 	//
 	// - We shouldn't have to care about how the ingress track (remote track
 	//   coming from clients) is writing to the egress track
-	// - When a track is set, then iterate through all peer connections associated
-	//   with the key representing the key ID, broadcast ID, and kind, and then
-	//   set the track to the peer connection.
+	// - When a track is set, then iterate through all peer connections
+	//   subscribed to the broadcast, and then set the track to whichever peer
+	//   connections should now be getting it.
 
-	t.tracks.Set(keyId, broadcastId, kind, track)
+	t.tracks.Set(keyId, broadcastId, track.ID(), track)
+	t.refreshSubscriptions(keyId, broadcastId)
 
-	pcSet, ok := t.receivingPeerConnections.Get(keyId, broadcastId, kind)
-	if !ok {
-		return
-	}
-
-	for pc := range pcSet.Iterate() {
-		setTrackForPeerConnection(pc, track)
-	}
+	t.trackLogger(keyId, broadcastId, track).Info("Track published", "relayed", track.relayed)
 }
 
-// AddReceivingPeerConnection adds a peer connection to the list of peer connections, and
-// adds the track to the peer connection.
+// AddReceivingPeerConnection subscribes a peer connection to a track, and adds
+// the track to the peer connection, if there is one.
+//
+// A peer connection can be subscribed to as many tracks as it likes, across
+// any number of broadcasts. Subscribing to the same track twice does nothing.
+//
+// The allocator is the one that splits up the peer connection's bandwidth.
 func (t TracksAndConnectionsManager) AddReceivingPeerConnection(
-	keyId KeyIDString,
-	broadcastId BroadcastIDString,
-	kind KindString,
+	key TrackKey,
 	pc *webrtc.PeerConnection,
+	allocator *BandwidthAllocator,
 ) {
-	t.lock.RLock()
-	defer t.lock.RUnlock()
+	key = key.normalize()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
 	// So, when we add a peer connection, we get a set, and ensure that the set
 	// exists. If it does not, create it. Now with our set, we add the peer
 	// but also, add tracks to the peer.
 
-	connections, ok := t.receivingPeerConnections.Get(keyId, broadcastId, kind)
+	if _, ok := t.getSubscription(key, pc); ok {
+		return
+	}
+
+	sub := &Subscription{key: key, pc: pc, allocator: allocator}
+
+	byTrack, ok := t.peerConnections[pc]
 	if !ok {
-		connections = Set[*webrtc.PeerConnection]{}
-		t.receivingPeerConnections.Set(keyId, broadcastId, kind, connections)
+		byTrack = map[TrackKey]*Subscription{}
+		t.peerConnections[pc] = byTrack
 	}
-	connections.Add(pc)
+	byTrack[key] = sub
+
+	t.addSubscription(sub)
+}
 
-	track, ok := t.tracks.Get(keyId, broadcastId, kind)
+// AddSink subscribes a sink to a track, just like AddReceivingPeerConnection
+// does for peer connections. Subscribing to the same track twice does nothing.
+func (t TracksAndConnectionsManager) AddSink(key TrackKey, sink TrackSink) {
+	key = key.normalize()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	byTrack, ok := t.sinks[sink]
 	if !ok {
+		byTrack = map[TrackKey]*Subscription{}
+		t.sinks[sink] = byTrack
+	}
+	if _, ok := byTrack[key]; ok {
 		return
 	}
 
-	setTrackForPeerConnection(pc, track)
+	sub := &Subscription{key: key, sink: sink}
+	byTrack[key] = sub
+
+	t.addSubscription(sub)
 }
 
-// RemoveReceivingPeerConnection removes a peer connection from the list of peers.
-func (t TracksAndConnectionsManager) RemoveReceivingPeerConnection(
-	keyId KeyIDString,
-	broadcastId BroadcastIDString,
-	kind KindString,
+// NOT THREAD SAFE!
+//
+// addSubscription adds a subscription to the ones of its track, and has it
+// receive the track, if there is one.
+func (t TracksAndConnectionsManager) addSubscription(sub *Subscription) {
+	key := sub.key
+
+	subscriptions, ok := t.subscriptions.Get(key.KeyID, key.BroadcastID, key.selector())
+	if !ok {
+		subscriptions = Set[*Subscription]{}
+		t.subscriptions.Set(key.KeyID, key.BroadcastID, key.selector(), subscriptions)
+	}
+	subscriptions.Add(sub)
+
+	track, ok := t.resolve(key.KeyID, key.BroadcastID, key.selector())
+	if !ok {
+		return
+	}
+
+	if err := setTrackForSubscription(sub, track); err != nil {
+		t.subscriptionLogger(sub).Warn("Failed to send track to receiver", "err", err)
+	}
+}
+
+// SelectLayer picks the simulcast layer (by RID) that a receiving peer
+// connection wants to get. An empty RID lets the layer be picked
+// automatically.
+//
+// The preference sticks around for as long as the peer connection is
+// receiving, even if the publisher goes away and comes back.
+func (t TracksAndConnectionsManager) SelectLayer(
+	key TrackKey,
+	pc *webrtc.PeerConnection,
+	rid string,
+) {
+	key = key.normalize()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sub, ok := t.getSubscription(key, pc)
+	if !ok {
+		return
+	}
+	sub.layer = rid
+
+	if sub.downTrack == nil {
+		return
+	}
+	if sub.track == nil {
+		// For once there is a track again
+		sub.downTrack.setPreferredLayer(rid)
+		return
+	}
+
+	sub.track.SelectLayer(sub.downTrack, rid)
+
+	// Whatever got allocated before may no longer make sense
+	sub.allocator.Allocate()
+}
+
+// SetPriority sets how important a track is to a receiving peer connection,
+// relative to the other tracks that it receives. Higher priority tracks get
+// bandwidth first.
+func (t TracksAndConnectionsManager) SetPriority(
+	key TrackKey,
 	pc *webrtc.PeerConnection,
+	priority int,
 ) {
+	key = key.normalize()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	sub, ok := t.getSubscription(key, pc)
+	if !ok {
+		return
+	}
+	sub.priority = priority
+
+	if sub.downTrack != nil {
+		sub.downTrack.setPriority(priority)
+		sub.allocator.Allocate()
+	}
+}
+
+// Subscriptions lists everything that a receiving peer connection is
+// subscribed to.
+func (t TracksAndConnectionsManager) Subscriptions(pc *webrtc.PeerConnection) []SubscriptionInfo {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	infos := []SubscriptionInfo{}
+	for key, sub := range t.peerConnections[pc] {
+		info := SubscriptionInfo{TrackKey: key}
+		if sub.track != nil {
+			info.Current = sub.track.ID()
+		}
+		if sub.sender != nil {
+			for _, transceiver := range pc.GetTransceivers() {
+				if transceiver.Sender() == sub.sender {
+					info.Mid = transceiver.Mid()
+				}
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// KeyAudioTracks lists every audio track of every broadcast of a key ID.
+func (t TracksAndConnectionsManager) KeyAudioTracks(keyId KeyIDString) []*ForwardedTrack {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
-	pcSet, ok := t.receivingPeerConnections.Get(keyId, broadcastId, kind)
+	tracks := []*ForwardedTrack{}
+	for _, broadcast := range t.tracks[keyId] {
+		for _, track := range broadcast {
+			if track.Kind() == webrtc.RTPCodecTypeAudio {
+				tracks = append(tracks, track)
+			}
+		}
+	}
+
+	return tracks
+}
+
+// RemoveReceivingPeerConnection unsubscribes a peer connection from a track,
+// and stops sending the track to it.
+func (t TracksAndConnectionsManager) RemoveReceivingPeerConnection(
+	key TrackKey,
+	pc *webrtc.PeerConnection,
+) {
+	key = key.normalize()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.removeSubscription(key, pc)
+
+	// Note: a track exists regardless of if any peer connections are listening
+}
+
+// RemoveAllSubscriptions unsubscribes a peer connection from every track that
+// it's subscribed to. Meant for when the peer connection is going away.
+func (t TracksAndConnectionsManager) RemoveAllSubscriptions(pc *webrtc.PeerConnection) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for key := range t.peerConnections[pc] {
+		t.removeSubscription(key, pc)
+	}
+}
+
+// RemoveSink unsubscribes a sink from every track that it's subscribed to.
+func (t TracksAndConnectionsManager) RemoveSink(sink TrackSink) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for key, sub := range t.sinks[sink] {
+		delete(t.sinks[sink], key)
+		t.unsubscribe(sub)
+	}
+	delete(t.sinks, sink)
+}
+
+// NOT THREAD SAFE!
+func (t TracksAndConnectionsManager) removeSubscription(key TrackKey, pc *webrtc.PeerConnection) {
+	sub, ok := t.getSubscription(key, pc)
 	if !ok {
 		return
 	}
-	pcSet.Remove(pc)
 
-	// Note: a track exists regardless of if any peer connections are listening
+	delete(t.peerConnections[pc], key)
+	if len(t.peerConnections[pc]) == 0 {
+		delete(t.peerConnections, pc)
+	}
+
+	t.unsubscribe(sub)
+}
+
+// NOT THREAD SAFE!
+//
+// unsubscribe removes a subscription from the ones of its track, and stops
+// sending anything for it.
+func (t TracksAndConnectionsManager) unsubscribe(sub *Subscription) {
+	key := sub.key
+
+	if subscriptions, ok := t.subscriptions.Get(key.KeyID, key.BroadcastID, key.selector()); ok {
+		subscriptions.Remove(sub)
+		if len(subscriptions) == 0 {
+			t.subscriptions.Remove(key.KeyID, key.BroadcastID, key.selector())
+		}
+	}
+
+	removeTrackFromSubscription(sub)
 }
 
 // RemoveTrack removes a track from the list of local tracks, but also removes
 // it from all receiving peer connections.
+//
+// The track is only removed if it is still the one set for its key ID,
+// broadcast ID, and track ID. Otherwise, a publisher that went away after
+// being replaced would end up taking its replacement down with it.
 func (t TracksAndConnectionsManager) RemoveTrack(
 	keyId KeyIDString,
 	broadcastId BroadcastIDString,
-	kind KindString,
+	track *ForwardedTrack,
 ) {
+	defer t.notifyWatchers(keyId, broadcastId)
+	defer t.syncRegistry(keyId, broadcastId)
+	defer t.syncHooks(keyId, broadcastId)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	current, trackExists := t.tracks.Get(keyId, broadcastId, track.ID())
+	if !trackExists || current != track {
+		return
+	}
+
+	t.tracks.Remove(keyId, broadcastId, track.ID())
+
+	// Subscriptions by kind may have another track of the same kind to fall
+	// back to; everything else stops receiving, until the track comes back.
+	t.refreshSubscriptions(keyId, broadcastId)
+
+	t.trackLogger(keyId, broadcastId, track).Info("Track removed")
+}
+
+// Tracks lists every track of a broadcast, in the order they were published.
+func (t TracksAndConnectionsManager) Tracks(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+) BroadcastTracks {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.broadcastTracks(keyId, broadcastId)
+}
+
+// Track gets a single track of a broadcast
+func (t TracksAndConnectionsManager) Track(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	trackId TrackIDString,
+) (*ForwardedTrack, bool) {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
 
-	track, trackExists := t.tracks.Get(keyId, broadcastId, kind)
-	t.tracks.Remove(keyId, broadcastId, kind)
-	pcSet, ok := t.receivingPeerConnections.Get(keyId, broadcastId, kind)
+	return t.tracks.Get(keyId, broadcastId, trackId)
+}
+
+// NOT THREAD SAFE!
+func (t TracksAndConnectionsManager) broadcastTracks(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+) BroadcastTracks {
+	infos := []TrackInfo{}
+	for _, track := range t.sortedTracks(keyId, broadcastId) {
+		infos = append(infos, track.Info())
+	}
+
+	return BroadcastTracks{keyId, broadcastId, infos}
+}
+
+// NOT THREAD SAFE!
+//
+// sortedTracks gets the tracks of a broadcast, in the order they were published
+func (t TracksAndConnectionsManager) sortedTracks(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+) []*ForwardedTrack {
+	tracks := []*ForwardedTrack{}
+	for _, track := range t.tracks[keyId][broadcastId] {
+		tracks = append(tracks, track)
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].created.Before(tracks[j].created)
+	})
+	return tracks
+}
+
+// WatchTracks calls the callback with the list of tracks of a broadcast right
+// away, and then again every time that a track is set or removed, until the
+// returned function is called.
+func (t TracksAndConnectionsManager) WatchTracks(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	callback func(BroadcastTracks),
+) func() {
+	watcher := &trackWatcher{callback}
+	key := broadcastKey{keyId, broadcastId}
+
+	t.lock.Lock()
+	watchers, ok := t.watchers[key]
 	if !ok {
-		return
+		watchers = Set[*trackWatcher]{}
+		t.watchers[key] = watchers
+	}
+	watchers.Add(watcher)
+	tracks := t.broadcastTracks(keyId, broadcastId)
+	t.lock.Unlock()
+
+	callback(tracks)
+
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+
+		watchers.Remove(watcher)
+		if len(watchers) == 0 {
+			delete(t.watchers, key)
+		}
+	}
+}
+
+// notifyWatchers tells everyone watching a broadcast what its tracks are.
+//
+// The callbacks are called without the lock held, since they usually end up
+// writing to some WebSocket, and there's no point in holding everything else
+// up while that happens.
+func (t TracksAndConnectionsManager) notifyWatchers(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+) {
+	t.lock.RLock()
+	tracks := t.broadcastTracks(keyId, broadcastId)
+	watchers := []*trackWatcher{}
+	for watcher := range t.watchers[broadcastKey{keyId, broadcastId}] {
+		watchers = append(watchers, watcher)
+	}
+	t.lock.RUnlock()
+
+	for _, watcher := range watchers {
+		watcher.callback(tracks)
 	}
+}
+
+// NOT THREAD SAFE!
+//
+// publishedKinds gets the kinds of tracks published to the broadcast on this
+// server, leaving out whatever is relayed from some other server
+func (t TracksAndConnectionsManager) publishedKinds(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+) Set[KindString] {
+	kinds := Set[KindString]{}
+	for _, track := range t.tracks[keyId][broadcastId] {
+		if !track.relayed {
+			kinds.Add(KindString(track.Kind().String()))
+		}
+	}
+	return kinds
+}
 
-	if !trackExists {
+// OnBroadcastStarted has the callback called whenever a broadcast gets its
+// first track published to this server (relayed tracks don't count), be it
+// over WebSocket, WHIP, RTP, or RTSP.
+//
+// Callbacks are called without the main lock held, so they're free to
+// subscribe to the broadcast, but must not publish to it.
+func (t TracksAndConnectionsManager) OnBroadcastStarted(
+	callback func(KeyIDString, BroadcastIDString),
+) {
+	t.hooks.lock.Lock()
+	defer t.hooks.lock.Unlock()
+
+	t.hooks.started = append(t.hooks.started, callback)
+}
+
+// OnBroadcastEnded has the callback called whenever a broadcast that had
+// started loses the last of the tracks published to this server. Same rules
+// as OnBroadcastStarted.
+func (t TracksAndConnectionsManager) OnBroadcastEnded(
+	callback func(KeyIDString, BroadcastIDString),
+) {
+	t.hooks.lock.Lock()
+	defer t.hooks.lock.Unlock()
+
+	t.hooks.ended = append(t.hooks.ended, callback)
+}
+
+// syncHooks calls the broadcast hooks, if the broadcast has started or ended
+// since they were last called for it
+func (t TracksAndConnectionsManager) syncHooks(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+) {
+	t.hooks.lock.Lock()
+	defer t.hooks.lock.Unlock()
+
+	t.lock.RLock()
+	published := len(t.publishedKinds(keyId, broadcastId)) > 0
+	t.lock.RUnlock()
+
+	key := broadcastKey{keyId, broadcastId}
+	if published == t.hooks.published[key] {
 		return
 	}
 
-	for pc := range pcSet {
-		for _, sender := range pc.GetSenders() {
-			if sender.Track() == track {
-				pc.RemoveTrack(sender)
+	hooks := t.hooks.ended
+	if published {
+		t.hooks.published.Add(key)
+		hooks = t.hooks.started
+	} else {
+		t.hooks.published.Remove(key)
+	}
+	for _, hook := range hooks {
+		hook(keyId, broadcastId)
+	}
+}
+
+// syncRegistry tells the registry which kinds of tracks the broadcast has now,
+// leaving out whatever is relayed from some other server, since that's not
+// where the broadcast lives.
+func (t TracksAndConnectionsManager) syncRegistry(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+) {
+	t.registryLock.Lock()
+	defer t.registryLock.Unlock()
+
+	t.lock.RLock()
+	kinds := t.publishedKinds(keyId, broadcastId)
+	t.lock.RUnlock()
+
+	entry := func(kind KindString) RegistryEntry {
+		return RegistryEntry{
+			KeyID:       keyId,
+			BroadcastID: broadcastId,
+			Kind:        kind,
+			Node:        RegistryNode{ID: config.NodeID(), URL: config.NodeURL()},
+		}
+	}
+
+	key := broadcastKey{keyId, broadcastId}
+	registered := t.registered[key]
+	for kind := range kinds {
+		if registered[kind] {
+			continue
+		}
+		if err := t.registry.Publish(entry(kind)); err != nil {
+			broadcastLogger(t.logger, keyId, broadcastId).Warn(
+				"Failed to publish to the registry",
+				"kind", kind,
+				"err", err,
+			)
+		}
+	}
+	for kind := range registered {
+		if kinds[kind] {
+			continue
+		}
+		if err := t.registry.Unpublish(entry(kind)); err != nil {
+			broadcastLogger(t.logger, keyId, broadcastId).Warn(
+				"Failed to unpublish from the registry",
+				"kind", kind,
+				"err", err,
+			)
+		}
+	}
+
+	if len(kinds) == 0 {
+		delete(t.registered, key)
+	} else {
+		t.registered[key] = kinds
+	}
+}
+
+// CodecInfo describes a track's codec
+type CodecInfo struct {
+	MimeType    string `json:"mimeType"`
+	ClockRate   uint32 `json:"clockRate"`
+	Channels    uint16 `json:"channels,omitempty"`
+	SDPFmtpLine string `json:"sdpFmtpLine,omitempty"`
+}
+
+// TrackStatus describes a single track of a broadcast, for the admin API
+type TrackStatus struct {
+	ID      TrackIDString `json:"track"`
+	Kind    KindString    `json:"kind"`
+	Codec   CodecInfo     `json:"codec"`
+	Relayed bool          `json:"relayed"`
+	Layers  []LayerStats  `json:"layers"`
+}
+
+// ReceiverStatus describes a single subscription to a broadcast's tracks, for
+// the admin API
+type ReceiverStatus struct {
+	// Whatever the receiver subscribed to
+	Kind    KindString    `json:"kind,omitempty"`
+	TrackID TrackIDString `json:"track,omitempty"`
+
+	// What it's getting right now. Empty while there's nothing to get.
+	Current TrackIDString `json:"current"`
+	Layer   string        `json:"layer"`
+	Paused  bool          `json:"paused"`
+
+	// Either "peerConnection" or "sink"
+	Type string `json:"type"`
+
+	// For peer connections
+	ConnectionState string `json:"connectionState,omitempty"`
+
+	// ID of the session that the peer connection belongs to. Left for the admin
+	// API to fill in, since the manager knows nothing about sessions.
+	Session string `json:"session,omitempty"`
+
+	PeerConnection *webrtc.PeerConnection `json:"-"`
+}
+
+// BroadcastStatus describes a broadcast, for the admin API
+type BroadcastStatus struct {
+	KeyID       KeyIDString       `json:"keyId"`
+	BroadcastID BroadcastIDString `json:"id"`
+	Tracks      []TrackStatus     `json:"tracks"`
+	Receivers   []ReceiverStatus  `json:"receivers"`
+}
+
+// Status describes every broadcast that has any tracks, or anyone waiting on
+// them, sorted by key ID, and then by ID
+func (t TracksAndConnectionsManager) Status() []BroadcastStatus {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	broadcasts := map[broadcastKey]*BroadcastStatus{}
+	broadcast := func(keyId KeyIDString, broadcastId BroadcastIDString) *BroadcastStatus {
+		key := broadcastKey{keyId, broadcastId}
+		status, ok := broadcasts[key]
+		if !ok {
+			status = &BroadcastStatus{
+				KeyID:       keyId,
+				BroadcastID: broadcastId,
+				Tracks:      []TrackStatus{},
+				Receivers:   []ReceiverStatus{},
+			}
+			broadcasts[key] = status
+		}
+		return status
+	}
+
+	for keyId, byBroadcast := range t.tracks {
+		for broadcastId := range byBroadcast {
+			status := broadcast(keyId, broadcastId)
+			for _, track := range t.sortedTracks(keyId, broadcastId) {
+				codec := track.Codec()
+				status.Tracks = append(status.Tracks, TrackStatus{
+					ID:   track.ID(),
+					Kind: KindString(track.Kind().String()),
+					Codec: CodecInfo{
+						MimeType:    codec.MimeType,
+						ClockRate:   codec.ClockRate,
+						Channels:    codec.Channels,
+						SDPFmtpLine: codec.SDPFmtpLine,
+					},
+					Relayed: track.relayed,
+					Layers:  track.LayerStats(),
+				})
+			}
+		}
+	}
+
+	for keyId, byBroadcast := range t.subscriptions {
+		for broadcastId, bySelector := range byBroadcast {
+			status := broadcast(keyId, broadcastId)
+			for selector, subscriptions := range bySelector {
+				for sub := range subscriptions {
+					receiver := ReceiverStatus{
+						Kind:           selector.kind,
+						TrackID:        selector.trackID,
+						Type:           "sink",
+						PeerConnection: sub.pc,
+					}
+					if sub.pc != nil {
+						receiver.Type = "peerConnection"
+						receiver.ConnectionState = sub.pc.ConnectionState().String()
+					}
+					if sub.track != nil {
+						receiver.Current = sub.track.ID()
+					}
+					if sub.downTrack != nil && sub.track != nil {
+						receiver.Layer, _ = sub.downTrack.CurrentLayer()
+						receiver.Paused = sub.downTrack.Paused()
+					}
+					status.Receivers = append(status.Receivers, receiver)
+				}
 			}
 		}
 	}
+
+	statuses := make([]BroadcastStatus, 0, len(broadcasts))
+	for _, status := range broadcasts {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].KeyID != statuses[j].KeyID {
+			return statuses[i].KeyID < statuses[j].KeyID
+		}
+		return statuses[i].BroadcastID < statuses[j].BroadcastID
+	})
+	return statuses
+}
+
+// trackLogger is the manager's logger, with a track tacked on
+func (t TracksAndConnectionsManager) trackLogger(
+	keyId KeyIDString,
+	broadcastId BroadcastIDString,
+	track *ForwardedTrack,
+) *slog.Logger {
+	return broadcastLogger(t.logger, keyId, broadcastId).With(
+		"kind", track.Kind().String(),
+		"track", track.ID(),
+	)
+}
+
+// subscriptionLogger is the manager's logger, with whatever the subscription is
+// to tacked on
+func (t TracksAndConnectionsManager) subscriptionLogger(sub *Subscription) *slog.Logger {
+	return broadcastLogger(t.logger, sub.key.KeyID, sub.key.BroadcastID).With(
+		"kind", sub.key.Kind,
+		"track", sub.key.TrackID,
+	)
 }
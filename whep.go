@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// WHEPServer lets standard players (anything that speaks WHEP) receive a
+// broadcast's audio and video, without the WebSocket signalling of /get.
+//
+// There's no renegotiating with WHEP, so players get whatever tracks the
+// broadcast has when they connect. Publishers can still come and go (and
+// switch layers) without the players noticing, just like with /get, as long
+// as they stick to the same codecs.
+type WHEPServer struct {
+	tracksAndConnections TracksAndConnectionsManager
+
+	lock      *sync.Mutex
+	resources map[string]*whepResource
+}
+
+// whepResource is a single WHEP player's session
+type whepResource struct {
+	id             string
+	sessionID      string
+	created        time.Time
+	keyID          KeyIDString
+	broadcastID    BroadcastIDString
+	peerConnection *webrtc.PeerConnection
+	allocator      *BandwidthAllocator
+	logger         *slog.Logger
+
+	lock   *sync.Mutex
+	closed bool
+}
+
+func NewWHEPServer(tracksAndConnections TracksAndConnectionsManager) *WHEPServer {
+	return &WHEPServer{
+		tracksAndConnections: tracksAndConnections,
+		lock:                 &sync.Mutex{},
+		resources:            map[string]*whepResource{},
+	}
+}
+
+// ServeHTTP serves /whep/{keyId}/{id}, where players POST their offers, and
+// /whep/{keyId}/{id}/{resource}, which players PATCH ICE candidates to, and
+// DELETE once they're done. Since key IDs can have slashes in them, they need
+// to be escaped.
+func (w *WHEPServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	writeWHIPHeaders(res)
+
+	parts, err := splitEscapedPath(req, "/whep/")
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch len(parts) {
+	case 2:
+		w.handleEndpoint(res, req, KeyIDString(parts[0]), BroadcastIDString(parts[1]))
+	case 3:
+		w.handleResource(res, req, KeyIDString(parts[0]), BroadcastIDString(parts[1]), parts[2])
+	default:
+		res.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (w *WHEPServer) handleEndpoint(
+	res http.ResponseWriter,
+	req *http.Request,
+	keyID KeyIDString,
+	id BroadcastIDString,
+) {
+	switch req.Method {
+	case http.MethodOptions:
+		res.Header().Set("Access-Control-Allow-Methods", "OPTIONS, POST")
+		res.Header().Set("Accept-Post", "application/sdp")
+		for _, link := range iceServerLinks() {
+			res.Header().Add("Link", link)
+		}
+		res.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		res.Header().Set("Allow", "OPTIONS, POST")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !hasContentType(req, "application/sdp") {
+		http.Error(res, "Offers have to be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, whipMaxOfferSize))
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+
+	// The kinds of media that the player wants to receive
+	description, err := offer.Unmarshal()
+	if err != nil {
+		http.Error(res, "Failed to parse offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	kinds := Set[KindString]{}
+	for _, media := range description.MediaDescriptions {
+		kind := KindString(media.MediaName.Media)
+		if kind != "audio" && kind != "video" {
+			continue
+		}
+		if _, sendOnly := media.Attribute("sendonly"); sendOnly {
+			continue
+		}
+		if _, inactive := media.Attribute("inactive"); inactive {
+			continue
+		}
+		kinds.Add(kind)
+	}
+	if len(kinds) == 0 {
+		http.Error(res, "Offer doesn't ask to receive any audio or video", http.StatusBadRequest)
+		return
+	}
+
+	// Without renegotiation, there'd be no way of getting the tracks to the
+	// player later on
+	if len(w.tracksAndConnections.Tracks(keyID, id).Tracks) == 0 {
+		http.Error(res, "The broadcast isn't live", http.StatusNotFound)
+		return
+	}
+
+	logger := broadcastLogger(requestLogger(req, "whep"), keyID, id)
+
+	resourceID, err := newSessionToken()
+	if err != nil {
+		logger.Error("Failed to create WHEP resource ID", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Just like with WHIP, the resource ID doesn't get logged
+	sessionID, err := newSessionID()
+	if err != nil {
+		logger.Error("Failed to create session ID", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger = logger.With("session", sessionID)
+
+	peerConnection, allocator, err := newReceivingPeerConnection()
+	if err != nil {
+		logger.Error("Failed to create peer connection", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resource := &whepResource{
+		id:             resourceID,
+		sessionID:      sessionID,
+		created:        time.Now(),
+		keyID:          keyID,
+		broadcastID:    id,
+		peerConnection: peerConnection,
+		allocator:      allocator,
+		logger:         logger,
+		lock:           &sync.Mutex{},
+	}
+
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		metrics.PeerConnectionState(s)
+
+		switch s {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			w.remove(resource)
+		}
+	})
+
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		w.remove(resource)
+		http.Error(res, "Failed to set remote description: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The tracks go on the transceivers that the player offered, so they have
+	// to be added before answering
+	layer := req.URL.Query().Get("layer")
+	for kind := range kinds {
+		key := TrackKey{KeyID: keyID, BroadcastID: id, Kind: kind}
+		w.tracksAndConnections.AddReceivingPeerConnection(key, peerConnection, allocator)
+		if kind == "video" && layer != "" {
+			w.tracksAndConnections.SelectLayer(key, peerConnection, layer)
+		}
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		logger.Error("Failed to create answer", "err", err)
+		w.remove(resource)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	gathered := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		logger.Error("Failed to set local description", "err", err)
+		w.remove(resource)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-gathered:
+	case <-time.After(whipGatheringTimeout):
+	}
+
+	// The peer connection might have already failed while gathering, in which
+	// case there's nothing left to keep track of
+	if !w.add(resource) {
+		logger.Warn("Peer connection closed before answering")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("WHEP player started playing")
+
+	res.Header().Set("Content-Type", "application/sdp")
+	res.Header().Set("Location", fmt.Sprintf(
+		"/whep/%s/%s/%s",
+		url.PathEscape(string(keyID)),
+		url.PathEscape(string(id)),
+		resourceID,
+	))
+	res.Header().Set("Accept-Patch", "application/trickle-ice-sdpfrag")
+	for _, link := range iceServerLinks() {
+		res.Header().Add("Link", link)
+	}
+	res.WriteHeader(http.StatusCreated)
+	res.Write([]byte(peerConnection.LocalDescription().SDP))
+}
+
+func (w *WHEPServer) handleResource(
+	res http.ResponseWriter,
+	req *http.Request,
+	keyID KeyIDString,
+	id BroadcastIDString,
+	resourceID string,
+) {
+	if req.Method == http.MethodOptions {
+		res.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PATCH, DELETE")
+		res.Header().Set("Accept-Patch", "application/trickle-ice-sdpfrag")
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if req.Method != http.MethodPatch && req.Method != http.MethodDelete {
+		res.Header().Set("Allow", "OPTIONS, PATCH, DELETE")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.lock.Lock()
+	resource, ok := w.resources[resourceID]
+	w.lock.Unlock()
+
+	if !ok || resource.keyID != keyID || resource.broadcastID != id {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		w.remove(resource)
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !hasContentType(req, "application/trickle-ice-sdpfrag") {
+		http.Error(res, "ICE candidates have to be application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, whipMaxOfferSize))
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	status, err := addTrickledCandidates(resource.peerConnection, string(body))
+	if err != nil {
+		http.Error(res, err.Error(), status)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// Sessions is part of SessionSource. The resource IDs are as good as
+// passwords, so it's the session IDs that are shown instead.
+func (w *WHEPServer) Sessions() []SessionStatus {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	sessions := make([]SessionStatus, 0, len(w.resources))
+	for _, resource := range w.resources {
+		sessions = append(sessions, SessionStatus{
+			ID:              resource.sessionID,
+			Endpoint:        "whep",
+			KeyID:           resource.keyID,
+			BroadcastID:     resource.broadcastID,
+			Created:         resource.created,
+			Connected:       true,
+			ConnectionState: resource.peerConnection.ConnectionState().String(),
+		})
+	}
+	return sessions
+}
+
+// SessionIDs is part of SessionSource
+func (w *WHEPServer) SessionIDs() map[*webrtc.PeerConnection]string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	ids := make(map[*webrtc.PeerConnection]string, len(w.resources))
+	for _, resource := range w.resources {
+		ids[resource.peerConnection] = resource.sessionID
+	}
+	return ids
+}
+
+// CloseSession is part of SessionSource. There's no telling a WHEP player why,
+// so the reason only gets logged.
+func (w *WHEPServer) CloseSession(id string, reason string) bool {
+	w.lock.Lock()
+	var found *whepResource
+	for _, resource := range w.resources {
+		if resource.sessionID == id {
+			found = resource
+			break
+		}
+	}
+	w.lock.Unlock()
+
+	if found == nil {
+		return false
+	}
+	found.logger.Info("WHEP player closed by an administrator", "reason", reason)
+	w.remove(found)
+	return true
+}
+
+// add keeps track of a WHEP player's session, unless it's already been torn
+// down. Returns whether it was kept track of.
+func (w *WHEPServer) add(resource *whepResource) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	resource.lock.Lock()
+	defer resource.lock.Unlock()
+	if resource.closed {
+		return false
+	}
+	w.resources[resource.id] = resource
+	return true
+}
+
+// remove tears down a WHEP player's session, if it isn't already
+func (w *WHEPServer) remove(resource *whepResource) {
+	resource.lock.Lock()
+	if resource.closed {
+		resource.lock.Unlock()
+		return
+	}
+	resource.closed = true
+	resource.lock.Unlock()
+
+	resource.logger.Info("WHEP session closed")
+
+	w.lock.Lock()
+	if w.resources[resource.id] == resource {
+		delete(w.resources, resource.id)
+	}
+	w.lock.Unlock()
+
+	w.tracksAndConnections.RemoveAllSubscriptions(resource.peerConnection)
+	resource.allocator.Close()
+
+	if err := resource.peerConnection.Close(); err != nil {
+		resource.logger.Warn("Failed to close peer connection", "err", err)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/castcam-live/simple-forwarding-unit/config"
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v4"
+)
+
+// How long an answer waits on ICE candidates to be gathered. Plenty of WHIP
+// clients don't do trickle ICE, so the answer should have candidates in it.
+const whipGatheringTimeout = 2 * time.Second
+
+// The largest offer that gets read
+const whipMaxOfferSize = 1 << 20
+
+// WHIPServer lets publishers that speak WHIP (OBS, hardware encoders, etc.)
+// publish to broadcasts, just like publishers that go through /broadcast/{id}
+// do.
+//
+// Rather than authenticating with a key, WHIP publishers hand over a bearer
+// token, which the server's configuration maps to a key ID.
+type WHIPServer struct {
+	tracksAndConnections TracksAndConnectionsManager
+	dataRelay            *DataRelay
+
+	lock      *sync.Mutex
+	resources map[string]*whipResource
+}
+
+// whipResource is a single WHIP publisher's session
+type whipResource struct {
+	id             string
+	sessionID      string
+	created        time.Time
+	keyID          KeyIDString
+	broadcastID    BroadcastIDString
+	peerConnection *webrtc.PeerConnection
+	logger         *slog.Logger
+
+	lock   *sync.Mutex
+	closed bool
+}
+
+func NewWHIPServer(
+	tracksAndConnections TracksAndConnectionsManager,
+	dataRelay *DataRelay,
+) *WHIPServer {
+	return &WHIPServer{
+		tracksAndConnections: tracksAndConnections,
+		dataRelay:            dataRelay,
+		lock:                 &sync.Mutex{},
+		resources:            map[string]*whipResource{},
+	}
+}
+
+// writeWHIPHeaders sets the headers that every WHIP (and WHEP) response gets,
+// so that browser based clients can use the endpoints too
+func writeWHIPHeaders(res http.ResponseWriter) {
+	res.Header().Set("Access-Control-Allow-Origin", "*")
+	res.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	res.Header().Set("Access-Control-Expose-Headers", "Location, Link, Accept-Post, Accept-Patch")
+}
+
+// bearerToken gets the token out of the Authorization header
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// hasContentType tells whether the request's body is of the given type
+func hasContentType(req *http.Request, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && strings.EqualFold(mediaType, contentType)
+}
+
+// iceServerLinks are the Link headers that tell WHIP (and WHEP) clients about
+// the ICE servers that they can use
+func iceServerLinks() []string {
+	links := []string{}
+	for _, server := range peerConnectionConfig.ICEServers {
+		for _, u := range server.URLs {
+			links = append(links, fmt.Sprintf("<%s>; rel=\"ice-server\"", u))
+		}
+	}
+	return links
+}
+
+// keyIDFor authenticates a request, responding with a 401 if there's nothing
+// to authenticate it with
+func (w *WHIPServer) keyIDFor(res http.ResponseWriter, req *http.Request) (KeyIDString, bool) {
+	token, ok := bearerToken(req)
+	if ok {
+		if keyID, ok := config.WHIPKeyID(token); ok {
+			return KeyIDString(keyID), true
+		}
+	}
+
+	res.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(res, "Missing or unknown bearer token", http.StatusUnauthorized)
+	return "", false
+}
+
+// HandleEndpoint handles /whip/{id}, where publishers POST their offers to
+// start publishing
+func (w *WHIPServer) HandleEndpoint(res http.ResponseWriter, req *http.Request) {
+	writeWHIPHeaders(res)
+
+	switch req.Method {
+	case http.MethodOptions:
+		res.Header().Set("Access-Control-Allow-Methods", "OPTIONS, POST")
+		res.Header().Set("Accept-Post", "application/sdp")
+		for _, link := range iceServerLinks() {
+			res.Header().Add("Link", link)
+		}
+		res.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		res.Header().Set("Allow", "OPTIONS, POST")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, ok := mux.Vars(req)["id"]
+	if !ok {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	keyID, ok := w.keyIDFor(res, req)
+	if !ok {
+		return
+	}
+
+	if !hasContentType(req, "application/sdp") {
+		http.Error(res, "Offers have to be application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, whipMaxOfferSize))
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(body)}
+
+	// Better to tell the publisher up front, than to have it wonder why nothing
+	// is being received
+	unacceptable, err := findUnacceptableMedia(offer)
+	if err != nil {
+		http.Error(res, "Failed to parse offer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(unacceptable) > 0 {
+		mids := []string{}
+		for _, media := range unacceptable {
+			mids = append(mids, fmt.Sprintf("%s (%s: %s)", media.Mid, media.Kind, strings.Join(media.Offered, ", ")))
+		}
+		http.Error(
+			res,
+			"Offer has media without a single codec that the server accepts: "+strings.Join(mids, "; "),
+			http.StatusNotAcceptable,
+		)
+		return
+	}
+
+	logger := broadcastLogger(requestLogger(req, "whip"), keyID, BroadcastIDString(id))
+
+	resourceID, err := newSessionToken()
+	if err != nil {
+		logger.Error("Failed to create WHIP resource ID", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The resource ID is as good as a password, so it doesn't get logged.
+	// There's a session ID for that instead, just like for any other session.
+	sessionID, err := newSessionID()
+	if err != nil {
+		logger.Error("Failed to create session ID", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger = logger.With("session", sessionID)
+
+	peerConnection, err := newPublishingPeerConnection()
+	if err != nil {
+		logger.Error("Failed to create peer connection", "err", err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resource := &whipResource{
+		id:             resourceID,
+		sessionID:      sessionID,
+		created:        time.Now(),
+		keyID:          keyID,
+		broadcastID:    BroadcastIDString(id),
+		peerConnection: peerConnection,
+		logger:         logger,
+		lock:           &sync.Mutex{},
+	}
+
+	NewPublisher(logger, w.tracksAndConnections, keyID, BroadcastIDString(id), peerConnection)
+
+	// Whatever the publisher sends on its data channels goes out to receivers
+	peerConnection.OnDataChannel(func(channel *webrtc.DataChannel) {
+		w.dataRelay.AddPublisherChannel(keyID, BroadcastIDString(id), peerConnection, channel)
+	})
+
+	// There's no signalling connection to notice a WHIP publisher going away, so
+	// the peer connection is all there is to go on
+	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		metrics.PeerConnectionState(s)
+
+		switch s {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			w.remove(resource)
+		}
+	})
+
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		logger.Warn("Failed to set remote description", "err", err)
+		peerConnection.Close()
+		http.Error(res, "Failed to set remote description: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		logger.Error("Failed to create answer", "err", err)
+		peerConnection.Close()
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	gathered := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		logger.Error("Failed to set local description", "err", err)
+		peerConnection.Close()
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-gathered:
+	case <-time.After(whipGatheringTimeout):
+	}
+
+	// The peer connection might have already failed while gathering, in which
+	// case there's nothing left to keep track of
+	if !w.add(resource) {
+		logger.Warn("Peer connection closed before answering")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("WHIP publisher started publishing")
+
+	res.Header().Set("Content-Type", "application/sdp")
+	res.Header().Set("Location", fmt.Sprintf("/whip/%s/%s", url.PathEscape(id), resourceID))
+	res.Header().Set("Accept-Patch", "application/trickle-ice-sdpfrag")
+	for _, link := range iceServerLinks() {
+		res.Header().Add("Link", link)
+	}
+	res.WriteHeader(http.StatusCreated)
+	res.Write([]byte(peerConnection.LocalDescription().SDP))
+}
+
+// HandleResource handles /whip/{id}/{resource}, which the publisher PATCHes
+// ICE candidates to, and DELETEs once it's done publishing
+func (w *WHIPServer) HandleResource(res http.ResponseWriter, req *http.Request) {
+	writeWHIPHeaders(res)
+
+	if req.Method == http.MethodOptions {
+		res.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PATCH, DELETE")
+		res.Header().Set("Accept-Patch", "application/trickle-ice-sdpfrag")
+		res.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if req.Method != http.MethodPatch && req.Method != http.MethodDelete {
+		res.Header().Set("Allow", "OPTIONS, PATCH, DELETE")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	keyID, ok := w.keyIDFor(res, req)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(req)
+
+	w.lock.Lock()
+	resource, ok := w.resources[vars["resource"]]
+	w.lock.Unlock()
+
+	// Only the publisher that created the resource gets to touch it
+	if !ok || resource.keyID != keyID || string(resource.broadcastID) != vars["id"] {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		w.remove(resource)
+		resource.logger.Info("WHIP publisher stopped publishing")
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !hasContentType(req, "application/trickle-ice-sdpfrag") {
+		http.Error(res, "ICE candidates have to be application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, whipMaxOfferSize))
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	status, err := addTrickledCandidates(resource.peerConnection, string(body))
+	if err != nil {
+		http.Error(res, err.Error(), status)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// Sessions is part of SessionSource. The resource IDs are as good as
+// passwords, so it's the session IDs that are shown instead.
+func (w *WHIPServer) Sessions() []SessionStatus {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	sessions := make([]SessionStatus, 0, len(w.resources))
+	for _, resource := range w.resources {
+		sessions = append(sessions, SessionStatus{
+			ID:              resource.sessionID,
+			Endpoint:        "whip",
+			KeyID:           resource.keyID,
+			BroadcastID:     resource.broadcastID,
+			Created:         resource.created,
+			Connected:       true,
+			ConnectionState: resource.peerConnection.ConnectionState().String(),
+		})
+	}
+	return sessions
+}
+
+// SessionIDs is part of SessionSource
+func (w *WHIPServer) SessionIDs() map[*webrtc.PeerConnection]string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	ids := make(map[*webrtc.PeerConnection]string, len(w.resources))
+	for _, resource := range w.resources {
+		ids[resource.peerConnection] = resource.sessionID
+	}
+	return ids
+}
+
+// CloseSession is part of SessionSource. There's no telling a WHIP publisher why,
+// so the reason only gets logged.
+func (w *WHIPServer) CloseSession(id string, reason string) bool {
+	w.lock.Lock()
+	var found *whipResource
+	for _, resource := range w.resources {
+		if resource.sessionID == id {
+			found = resource
+			break
+		}
+	}
+	w.lock.Unlock()
+
+	if found == nil {
+		return false
+	}
+	found.logger.Info("WHIP publisher closed by an administrator", "reason", reason)
+	w.remove(found)
+	return true
+}
+
+// add keeps track of a WHIP publisher's session, unless it's already been torn
+// down. Returns whether it was kept track of.
+func (w *WHIPServer) add(resource *whipResource) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	resource.lock.Lock()
+	defer resource.lock.Unlock()
+	if resource.closed {
+		return false
+	}
+	w.resources[resource.id] = resource
+	return true
+}
+
+// remove tears down a WHIP publisher's session, if it isn't already
+func (w *WHIPServer) remove(resource *whipResource) {
+	resource.lock.Lock()
+	if resource.closed {
+		resource.lock.Unlock()
+		return
+	}
+	resource.closed = true
+	resource.lock.Unlock()
+
+	w.lock.Lock()
+	if w.resources[resource.id] == resource {
+		delete(w.resources, resource.id)
+	}
+	w.lock.Unlock()
+
+	w.dataRelay.RemovePublisher(resource.keyID, resource.broadcastID, resource.peerConnection)
+
+	if err := resource.peerConnection.Close(); err != nil {
+		resource.logger.Warn("Failed to close peer connection", "err", err)
+	}
+}
+
+// addTrickledCandidates adds the ICE candidates in an SDP fragment (RFC 8840)
+// to the peer connection. ICE restarts aren't supported, so fragments with
+// credentials other than the ones that the peer connection already has are
+// turned down. Returns the HTTP status to respond with, on error.
+func addTrickledCandidates(peerConnection *webrtc.PeerConnection, fragment string) (int, error) {
+	remoteUfrag := ""
+	if remote := peerConnection.RemoteDescription(); remote != nil {
+		for _, line := range strings.Split(remote.SDP, "\n") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(line), "a=ice-ufrag:"); ok {
+				remoteUfrag = value
+				break
+			}
+		}
+	}
+
+	candidates := []webrtc.ICECandidateInit{}
+	mid := ""
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+		if value, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok && value != remoteUfrag {
+			return http.StatusUnprocessableEntity, fmt.Errorf("ICE restarts aren't supported")
+		}
+		if value, ok := strings.CutPrefix(line, "a=mid:"); ok {
+			mid = value
+			continue
+		}
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				m := mid
+				candidate.SDPMid = &m
+			} else {
+				index := uint16(0)
+				candidate.SDPMLineIndex = &index
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if err := peerConnection.AddICECandidate(candidate); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("Failed to add ICE candidate: %s", err.Error())
+		}
+	}
+
+	return 0, nil
+}